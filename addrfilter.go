@@ -0,0 +1,111 @@
+package tnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 一条地址规则，可以是 IP、CIDR 或者主机名，主机名支持 *.example.com 匹配所有子域名，后面可以带 :port 限定端口
+// 例如 10.0.0.0/8、192.168.1.1:22、[::1]:8080、*.example.com:443、example.com
+type addrRule struct {
+	ipnet  *net.IPNet
+	host   string // 小写，通配规则保存为 .example.com
+	suffix bool
+	port   int // 0 表示任意端口
+}
+
+func parseAddrRule(rule string) (obj *addrRule, err error) {
+	obj = new(addrRule)
+	host := rule
+	if h, p, err := net.SplitHostPort(rule); err == nil {
+		if obj.port, err = strconv.Atoi(p); err != nil || obj.port <= 0 || obj.port > 0xffff {
+			return nil, errors.New(fmt.Sprintf("invalid port in addr rule(%s)", rule))
+		}
+		host = h
+	}
+
+	if _, ipnet, err := net.ParseCIDR(host); err == nil {
+		obj.ipnet = ipnet
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		obj.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if strings.HasPrefix(host, "*.") {
+		obj.host = strings.ToLower(host[1:])
+		obj.suffix = true
+	} else if host != "" {
+		obj.host = strings.ToLower(host)
+	} else {
+		return nil, errors.New(fmt.Sprintf("invalid addr rule(%s)", rule))
+	}
+	return obj, nil
+}
+
+// host 为目标主机名（目标是 IP 时为空），ip 为解析后实际要连接的地址
+func (self *addrRule) match(host string, ip net.IP, port int) bool {
+	if self.port != 0 && self.port != port {
+		return false
+	}
+	if self.ipnet != nil {
+		return ip != nil && self.ipnet.Contains(ip)
+	}
+	if self.suffix {
+		return strings.HasSuffix(host, self.host)
+	}
+	return host == self.host
+}
+
+// 目标地址的黑白名单，先检查 deny，命中则拒绝；allow 为空时允许其他所有地址，否则必须命中 allow
+// 目标是主机名时，主机名规则匹配主机名，IP 和 CIDR 规则匹配解析出的每个地址，
+// 所以 deny 10.0.0.0/8 同样能拦住解析到内网的域名
+type AddrFilter struct {
+	allow []*addrRule
+	deny  []*addrRule
+}
+
+func NewAddrFilter(allow []string, deny []string) (obj *AddrFilter, err error) {
+	obj = new(AddrFilter)
+	for _, rule := range allow {
+		r, err := parseAddrRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		obj.allow = append(obj.allow, r)
+	}
+	for _, rule := range deny {
+		r, err := parseAddrRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		obj.deny = append(obj.deny, r)
+	}
+	return obj, nil
+}
+
+// 检查是否允许连接 host 解析出的 ip 的 port 端口
+func (self *AddrFilter) Allow(host string, ip net.IP, port int) bool {
+	host = strings.ToLower(host)
+	if net.ParseIP(host) != nil {
+		host = ""
+	}
+	for _, r := range self.deny {
+		if r.match(host, ip, port) {
+			return false
+		}
+	}
+	if len(self.allow) == 0 {
+		return true
+	}
+	for _, r := range self.allow {
+		if r.match(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,818 @@
+package tnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"git.tutils.com/tutils/tnet/tlog"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ARQ 分段 = conv:uint32 + cmd:uint8 + wnd:uint16 + ts:uint32 + sn:uint32 + una:uint32 + length:uint16 + data:string(length)
+// 一个 UDP 包可以包含多个分段
+const (
+	arq_cmd_push uint8 = 1 // 数据
+	arq_cmd_ack  uint8 = 2 // 确认，ts 为被确认分段的发送时间
+	arq_cmd_wins uint8 = 3 // 接收窗口从 0 恢复时通知对端
+	arq_cmd_fin  uint8 = 4 // 数据发送完毕，与 push 一样可靠按序送达
+
+	arq_header_size int = 21
+
+	arq_mtu            int           = 1400
+	arq_snd_wnd        int           = 128
+	arq_rcv_wnd        int           = 128
+	arq_interval       time.Duration = 10e6
+	arq_rto_default    uint32        = 200 // ms
+	arq_rto_min        uint32        = 50  // ms
+	arq_rto_max        uint32        = 60000
+	arq_fast_resend    int           = 3  // 被跳过确认的次数达到该值时立即重传
+	arq_dead_link      int           = 20 // 同一个分段重传超过该次数认为链路已断开
+	arq_close_linger   time.Duration = 60e9
+	arq_accept_backlog int           = 128
+)
+
+var (
+	ErrArqDeadLink = errors.New("tnet: ARQ link is dead")
+	errArqTimeout  = &arqTimeoutError{}
+	arqEpoch       = time.Now()
+)
+
+type arqTimeoutError struct{}
+
+func (self *arqTimeoutError) Error() string   { return "tnet: i/o timeout" }
+func (self *arqTimeoutError) Timeout() bool   { return true }
+func (self *arqTimeoutError) Temporary() bool { return true }
+
+// 毫秒时间戳，只用于计算差值
+func arqNow() uint32 {
+	return uint32(time.Since(arqEpoch) / time.Millisecond)
+}
+
+// 序号和时间戳都会回绕，比较时使用差值
+func arqDiff(a uint32, b uint32) int32 {
+	return int32(a - b)
+}
+
+type arqSegment struct {
+	cmd      uint8
+	sn       uint32
+	ts       uint32
+	data     []byte
+	rto      uint32
+	resendTs uint32
+	fastack  int
+	xmit     int
+}
+
+type arqAck struct {
+	sn uint32
+	ts uint32
+}
+
+// 基于 UDP 的可靠有序字节流，类似 KCP
+// 带序号、确认、按 RTT 估算的超时重传、快速重传、乱序重组和拥塞窗口，实现了 net.Conn
+type ArqConn struct {
+	conv       uint32
+	output     func(data []byte) (err error)
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	onClose    func()
+	logger     tlog.Logger
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	mtu      int
+	sndWnd   int
+	rcvWnd   int
+	interval time.Duration
+
+	sndUna     uint32
+	sndNxt     uint32
+	rcvNxt     uint32
+	sndQueue   []*arqSegment
+	sndBuf     []*arqSegment
+	rcvBuf     map[uint32]*arqSegment
+	rcvQueue   [][]byte
+	acks       []arqAck
+	rmtWnd     uint32
+	lastAdvWnd uint32
+
+	srtt     uint32
+	rttvar   uint32
+	rto      uint32
+	cwnd     int
+	cwndAcc  int
+	ssthresh int
+
+	finSent  bool
+	lingerTs uint32
+	rcvEOF   bool
+	closed   bool
+	err      error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+	quit          chan struct{}
+	onCloseOnce   sync.Once
+}
+
+// conv 用于区分同一对地址上的不同连接，两端必须相同
+// output 用于发出一个 UDP 包，会在持有连接锁时调用，不能阻塞太久
+func NewArqConn(conv uint32, output func(data []byte) (err error)) (obj *ArqConn) {
+	obj = new(ArqConn)
+	obj.conv = conv
+	obj.output = output
+	obj.logger = tlog.NewNopLogger()
+	obj.cond = sync.NewCond(&obj.mtx)
+	obj.mtu = arq_mtu
+	obj.sndWnd = arq_snd_wnd
+	obj.rcvWnd = arq_rcv_wnd
+	obj.interval = arq_interval
+	obj.rcvBuf = make(map[uint32]*arqSegment)
+	obj.rmtWnd = uint32(arq_rcv_wnd)
+	obj.lastAdvWnd = uint32(arq_rcv_wnd)
+	obj.rto = arq_rto_default
+	obj.cwnd = 1
+	obj.ssthresh = arq_snd_wnd
+	obj.quit = make(chan struct{})
+	go obj.updateHandler()
+	return obj
+}
+
+func (self *ArqConn) Conv() uint32 {
+	return self.conv
+}
+
+// 设置日志，默认不输出
+func (self *ArqConn) SetLogger(logger tlog.Logger) {
+	self.mtx.Lock()
+	self.logger = logger
+	self.mtx.Unlock()
+}
+
+func (self *ArqConn) getLogger() tlog.Logger {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	return self.logger
+}
+
+// 设置 UDP 包的最大长度，应不超过链路 MTU
+func (self *ArqConn) SetMtu(mtu int) {
+	if mtu <= arq_header_size {
+		return
+	}
+	self.mtx.Lock()
+	self.mtu = mtu
+	self.mtx.Unlock()
+}
+
+// 设置发送和接收窗口，单位为分段数
+func (self *ArqConn) SetWindowSize(sndWnd int, rcvWnd int) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if sndWnd > 0 {
+		self.sndWnd = sndWnd
+	}
+	if rcvWnd > 0 && rcvWnd <= 0xffff {
+		self.rcvWnd = rcvWnd
+	}
+}
+
+// 平滑后的 RTT
+func (self *ArqConn) RTT() time.Duration {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	return time.Duration(self.srtt) * time.Millisecond
+}
+
+func (self *ArqConn) mss() int {
+	return self.mtu - arq_header_size
+}
+
+func (self *ArqConn) updateHandler() {
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.mtx.Lock()
+			self.flush()
+			self.mtx.Unlock()
+		case <-self.quit:
+			return
+		}
+	}
+}
+
+// 处理从底层收到的一个 UDP 包
+func (self *ArqConn) Input(data []byte) (err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if self.closed {
+		return ErrConnClosed
+	}
+
+	oldUna := self.sndUna
+	var maxAck uint32
+	hasAck := false
+	for len(data) > 0 {
+		if len(data) < arq_header_size {
+			return errors.New("ARQ segment is too short")
+		}
+		conv := binary.BigEndian.Uint32(data)
+		cmd := data[4]
+		wnd := binary.BigEndian.Uint16(data[5:])
+		ts := binary.BigEndian.Uint32(data[7:])
+		sn := binary.BigEndian.Uint32(data[11:])
+		una := binary.BigEndian.Uint32(data[15:])
+		length := int(binary.BigEndian.Uint16(data[19:]))
+		data = data[arq_header_size:]
+		if conv != self.conv {
+			return errors.New("ARQ conv mismatch")
+		}
+		if len(data) < length {
+			return errors.New("ARQ segment is incomplete")
+		}
+		payload := data[:length]
+		data = data[length:]
+
+		self.rmtWnd = uint32(wnd)
+		self.ackUna(una)
+
+		switch cmd {
+		case arq_cmd_ack:
+			if rtt := arqDiff(arqNow(), ts); rtt >= 0 {
+				self.updateRtt(uint32(rtt))
+			}
+			self.ackSn(sn)
+			if !hasAck || arqDiff(sn, maxAck) > 0 {
+				maxAck = sn
+				hasAck = true
+			}
+
+		case arq_cmd_push, arq_cmd_fin:
+			if arqDiff(sn, self.rcvNxt+uint32(self.rcvWnd)) >= 0 {
+				// 超出接收窗口，不确认，等对端重传
+				continue
+			}
+			self.acks = append(self.acks, arqAck{sn, ts})
+			if arqDiff(sn, self.rcvNxt) < 0 {
+				continue
+			}
+			if _, ok := self.rcvBuf[sn]; !ok {
+				seg := &arqSegment{cmd: cmd, sn: sn}
+				seg.data = make([]byte, len(payload))
+				copy(seg.data, payload)
+				self.rcvBuf[sn] = seg
+			}
+
+		case arq_cmd_wins:
+
+		default:
+			return errors.New("unknown ARQ cmd")
+		}
+	}
+
+	if hasAck {
+		// 序号小于 maxAck 的分段被跳过了
+		for _, seg := range self.sndBuf {
+			if arqDiff(seg.sn, maxAck) < 0 {
+				seg.fastack++
+			}
+		}
+	}
+
+	if arqDiff(self.sndUna, oldUna) > 0 && self.cwnd < int(self.rmtWnd) {
+		// 慢启动和拥塞避免
+		if self.cwnd < self.ssthresh {
+			self.cwnd++
+		} else {
+			self.cwndAcc++
+			if self.cwndAcc >= self.cwnd {
+				self.cwnd++
+				self.cwndAcc = 0
+			}
+		}
+	}
+
+	self.moveRcv()
+	self.cond.Broadcast()
+	return nil
+}
+
+// 对端已经按序收到了 una 之前的所有分段
+func (self *ArqConn) ackUna(una uint32) {
+	i := 0
+	for i < len(self.sndBuf) && arqDiff(self.sndBuf[i].sn, una) < 0 {
+		i++
+	}
+	self.sndBuf = self.sndBuf[i:]
+	self.shrinkBuf()
+}
+
+func (self *ArqConn) shrinkBuf() {
+	if len(self.sndBuf) > 0 {
+		self.sndUna = self.sndBuf[0].sn
+	} else {
+		self.sndUna = self.sndNxt
+	}
+}
+
+func (self *ArqConn) ackSn(sn uint32) {
+	for i, seg := range self.sndBuf {
+		if seg.sn == sn {
+			self.sndBuf = append(self.sndBuf[:i], self.sndBuf[i+1:]...)
+			break
+		}
+		if arqDiff(seg.sn, sn) > 0 {
+			break
+		}
+	}
+	self.shrinkBuf()
+}
+
+// 按 RFC 6298 估算 RTO
+func (self *ArqConn) updateRtt(rtt uint32) {
+	if self.srtt == 0 {
+		self.srtt = rtt
+		self.rttvar = rtt / 2
+	} else {
+		delta := int32(rtt - self.srtt)
+		if delta < 0 {
+			delta = -delta
+		}
+		self.rttvar = (3*self.rttvar + uint32(delta)) / 4
+		self.srtt = (7*self.srtt + rtt) / 8
+		if self.srtt < 1 {
+			self.srtt = 1
+		}
+	}
+	rto := self.srtt + 4*self.rttvar
+	if interval := uint32(self.interval / time.Millisecond); rto < self.srtt+interval {
+		rto = self.srtt + interval
+	}
+	if rto < arq_rto_min {
+		rto = arq_rto_min
+	} else if rto > arq_rto_max {
+		rto = arq_rto_max
+	}
+	self.rto = rto
+}
+
+// 把按序到达的分段移入接收队列
+func (self *ArqConn) moveRcv() {
+	for len(self.rcvQueue) < self.rcvWnd {
+		seg, ok := self.rcvBuf[self.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(self.rcvBuf, self.rcvNxt)
+		self.rcvNxt++
+		if seg.cmd == arq_cmd_fin {
+			self.rcvEOF = true
+		} else if len(seg.data) > 0 {
+			self.rcvQueue = append(self.rcvQueue, seg.data)
+		}
+	}
+}
+
+func (self *ArqConn) wndUnused() uint32 {
+	if len(self.rcvQueue) < self.rcvWnd {
+		return uint32(self.rcvWnd - len(self.rcvQueue))
+	}
+	return 0
+}
+
+// 发出确认、新数据和需要重传的分段，调用前需要持有锁
+func (self *ArqConn) flush() {
+	if self.closed {
+		return
+	}
+
+	now := arqNow()
+	wnd := self.wndUnused()
+	buf := make([]byte, 0, self.mtu)
+	emit := func(cmd uint8, sn uint32, ts uint32, data []byte) {
+		if len(buf)+arq_header_size+len(data) > self.mtu {
+			self.emitPacket(buf)
+			buf = make([]byte, 0, self.mtu)
+		}
+		var header [arq_header_size]byte
+		binary.BigEndian.PutUint32(header[0:], self.conv)
+		header[4] = cmd
+		binary.BigEndian.PutUint16(header[5:], uint16(wnd))
+		binary.BigEndian.PutUint32(header[7:], ts)
+		binary.BigEndian.PutUint32(header[11:], sn)
+		binary.BigEndian.PutUint32(header[15:], self.rcvNxt)
+		binary.BigEndian.PutUint16(header[19:], uint16(len(data)))
+		buf = append(buf, header[:]...)
+		buf = append(buf, data...)
+		self.lastAdvWnd = wnd
+	}
+
+	for _, ack := range self.acks {
+		emit(arq_cmd_ack, ack.sn, ack.ts, nil)
+	}
+	self.acks = self.acks[:0]
+
+	if self.lastAdvWnd == 0 && wnd > 0 {
+		emit(arq_cmd_wins, 0, now, nil)
+	}
+
+	// 对端接收窗口为 0 时仍允许一个分段在途，用于探测窗口
+	limit := self.sndWnd
+	if int(self.rmtWnd) < limit {
+		limit = int(self.rmtWnd)
+	}
+	if self.cwnd < limit {
+		limit = self.cwnd
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	for len(self.sndQueue) > 0 && arqDiff(self.sndNxt, self.sndUna+uint32(limit)) < 0 {
+		seg := self.sndQueue[0]
+		self.sndQueue = self.sndQueue[1:]
+		seg.sn = self.sndNxt
+		self.sndNxt++
+		seg.rto = self.rto
+		self.sndBuf = append(self.sndBuf, seg)
+	}
+
+	lost := false
+	change := false
+	for _, seg := range self.sndBuf {
+		send := false
+		if seg.xmit == 0 {
+			send = true
+		} else if arqDiff(now, seg.resendTs) >= 0 {
+			send = true
+			lost = true
+			seg.rto *= 2
+			if seg.rto > arq_rto_max {
+				seg.rto = arq_rto_max
+			}
+		} else if seg.fastack >= arq_fast_resend {
+			send = true
+			change = true
+		}
+		if !send {
+			continue
+		}
+
+		seg.xmit++
+		seg.fastack = 0
+		seg.ts = now
+		seg.resendTs = now + seg.rto
+		emit(seg.cmd, seg.sn, seg.ts, seg.data)
+		if seg.xmit > arq_dead_link {
+			self.closeLocked(ErrArqDeadLink)
+			return
+		}
+	}
+	if len(buf) > 0 {
+		self.emitPacket(buf)
+	}
+	if self.finSent && (len(self.sndBuf) == 0 || arqDiff(now, self.lingerTs) >= 0) {
+		self.closeLocked(ErrConnClosed)
+		return
+	}
+
+	if change {
+		inflight := int(self.sndNxt - self.sndUna)
+		self.ssthresh = inflight / 2
+		if self.ssthresh < 2 {
+			self.ssthresh = 2
+		}
+		self.cwnd = self.ssthresh + arq_fast_resend
+		self.cwndAcc = 0
+	}
+	if lost {
+		self.ssthresh = self.cwnd / 2
+		if self.ssthresh < 2 {
+			self.ssthresh = 2
+		}
+		self.cwnd = 1
+		self.cwndAcc = 0
+	}
+	self.cond.Broadcast()
+}
+
+func (self *ArqConn) emitPacket(data []byte) {
+	if err := self.output(data); err != nil {
+		self.logger.Warn("ARQ conn output failed", tlog.F("conv", self.conv), tlog.Err(err))
+	}
+}
+
+func (self *ArqConn) Read(buf []byte) (n int, err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	for {
+		if self.finSent {
+			return 0, ErrConnClosed
+		}
+		if len(self.rcvQueue) > 0 {
+			for len(self.rcvQueue) > 0 && n < len(buf) {
+				m := copy(buf[n:], self.rcvQueue[0])
+				n += m
+				if m < len(self.rcvQueue[0]) {
+					self.rcvQueue[0] = self.rcvQueue[0][m:]
+				} else {
+					self.rcvQueue = self.rcvQueue[1:]
+				}
+			}
+			// 接收队列腾出了空间
+			self.moveRcv()
+			return n, nil
+		}
+		if self.rcvEOF {
+			return 0, io.EOF
+		}
+		if self.closed {
+			return 0, self.err
+		}
+		if !self.readDeadline.IsZero() && !time.Now().Before(self.readDeadline) {
+			return 0, errArqTimeout
+		}
+		self.cond.Wait()
+	}
+}
+
+// 把数据切分成分段放入发送队列，发送队列满时阻塞
+func (self *ArqConn) Write(data []byte) (n int, err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	for len(data) > 0 {
+		if self.closed {
+			return n, self.err
+		}
+		if self.finSent {
+			return n, ErrConnClosed
+		}
+		if !self.writeDeadline.IsZero() && !time.Now().Before(self.writeDeadline) {
+			return n, errArqTimeout
+		}
+		if len(self.sndQueue)+len(self.sndBuf) >= 2*self.sndWnd {
+			self.cond.Wait()
+			continue
+		}
+
+		size := self.mss()
+		if size > len(data) {
+			size = len(data)
+		}
+		seg := &arqSegment{cmd: arq_cmd_push}
+		seg.data = make([]byte, size)
+		copy(seg.data, data)
+		self.sndQueue = append(self.sndQueue, seg)
+		data = data[size:]
+		n += size
+	}
+	return n, nil
+}
+
+// 发送 fin 后立即返回，已写入的数据和 fin 由更新例程在后台继续发送，全部被确认或超过 arq_close_linger 后才真正关闭
+func (self *ArqConn) Close() (err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if self.closed || self.finSent {
+		return nil
+	}
+	self.finSent = true
+	self.lingerTs = arqNow() + uint32(arq_close_linger/time.Millisecond)
+	self.sndQueue = append(self.sndQueue, &arqSegment{cmd: arq_cmd_fin})
+	self.cond.Broadcast()
+	return nil
+}
+
+// 立即关闭连接，不等待数据发送完
+func (self *ArqConn) abort(err error) {
+	self.mtx.Lock()
+	self.closeLocked(err)
+	self.mtx.Unlock()
+}
+
+func (self *ArqConn) closeLocked(err error) {
+	if self.closed {
+		return
+	}
+	self.closed = true
+	self.err = err
+	close(self.quit)
+	self.cond.Broadcast()
+	if self.onClose != nil {
+		// onClose 可能会回调 abort，不能在持有锁时调用
+		go self.onCloseOnce.Do(self.onClose)
+	}
+}
+
+func (self *ArqConn) LocalAddr() net.Addr {
+	return self.localAddr
+}
+
+func (self *ArqConn) RemoteAddr() net.Addr {
+	return self.remoteAddr
+}
+
+func (self *ArqConn) SetDeadline(t time.Time) (err error) {
+	self.SetReadDeadline(t)
+	self.SetWriteDeadline(t)
+	return nil
+}
+
+func (self *ArqConn) SetReadDeadline(t time.Time) (err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.readDeadline = t
+	self.readTimer = self.resetDeadlineTimer(self.readTimer, t)
+	return nil
+}
+
+func (self *ArqConn) SetWriteDeadline(t time.Time) (err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.writeDeadline = t
+	self.writeTimer = self.resetDeadlineTimer(self.writeTimer, t)
+	return nil
+}
+
+// 到达超时时间时唤醒阻塞中的读写
+func (self *ArqConn) resetDeadlineTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	self.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		self.mtx.Lock()
+		self.cond.Broadcast()
+		self.mtx.Unlock()
+	})
+}
+
+// 基于 UdpPeer 服务器的 ARQ 监听器，每个远端地址对应一个 ArqConn，实现了 net.Listener
+type ArqListener struct {
+	peer      *UdpPeer
+	addr      net.Addr
+	acceptq   chan *ArqConn
+	quit      chan struct{}
+	closeOnce sync.Once
+	logger    tlog.Logger
+	loggerMtx sync.Mutex
+}
+
+func ListenArq(addr string) (obj *ArqListener, err error) {
+	obj = new(ArqListener)
+	obj.acceptq = make(chan *ArqConn, arq_accept_backlog)
+	obj.quit = make(chan struct{})
+	obj.logger = tlog.NewNopLogger()
+
+	peer := NewUdpServer()
+	peer.Addr = addr
+	obj.peer = peer
+	ready := make(chan error, 2)
+	peer.OnListenSuccCallback = func(self *UdpPeer, conn *net.UDPConn) (ok bool) {
+		obj.addr = conn.LocalAddr()
+		ready <- nil
+		return true
+	}
+	peer.OnHandleSessionDataCallback = func(self *UdpPeer, sess *UdpSession, data []byte) (ok bool) {
+		if sess.Ext == nil && !obj.newConn(sess, data) {
+			self.RemoveSession(sess)
+			return true
+		}
+		conn := sess.Ext.(*ArqConn)
+		if err := conn.Input(data); err != nil && err != ErrConnClosed {
+			obj.getLogger().Warn("ARQ conn input failed", tlog.RemoteAddr(sess.Addr), tlog.Err(err))
+		}
+		return true
+	}
+	peer.OnSessionExpiredCallback = func(self *UdpPeer, sess *UdpSession) {
+		if sess.Ext != nil {
+			sess.Ext.(*ArqConn).abort(ErrConnClosed)
+		}
+	}
+
+	go func() {
+		ready <- peer.Start()
+		obj.Close()
+	}()
+	if err = <-ready; err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// 设置日志，之后接受的连接也会使用它，默认不输出
+func (self *ArqListener) SetLogger(logger tlog.Logger) {
+	self.loggerMtx.Lock()
+	self.logger = logger
+	self.loggerMtx.Unlock()
+}
+
+func (self *ArqListener) getLogger() tlog.Logger {
+	self.loggerMtx.Lock()
+	defer self.loggerMtx.Unlock()
+	return self.logger
+}
+
+// 收到新远端的第一个包时创建连接，只接受 sn 为 0 的数据分段，避免已关闭连接的重传包创建出新连接
+func (self *ArqListener) newConn(sess *UdpSession, data []byte) (ok bool) {
+	if len(data) < arq_header_size || data[4] != arq_cmd_push || binary.BigEndian.Uint32(data[11:]) != 0 {
+		return false
+	}
+
+	peer := self.peer
+	conn := NewArqConn(binary.BigEndian.Uint32(data), func(data []byte) (err error) {
+		return peer.SendTo(sess, data)
+	})
+	conn.localAddr = self.addr
+	conn.remoteAddr = sess.Addr
+	conn.logger = self.getLogger().With(tlog.RemoteAddr(sess.Addr))
+	conn.onClose = func() {
+		peer.RemoveSession(sess)
+	}
+	select {
+	case self.acceptq <- conn:
+	default:
+		self.getLogger().Warn("ARQ accept queue is full, drop conn", tlog.RemoteAddr(sess.Addr))
+		conn.abort(ErrConnClosed)
+		return false
+	}
+	sess.Ext = conn
+	return true
+}
+
+func (self *ArqListener) Accept() (conn net.Conn, err error) {
+	select {
+	case c := <-self.acceptq:
+		return c, nil
+	case <-self.quit:
+		return nil, ErrConnClosed
+	}
+}
+
+// 关闭监听器和底层的 UDP 连接，已经接受的连接也会随之关闭
+func (self *ArqListener) Close() (err error) {
+	self.closeOnce.Do(func() {
+		close(self.quit)
+		err = self.peer.Close()
+		self.peer.SessionMap.Range(func(k, v interface{}) bool {
+			if conn, ok := v.(*UdpSession).Ext.(*ArqConn); ok {
+				conn.abort(ErrConnClosed)
+			}
+			return true
+		})
+	})
+	return err
+}
+
+func (self *ArqListener) Addr() net.Addr {
+	return self.addr
+}
+
+// 通过 UDP 连接到 ListenArq 监听的地址
+func DialArq(addr string) (obj *ArqConn, err error) {
+	peer := NewUdpClient()
+	peer.Addr = addr
+	ready := make(chan error, 2)
+	peer.OnDialCallback = func(self *UdpPeer, conn *net.UDPConn) (ok bool) {
+		conv := rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+		obj = NewArqConn(conv, func(data []byte) (err error) {
+			_, err = conn.Write(data)
+			return err
+		})
+		obj.localAddr = conn.LocalAddr()
+		obj.remoteAddr = conn.RemoteAddr()
+		obj.onClose = func() {
+			self.Close()
+		}
+		ready <- nil
+		return true
+	}
+	peer.OnHandleConnDataCallback = func(self *UdpPeer, conn *net.UDPConn, addr *net.UDPAddr, data []byte) (ok bool) {
+		if err := obj.Input(data); err != nil && err != ErrConnClosed {
+			obj.getLogger().Warn("ARQ conn input failed", tlog.RemoteAddr(addr), tlog.Err(err))
+		}
+		return true
+	}
+
+	go func() {
+		err := peer.Start()
+		if obj != nil {
+			obj.abort(ErrConnClosed)
+		}
+		ready <- err
+	}()
+	if err = <-ready; err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,161 @@
+package tnet
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 按 loss 的概率丢包，并给每个包加上随机延迟造成乱序
+func newLossyOutput(loss float64, peer func() *ArqConn) func(data []byte) (err error) {
+	var mtx sync.Mutex
+	rnd := rand.New(rand.NewSource(1))
+	return func(data []byte) (err error) {
+		mtx.Lock()
+		drop := rnd.Float64() < loss
+		delay := time.Duration(rnd.Intn(5)) * time.Millisecond
+		mtx.Unlock()
+		if drop {
+			return nil
+		}
+		pkt := make([]byte, len(data))
+		copy(pkt, data)
+		time.AfterFunc(delay, func() {
+			peer().Input(pkt)
+		})
+		return nil
+	}
+}
+
+func transfer(t *testing.T, w net.Conn, r net.Conn, size int) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		done <- err
+	}()
+
+	r.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d bytes", len(got), len(data))
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func TestArqConnLossy(t *testing.T) {
+	var a, b *ArqConn
+	a = NewArqConn(1, newLossyOutput(0.2, func() *ArqConn { return b }))
+	b = NewArqConn(1, newLossyOutput(0.2, func() *ArqConn { return a }))
+	defer b.Close()
+	transfer(t, a, b, 128*1024)
+}
+
+// 在 UDP 上转发 client 和 server 之间的包，按 loss 的概率丢包
+func startLossyRelay(t *testing.T, target string, loss float64) (addr string, closeFunc func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.Dial("udp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeFunc = func() {
+		conn.Close()
+		upstream.Close()
+	}
+
+	var mtx sync.Mutex
+	rnd := rand.New(rand.NewSource(3))
+	drop := func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return rnd.Float64() < loss
+	}
+	var client *net.UDPAddr
+	clientCh := make(chan *net.UDPAddr, 1)
+	go func() {
+		buf := make([]byte, 0xffff)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if client == nil {
+				client = addr
+				clientCh <- addr
+			}
+			if !drop() {
+				upstream.Write(buf[:n])
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 0xffff)
+		client := <-clientCh
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			if !drop() {
+				conn.WriteToUDP(buf[:n], client)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), closeFunc
+}
+
+func TestArqListenDialLossy(t *testing.T) {
+	lstn, err := ListenArq("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	relay, closeRelay := startLossyRelay(t, lstn.Addr().String(), 0.1)
+	defer closeRelay()
+	client, err := DialArq(relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := lstn.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	// 连接在收到第一个分段时才被接受
+	client.Write([]byte("hello"))
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("accept timeout")
+	}
+	defer server.Close()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read hello: %q, %v", buf, err)
+	}
+	transfer(t, server, client, 128*1024)
+}
@@ -0,0 +1,69 @@
+package tnet
+
+import (
+	"bytes"
+	"sync"
+)
+
+// 缓冲区池，netpeer 的读缓冲区、Slde 的编解码缓冲区和 EncryptTunPeer 的协议包共用
+// 大量连接时避免每个连接、每个帧都重新分配 64KB 的缓冲区
+
+const (
+	max_pooled_buffer_size int = 0x100000 // 超过 1MB 的 bytes.Buffer 不归还，避免池中常驻大块内存
+)
+
+var (
+	// 分级的切片池，每一级只保存容量恰好为该级大小的切片
+	bufPoolSizes = [...]int{0x200, 0x1000, 0x4000, 0x10000}
+	bufPools     [len(bufPoolSizes)]sync.Pool
+
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+)
+
+// 取出长度为 size 的切片，用完后调用 putBuf 归还，归还后不能再使用
+// 超过最大一级的直接分配，返回指针是为了放回池中时不再产生分配
+func getBuf(size int) (buf *[]byte) {
+	for i, poolSize := range bufPoolSizes {
+		if size > poolSize {
+			continue
+		}
+		if v := bufPools[i].Get(); v != nil {
+			buf = v.(*[]byte)
+		} else {
+			b := make([]byte, poolSize)
+			buf = &b
+		}
+		*buf = (*buf)[:size]
+		return buf
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+func putBuf(buf *[]byte) {
+	c := cap(*buf)
+	for i, poolSize := range bufPoolSizes {
+		if c == poolSize {
+			*buf = (*buf)[:c]
+			bufPools[i].Put(buf)
+			return
+		}
+	}
+}
+
+// 取出一个空的 bytes.Buffer，用完后调用 putBuffer 归还
+func getBuffer() (buf *bytes.Buffer) {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > max_pooled_buffer_size {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,157 @@
+package tnet
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func newBenchData(size int) (data []byte) {
+	data = make([]byte, size)
+	rnd := rand.New(rand.NewSource(4))
+	// 一半随机一半重复，接近真实流量的压缩率
+	rnd.Read(data[:size/2])
+	return data
+}
+
+func TestXorKeyStreamCompatible(t *testing.T) {
+	data := newBenchData(3 * xor_key_stream_step)
+	rnd := rand.New(rand.NewSource(xor_encrypt_seed))
+	want := make([]byte, len(data))
+	for i, v := range data {
+		want[i] = v ^ byte(rnd.Intn(256))
+	}
+
+	// 先取一小段再扩展，扩展后的密钥流要和一次生成的一致
+	xorEncrypt(data[:10], xor_encrypt_seed)
+	if got := xorEncrypt(data, xor_encrypt_seed); !bytes.Equal(got, want) {
+		t.Fatal("xor key stream mismatch")
+	}
+
+	// 超过缓存上限的密钥流临时生成，与缓存的前缀一致，缓存不会增长
+	long := loadXorKeyStream(xor_encrypt_seed, max_xor_key_stream+1)
+	if !bytes.Equal(long[:len(data)], loadXorKeyStream(xor_encrypt_seed, len(data))) {
+		t.Fatal("uncached xor key stream mismatch")
+	}
+	v, _ := xorKeyStreams.Load(int64(xor_encrypt_seed))
+	ks := v.(*xorKeyStream)
+	ks.mtx.RLock()
+	cached := len(ks.stream)
+	ks.mtx.RUnlock()
+	if cached > max_xor_key_stream {
+		t.Fatalf("cached %d bytes of key stream", cached)
+	}
+}
+
+func TestPeerPacketRoundTrip(t *testing.T) {
+	payload := getBuffer()
+	defer putBuffer(payload)
+	data := newBenchData(max_tcp_read)
+	packDataPacket(payload, 7, 0x123456789, data)
+	frame := getBuffer()
+	defer putBuffer(frame)
+	encodeSldeTo(frame, payload.Bytes())
+
+	slde := NewSlde()
+	defer slde.Release()
+	if left, err := slde.WriteAndGetNextToWrite(frame.Bytes()); err != nil || left != 0 {
+		t.Fatalf("write frame: left(%d), %v", left, err)
+	}
+	recvdata, err := slde.decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, connId, left, err := unpackPacket(recvdata)
+	if err != nil || cmd != cmd_data || connId != 7 {
+		t.Fatalf("unpack packet: cmd(%d), connId(%d), %v", cmd, connId, err)
+	}
+	offset, got, err := unpackData(left)
+	if err != nil || offset != 0x123456789 {
+		t.Fatalf("unpack data: offset(%x), %v", offset, err)
+	}
+	defer putBuf(got)
+	if !bytes.Equal(*got, data) {
+		t.Fatalf("got %d bytes, want %d bytes", len(*got), len(data))
+	}
+}
+
+var benchSink []byte
+
+func BenchmarkReadBufMake(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchSink = make([]byte, read_buf_size)
+	}
+}
+
+func BenchmarkReadBufPool(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := getBuf(read_buf_size)
+		benchSink = *buf
+		putBuf(buf)
+	}
+}
+
+// 每帧分配的编码接口，作为对照
+func BenchmarkSldeEncode(b *testing.B) {
+	data := newBenchData(0x1000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		EncodeToSldeDataFromBytes(data)
+	}
+}
+
+func BenchmarkSldeEncodePooled(b *testing.B) {
+	data := newBenchData(0x1000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		frame := getBuffer()
+		encodeSldeTo(frame, data)
+		putBuffer(frame)
+	}
+}
+
+func BenchmarkSldeDecode(b *testing.B) {
+	data := newBenchData(0x1000)
+	frame, _ := EncodeToSldeDataFromBytes(data)
+	slde := NewSlde()
+	defer slde.Release()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		slde.WriteAndGetNextToWrite(frame)
+		if _, err := slde.decode(); err != nil {
+			b.Fatal(err)
+		}
+		slde.Reset()
+	}
+}
+
+func BenchmarkPeerPacketRoundTrip(b *testing.B) {
+	data := newBenchData(0x1000)
+	slde := NewSlde()
+	defer slde.Release()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		payload := getBuffer()
+		packDataPacket(payload, 1, uint64(i), data)
+		frame := getBuffer()
+		encodeSldeTo(frame, payload.Bytes())
+		slde.WriteAndGetNextToWrite(frame.Bytes())
+		putBuffer(frame)
+		putBuffer(payload)
+
+		recvdata, err := slde.decode()
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _, left, _ := unpackPacket(recvdata)
+		_, buf, _ := unpackData(left)
+		putBuf(buf)
+		slde.Reset()
+	}
+}
@@ -0,0 +1,265 @@
+package tnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	max_frame_size int = 0xffffff
+
+	length_prefix_size int = 4
+	max_varint_size    int = binary.MaxVarintLen64
+)
+
+// 帧编解码器
+// TcpServer/TcpClient 设置 FrameCodecFactory 后，读例程用它把收到的数据切分成完整的消息，
+// 然后调用 OnHandleMessageCallback，发送时用 TCPConnEx.SendMessage 编码成帧
+type FrameCodec interface {
+	// 将一个完整的消息编码成帧，可能被多个例程并发调用
+	Encode(msg []byte) (frame []byte, err error)
+
+	// 下一次期望写入的字节数
+	GetNextToWrite() (nextToWrite int)
+
+	// 写入从连接读到的数据，len(data) 不会超过 GetNextToWrite，返回下一次期望写入的字节数，为 0 表示已经收到一个完整的帧
+	WriteAndGetNextToWrite(data []byte) (left int, err error)
+
+	// 收到完整的帧后取出消息并重置解码状态
+	DecodeAndReset() (msg []byte, err error)
+}
+
+// 依次把 data 写入 codec，每解出一个完整的消息调用一次 handle，handle 返回 false 时停止
+func decodeFrames(codec FrameCodec, data []byte, handle func(msg []byte) (ok bool)) (ok bool, err error) {
+	for len(data) > 0 {
+		n := codec.GetNextToWrite()
+		if n <= 0 {
+			return false, errors.New(fmt.Sprintf("invalid next to write(%d)", n))
+		}
+		if n > len(data) {
+			n = len(data)
+		}
+		left, err := codec.WriteAndGetNextToWrite(data[:n])
+		if err != nil {
+			return false, err
+		}
+		data = data[n:]
+		if left > 0 {
+			continue
+		} else if left < 0 {
+			return false, errors.New("left < 0")
+		}
+
+		msg, err := codec.DecodeAndReset()
+		if err != nil {
+			return false, err
+		}
+		if !handle(msg) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Slde 帧
+type SldeCodec struct {
+	*Slde
+}
+
+func NewSldeCodec() (obj FrameCodec) {
+	return &SldeCodec{NewSlde()}
+}
+
+func (self *SldeCodec) Encode(msg []byte) (frame []byte, err error) {
+	return EncodeToSldeDataFromBytes(msg)
+}
+
+// 长度前缀帧 = length:uint32 + msg:string(length)
+type LengthPrefixCodec struct {
+	MaxFrameSize int
+	header       [length_prefix_size]byte
+	headerLen    int
+	msg          []byte
+	msgLen       int
+}
+
+func NewLengthPrefixCodec() (obj FrameCodec) {
+	return &LengthPrefixCodec{MaxFrameSize: max_frame_size}
+}
+
+func (self *LengthPrefixCodec) Encode(msg []byte) (frame []byte, err error) {
+	if len(msg) > self.MaxFrameSize {
+		return nil, errors.New(fmt.Sprintf("frame size(%d) exceeds %d", len(msg), self.MaxFrameSize))
+	}
+	frame = make([]byte, length_prefix_size+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[length_prefix_size:], msg)
+	return frame, nil
+}
+
+func (self *LengthPrefixCodec) GetNextToWrite() (nextToWrite int) {
+	if self.msg == nil {
+		return length_prefix_size - self.headerLen
+	}
+	return len(self.msg) - self.msgLen
+}
+
+func (self *LengthPrefixCodec) WriteAndGetNextToWrite(data []byte) (left int, err error) {
+	if self.msg == nil {
+		self.headerLen += copy(self.header[self.headerLen:], data)
+		if self.headerLen < length_prefix_size {
+			return self.GetNextToWrite(), nil
+		}
+		length := int(binary.BigEndian.Uint32(self.header[:]))
+		if length > self.MaxFrameSize {
+			return -1, errors.New(fmt.Sprintf("frame size(%d) exceeds %d", length, self.MaxFrameSize))
+		}
+		self.msg = make([]byte, length)
+		return self.GetNextToWrite(), nil
+	}
+
+	self.msgLen += copy(self.msg[self.msgLen:], data)
+	return self.GetNextToWrite(), nil
+}
+
+func (self *LengthPrefixCodec) DecodeAndReset() (msg []byte, err error) {
+	if self.msg == nil || self.msgLen != len(self.msg) {
+		return nil, errors.New("frame is incomplete")
+	}
+	msg = self.msg
+	self.msg = nil
+	self.msgLen = 0
+	self.headerLen = 0
+	return msg, nil
+}
+
+// 变长整数（protobuf varint）长度前缀帧 = length:uvarint + msg:string(length)
+type VarintCodec struct {
+	MaxFrameSize int
+	header       [max_varint_size]byte
+	headerLen    int
+	msg          []byte
+	msgLen       int
+}
+
+func NewVarintCodec() (obj FrameCodec) {
+	return &VarintCodec{MaxFrameSize: max_frame_size}
+}
+
+func (self *VarintCodec) Encode(msg []byte) (frame []byte, err error) {
+	if len(msg) > self.MaxFrameSize {
+		return nil, errors.New(fmt.Sprintf("frame size(%d) exceeds %d", len(msg), self.MaxFrameSize))
+	}
+	frame = make([]byte, max_varint_size+len(msg))
+	n := binary.PutUvarint(frame, uint64(len(msg)))
+	n += copy(frame[n:], msg)
+	return frame[:n], nil
+}
+
+func (self *VarintCodec) GetNextToWrite() (nextToWrite int) {
+	if self.msg == nil {
+		// 长度字段按字节读取，直到最高位为 0
+		return 1
+	}
+	return len(self.msg) - self.msgLen
+}
+
+func (self *VarintCodec) WriteAndGetNextToWrite(data []byte) (left int, err error) {
+	if self.msg == nil {
+		for _, b := range data {
+			if self.headerLen >= max_varint_size {
+				return -1, errors.New("varint length field overflow")
+			}
+			self.header[self.headerLen] = b
+			self.headerLen++
+			if b&0x80 != 0 {
+				continue
+			}
+
+			length, _ := binary.Uvarint(self.header[:self.headerLen])
+			if length > uint64(self.MaxFrameSize) {
+				return -1, errors.New(fmt.Sprintf("frame size(%d) exceeds %d", length, self.MaxFrameSize))
+			}
+			self.msg = make([]byte, length)
+			break
+		}
+		return self.GetNextToWrite(), nil
+	}
+
+	self.msgLen += copy(self.msg[self.msgLen:], data)
+	return self.GetNextToWrite(), nil
+}
+
+func (self *VarintCodec) DecodeAndReset() (msg []byte, err error) {
+	if self.msg == nil || self.msgLen != len(self.msg) {
+		return nil, errors.New("frame is incomplete")
+	}
+	msg = self.msg
+	self.msg = nil
+	self.msgLen = 0
+	self.headerLen = 0
+	return msg, nil
+}
+
+// 按分隔符切分的帧，默认以 '\n' 结尾，解出的消息不包含分隔符和它前面的 '\r'
+type LineCodec struct {
+	Delim        byte
+	MaxFrameSize int
+	line         bytes.Buffer
+	done         bool
+}
+
+func NewLineCodec() (obj FrameCodec) {
+	return &LineCodec{Delim: '\n', MaxFrameSize: max_frame_size}
+}
+
+func (self *LineCodec) Encode(msg []byte) (frame []byte, err error) {
+	if len(msg) > self.MaxFrameSize {
+		return nil, errors.New(fmt.Sprintf("frame size(%d) exceeds %d", len(msg), self.MaxFrameSize))
+	}
+	if bytes.IndexByte(msg, self.Delim) >= 0 {
+		return nil, errors.New("message contains delimiter")
+	}
+	frame = make([]byte, len(msg)+1)
+	copy(frame, msg)
+	frame[len(msg)] = self.Delim
+	return frame, nil
+}
+
+func (self *LineCodec) GetNextToWrite() (nextToWrite int) {
+	if self.done {
+		return 0
+	}
+	// 不知道分隔符的位置，只能按字节读取
+	return 1
+}
+
+func (self *LineCodec) WriteAndGetNextToWrite(data []byte) (left int, err error) {
+	for _, b := range data {
+		if b == self.Delim {
+			self.done = true
+			return 0, nil
+		}
+		if self.line.Len() >= self.MaxFrameSize {
+			return -1, errors.New(fmt.Sprintf("frame size exceeds %d", self.MaxFrameSize))
+		}
+		self.line.WriteByte(b)
+	}
+	return 1, nil
+}
+
+func (self *LineCodec) DecodeAndReset() (msg []byte, err error) {
+	if !self.done {
+		return nil, errors.New("frame is incomplete")
+	}
+	msg = make([]byte, self.line.Len())
+	copy(msg, self.line.Bytes())
+	if n := len(msg); n > 0 && msg[n-1] == '\r' {
+		msg = msg[:n-1]
+	}
+	self.line.Reset()
+	self.done = false
+	return msg, nil
+}
@@ -0,0 +1,131 @@
+package tnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+var codecFactories = []struct {
+	name    string
+	factory func() FrameCodec
+}{
+	{"slde", NewSldeCodec},
+	{"length prefix", NewLengthPrefixCodec},
+	{"varint", NewVarintCodec},
+	{"line", NewLineCodec},
+}
+
+func testCodecMessages() (msgs [][]byte) {
+	msgs = [][]byte{[]byte(""), []byte("a"), []byte("hello world\r")}
+	long := bytes.Repeat([]byte("0123456789"), 30)
+	return append(msgs, long)
+}
+
+// 编码多个消息后按不同的块大小写入，解出的消息与原来一致
+func TestFrameCodecRoundTrip(t *testing.T) {
+	for _, c := range codecFactories {
+		var stream []byte
+		msgs := testCodecMessages()
+		for _, msg := range msgs {
+			frame, err := c.factory().Encode(msg)
+			if err != nil {
+				t.Fatalf("%s: encode: %v", c.name, err)
+			}
+			stream = append(stream, frame...)
+		}
+		for _, chunk := range []int{1, 3, 7, len(stream)} {
+			codec := c.factory()
+			var got [][]byte
+			handle := func(msg []byte) (ok bool) {
+				got = append(got, append([]byte(nil), msg...))
+				return true
+			}
+			for data := stream; len(data) > 0; {
+				n := chunk
+				if n > len(data) {
+					n = len(data)
+				}
+				if ok, err := decodeFrames(codec, data[:n], handle); !ok || err != nil {
+					t.Fatalf("%s: decode in chunks of %d: %v", c.name, chunk, err)
+				}
+				data = data[n:]
+			}
+			if len(got) != len(msgs) {
+				t.Fatalf("%s: decoded %d messages, want %d", c.name, len(got), len(msgs))
+			}
+			for i, msg := range msgs {
+				want := msg
+				if c.name == "line" {
+					// LineCodec 去掉行尾的 '\r'
+					want = bytes.TrimSuffix(msg, []byte("\r"))
+				}
+				if !bytes.Equal(got[i], want) {
+					t.Fatalf("%s: message %d is %q, want %q", c.name, i, got[i], want)
+				}
+			}
+		}
+	}
+}
+
+// 不完整的帧不会交付，取出时返回错误
+func TestFrameCodecTruncated(t *testing.T) {
+	for _, c := range codecFactories {
+		frame, _ := c.factory().Encode([]byte("hello"))
+		codec := c.factory()
+		ok, err := decodeFrames(codec, frame[:len(frame)-1], func(msg []byte) bool {
+			t.Fatalf("%s: truncated frame delivered %q", c.name, msg)
+			return false
+		})
+		if !ok || err != nil {
+			t.Fatalf("%s: decode truncated frame: %v", c.name, err)
+		}
+		if _, err = codec.DecodeAndReset(); err == nil {
+			t.Fatalf("%s: incomplete frame should not decode", c.name)
+		}
+	}
+}
+
+func TestFrameCodecOversized(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 9)
+	small := []FrameCodec{
+		&LengthPrefixCodec{MaxFrameSize: 8},
+		&VarintCodec{MaxFrameSize: 8},
+		&LineCodec{Delim: '\n', MaxFrameSize: 8},
+	}
+	for i, codec := range small {
+		if _, err := codec.Encode(big); err == nil {
+			t.Fatalf("%s: oversized message should not encode", codecFactories[i+1].name)
+		}
+		frame, _ := codecFactories[i+1].factory().Encode(big)
+		if _, err := decodeFrames(codec, frame, func(msg []byte) bool { return true }); err == nil {
+			t.Fatalf("%s: oversized frame should be rejected", codecFactories[i+1].name)
+		}
+	}
+
+	// 长度字段由对端决定，超过上限时立即拒绝，不会等待或者分配对应的缓冲区
+	header := make([]byte, SLDE_HEADER_SIZE)
+	header[0] = SLDE_STX
+	binary.BigEndian.PutUint32(header[1+SLDE_CUSTOM_SIZE:], uint32(max_frame_size+1))
+	if _, err := decodeFrames(NewSldeCodec(), header, func(msg []byte) bool { return true }); err == nil {
+		t.Fatal("slde: oversized frame should be rejected")
+	}
+	header = make([]byte, length_prefix_size)
+	binary.BigEndian.PutUint32(header, uint32(max_frame_size+1))
+	if _, err := decodeFrames(NewLengthPrefixCodec(), header, func(msg []byte) bool { return true }); err == nil {
+		t.Fatal("length prefix: oversized frame should be rejected")
+	}
+	overflow := bytes.Repeat([]byte{0xff}, max_varint_size+1)
+	if _, err := decodeFrames(NewVarintCodec(), overflow, func(msg []byte) bool { return true }); err == nil {
+		t.Fatal("varint: overflowed length field should be rejected")
+	}
+}
+
+// 帧尾不是 SLDE_ETX 时拒绝
+func TestSldeCodecMalformed(t *testing.T) {
+	frame, _ := NewSldeCodec().Encode([]byte("hello"))
+	frame[len(frame)-1] = 0
+	if _, err := decodeFrames(NewSldeCodec(), frame, func(msg []byte) bool { return true }); err == nil {
+		t.Fatal("frame without etx should be rejected")
+	}
+}
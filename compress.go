@@ -0,0 +1,277 @@
+package tnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"sync"
+	"sync/atomic"
+)
+
+// 隧道帧的压缩，在握手时协商，参见 handshake.go
+// 协商后每帧的压缩数据前加一个标志字节：frame_raw 表示原始数据，frame_compressed 表示用协商的方式压缩
+// 太短的帧不压缩；压缩后没有变小时改为发送原始数据，连续多帧没有变小后暂停一段时间不再尝试，
+// 已经压缩过的数据（TLS、视频等）不会一直浪费 CPU
+// 没有握手的连接与旧版本兼容，每帧都用 zlib 压缩，没有标志字节
+// 快速压缩没有使用 LZ4，而是用 klauspost/compress 中的 S2 代替，速度与 LZ4 相当，与 zstd 共用这个新增的依赖，协商和配置中的名称为 snappy
+
+type Compression uint8
+
+const (
+	CompressNone   Compression = 0
+	CompressZlib   Compression = 1
+	CompressSnappy Compression = 2 // S2，兼容 Snappy 的 LZ 压缩，代替 LZ4
+	CompressZstd   Compression = 3
+)
+
+const (
+	frame_raw        byte = 0
+	frame_compressed byte = 1
+
+	compress_min_size     = 0x80     // 更短的帧不压缩
+	compress_max_misses   = 8        // 连续这么多帧压缩后没有变小就暂停压缩
+	compress_skip_frames  = 0x100    // 暂停压缩的帧数，之后重新尝试
+	max_decompressed_size = 0x100000 // 一帧解压后的上限，超过时认为数据有误
+	max_compressions      = 8        // 握手时最多提供的压缩方式
+)
+
+var (
+	// proxy 没有设置 Compressions 时按这个顺序提供，agent 没有设置时全部允许
+	defaultCompressions = []Compression{CompressSnappy, CompressZstd, CompressZlib, CompressNone}
+
+	errFrameTooLarge = errors.New("tnet: decompressed frame too large")
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error // 初始化失败时不再提供和接受 zstd
+)
+
+func (self Compression) String() string {
+	switch self {
+	case CompressNone:
+		return "none"
+	case CompressZlib:
+		return "zlib"
+	case CompressSnappy:
+		return "snappy"
+	case CompressZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(self))
+}
+
+// 按名称解析压缩方式，名称与 String 的返回值相同
+func ParseCompression(name string) (c Compression, err error) {
+	for c = CompressNone; c.supported(); c++ {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("unknown compression(%s)", name))
+}
+
+func (self Compression) supported() bool {
+	return self <= CompressZstd
+}
+
+// 本端可以使用的压缩方式，zstd 初始化失败时不可用
+func (self Compression) available() (err error) {
+	if !self.supported() {
+		return errors.New(fmt.Sprintf("unknown compression(%d)", uint8(self)))
+	}
+	if self == CompressZstd {
+		zstdOnce.Do(initZstd)
+		return zstdErr
+	}
+	return nil
+}
+
+// 去掉 compressions 中本端不能使用的压缩方式，compressions 为 nil 时使用 defaultCompressions
+// err 为最后一个被去掉的压缩方式不可用的原因
+func availableCompressions(compressions []Compression) (list []Compression, err error) {
+	if compressions == nil {
+		compressions = defaultCompressions
+	}
+	list = make([]Compression, 0, len(compressions))
+	for _, c := range compressions {
+		if e := c.available(); e != nil {
+			err = e
+			continue
+		}
+		list = append(list, c)
+	}
+	return list, err
+}
+
+// 压缩算法，实现需要可以被多个例程同时调用
+type frameCodec interface {
+	// 压缩 data 并追加到 dst
+	compressTo(dst *bytes.Buffer, data []byte)
+	// 解压 data 并追加到 dst
+	decompressTo(dst *bytes.Buffer, data []byte) (err error)
+}
+
+type zlibCodec struct{}
+
+func (self zlibCodec) compressTo(dst *bytes.Buffer, data []byte) {
+	zlibCompressTo(dst, data)
+}
+
+func (self zlibCodec) decompressTo(dst *bytes.Buffer, data []byte) (err error) {
+	return zlibDecompressTo(dst, data, max_decompressed_size)
+}
+
+type snappyCodec struct{}
+
+func (self snappyCodec) compressTo(dst *bytes.Buffer, data []byte) {
+	buf := getBuf(s2.MaxEncodedLen(len(data)))
+	dst.Write(s2.Encode(*buf, data))
+	putBuf(buf)
+}
+
+func (self snappyCodec) decompressTo(dst *bytes.Buffer, data []byte) (err error) {
+	size, err := s2.DecodedLen(data)
+	if err != nil {
+		return err
+	}
+	if size > max_decompressed_size {
+		return errFrameTooLarge
+	}
+	buf := getBuf(size)
+	defer putBuf(buf)
+	out, err := s2.Decode(*buf, data)
+	if err != nil {
+		return err
+	}
+	dst.Write(out)
+	return nil
+}
+
+type zstdCodec struct{}
+
+func initZstd() {
+	if zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderCRC(false)); zstdErr != nil {
+		return
+	}
+	zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(max_decompressed_size))
+}
+
+func (self zstdCodec) compressTo(dst *bytes.Buffer, data []byte) {
+	buf := getBuf(len(data))
+	out := zstdEncoder.EncodeAll(data, (*buf)[:0])
+	dst.Write(out)
+	putBuf(buf)
+}
+
+func (self zstdCodec) decompressTo(dst *bytes.Buffer, data []byte) (err error) {
+	buf := getBuf(max_tcp_read)
+	defer putBuf(buf)
+	out, err := zstdDecoder.DecodeAll(data, (*buf)[:0])
+	if err != nil {
+		return err
+	}
+	dst.Write(out)
+	return nil
+}
+
+// c 不可用时返回 nil，握手时只会协商出可用的压缩方式
+func newFrameCodec(c Compression) (codec frameCodec) {
+	if c.available() != nil {
+		return nil
+	}
+	switch c {
+	case CompressZlib:
+		return zlibCodec{}
+	case CompressSnappy:
+		return snappyCodec{}
+	case CompressZstd:
+		return zstdCodec{}
+	}
+	return nil
+}
+
+// 一条 peer 连接的帧压缩，两个方向共用，发送时会被多个例程同时调用
+type frameCompressor struct {
+	compression Compression
+	codec       frameCodec // CompressNone 时为 nil
+	legacy      bool       // 没有握手的旧版本连接，总是用 zlib 压缩，没有标志字节
+	misses      int32      // 连续没有变小的帧数，原子操作
+	skip        int32      // 还要跳过压缩的帧数，原子操作
+}
+
+func newFrameCompressor(c Compression) (obj *frameCompressor) {
+	obj = new(frameCompressor)
+	obj.compression = c
+	obj.codec = newFrameCodec(c)
+	return obj
+}
+
+func newLegacyFrameCompressor() (obj *frameCompressor) {
+	obj = newFrameCompressor(CompressZlib)
+	obj.legacy = true
+	return obj
+}
+
+func (self *frameCompressor) skipping() bool {
+	for {
+		n := atomic.LoadInt32(&self.skip)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&self.skip, n, n-1) {
+			return true
+		}
+	}
+}
+
+// 压缩 data 并追加到 dst
+func (self *frameCompressor) compressTo(dst *bytes.Buffer, data []byte) {
+	if self.legacy {
+		self.codec.compressTo(dst, data)
+		return
+	}
+	if self.codec == nil || len(data) < compress_min_size || self.skipping() {
+		dst.WriteByte(frame_raw)
+		dst.Write(data)
+		return
+	}
+	start := dst.Len()
+	dst.WriteByte(frame_compressed)
+	self.codec.compressTo(dst, data)
+	if dst.Len()-start-1 < len(data) {
+		atomic.StoreInt32(&self.misses, 0)
+		return
+	}
+
+	dst.Truncate(start)
+	dst.WriteByte(frame_raw)
+	dst.Write(data)
+	if atomic.AddInt32(&self.misses, 1) >= compress_max_misses {
+		atomic.StoreInt32(&self.misses, 0)
+		atomic.StoreInt32(&self.skip, compress_skip_frames)
+	}
+}
+
+// 解压 data 并追加到 dst
+func (self *frameCompressor) decompressTo(dst *bytes.Buffer, data []byte) (err error) {
+	if self.legacy {
+		return self.codec.decompressTo(dst, data)
+	}
+	if len(data) < 1 {
+		return errors.New("empty frame")
+	}
+	switch data[0] {
+	case frame_raw:
+		dst.Write(data[1:])
+		return nil
+	case frame_compressed:
+		if self.codec == nil {
+			return errors.New(fmt.Sprintf("compressed frame without negotiated compression"))
+		}
+		return self.codec.decompressTo(dst, data[1:])
+	}
+	return errors.New(fmt.Sprintf("invalid frame flag(%d)", data[0]))
+}
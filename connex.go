@@ -0,0 +1,377 @@
+package tnet
+
+import (
+	"crypto/tls"
+	"errors"
+	"git.tutils.com/tutils/tnet/tlog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	send_queue_size     int           = 64
+	close_flush_timeout time.Duration = 5e9
+)
+
+var (
+	ErrConnClosed    = errors.New("tnet: connection closed")
+	ErrSendQueueFull = errors.New("tnet: send queue is full")
+	ErrNoFrameCodec  = errors.New("tnet: no frame codec")
+)
+
+// 超时类型，参见 OnTimeoutCallback
+type TimeoutKind int
+
+const (
+	TimeoutRead TimeoutKind = iota // 单次读超过 ReadTimeout 没有收到数据
+	TimeoutIdle                    // 超过 IdleTimeout 没有任何读写
+)
+
+func (self TimeoutKind) String() string {
+	switch self {
+	case TimeoutRead:
+		return "read"
+	case TimeoutIdle:
+		return "idle"
+	}
+	return "unknown"
+}
+
+// 发送队列满时的处理策略
+type SendQueuePolicy int
+
+const (
+	SendQueueBlock SendQueuePolicy = iota // 阻塞直到队列有空位或连接关闭
+	SendQueueDrop                         // 丢弃本次数据并返回 ErrSendQueueFull
+	SendQueueClose                        // 关闭连接并返回 ErrSendQueueFull
+)
+
+// TcpServer 和 TcpClient 的连接，底层可以是任意 net.Conn，例如 TCP、unix socket 或 net.Pipe
+type TCPConnEx struct {
+	lastActive int64 // UnixNano，放在首位保证 64 位对齐
+	net.Conn         // 启用 TLS 时为 *tls.Conn，所有读写都经过它，否则为底层连接
+	ReadSize   int
+	Ext        interface{}
+
+	logger      tlog.Logger
+	metrics     Metrics
+	handled     bool // 是否由 connReadHandler 例程负责读取和关闭
+	rawConn     net.Conn
+	tlsConn     *tls.Conn
+	codec       FrameCodec
+	readTimeout time.Duration
+	idleTimeout time.Duration
+	readStop    int32
+
+	sendq        chan []byte
+	sendPolicy   SendQueuePolicy
+	writeTimeout time.Duration
+	sending      bool // 发送例程是否已经启动，在 sendOnce 中设置
+	sendOnce     sync.Once
+	sendDone     chan struct{}
+	sendMtx      sync.RWMutex
+	sendClosed   bool // 发送例程已经退出，之后放入队列的数据不会再被写出，由 sendMtx 保护
+	closeOnce    sync.Once
+	quit         chan struct{}
+	onClose      func()
+	onCloseOnce  sync.Once
+}
+
+func newTCPConnEx(conn net.Conn, tlsConn *tls.Conn, readSize int, ext interface{}) (obj *TCPConnEx) {
+	obj = &TCPConnEx{Conn: conn, ReadSize: readSize, Ext: ext}
+	obj.rawConn = conn
+	if tlsConn != nil {
+		obj.Conn = tlsConn
+		obj.tlsConn = tlsConn
+	}
+	obj.logger = tlog.NewNopLogger()
+	obj.metrics = NewNopMetrics()
+	obj.sendPolicy = SendQueueBlock
+	obj.sendDone = make(chan struct{})
+	obj.quit = make(chan struct{})
+	obj.touch()
+	return obj
+}
+
+func (self *TCPConnEx) setTimeouts(readTimeout time.Duration, idleTimeout time.Duration, keepAlivePeriod time.Duration) {
+	self.readTimeout = readTimeout
+	self.idleTimeout = idleTimeout
+	tcpConn := self.TCPConn()
+	if tcpConn == nil {
+		return
+	}
+	if keepAlivePeriod > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(keepAlivePeriod)
+	} else if keepAlivePeriod < 0 {
+		tcpConn.SetKeepAlive(false)
+	}
+}
+
+func (self *TCPConnEx) touch() {
+	atomic.StoreInt64(&self.lastActive, time.Now().UnixNano())
+}
+
+// 最后一次成功读写的时间
+func (self *TCPConnEx) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&self.lastActive))
+}
+
+// 按 ReadTimeout 和 IdleTimeout 设置读超时后读取数据，kind 为本次生效的超时类型
+func (self *TCPConnEx) readWithDeadline(buf []byte) (n int, err error, kind TimeoutKind) {
+	var deadline time.Time
+	if self.readTimeout > 0 {
+		deadline = time.Now().Add(self.readTimeout)
+		kind = TimeoutRead
+	}
+	if self.idleTimeout > 0 {
+		idle := self.LastActive().Add(self.idleTimeout)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+			kind = TimeoutIdle
+		}
+	}
+	if !deadline.IsZero() {
+		self.SetReadDeadline(deadline)
+		if atomic.LoadInt32(&self.readStop) != 0 {
+			// stopRead 可能发生在设置超时之前
+			self.SetReadDeadline(time.Now())
+		}
+	}
+
+	n, err = self.Read(buf)
+	if n > 0 {
+		self.touch()
+		self.metrics.AddCounter(MetricBytesIn, int64(n))
+	}
+	return n, err, kind
+}
+
+// 未启用 TLS 时返回 nil
+func (self *TCPConnEx) TLSConn() *tls.Conn {
+	return self.tlsConn
+}
+
+// 底层连接，启用 TLS 时不能直接读写
+func (self *TCPConnEx) RawConn() net.Conn {
+	return self.rawConn
+}
+
+// 底层连接不是 TCP 连接时返回 nil，可以用来设置 SetNoDelay 等 TCP 选项
+func (self *TCPConnEx) TCPConn() *net.TCPConn {
+	tcpConn, _ := self.rawConn.(*net.TCPConn)
+	return tcpConn
+}
+
+// 判断读错误是否为需要交给 OnTimeoutCallback 处理的超时
+func (self *TCPConnEx) checkTimeout(err error, kind TimeoutKind) (timeout bool, expired bool) {
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || atomic.LoadInt32(&self.readStop) != 0 {
+		return false, false
+	}
+	if kind == TimeoutIdle && time.Since(self.LastActive()) < self.idleTimeout {
+		// 读等待期间有写操作，空闲时间被刷新了
+		return true, false
+	}
+	return true, true
+}
+
+// 打断阻塞中的读操作，之后的读操作都会立即超时返回
+func (self *TCPConnEx) stopRead() {
+	atomic.StoreInt32(&self.readStop, 1)
+	self.SetReadDeadline(time.Now())
+}
+
+// 写数据，受 WriteTimeout 限制，与 Send 混用时无法保证数据不交错
+func (self *TCPConnEx) Write(data []byte) (n int, err error) {
+	if self.writeTimeout > 0 {
+		self.SetWriteDeadline(time.Now().Add(self.writeTimeout))
+	}
+	n, err = self.Conn.Write(data)
+	if n > 0 {
+		self.touch()
+		self.metrics.AddCounter(MetricBytesOut, int64(n))
+	}
+	return n, err
+}
+
+func (self *TCPConnEx) setSendQueue(size int, policy SendQueuePolicy, writeTimeout time.Duration) {
+	if size < 1 {
+		size = 1
+	}
+	self.sendq = make(chan []byte, size)
+	self.sendPolicy = policy
+	self.writeTimeout = writeTimeout
+}
+
+// 将 data 放入发送队列，由连接的发送例程按顺序整块写出，可以在多个例程中并发调用
+// 队列满时的行为由 SendQueuePolicy 决定，data 在调用后不应再被修改
+func (self *TCPConnEx) Send(data []byte) (err error) {
+	self.sendOnce.Do(self.goStartSender)
+	err = self.enqueue(data)
+	if err == ErrSendQueueFull && self.sendPolicy == SendQueueClose {
+		self.logger.Warn("send queue of TCP conn is full, close it")
+		self.Close()
+	}
+	return err
+}
+
+// 放入发送队列，发送例程退出后返回 ErrConnClosed
+// 持有 sendMtx 的读锁，发送例程退出前取得写锁，之后不会再有数据放入队列而无人写出
+func (self *TCPConnEx) enqueue(data []byte) (err error) {
+	self.sendMtx.RLock()
+	defer self.sendMtx.RUnlock()
+	if self.sendClosed {
+		return ErrConnClosed
+	}
+	select {
+	case <-self.quit:
+		return ErrConnClosed
+	default:
+	}
+
+	switch self.sendPolicy {
+	case SendQueueDrop, SendQueueClose:
+		select {
+		case self.sendq <- data:
+			return nil
+		case <-self.quit:
+			return ErrConnClosed
+		default:
+			return ErrSendQueueFull
+		}
+
+	default:
+		select {
+		case self.sendq <- data:
+			return nil
+		case <-self.quit:
+			return ErrConnClosed
+		}
+	}
+}
+
+// 未设置 FrameCodecFactory 时返回 nil
+func (self *TCPConnEx) Codec() FrameCodec {
+	return self.codec
+}
+
+// 用连接的 FrameCodec 把 msg 编码成帧后放入发送队列
+func (self *TCPConnEx) SendMessage(msg []byte) (err error) {
+	if self.codec == nil {
+		return ErrNoFrameCodec
+	}
+	frame, err := self.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return self.Send(frame)
+}
+
+func (self *TCPConnEx) goStartSender() {
+	if self.sendq == nil {
+		self.setSendQueue(send_queue_size, self.sendPolicy, self.writeTimeout)
+	}
+	self.sending = true
+	go self.sendLoop()
+}
+
+func (self *TCPConnEx) writeWithTimeout(data []byte) (err error) {
+	_, err = self.Write(data)
+	return err
+}
+
+// 发送例程，写失败时关闭连接，让读例程走正常的关闭流程
+func (self *TCPConnEx) sendLoop() {
+	defer close(self.sendDone)
+	self.metrics.AddGauge(MetricGoroutines, 1)
+	defer self.metrics.AddGauge(MetricGoroutines, -1)
+	for {
+		select {
+		case data := <-self.sendq:
+			if err := self.writeWithTimeout(data); err != nil {
+				self.logger.Warn("TCP conn send failed", tlog.Err(err))
+				self.closeOnce.Do(func() { close(self.quit) })
+				self.rawConn.Close()
+				self.stopSending()
+				return
+			}
+
+		case <-self.quit:
+			self.stopSending()
+			self.flush()
+			return
+		}
+	}
+}
+
+// 之后的 Send 返回 ErrConnClosed，quit 已经关闭，阻塞在 enqueue 中的 Send 会释放读锁
+func (self *TCPConnEx) stopSending() {
+	self.sendMtx.Lock()
+	self.sendClosed = true
+	self.sendMtx.Unlock()
+}
+
+// 连接关闭前尽量写出队列中剩余的数据
+func (self *TCPConnEx) flush() {
+	for {
+		select {
+		case data := <-self.sendq:
+			if err := self.writeWithTimeout(data); err != nil {
+				self.logger.Warn("TCP conn flush failed", tlog.Err(err))
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// 关闭连接，发送队列中剩余的数据会在关闭前写出
+func (self *TCPConnEx) Close() (err error) {
+	self.closeOnce.Do(func() { close(self.quit) })
+	// 与 Send 同步：发送例程还没有启动时不再启动，已经启动时等待它写出剩余的数据
+	self.sendOnce.Do(func() {})
+	if self.sending {
+		if self.writeTimeout <= 0 {
+			// 避免对端不再读取时 Close 一直阻塞
+			self.SetWriteDeadline(time.Now().Add(close_flush_timeout))
+		}
+		<-self.sendDone
+	}
+	err = self.Conn.Close()
+	if self.onClose != nil {
+		self.onCloseOnce.Do(self.onClose)
+	}
+	return err
+}
+
+// 交给 OnAcceptConnCallback/OnDialCallback 的连接
+// 回调自己处理的连接（ReadSize 为 0）不经过 TCPConnEx.Close，关闭时同样需要释放连接限制的计数并更新指标
+type ownedConn struct {
+	net.Conn
+	closed  int32 // 原子操作
+	onClose func()
+}
+
+func newOwnedConn(conn net.Conn, onClose func()) (obj *ownedConn) {
+	return &ownedConn{Conn: conn, onClose: onClose}
+}
+
+func (self *ownedConn) Close() (err error) {
+	err = self.Conn.Close()
+	self.release()
+	return err
+}
+
+// 执行关闭处理，多次调用只执行一次
+func (self *ownedConn) release() {
+	if atomic.CompareAndSwapInt32(&self.closed, 0, 1) {
+		self.onClose()
+	}
+}
+
+func (self *ownedConn) isClosed() bool {
+	return atomic.LoadInt32(&self.closed) != 0
+}
@@ -0,0 +1,117 @@
+package tnet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestConnEx(size int, policy SendQueuePolicy, writeTimeout time.Duration) (connx *TCPConnEx, peer net.Conn) {
+	conn, peer := net.Pipe()
+	connx = newTCPConnEx(conn, nil, 0, nil)
+	connx.setSendQueue(size, policy, writeTimeout)
+	return connx, peer
+}
+
+// 同一个例程的数据按顺序整块写出，Close 前写出队列中剩余的数据
+func TestTCPConnExSend(t *testing.T) {
+	connx, peer := newTestConnEx(4, SendQueueBlock, 0)
+	defer peer.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := connx.Send([]byte(fmt.Sprintf("%d:%03d;", i, j))); err != nil {
+					t.Errorf("send: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(peer)
+		received <- data
+	}()
+	wg.Wait()
+	connx.Close()
+
+	next := make([]int, 4)
+	data := <-received
+	for len(data) > 0 {
+		var i, j int
+		if _, err := fmt.Sscanf(string(data[:6]), "%d:%03d;", &i, &j); err != nil || j != next[i] {
+			t.Fatalf("unexpected message %q, want %d:%03d", data[:6], i, next[i])
+		}
+		next[i]++
+		data = data[6:]
+	}
+	for i, n := range next {
+		if n != 100 {
+			t.Fatalf("sender %d: received %d messages", i, n)
+		}
+	}
+	if err := connx.Send([]byte("x")); err != ErrConnClosed {
+		t.Fatalf("send after close: %v", err)
+	}
+}
+
+// 写失败后发送例程退出，之后的 Send 返回 ErrConnClosed，而不是把数据放入无人写出的队列
+func TestTCPConnExSendAfterWriteError(t *testing.T) {
+	connx, peer := newTestConnEx(4, SendQueueBlock, 0)
+	peer.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for connx.Send([]byte("x")) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("send never failed")
+		}
+	}
+	<-connx.sendDone
+	for i := 0; i < 10; i++ {
+		if err := connx.Send([]byte("x")); err != ErrConnClosed {
+			t.Fatalf("send after sender exited: %v", err)
+		}
+	}
+	connx.Close()
+}
+
+func TestTCPConnExSendQueueFull(t *testing.T) {
+	for _, policy := range []SendQueuePolicy{SendQueueDrop, SendQueueClose} {
+		// 对端不读取，第一块数据阻塞在写操作中，第二块留在队列中
+		connx, peer := newTestConnEx(1, policy, 500*time.Millisecond)
+		var err error
+		deadline := time.Now().Add(5 * time.Second)
+		for err == nil && time.Now().Before(deadline) {
+			err = connx.Send([]byte("x"))
+		}
+		if err != ErrSendQueueFull {
+			t.Fatalf("policy %d: send to a full queue: %v", policy, err)
+		}
+		err = connx.Send([]byte("x"))
+		if policy == SendQueueClose && err != ErrConnClosed {
+			t.Fatalf("send after the full queue closed the conn: %v", err)
+		}
+		connx.Close()
+		peer.Close()
+	}
+}
+
+// 对端不读取时写操作在 WriteTimeout 后返回超时错误
+func TestTCPConnExWriteTimeout(t *testing.T) {
+	connx, peer := newTestConnEx(1, SendQueueBlock, 100*time.Millisecond)
+	defer peer.Close()
+	start := time.Now()
+	_, err := connx.Write([]byte("x"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("write to a stalled peer: %v", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > 5*time.Second {
+		t.Fatalf("write returned after %v", d)
+	}
+	connx.Close()
+}
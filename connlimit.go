@@ -0,0 +1,127 @@
+package tnet
+
+import (
+	"git.tutils.com/tutils/tnet/tlog"
+	"net"
+	"time"
+)
+
+// 连接被拒绝的原因，参见 OnRejectConnCallback
+type RejectReason int
+
+const (
+	RejectMaxConns      RejectReason = iota // 超过 MaxConns
+	RejectMaxConnsPerIP                     // 超过 MaxConnsPerIP
+	RejectAcceptRate                        // 超过 AcceptRate
+)
+
+func (self RejectReason) String() string {
+	switch self {
+	case RejectMaxConns:
+		return "max conns"
+	case RejectMaxConnsPerIP:
+		return "max conns per ip"
+	case RejectAcceptRate:
+		return "accept rate"
+	}
+	return "unknown"
+}
+
+// 非 TCP 连接（例如 unix socket）返回空字符串，不受 MaxConnsPerIP 限制
+func remoteIp(conn net.Conn) (ip string) {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// 拒绝连接，返回 true 表示需要排队等待
+func (self *TcpServer) rejectConn(conn net.Conn, reason RejectReason) (wait bool) {
+	if self.OnRejectConnCallback != nil {
+		wait = self.OnRejectConnCallback(self, conn, reason)
+	}
+	if !wait {
+		self.Logger.Info("reject TCP conn", tlog.RemoteAddr(conn.RemoteAddr()), tlog.F("reason", reason))
+		self.Metrics.AddCounter(MetricConnsRejected, 1, metric_label_reason, reason.String())
+		conn.Close()
+	}
+	return wait
+}
+
+// 检查是否超过并发连接数限制，需要持有 limitMtx
+func (self *TcpServer) checkConnLimit(ip string) (reason RejectReason, over bool) {
+	if self.MaxConns > 0 && self.connCount >= self.MaxConns {
+		return RejectMaxConns, true
+	}
+	if self.MaxConnsPerIP > 0 && ip != "" && self.ipConnCount[ip] >= self.MaxConnsPerIP {
+		return RejectMaxConnsPerIP, true
+	}
+	return 0, false
+}
+
+// 检查连接限制并计数，返回 false 表示连接已被拒绝并关闭
+func (self *TcpServer) admitConn(conn net.Conn) (ok bool) {
+	if self.acceptBucket != nil && !self.acceptBucket.allow(1) {
+		if !self.rejectConn(conn, RejectAcceptRate) {
+			return false
+		}
+		if wait := self.acceptBucket.reserve(1); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-self.quit:
+				conn.Close()
+				return false
+			}
+		}
+	}
+
+	ip := remoteIp(conn)
+	self.limitMtx.Lock()
+	defer self.limitMtx.Unlock()
+	waiting := RejectReason(-1)
+	for {
+		if self.isClosing() {
+			conn.Close()
+			return false
+		}
+
+		reason, over := self.checkConnLimit(ip)
+		if !over {
+			break
+		}
+
+		if reason != waiting {
+			// 回调中可能会关闭其他连接，不能持有锁
+			self.limitMtx.Unlock()
+			wait := self.rejectConn(conn, reason)
+			self.limitMtx.Lock()
+			if !wait {
+				return false
+			}
+			waiting = reason
+			continue
+		}
+		self.limitCond.Wait()
+	}
+
+	self.connCount++
+	if ip != "" {
+		self.ipConnCount[ip]++
+	}
+	return true
+}
+
+// 连接关闭后释放计数，唤醒排队等待的接入例程
+func (self *TcpServer) releaseConn(ip string) {
+	self.limitMtx.Lock()
+	self.connCount--
+	if ip != "" {
+		if n := self.ipConnCount[ip] - 1; n > 0 {
+			self.ipConnCount[ip] = n
+		} else {
+			delete(self.ipConnCount, ip)
+		}
+	}
+	self.limitCond.Broadcast()
+	self.limitMtx.Unlock()
+}
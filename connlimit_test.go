@@ -0,0 +1,173 @@
+package tnet
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 启动一个带连接限制的服务器，被拒绝的连接原因写入 rejected
+func startLimitServer(t *testing.T, svr *TcpServer) (rejected chan RejectReason) {
+	rejected = make(chan RejectReason, 16)
+	svr.OnRejectConnCallback = func(self *TcpServer, conn net.Conn, reason RejectReason) (wait bool) {
+		rejected <- reason
+		return false
+	}
+	if svr.Listener == nil {
+		svr.Addr = "127.0.0.1:0"
+		addrCh := make(chan string, 1)
+		svr.OnListenSuccCallback = func(self *TcpServer, lstn net.Listener) (ok bool) {
+			addrCh <- lstn.Addr().String()
+			return true
+		}
+		go svr.Start()
+		svr.Addr = <-addrCh
+	} else {
+		go svr.Start()
+	}
+	return rejected
+}
+
+func expectRejected(t *testing.T, rejected chan RejectReason, want RejectReason) {
+	select {
+	case reason := <-rejected:
+		if reason != want {
+			t.Fatalf("rejected for %v, want %v", reason, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("conn should be rejected for %v", want)
+	}
+}
+
+func expectAccepted(t *testing.T, accepted chan net.Conn) (conn net.Conn) {
+	select {
+	case conn = <-accepted:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn should be accepted")
+	}
+	return nil
+}
+
+// 回调自己处理的连接（ReadSize 为 0）关闭后释放 MaxConns 的计数
+func TestTcpServerMaxConns(t *testing.T) {
+	lstn := NewPipeListener("limit")
+	exporter := NewPrometheusExporter()
+	svr := NewTcpServer()
+	svr.Listener = lstn
+	svr.MaxConns = 2
+	svr.Metrics = exporter
+	accepted := make(chan net.Conn, 16)
+	svr.OnAcceptConnCallback = func(self *TcpServer, conn net.Conn, connId uint32) (ok bool, readSize int, connExt interface{}) {
+		accepted <- conn
+		return true, 0, nil
+	}
+	rejected := startLimitServer(t, svr)
+	defer svr.Close()
+
+	var owned []net.Conn
+	for i := 0; i < 2; i++ {
+		if _, err := lstn.Dial(); err != nil {
+			t.Fatal(err)
+		}
+		owned = append(owned, expectAccepted(t, accepted))
+	}
+	lstn.Dial()
+	expectRejected(t, rejected, RejectMaxConns)
+
+	owned[0].Close()
+	owned[0].Close()
+	lstn.Dial()
+	owned[0] = expectAccepted(t, accepted)
+	lstn.Dial()
+	expectRejected(t, rejected, RejectMaxConns)
+
+	for _, conn := range owned {
+		conn.Close()
+	}
+	var buf bytes.Buffer
+	exporter.Export(&buf)
+	for _, line := range []string{MetricConnsActive + " 0\n", MetricConnsClosed + " 3\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("missing %q in:\n%s", line, buf.String())
+		}
+	}
+	n := 0
+	svr.ConnMap.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	if n != 0 {
+		t.Fatalf("%d conns left in ConnMap", n)
+	}
+}
+
+// 同一个 IP 的连接数超过 MaxConnsPerIP 时拒绝，由 connReadHandler 关闭的连接释放计数
+func TestTcpServerMaxConnsPerIP(t *testing.T) {
+	svr := NewTcpServer()
+	svr.MaxConnsPerIP = 1
+	accepted := make(chan net.Conn, 16)
+	svr.OnAcceptConnCallback = func(self *TcpServer, conn net.Conn, connId uint32) (ok bool, readSize int, connExt interface{}) {
+		accepted <- conn
+		return true, read_buf_size, nil
+	}
+	rejected := startLimitServer(t, svr)
+	defer svr.Close()
+
+	first, err := net.Dial("tcp", svr.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAccepted(t, accepted)
+	second, err := net.Dial("tcp", svr.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	expectRejected(t, rejected, RejectMaxConnsPerIP)
+
+	// 客户端关闭后服务端的读例程关闭连接并释放计数
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", svr.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		select {
+		case <-accepted:
+			return
+		case <-rejected:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot was not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTcpServerAcceptRate(t *testing.T) {
+	lstn := NewPipeListener("rate")
+	svr := NewTcpServer()
+	svr.Listener = lstn
+	svr.AcceptRate = 1
+	accepted := make(chan net.Conn, 16)
+	svr.OnAcceptConnCallback = func(self *TcpServer, conn net.Conn, connId uint32) (ok bool, readSize int, connExt interface{}) {
+		accepted <- conn
+		return true, read_buf_size, nil
+	}
+	rejected := startLimitServer(t, svr)
+	defer svr.Close()
+
+	lstn.Dial()
+	expectAccepted(t, accepted)
+	lstn.Dial()
+	expectRejected(t, rejected, RejectAcceptRate)
+	// 令牌恢复后可以再次接入
+	time.Sleep(1100 * time.Millisecond)
+	lstn.Dial()
+	expectAccepted(t, accepted)
+}
@@ -3,24 +3,138 @@ package tnet
 import (
 	"bytes"
 	"compress/zlib"
-	"io/ioutil"
+	"io"
 	"math/rand"
+	"sync"
 )
 
+const (
+	xor_key_stream_step int = 0x1000  // 密钥流每次至少扩展 4KB
+	max_xor_key_stream  int = 0x20000 // 缓存的密钥流上限，帧的长度由对端决定，更长的密钥流临时生成，不缓存
+)
+
+var (
+	xorKeyStreams sync.Map // map[int64]*xorKeyStream
+
+	zlibWriterPool = sync.Pool{
+		New: func() interface{} {
+			return zlib.NewWriter(nil)
+		},
+	}
+	zlibReaderPool sync.Pool // *zlibReader
+)
+
+// 连同输入一起复用的 zlib 解压器
+type zlibReader struct {
+	src bytes.Reader
+	r   io.ReadCloser
+}
+
 type CryptCodec interface {
 	Encrypt(data []byte) (ret []byte)
 	Decrypt(data []byte) (ret []byte, err error)
 }
 
-func xorEncrypt(data []byte, seed int64) (ret []byte) {
-	ret = make([]byte, len(data))
+// seed 对应的异或密钥流，每个 seed 只生成一次并按需扩展，避免每次加解密都重新创建随机数发生器
+// seed 一般是固定的几个值，缓存不会回收，每个 seed 最多缓存 max_xor_key_stream 字节
+type xorKeyStream struct {
+	mtx    sync.RWMutex
+	rnd    *rand.Rand
+	stream []byte
+}
+
+// 返回 seed 对应的密钥流的前 n 个字节，返回值只读
+func loadXorKeyStream(seed int64, n int) (stream []byte) {
+	v, ok := xorKeyStreams.Load(seed)
+	if !ok {
+		v, _ = xorKeyStreams.LoadOrStore(seed, &xorKeyStream{rnd: rand.New(rand.NewSource(seed))})
+	}
+	ks := v.(*xorKeyStream)
+	if n > max_xor_key_stream {
+		return newXorKeyStream(seed, n)
+	}
+
+	ks.mtx.RLock()
+	if len(ks.stream) >= n {
+		stream = ks.stream[:n]
+		ks.mtx.RUnlock()
+		return stream
+	}
+	ks.mtx.RUnlock()
+
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	if len(ks.stream) < n {
+		// 已经返回出去的切片可能还在使用，扩展时总是分配新的底层数组
+		size := (n + xor_key_stream_step - 1) / xor_key_stream_step * xor_key_stream_step
+		stream = make([]byte, size)
+		copy(stream, ks.stream)
+		for i := len(ks.stream); i < size; i++ {
+			stream[i] = byte(ks.rnd.Intn(256))
+		}
+		ks.stream = stream
+	}
+	return ks.stream[:n]
+}
+
+// 不经过缓存生成 seed 对应的密钥流的前 n 个字节
+func newXorKeyStream(seed int64, n int) (stream []byte) {
 	rnd := rand.New(rand.NewSource(seed))
-	for i, v := range data {
-		ret[i] = v ^ byte(rnd.Intn(256))
+	stream = make([]byte, n)
+	for i := range stream {
+		stream[i] = byte(rnd.Intn(256))
+	}
+	return stream
+}
+
+// dst = src ^ keystream(seed)，dst 和 src 可以是同一个切片
+func xorBytes(dst []byte, src []byte, seed int64) {
+	stream := loadXorKeyStream(seed, len(src))
+	for i, v := range src {
+		dst[i] = v ^ stream[i]
 	}
+}
+
+func xorEncrypt(data []byte, seed int64) (ret []byte) {
+	ret = make([]byte, len(data))
+	xorBytes(ret, data, seed)
 	return ret
 }
 
+// 将 data 压缩后追加到 dst
+func zlibCompressTo(dst *bytes.Buffer, data []byte) {
+	w := zlibWriterPool.Get().(*zlib.Writer)
+	w.Reset(dst)
+	w.Write(data)
+	w.Close()
+	zlibWriterPool.Put(w)
+}
+
+// 将 data 解压后追加到 dst，解压后超过 limit 字节时返回 errFrameTooLarge，避免很小的数据解压出无限多的数据
+func zlibDecompressTo(dst *bytes.Buffer, data []byte, limit int) (err error) {
+	var zr *zlibReader
+	if v := zlibReaderPool.Get(); v != nil {
+		zr = v.(*zlibReader)
+		zr.src.Reset(data)
+		err = zr.r.(zlib.Resetter).Reset(&zr.src, nil)
+	} else {
+		zr = new(zlibReader)
+		zr.src.Reset(data)
+		zr.r, err = zlib.NewReader(&zr.src)
+	}
+	if err != nil {
+		return err
+	}
+	n, err := dst.ReadFrom(io.LimitReader(zr.r, int64(limit)+1))
+	if err == nil && n > int64(limit) {
+		err = errFrameTooLarge
+	}
+	zr.r.Close()
+	zr.src.Reset(nil)
+	zlibReaderPool.Put(zr)
+	return err
+}
+
 type XorCodec struct {
 	seed int64
 }
@@ -38,25 +152,34 @@ func (self *XorCodec) Decrypt(data []byte) (ret []byte, err error) {
 	return xorEncrypt(data, self.seed), nil
 }
 
+// 将 data 压缩并异或后追加到 dst
+func zlibXorEncryptTo(dst *bytes.Buffer, data []byte, seed int64) {
+	start := dst.Len()
+	zlibCompressTo(dst, data)
+	out := dst.Bytes()[start:]
+	xorBytes(out, out, seed)
+}
+
+// 将 data 异或并解压后追加到 dst，data 不会被修改
+func zlibXorDecryptTo(dst *bytes.Buffer, data []byte, seed int64) (err error) {
+	tmp := getBuf(len(data))
+	defer putBuf(tmp)
+	xorBytes(*tmp, data, seed)
+	return zlibDecompressTo(dst, *tmp, max_frame_size)
+}
+
 func zlibXorEncrypt(data []byte, seed int64) (ret []byte) {
 	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
-	w.Write(data)
-	w.Close()
-	ret = xorEncrypt(b.Bytes(), seed)
-	return ret
+	zlibXorEncryptTo(&b, data, seed)
+	return b.Bytes()
 }
 
 func zlibXorDecrypt(data []byte, seed int64) (ret []byte, err error) {
-	data = xorEncrypt(data, seed)
-	b := bytes.NewBuffer(data)
-	r, err := zlib.NewReader(b)
-	if err != nil {
+	var b bytes.Buffer
+	if err = zlibXorDecryptTo(&b, data, seed); err != nil {
 		return nil, err
 	}
-	ret, err = ioutil.ReadAll(r)
-	r.Close()
-	return ret, nil
+	return b.Bytes(), nil
 }
 
 type ZlibCodec struct {
@@ -69,21 +192,16 @@ func NewZlibCodec(seed int64) (obj CryptCodec) {
 
 func (self *ZlibCodec) Encrypt(data []byte) (ret []byte) {
 	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
-	w.Write(data)
-	w.Close()
+	zlibCompressTo(&b, data)
 	return b.Bytes()
 }
 
 func (self *ZlibCodec) Decrypt(data []byte) (ret []byte, err error) {
-	b := bytes.NewBuffer(data)
-	r, err := zlib.NewReader(b)
-	if err != nil {
+	var b bytes.Buffer
+	if err = zlibDecompressTo(&b, data, max_frame_size); err != nil {
 		return nil, err
 	}
-	ret, err = ioutil.ReadAll(r)
-	r.Close()
-	return ret, nil
+	return b.Bytes(), nil
 }
 
 type ZlibXorCodec struct {
@@ -0,0 +1,104 @@
+package tnet
+
+import (
+	"net"
+	"sync"
+)
+
+// 双栈监听，IPv4 和 IPv6 各使用一个 socket（tcp6/udp6 会设置 IPV6_V6ONLY），
+// 不依赖系统是否支持 IPv4-mapped 地址，也不受 net.ipv6.bindv6only 等系统设置影响
+
+// 把通配地址拆成 IPv4 和 IPv6 的通配地址，addr 不是通配地址时 ok 为 false
+func dualStackAddrs(addr string) (addr4 string, addr6 string, ok bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", false
+	}
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsUnspecified() {
+			return "", "", false
+		}
+	}
+	return net.JoinHostPort("0.0.0.0", port), net.JoinHostPort("::", port), true
+}
+
+// 端口为 0 时，让 IPv6 使用 IPv4 分配到的端口，两个地址族保持同一个端口
+func samePortAddr(addr6 string, bound net.Addr) string {
+	host, port, err := net.SplitHostPort(addr6)
+	if err != nil || port != "0" {
+		return addr6
+	}
+	_, port, err = net.SplitHostPort(bound.String())
+	if err != nil {
+		return addr6
+	}
+	return net.JoinHostPort(host, port)
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// 合并多个 Listener 的 net.Listener，Addr 返回第一个 Listener 的地址
+// 任何一个 Listener 出错后 Accept 都会返回该错误
+type multiListener struct {
+	lstns     []net.Listener
+	results   chan acceptResult
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(lstns ...net.Listener) (obj *multiListener) {
+	obj = new(multiListener)
+	obj.lstns = lstns
+	obj.results = make(chan acceptResult)
+	obj.quit = make(chan struct{})
+	for _, lstn := range lstns {
+		go obj.acceptLoop(lstn)
+	}
+	return obj
+}
+
+func (self *multiListener) acceptLoop(lstn net.Listener) {
+	for {
+		conn, err := lstn.Accept()
+		select {
+		case self.results <- acceptResult{conn, err}:
+		case <-self.quit:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (self *multiListener) Accept() (conn net.Conn, err error) {
+	select {
+	case result := <-self.results:
+		return result.conn, result.err
+	case <-self.quit:
+		return nil, ErrConnClosed
+	}
+}
+
+func (self *multiListener) Close() (err error) {
+	self.closeOnce.Do(func() {
+		close(self.quit)
+		for _, lstn := range self.lstns {
+			if err0 := lstn.Close(); err0 != nil && err == nil {
+				err = err0
+			}
+		}
+	})
+	return err
+}
+
+func (self *multiListener) Addr() net.Addr {
+	return self.lstns[0].Addr()
+}
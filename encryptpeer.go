@@ -2,13 +2,18 @@ package tnet
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
-	"git.tutils.com/tutils/tnet/tcounter"
-	"io"
-	"log"
+	"fmt"
+	"git.tutils.com/tutils/tnet/tlog"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /* encrypt connection
@@ -20,419 +25,756 @@ conn /                       \ conn
 */
 
 const (
-	cmd_connect uint16 = 0
-	cmd_data    uint16 = 1
-	cmd_close   uint16 = 2
+	cmd_connect        uint16 = 0
+	cmd_data           uint16 = 1
+	cmd_close          uint16 = 2
+	cmd_window_update  uint16 = 3
+	cmd_connect_result uint16 = 4
+	cmd_listen         uint16 = 5
+	cmd_listen_result  uint16 = 6
+	cmd_ping           uint16 = 7
+	cmd_pong           uint16 = 8
+	cmd_session        uint16 = 9
+	cmd_resume         uint16 = 10
+
+	// cmd_connect_result 和 cmd_listen_result 的结果
+	connect_ok      byte = 0
+	connect_refused byte = 1 // 被 TargetFilter 或 ListenFilter 拒绝
+	connect_failed  byte = 2 // 解析、连接目标或者监听失败
 
 	server_mode_proxy = 0
 	server_mode_agent = 1
 
-	max_tcp_read               = 0xffff
-	max_peer_conn_op_chan_size = 10
-	max_close_notify_chan_size = 1024
+	max_tcp_read          = 0xffff
+	tun_accept_backlog    = 128
+	tun_connect_timeout   = 30e9 // DialStream 等待对端连接目标的时间
+	tun_dial_timeout      = 10e9
+	peer_cmd_size         = 2
+	peer_conn_id_size     = 4
+	peer_data_offset_size = 8
+	peer_data_len_size    = 4
+)
 
-	tcounter_id_up   = 200
-	tcounter_id_down = 201
+var (
+	ErrTunConnectRefused = errors.New("tnet: target refused by peer")
+	ErrTunConnectFailed  = errors.New("tnet: peer failed to connect target")
 )
 
-type connChanItem struct {
-	cmd    uint16
-	reader io.Reader
+// Accept 返回的连接都实现了这个接口
+type TunStream interface {
+	net.Conn
+	// 对端 DialStream 时指定的目标地址，OpenStream 打开的连接为空
+	Target() string
+	// 设置这条连接在隧道级带宽限制中的优先级，默认由 EncryptTunPeer.Classify 决定
+	SetPriority(priority StreamPriority)
+	// 设置这条连接发送和接收的带宽限制，默认为 EncryptTunPeer.StreamSendLimit 和 StreamRecvLimit
+	SetRateLimit(send RateLimit, recv RateLimit)
 }
 
 type EncryptTunPeer struct {
+	// 不为 nil 时 peer 连接在 Start 时先完成 TLS 握手，proxy 为客户端，agent 为服务端
+	// 双向认证时 proxy 的配置需要带上客户端证书，agent 的配置需要设置 ClientAuth 和 ClientCAs，参见 NewTLSServerConfig 和 NewTLSClientConfig
+	TLSConfig *tls.Config
+
+	// 握手认证，设置了 PSK 或 IdentityKey 后，Start 时（TLS 握手之后）先完成 X25519 密钥交换和双向认证，
+	// 之后的帧使用派生出的密钥以 AES-256-GCM 加密，两端的配置必须一致，参见 handshake.go
+	// 都不设置时使用固定种子异或，与旧版本兼容，但没有保密性
+	PSK []byte
+	// 本端的 Ed25519 身份私钥，对端需要在 PeerKeys 中配置对应的公钥，参见 GenerateIdentityKey
+	IdentityKey ed25519.PrivateKey
+	// 允许的对端 Ed25519 身份公钥
+	PeerKeys []ed25519.PublicKey
+	// 帧的压缩方式，在握手时协商，proxy 按这个顺序提供，agent 选择其中第一个自己也允许的，参见 compress.go
+	// 为 nil 时 proxy 按 snappy、zstd、zlib、none 的顺序提供，agent 全部允许；不握手时总是使用 zlib
+	// snappy 实际使用 S2，代替 LZ4；本端初始化失败的压缩方式（例如 zstd）不会提供或者接受
+	Compressions []Compression
+
+	// 允许对端通过 DialStream 连接的目标，为 nil 时拒绝所有指定了目标的连接
+	// 端口转发的两端和调用了 ServeProxy 的隧道都会按它检查对端的正向映射和 DialStream，agent 不指定目标的连接总是转发到固定的 raddr
+	TargetFilter *AddrFilter
+
+	// 端口映射，Start 完成握手后启动，参见 PortMapping
+	Mappings []PortMapping
+	// 允许对端通过反向映射让本端监听的地址，为 nil 时拒绝所有反向映射
+	ListenFilter *AddrFilter
+
+	// 心跳间隔，为 0 时不发送心跳，参见 heartbeat.go
+	HeartbeatInterval time.Duration
+	// 连续多少个心跳间隔没有收到对端的协议包时认为对端已经断开，默认 3
+	HeartbeatMisses int
+
+	// 新建 stream 时选择 peer 连接的策略，参见 link.go
+	LinkPolicy LinkPolicy
+	// 服务端的会话表，设置后客户端才能通过 AddLink 增加连接
+	// 加入会话的连接需要通过 PSK 或 IdentityKey 认证，并且与第一条连接是同一个身份，没有握手的旧版本连接不能加入
+	Sessions *TunSessionTable
+
+	// 所有 peer 连接断开后保留会话等待恢复的时间，为 0 时立即关闭隧道，参见 resume.go
+	// 服务端需要同时设置 Sessions，客户端才能加入原来的会话
+	ResumeTimeout time.Duration
+	// 客户端在会话挂起期间用来重新建立 peer 连接，为 nil 时只能由调用者通过 AddLink 恢复
+	Redial func() (net.Conn, error)
+	// Redial 失败后的退避策略，为 nil 时使用 NewReconnectPolicy
+	Reconnect *ReconnectPolicy
+
+	// 带宽限制，Rate 为 0 时不限制，参见 shaper.go
+	SendLimit       RateLimit // 整个隧道发往对端的带宽
+	RecvLimit       RateLimit // 整个隧道从对端接收的带宽
+	StreamSendLimit RateLimit // 每条连接发往对端的带宽
+	StreamRecvLimit RateLimit // 每条连接从对端接收的带宽
+	// 新建连接时决定它在 SendLimit 和 RecvLimit 中的优先级，为 nil 时都是 PriorityNormal，在 peer 读例程中调用，不能阻塞
+	Classify func(stream TunStream) StreamPriority
+
+	// 日志，默认不输出
+	Logger tlog.Logger
+
+	// 指标钩子，默认不上报，参见 MetricTunBytesIn 等指标名，例如 tnet.NewPrometheusExporter().With("tunnel", "office") 或者 tcounter.NewCounterMetrics
+	Metrics Metrics
+
 	// 所有线程都有用到，初始化后不会改动 或 线程安全
-	peer                *net.TCPConn
-	addr                *net.TCPAddr
-	mode                byte
-	connChanMap         *sync.Map // map[uint32] chan connChanItem
-	connCloseNotifyChan chan uint32
-	wg                  sync.WaitGroup
-	lstn                *net.TCPListener
-	tcou                *tcounter.CounterClient
+	rawPeer   net.Conn // Start 时握手的第一条 peer 连接
+	mtx       sync.Mutex
+	links     []*tunLink // 由 mtx 保护
+	linkSeq   uint32     // 由 mtx 保护
+	linkRR    uint32     // 由 mtx 保护
+	sessionId []byte
+	peerKey   ed25519.PublicKey // 服务端会话第一条连接认证的对端公钥，加入会话的连接需要相同
+	addr      *net.TCPAddr
+	forward   bool // 是否做端口转发，proxy 监听 addr，agent 把连接转发到 addr
+	mode      byte
+	streams   *sync.Map // map[uint32]*tunStream
+	nextId    uint32    // proxy 一端打开的连接 id 为奇数，agent 一端为偶数，双方可以同时打开连接
+	acceptq   chan *tunStream
+	fwdOnce   sync.Once     // 保证只有一个 startForwardLoop
+	ready     chan struct{} // Start 完成握手后关闭
+	quit      chan struct{} // 在 mtx 保护下关闭，参见 addTask
+	closeOnce sync.Once
+	cleanOnce sync.Once
+	done      chan struct{} // clean 完成后关闭
+	wg        sync.WaitGroup
+	lstn      *net.TCPListener
+
+	reverseTargets map[string]bool // 反向映射的 Target，Start 之后只读
+	lastSeen       int64           // UnixNano，原子操作
+	resumeTimer    *time.Timer     // 会话挂起时不为 nil，由 mtx 保护
+	suspendSeq     uint32          // 由 mtx 保护
+	sendShaper     *tunShaper      // Start 之后只读
+	recvShaper     *tunShaper      // Start 之后只读
 }
 
-func NewEncryptConnProxy(peer *net.TCPConn, laddr string) (obj *EncryptTunPeer) {
+func newEncryptTunPeer(peer net.Conn, mode byte) (obj *EncryptTunPeer) {
 	obj = new(EncryptTunPeer)
-	obj.peer = peer
-	log.Printf("resolve addr(%s)", laddr)
+	obj.rawPeer = peer
+	obj.Logger = tlog.NewNopLogger()
+	obj.Metrics = NewNopMetrics()
+	obj.mode = mode
+	if mode == server_mode_proxy {
+		obj.nextId = ^uint32(0)
+	}
+	obj.streams = new(sync.Map)
+	obj.acceptq = make(chan *tunStream, tun_accept_backlog)
+	obj.ready = make(chan struct{})
+	obj.quit = make(chan struct{})
+	obj.done = make(chan struct{})
+	return obj
+}
+
+// 端口转发的 proxy 端，监听 laddr，每个接入的连接对应隧道中的一条连接
+func NewEncryptConnProxy(peer net.Conn, laddr string) (obj *EncryptTunPeer) {
+	obj = newEncryptTunPeer(peer, server_mode_proxy)
 	obj.addr, _ = net.ResolveTCPAddr("tcp", laddr)
-	obj.mode = server_mode_proxy
-	obj.connChanMap = new(sync.Map)
-	obj.connCloseNotifyChan = make(chan uint32, max_close_notify_chan_size)
+	obj.forward = true
 	return obj
 }
 
-func NewEncryptConnAgent(peer *net.TCPConn, raddr string) (obj *EncryptTunPeer) {
-	obj = new(EncryptTunPeer)
-	obj.peer = peer
-	log.Printf("resolve addr(%s)", raddr)
+// 端口转发的 agent 端，对端打开的每条连接都转发到 raddr
+func NewEncryptConnAgent(peer net.Conn, raddr string) (obj *EncryptTunPeer) {
+	obj = newEncryptTunPeer(peer, server_mode_agent)
 	obj.addr, _ = net.ResolveTCPAddr("tcp", raddr)
-	obj.mode = server_mode_agent
-	obj.connChanMap = new(sync.Map)
-	obj.connCloseNotifyChan = make(chan uint32, max_close_notify_chan_size)
-	obj.tcou = tcounter.NewCounterClientUseUnix("/tmp/tcountera.sock")
+	obj.forward = true
 	return obj
 }
 
-// connect = cmd:uint16 + connId:uint32
-func packConnect(connId uint32) (ret []byte) {
-	payload := bytes.NewBuffer(make([]byte, 0, bytes.MinRead))
-	binary.Write(payload, binary.BigEndian, cmd_connect)
-	binary.Write(payload, binary.BigEndian, connId)
-	ret, _ = EncodeToSldeDataFromBytes(payload.Bytes())
-	//log.Println("pack", ret)
-	return ret
+// 不做端口转发的隧道客户端，TLS 握手时作为客户端
+// 通过 OpenStream 打开连接，通过 Accept 接受对端打开的连接，可以直接作为 net.Listener 使用
+func NewEncryptTunClient(peer net.Conn) (obj *EncryptTunPeer) {
+	return newEncryptTunPeer(peer, server_mode_proxy)
 }
 
-// write = cmd:uint16 + connId:uint32 + dataLen:uint32 + data:string(dataLen)
-func packData(connId uint32, data []byte) (ret []byte) {
-	payload := bytes.NewBuffer(make([]byte, 0, bytes.MinRead))
-	binary.Write(payload, binary.BigEndian, cmd_data)
-	binary.Write(payload, binary.BigEndian, connId)
-	dataLen := uint32(len(data))
-	binary.Write(payload, binary.BigEndian, dataLen)
-	binary.Write(payload, binary.BigEndian, data)
-	ret, _ = EncodeToSldeDataFromBytes(payload.Bytes())
-	//log.Println("pack", ret)
-	return ret
+// 不做端口转发的隧道服务端，TLS 握手时作为服务端，用法与 NewEncryptTunClient 相同
+func NewEncryptTunServer(peer net.Conn) (obj *EncryptTunPeer) {
+	return newEncryptTunPeer(peer, server_mode_agent)
 }
 
-// close cmd:uint16 + connId:uint32
-func packClose(connId uint32) (ret []byte) {
-	payload := bytes.NewBuffer(make([]byte, 0, bytes.MinRead))
-	binary.Write(payload, binary.BigEndian, cmd_close)
-	binary.Write(payload, binary.BigEndian, connId)
-	ret, _ = EncodeToSldeDataFromBytes(payload.Bytes())
-	//log.Println("pack", ret)
-	return ret
+// 将协议包追加到 dst，之后再压缩、加密成 Slde 帧
+// connect = cmd:uint16 + connId:uint32 + target:string，target 为 host:port，可以为空
+// connect_result = cmd:uint16 + connId:uint32 + result:uint8，只有 target 不为空时才会回复
+// write = cmd:uint16 + connId:uint32 + offset:uint64 + dataLen:uint32 + data:string(dataLen)，offset 为数据在连接中的偏移
+// close = cmd:uint16 + connId:uint32
+// window_update = cmd:uint16 + connId:uint32 + returned:uint64，returned 为累计归还的信用
+// listen = cmd:uint16 + mappingId:uint32 + listenLen:uint16 + listen:string(listenLen) + target:string，参见 portmap.go
+// listen_result = cmd:uint16 + mappingId:uint32 + result:uint8
+// ping = cmd:uint16 + seq:uint32 + sendTime:int64，pong 原样带回，参见 heartbeat.go
+// session = cmd:uint16 + 0:uint32 + op:uint8 + sessionId:string(16)，参见 link.go
+// resume = cmd:uint16 + connId:uint32 + recvOff:uint64 + returned:uint64，参见 link.go
+// cmd_data 由 packDataPacket 编码，其他命令的 data 原样追加在 connId 之后
+func packPacket(dst *bytes.Buffer, cmd uint16, connId uint32, data []byte) {
+	var header [peer_cmd_size + peer_conn_id_size]byte
+	binary.BigEndian.PutUint16(header[:], cmd)
+	binary.BigEndian.PutUint32(header[peer_cmd_size:], connId)
+	dst.Write(header[:])
+	dst.Write(data)
 }
 
-// 解码出 cmd 并且返回一个用于继续解码的 io.Reader
-func unpackCmd(data []byte) (cmd uint16, reader io.Reader) {
-	reader = bytes.NewBuffer(data)
-	binary.Read(reader, binary.BigEndian, &cmd)
-	return cmd, reader
+func packDataPacket(dst *bytes.Buffer, connId uint32, offset uint64, data []byte) {
+	var header [peer_cmd_size + peer_conn_id_size + peer_data_offset_size + peer_data_len_size]byte
+	binary.BigEndian.PutUint16(header[:], cmd_data)
+	binary.BigEndian.PutUint32(header[peer_cmd_size:], connId)
+	binary.BigEndian.PutUint64(header[peer_cmd_size+peer_conn_id_size:], offset)
+	binary.BigEndian.PutUint32(header[peer_cmd_size+peer_conn_id_size+peer_data_offset_size:], uint32(len(data)))
+	dst.Write(header[:])
+	dst.Write(data)
 }
 
-// 解码 connId
-func unpackConnId(reader io.Reader) (connId uint32) {
-	binary.Read(reader, binary.BigEndian, &connId)
-	return connId
+// 解码出 cmd 和 connId，返回剩余的数据
+func unpackPacket(data []byte) (cmd uint16, connId uint32, left []byte, err error) {
+	if len(data) < peer_cmd_size+peer_conn_id_size {
+		return 0, 0, nil, errors.New(fmt.Sprintf("packet too short(%d)", len(data)))
+	}
+	cmd = binary.BigEndian.Uint16(data)
+	connId = binary.BigEndian.Uint32(data[peer_cmd_size:])
+	return cmd, connId, data[peer_cmd_size+peer_conn_id_size:], nil
 }
 
-func unpackConnect(reader io.Reader) {
+// 解码 cmd_data 的偏移和数据，数据复制到缓冲区池的切片中
+func unpackData(data []byte) (offset uint64, ret *[]byte, err error) {
+	if len(data) < peer_data_offset_size+peer_data_len_size {
+		return 0, nil, errors.New(fmt.Sprintf("data packet too short(%d)", len(data)))
+	}
+	offset = binary.BigEndian.Uint64(data)
+	dataLen := int(binary.BigEndian.Uint32(data[peer_data_offset_size:]))
+	data = data[peer_data_offset_size+peer_data_len_size:]
+	if dataLen > len(data) {
+		return 0, nil, errors.New(fmt.Sprintf("data length field(%d) exceeds packet(%d)", dataLen, len(data)))
+	}
+	ret = getBuf(dataLen)
+	copy(*ret, data)
+	return offset, ret, nil
 }
 
-func unpackData(reader io.Reader) (data []byte) {
-	var dataLen uint32
-	binary.Read(reader, binary.BigEndian, &dataLen)
-	data = make([]byte, dataLen)
-	binary.Read(reader, binary.BigEndian, data)
-	return data
+// 写入不属于某个 stream 的协议包，按 LinkPolicy 选择 peer 连接
+func (self *EncryptTunPeer) writePacket(cmd uint16, connId uint32, data []byte) (err error) {
+	link := self.pickLink()
+	if link == nil {
+		return ErrConnClosed
+	}
+	return link.writePacket(cmd, connId, data)
 }
 
-func unpackClose(reader io.Reader) {
+func (self *EncryptTunPeer) removeStream(stream *tunStream) {
+	if v, ok := self.streams.Load(stream.id); ok && v.(*tunStream) == stream {
+		self.streams.Delete(stream.id)
+		stream.unbind()
+		self.streamClosed(stream)
+	}
 }
 
-func (self *EncryptTunPeer) notifyToCloseChan(c chan connChanItem, connId uint32) {
-_for:
-	for {
-		select {
-		case _, ok := <-c:
-			if !ok {
-				break _for
-			}
-			// drop
-			log.Printf("drop conn(%d) chan datas", connId)
-		default:
-			log.Printf("@@ send notify chan, conn(%d)", connId)
-			self.connCloseNotifyChan <- connId
-			log.Printf("## sent notify chan, conn(%d), finished", connId)
-			break _for
-		}
+func (self *EncryptTunPeer) storeStream(stream *tunStream) {
+	self.streams.Store(stream.id, stream)
+	self.Metrics.AddCounter(MetricTunStreamsOpened, 1)
+	self.Metrics.AddGauge(MetricTunStreamsActive, 1)
+}
+
+func (self *EncryptTunPeer) streamClosed(stream *tunStream) {
+	self.Metrics.AddCounter(MetricTunStreamsClosed, 1)
+	self.Metrics.AddGauge(MetricTunStreamsActive, -1)
+	self.Metrics.Observe(MetricTunStreamDuration, time.Since(stream.start))
+}
+
+// 本端替对端连接目标失败
+func (self *EncryptTunPeer) dialFailed(result byte) {
+	reason := "failed"
+	if result == connect_refused {
+		reason = "refused"
 	}
+	self.Metrics.AddCounter(MetricTunDialFails, 1, metric_label_reason, reason)
 }
 
-func (self *EncryptTunPeer) clean() {
-	log.Println("clean")
-	todel := self.connChanMap
-	self.connChanMap = new(sync.Map)
-	todel.Range(func(k, v interface{}) bool {
-		connId := k.(uint32)
-		connChan := v.(chan connChanItem)
-		log.Printf("cleaning, close conn(%d) chan", connId)
-		close(connChan)
-		return true
+func (self *EncryptTunPeer) shutdown() {
+	self.mtx.Lock()
+	self.closeOnce.Do(func() {
+		close(self.quit)
 	})
+	self.mtx.Unlock()
+}
 
-_for:
-	for {
-		select {
-		case _, ok := <-self.connCloseNotifyChan:
-			if !ok {
-				break _for
-			}
-		default:
-			break _for
+// 增加 n 个 clean 时需要等待结束的例程，隧道已经关闭时返回 false
+// quit 在 mtx 保护下关闭，保证 wg.Add 都发生在 clean 的 wg.Wait 之前
+func (self *EncryptTunPeer) addTask(n int) (ok bool) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	select {
+	case <-self.quit:
+		return false
+	default:
+	}
+	self.wg.Add(n)
+	return true
+}
+
+func (self *EncryptTunPeer) goTask(f func()) (ok bool) {
+	if !self.addTask(1) {
+		return false
+	}
+	go func() {
+		defer self.wg.Done()
+		f()
+	}()
+	return true
+}
+
+func (self *EncryptTunPeer) clean() {
+	self.cleanOnce.Do(func() {
+		self.Logger.Info("clean all of conns")
+		self.shutdown()
+		// 先关闭 peer 连接，阻塞在写 peer 上的例程才能退出
+		self.mtx.Lock()
+		links := self.links
+		self.links = nil
+		self.stopSuspend()
+		self.mtx.Unlock()
+		for _, link := range links {
+			link.close()
+		}
+		if self.lstn != nil {
+			self.Logger.Info("stop listener", tlog.Addr(self.addr))
+			self.lstn.Close()
+		}
+		if self.Sessions != nil {
+			self.Sessions.remove(self.sessionId, self)
 		}
+		self.streams.Range(func(k, v interface{}) bool {
+			stream := v.(*tunStream)
+			self.Logger.Debug("cleaning, close conn", tlog.ConnId(stream.id))
+			stream.localClose()
+			self.streams.Delete(k)
+			self.streamClosed(stream)
+			return true
+		})
+
+		self.Logger.Debug("wait for stopping all of conn handler")
+		self.wg.Wait()
+		self.Logger.Debug("all of conn handler stopped")
+		close(self.done)
+	})
+}
+
+// 打开一条到对端的连接，对端通过 Accept 接受，Start 完成握手前会阻塞
+func (self *EncryptTunPeer) OpenStream() (conn net.Conn, err error) {
+	stream, err := self.openStream("")
+	if err != nil {
+		return nil, err
 	}
-	self.connCloseNotifyChan = make(chan uint32, max_close_notify_chan_size)
+	return stream, nil
+}
+
+// 打开一条到对端的连接，并由对端连接 target(host:port)，等待对端回复连接结果
+// 端口转发的两端和调用了 ServeProxy 的隧道按 TargetFilter 检查后连接 target，其他隧道在 Accept 接受连接时就回复成功
+func (self *EncryptTunPeer) DialStream(target string) (conn net.Conn, err error) {
+	start := time.Now()
+	stream, err := self.openStream(target)
+	if err != nil {
+		return nil, err
+	}
+	if err = stream.waitConnect(tun_connect_timeout); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	self.Metrics.Observe(MetricTunConnectDuration, time.Since(start))
+	return stream, nil
+}
+
+func (self *EncryptTunPeer) openStream(target string) (stream *tunStream, err error) {
+	select {
+	case <-self.ready:
+	case <-self.quit:
+		return nil, ErrConnClosed
+	}
+
+	link := self.pickLink()
+	if link == nil {
+		return nil, ErrConnClosed
+	}
+	connId := atomic.AddUint32(&self.nextId, 2)
+	stream = newTunStream(self, connId)
+	stream.target = target
+	self.classify(stream)
+	stream.bind(link)
+	self.storeStream(stream)
+	self.Logger.Debug("send conn op", tlog.ConnId(connId), tlog.Cmd("connect"), tlog.F("target", target))
+	if err = stream.writePacket(cmd_connect, []byte(target)); err != nil {
+		self.removeStream(stream)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// 接受对端通过 OpenStream 或者 DialStream 打开的连接，返回的连接实现了 TunStream
+func (self *EncryptTunPeer) Accept() (conn net.Conn, err error) {
+	stream, err := self.accept()
+	if err != nil {
+		return nil, err
+	}
+	if stream.target != "" {
+		stream.writePacket(cmd_connect_result, []byte{connect_ok})
+	}
+	return stream, nil
+}
+
+func (self *EncryptTunPeer) accept() (stream *tunStream, err error) {
+	select {
+	case stream = <-self.acceptq:
+		return stream, nil
+	case <-self.quit:
+		return nil, ErrConnClosed
+	}
+}
+
+// 关闭隧道，隧道中的所有连接随之关闭，Start 返回
+func (self *EncryptTunPeer) Close() (err error) {
+	self.shutdown()
+	self.mtx.Lock()
+	links := append([]*tunLink(nil), self.links...)
+	suspended := self.resumeTimer != nil
+	self.mtx.Unlock()
+	for _, link := range links {
+		link.close()
+	}
+	if suspended {
+		// 挂起时没有连接的读例程来 clean；调用者可能是 clean 需要等待的例程，不能同步调用
+		go self.clean()
+	}
+	return self.rawPeer.Close()
+}
 
-	log.Println("wait for stopping all of conn handler and peer conn op hander")
-	self.wg.Wait()
-	log.Println("all of conn handler and peer conn op hander stopped")
+func (self *EncryptTunPeer) Addr() net.Addr {
+	return self.rawPeer.LocalAddr()
+}
 
-	if self.mode == server_mode_proxy {
-		log.Printf("stop listener(%s)", self.addr.String())
-		self.lstn.Close()
+// 收到 cmd_connect，连接放入 Accept 队列，队列满时重置连接
+// 本端发送时先使用收到 cmd_connect 的 peer 连接
+func (self *EncryptTunPeer) acceptStream(link *tunLink, connId uint32, target string) {
+	if _, ok := self.streams.Load(connId); ok {
+		self.Logger.Warn("duplicate conn id", tlog.ConnId(connId))
+		return
+	}
+	stream := newTunStream(self, connId)
+	stream.target = target
+	self.classify(stream)
+	stream.bind(link)
+	self.storeStream(stream)
+	if target != "" && self.reverseTargets[target] {
+		self.goDialReverse(stream)
+		return
+	}
+	select {
+	case self.acceptq <- stream:
+	default:
+		self.Logger.Warn("accept queue is full, reset conn", tlog.ConnId(connId))
+		// 在 peer 读例程中，写入可能阻塞
+		self.goTask(func() { stream.Close() })
 	}
 }
 
-// 连接处理循环
-func (self *EncryptTunPeer) startConnHandler(conn *net.TCPConn, connId uint32) {
-	self.wg.Add(1)
-	log.Printf("start conn(%d) handler", connId)
-	buf := make([]byte, max_tcp_read)
+// 从 src 读数据写入 dst，任意一端出错后关闭两端
+func (self *EncryptTunPeer) forwardConn(dst net.Conn, src net.Conn, connId uint32) {
+	defer self.wg.Done()
+	defer src.Close()
+	defer dst.Close()
+	self.Logger.Debug("start conn handler", tlog.ConnId(connId))
+	pbuf := getBuf(max_tcp_read)
+	defer putBuf(pbuf)
+	buf := *pbuf
 	for {
-		n, err0 := conn.Read(buf)
+		n, err0 := src.Read(buf)
 		if n > 0 {
-			// tell to (connect and )send data
-			if self.mode == server_mode_agent {
-				self.tcou.SendValue(tcounter_id_down, int64(len(buf[:n])))
+			if _, err := dst.Write(buf[:n]); err != nil {
+				self.Logger.Debug("conn write failed", tlog.ConnId(connId), tlog.Err(err))
+				break
 			}
-			log.Printf("send conn(%d) op: senddata", connId)
-			protodata := packData(connId, buf[:n])
-			self.peer.Write(protodata)
 		}
 
 		if err0 != nil {
-			log.Println(err0.Error())
+			self.Logger.Debug("conn read failed", tlog.ConnId(connId), tlog.Err(err0))
 			break
 		}
 	}
+	self.Logger.Debug("stop conn handler", tlog.ConnId(connId))
+}
 
-	log.Printf("stop conn(%d) handler", connId)
-	if v, ok := self.connChanMap.Load(connId); ok {
-		// 来自 conn 的关闭
-		log.Printf("send conn(%d) op: close", connId)
-		protodata := packClose(connId)
-		self.peer.Write(protodata)
-		connChan := v.(chan connChanItem)
-		log.Printf("conn EOF, notify to close conn(%d) chan", connId)
-		//safeClose(connChan)
-		self.notifyToCloseChan(connChan, connId)
+// 在本地连接和隧道连接之间双向转发数据
+func (self *EncryptTunPeer) goForward(conn net.Conn, stream *tunStream) {
+	if !self.addTask(2) {
+		conn.Close()
+		stream.Close()
+		return
 	}
-	self.wg.Done()
+	go self.forwardConn(stream, conn, stream.id)
+	go self.forwardConn(conn, stream, stream.id)
 }
 
-// 处理远端 peer 发送过来的请求
-func (self *EncryptTunPeer) goStartPeerConnOpHandler(conn *net.TCPConn, connId uint32) (connChan chan connChanItem) {
-	log.Printf("start peer conn(%d) op handler", connId)
-	connChan = make(chan connChanItem, max_peer_conn_op_chan_size)
-	self.connChanMap.Store(connId, connChan)
+// 按 TargetFilter 检查并连接对端指定的目标，目标是主机名时检查并连接解析出的地址，避免解析两次得到不同的结果
+func (self *EncryptTunPeer) dialTarget(target string) (conn net.Conn, result byte) {
+	if self.TargetFilter == nil {
+		return nil, connect_refused
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, connect_failed
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, connect_failed
+	}
 
-	go func() {
-		self.wg.Add(1)
-
-		var ok bool
-		var item connChanItem
-
-	_for:
-		for {
-			item, ok = <-connChan
-			if !ok {
-				log.Printf("conn(%d) chan is closed", connId)
-				//self.connChanMap.Delete(connId)
-				if conn != nil {
-					conn.Close()
-					log.Printf("conn(%d) is closing", connId)
-				}
-				break
-			}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), tun_dial_timeout)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			self.Logger.Warn("resolve target failed", tlog.F("target", target), tlog.Err(err))
+			return nil, connect_failed
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
 
-			switch item.cmd {
-			case cmd_connect:
-				unpackConnect(item.reader)
-				// agent
-				var err error
-				log.Printf("conn(%d) dial(%s)", connId, self.addr.String())
-				conn, err = net.DialTCP("tcp", nil, self.addr)
-				if err != nil {
-					// tell to close
-					log.Println(err.Error())
-					log.Printf("send conn(%d) op: close", connId)
-					protodata := packClose(connId)
-					self.peer.Write(protodata)
-					log.Printf("dial(%s) err, notify to close conn(%d) chan", self.addr.String(), connId)
-					//safeClose(connChan)
-					self.notifyToCloseChan(connChan, connId)
-				} else {
-					go self.startConnHandler(conn, connId)
-				}
+	result = connect_refused
+	for _, ip := range ips {
+		if !self.TargetFilter.Allow(host, ip, port) {
+			continue
+		}
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), portStr), tun_dial_timeout)
+		if err == nil {
+			return conn, connect_ok
+		}
+		self.Logger.Warn("dial to target failed", tlog.F("target", target), tlog.Err(err))
+		result = connect_failed
+	}
+	return nil, result
+}
 
-			case cmd_data:
-				data := unpackData(item.reader)
-				conn.Write(data)
-				if self.mode == server_mode_agent {
-					self.tcou.SendValue(tcounter_id_up, int64(len(data)))
-				}
+// 启动 startForwardLoop，多次调用只启动一次，之后不能再调用 Accept
+func (self *EncryptTunPeer) goForwardLoop() {
+	self.fwdOnce.Do(func() { go self.startForwardLoop() })
+}
 
-			case cmd_close:
-				unpackClose(item.reader)
-				//self.connChanMap.Delete(connId)
-				conn.Close()
-				log.Printf("conn(%d) is closing", connId)
-				log.Printf("peer op, notify to close conn(%d) chan", connId)
-				//safeClose(connChan)
-				self.notifyToCloseChan(connChan, connId)
-				break _for
-			}
+// 接受对端打开的连接并转发，拨号期间收到的数据先放在接收队列中
+// 对端指定了目标时按 TargetFilter 检查后连接目标，否则 agent 转发到 addr，其他情况下直接关闭
+func (self *EncryptTunPeer) startForwardLoop() {
+	for {
+		stream, err := self.accept()
+		if err != nil {
+			break
 		}
-		log.Printf("stop peer conn(%d) op handler", connId)
-		self.wg.Done()
-	}()
+		if !self.addTask(1) {
+			stream.Close()
+			break
+		}
+		go func() {
+			defer self.wg.Done()
+			if stream.target != "" {
+				self.Logger.Info("dial to target", tlog.ConnId(stream.id), tlog.F("target", stream.target))
+				conn, result := self.dialTarget(stream.target)
+				stream.writePacket(cmd_connect_result, []byte{result})
+				if result != connect_ok {
+					self.Logger.Warn("connect to target failed", tlog.ConnId(stream.id), tlog.F("target", stream.target), tlog.F("result", result))
+					self.dialFailed(result)
+					stream.Close()
+					return
+				}
+				self.goForward(conn, stream)
+				return
+			}
+			if !self.forward || self.mode != server_mode_agent {
+				self.Logger.Warn("no target to forward conn, reset conn", tlog.ConnId(stream.id))
+				stream.Close()
+				return
+			}
 
-	return connChan
+			self.Logger.Info("dial to TCP", tlog.ConnId(stream.id), tlog.Addr(self.addr))
+			conn, err := net.DialTCP("tcp", nil, self.addr)
+			if err != nil {
+				// tell to close
+				self.Logger.Warn("dial to TCP failed", tlog.ConnId(stream.id), tlog.Addr(self.addr), tlog.Err(err))
+				self.dialFailed(connect_failed)
+				stream.Close()
+				return
+			}
+			self.goForward(conn, stream)
+		}()
+	}
 }
 
-// 连接操作序列化
-func (self *EncryptTunPeer) dispatchPeerConnOp(cmd uint16, reader io.Reader) {
-	connId := unpackConnId(reader)
-	var connChan chan connChanItem
-	if cmd == cmd_connect {
-		connChan = self.goStartPeerConnOpHandler(nil, connId)
-	} else if v, ok := self.connChanMap.Load(connId); ok {
-		connChan = v.(chan connChanItem)
-	} else {
-		log.Printf("invalid dispatch, connId(%d)", connId)
+// 处理远端 peer 发送过来的连接操作，不能阻塞，否则会影响隧道中的其他连接
+func (self *EncryptTunPeer) dispatchPeerConnOp(link *tunLink, cmd uint16, connId uint32, data []byte) {
+	switch cmd {
+	case cmd_connect:
+		self.acceptStream(link, connId, string(data))
+		return
+	case cmd_listen:
+		self.handleListen(connId, data)
+		return
+	case cmd_listen_result:
+		self.handleListenResult(connId, data)
 		return
 	}
-	log.Printf("@@ serialize op conn(%d), send conn chan", connId)
-	connChan <- connChanItem{cmd, reader}
-	log.Printf("## serialize op conn(%d), sent conn chan, finished", connId)
-}
 
-// 主连接处理循环
-func (self *EncryptTunPeer) startPeerHandler() {
-	defer func() {
-		self.peer.Close()
-		log.Printf("peer is closing")
-	}()
-	log.Println("start peer handler")
-	buf := make([]byte, max_tcp_read)
-	slde := NewSlde()
-	sldeleft := SLDE_HEADER_SIZE
-	var err error
-	for {
-		//log.Printf("peer will read %d bytes", sldeleft)
-		log.Println("@@@@@ peer read")
-		n, err0 := self.peer.Read(buf[:sldeleft])
-		log.Println("##### peer read finished")
-		if n > 0 {
-			sldeleft, err = slde.WriteAndGetNextToWrite(buf[:n])
-			if err != nil {
-				log.Println(err.Error())
-				// close all connection
-				self.clean()
-				break
-			}
+	v, ok := self.streams.Load(connId)
+	if !ok {
+		self.Logger.Debug("invalid dispatch", tlog.ConnId(connId), tlog.Cmd(cmd))
+		if cmd == cmd_resume {
+			// 对端在连接断开前没有收到 cmd_close
+			self.goTask(func() { link.writePacket(cmd_close, connId, nil) })
+		}
+		return
+	}
+	stream := v.(*tunStream)
 
-			if sldeleft == 0 {
-				// 一个协议包接收完成，根据connId将slde加入对应的待处理队列
-				recvdata, err := slde.Decode()
-				if err != nil {
-					log.Println(err.Error())
-					// close all connection
-					self.clean()
-					break
-				}
-				slde = NewSlde()
-				sldeleft = SLDE_HEADER_SIZE
-				log.Println("slde recv complete")
-
-				select {
-				case connId, ok := <-self.connCloseNotifyChan:
-					if ok {
-						if v, ok := self.connChanMap.Load(connId); ok {
-							connChan := v.(chan connChanItem)
-							log.Printf("close conn(%d) chan", connId)
-							self.connChanMap.Delete(connId)
-							close(connChan)
-						}
-					}
-				default:
-				}
+	switch cmd {
+	case cmd_data:
+		// 解码缓冲区会被下一个协议包复用，数据需要复制出来
+		offset, buf, err := unpackData(data)
+		if err != nil {
+			self.Logger.Warn("unpack data failed", tlog.ConnId(connId), tlog.Err(err))
+			return
+		}
+		if err = stream.push(offset, buf); err != nil {
+			self.Logger.Warn("reset conn", tlog.ConnId(connId), tlog.Err(err))
+			self.goTask(func() { stream.Close() })
+		}
 
-				cmd, recvReader := unpackCmd(recvdata)
-				switch cmd {
-				case cmd_connect:
-					log.Println("dispatch cmd: connect")
-					self.dispatchPeerConnOp(cmd, recvReader)
-				case cmd_data:
-					log.Println("dispatch cmd: senddata")
-					self.dispatchPeerConnOp(cmd, recvReader)
-				case cmd_close:
-					log.Println("dispatch cmd: close")
-					self.dispatchPeerConnOp(cmd, recvReader)
-				}
-			} else if sldeleft > max_tcp_read {
-				sldeleft = max_tcp_read
-			}
+	case cmd_close:
+		self.Logger.Info("close conn by peer", tlog.ConnId(connId))
+		stream.remoteClose()
+
+	case cmd_window_update:
+		returned, err := unpackWindowUpdate(data)
+		if err != nil {
+			self.Logger.Warn("unpack window update failed", tlog.ConnId(connId), tlog.Err(err))
+			return
 		}
+		stream.updateCredit(returned)
 
-		if err0 != nil {
-			log.Println(err0.Error())
-			// close all connection
-			self.clean()
-			break
+	case cmd_connect_result:
+		if len(data) < 1 {
+			self.Logger.Warn("connect result packet too short", tlog.ConnId(connId))
+			return
 		}
-	}
+		stream.setConnectResult(data[0])
 
-	log.Println("stop peer handler")
+	case cmd_resume:
+		recvOff, returned, err := unpackResume(data)
+		if err != nil {
+			self.Logger.Warn("unpack resume failed", tlog.ConnId(connId), tlog.Err(err))
+			return
+		}
+		self.Logger.Debug("resume conn", tlog.ConnId(connId), tlog.F("link", link.id), tlog.F("offset", recvOff))
+		stream.updateCredit(returned)
+		self.goTask(func() { stream.resume(link, recvOff) })
+	}
 }
 
-func (self *EncryptTunPeer) startProxy() (err error) {
-	log.Println("start proxy")
-	log.Printf("start listener(%s)", self.addr.String())
-	self.lstn, err = net.ListenTCP("tcp", self.addr)
+// 处理一个完整的协议包
+func (self *EncryptTunPeer) handlePeerPacket(link *tunLink, data []byte) {
+	cmd, connId, left, err := unpackPacket(data)
 	if err != nil {
-		log.Println(err.Error())
-		return err
+		self.Logger.Warn("unpack peer packet failed", tlog.Err(err))
+		return
 	}
-	defer self.lstn.Close()
-
-	go self.startPeerHandler()
+	link.touch()
+	switch cmd {
+	case cmd_connect, cmd_data, cmd_close, cmd_window_update, cmd_connect_result, cmd_listen, cmd_listen_result, cmd_resume:
+		self.dispatchPeerConnOp(link, cmd, connId, left)
+	case cmd_ping:
+		self.handlePing(link, connId, left)
+	case cmd_pong:
+		self.handlePong(link, connId, left)
+	default:
+		self.Logger.Warn("unknown peer cmd", tlog.Cmd(cmd))
+	}
+}
 
-	var connId uint32 = 0
+func (self *EncryptTunPeer) startProxy() (err error) {
+	self.Logger.Info("start proxy")
+	// 对端的正向映射
+	self.goForwardLoop()
 	for {
 		conn, err := self.lstn.AcceptTCP()
 		if err != nil {
-			log.Println(err.Error())
+			self.Logger.Info("accept TCP conn failed", tlog.Err(err))
 			break
 		}
 
-		connId += 1
-		self.goStartPeerConnOpHandler(conn, connId)
-		log.Printf("send conn(%d) op: connect", connId)
-		data := packConnect(connId)
-		self.peer.Write(data)
-		go self.startConnHandler(conn, connId)
+		stream, err := self.openStream("")
+		if err != nil {
+			self.Logger.Info("open stream failed", tlog.Err(err))
+			conn.Close()
+			break
+		}
+		self.Logger.Info("new conn", tlog.ConnId(stream.id), tlog.RemoteAddr(conn.RemoteAddr()))
+		self.goForward(conn, stream)
 	}
-
+	self.Close()
+	<-self.done
 	return err
 }
 
 func (self *EncryptTunPeer) startAgent() (err error) {
-	log.Println("start agent")
-	self.startPeerHandler()
-	self.tcou.Close()
+	self.Logger.Info("start agent")
+	self.goForwardLoop()
+	<-self.done
 	return nil
 }
 
-// 启动proxy
+// 启动隧道，隧道关闭后返回
+// 服务端收到的是客户端通过 AddLink 增加的连接时，把连接交给所属的隧道后立即返回
 func (self *EncryptTunPeer) Start() (err error) {
-	if self.mode == server_mode_proxy {
+	link := newTunLink(self, self.rawPeer)
+	var first []byte
+	var joined bool
+	if err = link.setup(); err == nil {
+		first, joined, err = self.startSession(link)
+	}
+	if err == nil && !joined && self.forward && self.mode == server_mode_proxy {
+		self.Logger.Info("start listener", tlog.Addr(self.addr))
+		if self.lstn, err = net.ListenTCP("tcp", self.addr); err != nil {
+			self.Logger.Error("start listener failed", tlog.Addr(self.addr), tlog.Err(err))
+			link.release()
+		}
+	}
+	if err != nil || joined {
+		self.shutdown()
+		return err
+	}
+	self.sendShaper = newTunShaper(self.SendLimit)
+	self.recvShaper = newTunShaper(self.RecvLimit)
+	close(self.ready)
+	self.loadReverseTargets()
+	if err = self.attachLink(link, first); err != nil {
+		return err
+	}
+	self.startMappings()
+
+	if !self.forward {
+		self.Logger.Info("start tunnel")
+		<-self.done
+		return nil
+	} else if self.mode == server_mode_proxy {
 		return self.startProxy()
 	} else if self.mode == server_mode_agent {
 		return self.startAgent()
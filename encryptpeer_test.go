@@ -0,0 +1,1191 @@
+package tnet
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startEchoServer(t *testing.T) (addr string, lstn net.Listener) {
+	lstn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lstn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return lstn.Addr().String(), lstn
+}
+
+func freeTCPAddr(t *testing.T) (addr string) {
+	lstn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = lstn.Addr().String()
+	lstn.Close()
+	return addr
+}
+
+func dialRetry(t *testing.T, addr string) (conn net.Conn) {
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			return conn
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+// 一条连接的本地端不读数据，不能影响隧道中的其他连接
+func TestEncryptTunPeerSlowStream(t *testing.T) {
+	echoAddr, echoLstn := startEchoServer(t)
+	defer echoLstn.Close()
+
+	proxyAddr := freeTCPAddr(t)
+	peer1, peer2 := net.Pipe()
+	proxy := NewEncryptConnProxy(peer1, proxyAddr)
+	agent := NewEncryptConnAgent(peer2, echoAddr)
+	proxyDone := make(chan error, 1)
+	agentDone := make(chan error, 1)
+	go func() { proxyDone <- proxy.Start() }()
+	go func() { agentDone <- agent.Start() }()
+	defer func() {
+		peer1.Close()
+		for _, done := range []chan error{proxyDone, agentDone} {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Error("tunnel did not stop")
+			}
+		}
+	}()
+
+	slow := dialRetry(t, proxyAddr).(*net.TCPConn)
+	defer slow.Close()
+	slow.SetReadBuffer(0x1000)
+	go func() {
+		data := make([]byte, 0x10000)
+		for i := 0; i < 0x200; i++ {
+			if _, err := slow.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	// 等待回显数据填满 slow 的接收窗口
+	time.Sleep(300 * time.Millisecond)
+
+	fast := dialRetry(t, proxyAddr)
+	defer fast.Close()
+	fast.SetDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 10; i++ {
+		if _, err := fast.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(fast, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("echo through tunnel: %q, %v", buf, err)
+		}
+	}
+}
+
+func echoAccept(lstn net.Listener) {
+	for {
+		conn, err := lstn.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func checkEcho(t *testing.T, conn net.Conn, msg string) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// 超过窗口的数据需要边写边读
+	go conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("echo through stream: %q, %v", buf, err)
+	}
+}
+
+// 双方都可以打开连接，对端通过 Accept 接受
+func TestEncryptTunPeerOpenStream(t *testing.T) {
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	server := NewEncryptTunServer(peer2)
+	clientDone := make(chan error, 1)
+	serverDone := make(chan error, 1)
+	go func() { clientDone <- client.Start() }()
+	go func() { serverDone <- server.Start() }()
+	go echoAccept(client)
+	go echoAccept(server)
+
+	streams := make([]net.Conn, 0, 4)
+	for _, tun := range []*EncryptTunPeer{client, client, server, server} {
+		stream, err := tun.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream)
+	}
+	big := string(newBenchData(3 * tun_stream_window))
+	for i, stream := range streams {
+		checkEcho(t, stream, big[i:])
+		stream.Close()
+	}
+
+	// 读超时
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = stream.Read(make([]byte, 1)); err != errTunTimeout || !err.(net.Error).Timeout() {
+		t.Fatalf("read should time out, got %v", err)
+	}
+
+	client.Close()
+	for _, done := range []chan error{clientDone, serverDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel did not stop")
+		}
+	}
+	if _, err = stream.Read(make([]byte, 1)); err != ErrConnClosed {
+		t.Fatalf("read after tunnel closed: %v", err)
+	}
+}
+
+// 同时启动一对隧道，返回两端 Start 的结果
+func startTunPair(client *EncryptTunPeer, server *EncryptTunPeer) (clientDone chan error, serverDone chan error) {
+	clientDone = make(chan error, 1)
+	serverDone = make(chan error, 1)
+	go func() { clientDone <- client.Start() }()
+	go func() { serverDone <- server.Start() }()
+	return clientDone, serverDone
+}
+
+func TestEncryptTunPeerHandshake(t *testing.T) {
+	pub1, priv1, _ := GenerateIdentityKey()
+	pub2, priv2, _ := GenerateIdentityKey()
+	pub3, _, _ := GenerateIdentityKey()
+	cases := []struct {
+		name string
+		set  func(client *EncryptTunPeer, server *EncryptTunPeer)
+		ok   bool
+	}{
+		{"psk", func(client *EncryptTunPeer, server *EncryptTunPeer) {
+			client.PSK = []byte("secret")
+			server.PSK = []byte("secret")
+		}, true},
+		{"psk mismatch", func(client *EncryptTunPeer, server *EncryptTunPeer) {
+			client.PSK = []byte("secret")
+			server.PSK = []byte("secret2")
+		}, false},
+		{"ed25519", func(client *EncryptTunPeer, server *EncryptTunPeer) {
+			client.IdentityKey, client.PeerKeys = priv1, []ed25519.PublicKey{pub2}
+			server.IdentityKey, server.PeerKeys = priv2, []ed25519.PublicKey{pub3, pub1}
+		}, true},
+		{"ed25519 unknown peer", func(client *EncryptTunPeer, server *EncryptTunPeer) {
+			client.IdentityKey, client.PeerKeys = priv1, []ed25519.PublicKey{pub2}
+			server.IdentityKey, server.PeerKeys = priv2, []ed25519.PublicKey{pub3}
+		}, false},
+		{"auth mismatch", func(client *EncryptTunPeer, server *EncryptTunPeer) {
+			client.PSK = []byte("secret")
+			server.IdentityKey, server.PeerKeys = priv2, []ed25519.PublicKey{pub1}
+		}, false},
+		{"legacy client", func(client *EncryptTunPeer, server *EncryptTunPeer) {
+			server.PSK = []byte("secret")
+		}, false},
+	}
+	for _, c := range cases {
+		peer1, peer2 := net.Pipe()
+		client := NewEncryptTunClient(peer1)
+		server := NewEncryptTunServer(peer2)
+		c.set(client, server)
+		clientDone, serverDone := startTunPair(client, server)
+		if c.ok {
+			go echoAccept(server)
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			checkEcho(t, stream, c.name)
+			client.Close()
+		} else {
+			// 不握手的一端在打开连接时才会写入数据
+			go client.OpenStream()
+		}
+		// 最后一条握手消息由 agent 一端验证，proxy 一端握手完成后才发现连接被关闭，所以只检查 agent 一端
+		for i, done := range []chan error{clientDone, serverDone} {
+			select {
+			case err := <-done:
+				if (c.ok && err != nil) || (!c.ok && i == 1 && err == nil) {
+					t.Fatalf("%s: Start returned %v", c.name, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: tunnel did not stop", c.name)
+			}
+		}
+	}
+}
+
+// 帧序号作为 nonce，重放和乱序的帧都不能解密
+func TestAeadFrameCipherReplay(t *testing.T) {
+	key := make([]byte, handshake_key_size)
+	send, _ := newAeadFrameCipher(key)
+	recv, _ := newAeadFrameCipher(key)
+	frames := make([][]byte, 3)
+	for i := range frames {
+		var b bytes.Buffer
+		send.sealTo(&b, []byte("frame"))
+		frames[i] = b.Bytes()
+	}
+	replay := append([]byte(nil), frames[0]...)
+	if got, err := recv.open(frames[0]); err != nil || string(got) != "frame" {
+		t.Fatalf("open first frame: %q, %v", got, err)
+	}
+	if _, err := recv.open(replay); err != errFrameAuth {
+		t.Fatalf("replayed frame should be rejected, got %v", err)
+	}
+	recv, _ = newAeadFrameCipher(key)
+	if _, err := recv.open(frames[2]); err != errFrameAuth {
+		t.Fatalf("reordered frame should be rejected, got %v", err)
+	}
+}
+
+// 每种压缩方式都能还原数据，不能变小的帧以原始数据发送，连续没有变小后暂停压缩
+func TestFrameCompressor(t *testing.T) {
+	text := newBenchData(0x4000)
+	noise := make([]byte, 0x4000)
+	rand.New(rand.NewSource(5)).Read(noise)
+	for c := CompressNone; c.supported(); c++ {
+		comp := newFrameCompressor(c)
+		check := func(data []byte, flag byte) {
+			var frame, out bytes.Buffer
+			comp.compressTo(&frame, data)
+			if frame.Bytes()[0] != flag {
+				t.Fatalf("%v: frame flag %d, want %d", c, frame.Bytes()[0], flag)
+			}
+			if err := comp.decompressTo(&out, frame.Bytes()); err != nil || !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("%v: round trip failed, %v", c, err)
+			}
+		}
+		if c == CompressNone {
+			check(text, frame_raw)
+			continue
+		}
+		check(text, frame_compressed)
+		check(text[:compress_min_size-1], frame_raw)
+		for i := 0; i < compress_max_misses; i++ {
+			check(noise, frame_raw)
+		}
+		for i := 0; i < compress_skip_frames; i++ {
+			check(text, frame_raw)
+		}
+		check(text, frame_compressed)
+	}
+
+	legacy := newLegacyFrameCompressor()
+	var frame, out bytes.Buffer
+	legacy.compressTo(&frame, text)
+	zlibDecompressTo(&out, frame.Bytes(), max_decompressed_size)
+	if !bytes.Equal(out.Bytes(), text) {
+		t.Fatal("legacy frame should be plain zlib")
+	}
+	if err := newFrameCompressor(CompressSnappy).decompressTo(&out, []byte{2, 0}); err == nil {
+		t.Fatal("invalid frame flag should be rejected")
+	}
+
+	// 对端发来的很小的帧不能解压出超过 max_decompressed_size 的数据
+	bomb := make([]byte, max_decompressed_size+1)
+	for c := CompressZlib; c.supported(); c++ {
+		var frame bytes.Buffer
+		codec := newFrameCodec(c)
+		codec.compressTo(&frame, bomb)
+		if frame.Len() > len(bomb)/100 {
+			t.Fatalf("%v: bomb frame is %d bytes", c, frame.Len())
+		}
+		out.Reset()
+		if err := codec.decompressTo(&out, frame.Bytes()); err == nil {
+			t.Fatalf("%v: oversized frame should be rejected", c)
+		}
+	}
+}
+
+func TestEncryptTunPeerCompression(t *testing.T) {
+	cases := []struct {
+		name   string
+		proxy  []Compression
+		agent  []Compression
+		ok     bool
+		result Compression
+		noZstd bool
+	}{
+		{"default", nil, nil, true, CompressSnappy, false},
+		{"proxy order", []Compression{CompressZstd, CompressSnappy}, nil, true, CompressZstd, false},
+		{"agent allowed", nil, []Compression{CompressNone, CompressZlib}, true, CompressZlib, false},
+		{"none", []Compression{CompressNone}, nil, true, CompressNone, false},
+		{"unknown offered", []Compression{Compression(9), CompressZlib}, nil, true, CompressZlib, false},
+		{"no common", []Compression{CompressZstd}, []Compression{CompressZlib}, false, 0, false},
+		// zstd 初始化失败时两端都不再使用 zstd
+		{"zstd unavailable", []Compression{CompressZstd, CompressZlib}, nil, true, CompressZlib, true},
+		{"zstd unavailable only", []Compression{CompressZstd}, nil, false, 0, true},
+	}
+	zstdOnce.Do(initZstd)
+	initErr := zstdErr
+	defer func() { zstdErr = initErr }()
+	for _, c := range cases {
+		zstdErr = initErr
+		if c.noZstd {
+			zstdErr = errors.New("zstd disabled")
+		}
+		peer1, peer2 := net.Pipe()
+		client := NewEncryptTunClient(peer1)
+		server := NewEncryptTunServer(peer2)
+		client.PSK, client.Compressions = []byte("secret"), c.proxy
+		server.PSK, server.Compressions = []byte("secret"), c.agent
+		clientDone, serverDone := startTunPair(client, server)
+		if c.ok {
+			go echoAccept(server)
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			checkEcho(t, stream, string(newBenchData(3*tun_stream_window)))
+			for _, tun := range []*EncryptTunPeer{client, server} {
+				tun.mtx.Lock()
+				got := tun.links[0].compressor.compression
+				tun.mtx.Unlock()
+				if got != c.result {
+					t.Fatalf("%s: negotiated %v, want %v", c.name, got, c.result)
+				}
+			}
+			client.Close()
+		}
+		for i, done := range []chan error{clientDone, serverDone} {
+			select {
+			case err := <-done:
+				if (c.ok && err != nil) || (!c.ok && i == 1 && err == nil) {
+					t.Fatalf("%s: Start returned %v", c.name, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: tunnel did not stop", c.name)
+			}
+		}
+	}
+}
+
+func TestAddrFilter(t *testing.T) {
+	filter, err := NewAddrFilter([]string{"127.0.0.0/8", "*.example.com:443", "[::1]:8080"}, []string{"127.0.0.2", "bad.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		host string
+		ip   string
+		port int
+		ok   bool
+	}{
+		{"127.0.0.1", "127.0.0.1", 80, true},
+		{"127.0.0.2", "127.0.0.2", 80, false},
+		{"www.example.com", "93.184.216.34", 443, true},
+		{"www.example.com", "93.184.216.34", 80, false},
+		{"bad.example.com", "93.184.216.34", 443, false},
+		{"evil.com", "127.0.0.2", 80, false},
+		{"::1", "::1", 8080, true},
+		{"::1", "::1", 22, false},
+		{"10.0.0.1", "10.0.0.1", 80, false},
+	}
+	for _, c := range cases {
+		if got := filter.Allow(c.host, net.ParseIP(c.ip), c.port); got != c.ok {
+			t.Errorf("Allow(%s, %s, %d) = %v, want %v", c.host, c.ip, c.port, got, c.ok)
+		}
+	}
+	if _, err = NewAddrFilter([]string{"example.com:99999"}, nil); err == nil {
+		t.Error("invalid port should be rejected")
+	}
+}
+
+func socks5Connect(t *testing.T, addr string, target *net.TCPAddr) (conn net.Conn, rep byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := []byte{socks5_version, 1, socks5_auth_none, socks5_version, socks5_cmd_connect, 0, socks5_atyp_ipv4}
+	req = append(req, target.IP.To4()...)
+	req = append(req, byte(target.Port>>8), byte(target.Port))
+	conn.Write(req)
+	reply := make([]byte, 12)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply[3]
+}
+
+// 通过 proxy 端的 SOCKS5 和 HTTP CONNECT 连接 agent 允许的目标
+func TestEncryptTunPeerServeProxy(t *testing.T) {
+	echoAddr, echoLstn := startEchoServer(t)
+	defer echoLstn.Close()
+	deniedAddr, deniedLstn := startEchoServer(t)
+	defer deniedLstn.Close()
+
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	agent := NewEncryptConnAgent(peer2, echoAddr)
+	agent.TargetFilter, _ = NewAddrFilter(nil, []string{deniedAddr})
+	clientDone, agentDone := startTunPair(client, agent)
+	lstn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.ServeProxy(lstn)
+
+	conn, rep := socks5Connect(t, lstn.Addr().String(), echoLstn.Addr().(*net.TCPAddr))
+	if rep != socks5_rep_succeeded {
+		t.Fatalf("socks5 connect: rep(%d)", rep)
+	}
+	checkEcho(t, conn, "socks5")
+	conn.Close()
+
+	conn, rep = socks5Connect(t, lstn.Addr().String(), deniedLstn.Addr().(*net.TCPAddr))
+	conn.Close()
+	if rep != socks5_rep_not_allowed {
+		t.Fatalf("socks5 connect to denied target: rep(%d)", rep)
+	}
+
+	conn, err = net.Dial("tcp", lstn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+echoAddr+" HTTP/1.1\r\nHost: "+echoAddr+"\r\n\r\nearly")
+	want := "HTTP/1.1 200 Connection established\r\n\r\nearly"
+	buf := make([]byte, len(want))
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != want {
+		t.Fatalf("http connect: %q, %v", buf, err)
+	}
+	checkEcho(t, conn, "http")
+	conn.Close()
+
+	client.Close()
+	for _, done := range []chan error{clientDone, agentDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel did not stop")
+		}
+	}
+}
+
+// 一条 peer 连接上同时有正向和反向映射
+func TestEncryptTunPeerMappings(t *testing.T) {
+	echoAddr, echoLstn := startEchoServer(t)
+	defer echoLstn.Close()
+	forwardAddr, reverseAddr, refusedAddr := freeTCPAddr(t), freeTCPAddr(t), freeTCPAddr(t)
+
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	client.Mappings = []PortMapping{
+		{Listen: forwardAddr, Target: echoAddr},
+		{Reverse: true, Listen: reverseAddr, Target: echoAddr},
+		{Reverse: true, Listen: refusedAddr, Target: echoAddr},
+	}
+	agent := NewEncryptConnAgent(peer2, echoAddr)
+	agent.TargetFilter, _ = NewAddrFilter([]string{echoAddr}, nil)
+	agent.ListenFilter, _ = NewAddrFilter([]string{reverseAddr}, nil)
+	clientDone, agentDone := startTunPair(client, agent)
+
+	for _, addr := range []string{forwardAddr, reverseAddr} {
+		conn := dialRetry(t, addr)
+		checkEcho(t, conn, addr)
+		conn.Close()
+	}
+	if conn, err := net.DialTimeout("tcp", refusedAddr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("refused reverse mapping should not listen")
+	}
+
+	client.Close()
+	for _, done := range []chan error{clientDone, agentDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel did not stop")
+		}
+	}
+	if conn, err := net.DialTimeout("tcp", reverseAddr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("reverse mapping listener should be closed with the tunnel")
+	}
+}
+
+// 映射配置在 agent 上，由端口转发的 proxy 或者调用了 ServeProxy 的隧道按 TargetFilter 连接目标
+func TestEncryptTunPeerAgentMappings(t *testing.T) {
+	echoAddr, echoLstn := startEchoServer(t)
+	defer echoLstn.Close()
+	deniedTarget, deniedLstn := startEchoServer(t)
+	defer deniedLstn.Close()
+
+	for _, name := range []string{"proxy", "socks"} {
+		forwardAddr, reverseAddr, deniedAddr := freeTCPAddr(t), freeTCPAddr(t), freeTCPAddr(t)
+		peer1, peer2 := net.Pipe()
+		var client *EncryptTunPeer
+		if name == "proxy" {
+			client = NewEncryptConnProxy(peer1, freeTCPAddr(t))
+		} else {
+			client = NewEncryptTunClient(peer1)
+		}
+		client.TargetFilter, _ = NewAddrFilter([]string{echoAddr}, nil)
+		client.ListenFilter, _ = NewAddrFilter([]string{reverseAddr}, nil)
+		agent := NewEncryptConnAgent(peer2, echoAddr)
+		agent.Mappings = []PortMapping{
+			{Listen: forwardAddr, Target: echoAddr},
+			{Reverse: true, Listen: reverseAddr, Target: echoAddr},
+			{Listen: deniedAddr, Target: deniedTarget},
+		}
+		clientDone, agentDone := startTunPair(client, agent)
+		if name == "socks" {
+			lstn, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go client.ServeProxy(lstn)
+		}
+
+		for _, addr := range []string{forwardAddr, reverseAddr} {
+			conn := dialRetry(t, addr)
+			checkEcho(t, conn, addr)
+			conn.Close()
+		}
+		// 目标不在 TargetFilter 中，连接被关闭
+		conn := dialRetry(t, deniedAddr)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%s: read from denied mapping: %v", name, err)
+		}
+		conn.Close()
+
+		client.Close()
+		for _, done := range []chan error{clientDone, agentDone} {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: tunnel did not stop", name)
+			}
+		}
+	}
+}
+
+func TestParsePortMapping(t *testing.T) {
+	mapping, err := ParsePortMapping("R::8080=localhost:80")
+	if err != nil || !mapping.Reverse || mapping.Listen != ":8080" || mapping.Target != "localhost:80" {
+		t.Fatalf("R mapping: %+v, %v", mapping, err)
+	}
+	mapping, err = ParsePortMapping("L:[::1]:2222=10.0.0.5:22")
+	if err != nil || mapping.Reverse || mapping.Listen != "[::1]:2222" || mapping.Target != "10.0.0.5:22" {
+		t.Fatalf("L mapping: %+v, %v", mapping, err)
+	}
+	for _, s := range []string{"", "X:1=2", "L:8080=localhost:80", "L:127.0.0.1:8080"} {
+		if _, err = ParsePortMapping(s); err == nil {
+			t.Errorf("ParsePortMapping(%q) should fail", s)
+		}
+	}
+}
+
+// 模拟 NAT 映射失效，drop 之后写入的数据全部丢弃
+type blackholeConn struct {
+	net.Conn
+	drop *int32
+}
+
+func (self blackholeConn) Write(data []byte) (int, error) {
+	if atomic.LoadInt32(self.drop) != 0 {
+		return len(data), nil
+	}
+	return self.Conn.Write(data)
+}
+
+func TestEncryptTunPeerHeartbeat(t *testing.T) {
+	var drop int32
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(blackholeConn{peer1, &drop})
+	client.HeartbeatInterval = 20 * time.Millisecond
+	server := NewEncryptTunServer(blackholeConn{peer2, &drop})
+	clientDone, serverDone := startTunPair(client, server)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.RTT() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.RTT() <= 0 || time.Since(client.LastSeen()) > time.Second {
+		t.Fatalf("rtt(%v) last seen(%v)", client.RTT(), client.LastSeen())
+	}
+	// 对端没有开启心跳，只回复 pong
+	if server.RTT() != 0 {
+		t.Fatalf("server rtt(%v)", server.RTT())
+	}
+
+	atomic.StoreInt32(&drop, 1)
+	select {
+	case <-clientDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead peer was not detected")
+	}
+	if idle := time.Since(client.LastSeen()); idle < 3*client.HeartbeatInterval {
+		t.Fatalf("closed after idle(%v)", idle)
+	}
+	server.Close()
+	<-serverDone
+}
+
+func echoTunAccept(tun *EncryptTunPeer) {
+	for {
+		conn, err := tun.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+// 多条 peer 连接，传输过程中移除一条连接、断开一条连接，stream 迁移到剩下的连接上继续传输
+func TestEncryptTunPeerMultiLink(t *testing.T) {
+	psk := []byte("multi link")
+	sessions := NewTunSessionTable()
+	newServer := func(conn net.Conn) (server *EncryptTunPeer, done chan error) {
+		server = NewEncryptTunServer(conn)
+		server.PSK = psk
+		server.Sessions = sessions
+		done = make(chan error, 1)
+		go func() { done <- server.Start() }()
+		return server, done
+	}
+
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	client.PSK = psk
+	clientDone := make(chan error, 1)
+	go func() { clientDone <- client.Start() }()
+	server, serverDone := newServer(peer2)
+	go echoTunAccept(server)
+
+	var clientLinks, serverLinks []net.Conn
+	for i := 0; i < 2; i++ {
+		c, s := net.Pipe()
+		_, joinDone := newServer(s)
+		if err := client.AddLink(c); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-joinDone; err != nil {
+			t.Fatal(err)
+		}
+		clientLinks = append(clientLinks, c)
+		serverLinks = append(serverLinks, s)
+	}
+	if client.LinkCount() != 3 || server.LinkCount() != 3 {
+		t.Fatalf("links: client(%d) server(%d)", client.LinkCount(), server.LinkCount())
+	}
+
+	const streamCount = 6
+	const size = 0x100000
+	var streams []net.Conn
+	for i := 0; i < streamCount; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream)
+	}
+	client.mtx.Lock()
+	for _, link := range client.links {
+		if n := atomic.LoadInt32(&link.streams); n != streamCount/3 {
+			t.Errorf("link(%d) streams(%d)", link.id, n)
+		}
+	}
+	client.mtx.Unlock()
+
+	// 每条 stream 读到一部分后暂停，发送方受流量控制阻塞，此时断开连接，还有没有读走的数据需要重发
+	errs := make(chan error, streamCount)
+	var paused sync.WaitGroup
+	paused.Add(streamCount)
+	proceed := make(chan struct{})
+	for i, stream := range streams {
+		want := make([]byte, size)
+		for j := range want {
+			want[j] = byte(i*7 + j*13)
+		}
+		go stream.Write(want)
+		go func(stream net.Conn, want []byte) {
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got := make([]byte, len(want))
+			_, err := io.ReadFull(stream, got[:size/4])
+			paused.Done()
+			<-proceed
+			if err == nil {
+				_, err = io.ReadFull(stream, got[size/4:])
+			}
+			if err == nil && !bytes.Equal(got, want) {
+				err = io.ErrUnexpectedEOF
+			}
+			errs <- err
+		}(stream, want)
+	}
+
+	paused.Wait()
+	client.RemoveLink(clientLinks[0])
+	serverLinks[1].Close()
+	close(proceed)
+
+	for i := 0; i < streamCount; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.LinkCount() != 1 || server.LinkCount() != 1 {
+		t.Fatalf("links after failover: client(%d) server(%d)", client.LinkCount(), server.LinkCount())
+	}
+
+	client.Close()
+	for _, done := range []chan error{clientDone, serverDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel did not stop")
+		}
+	}
+}
+
+func TestEncryptTunPeerResume(t *testing.T) {
+	psk := []byte("resume")
+	sessions := NewTunSessionTable()
+	newServer := func(conn net.Conn) (server *EncryptTunPeer, done chan error) {
+		server = NewEncryptTunServer(conn)
+		server.PSK = psk
+		server.Sessions = sessions
+		// 客户端关闭后服务端也会挂起，等待超时后才结束
+		server.ResumeTimeout = time.Second
+		done = make(chan error, 1)
+		go func() { done <- server.Start() }()
+		return server, done
+	}
+
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	client.PSK = psk
+	client.ResumeTimeout = 5 * time.Second
+	var redials int32
+	client.Redial = func() (net.Conn, error) {
+		atomic.AddInt32(&redials, 1)
+		c, s := net.Pipe()
+		newServer(s)
+		return c, nil
+	}
+	clientDone := make(chan error, 1)
+	go func() { clientDone <- client.Start() }()
+	server, serverDone := newServer(peer2)
+	go echoTunAccept(server)
+
+	const streamCount = 2
+	const size = 0x100000
+	errs := make(chan error, streamCount)
+	var paused sync.WaitGroup
+	paused.Add(streamCount)
+	proceed := make(chan struct{})
+	for i := 0; i < streamCount; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]byte, size)
+		for j := range want {
+			want[j] = byte(i*5 + j*11)
+		}
+		go stream.Write(want)
+		go func(stream net.Conn, want []byte) {
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got := make([]byte, len(want))
+			_, err := io.ReadFull(stream, got[:size/4])
+			paused.Done()
+			<-proceed
+			if err == nil {
+				_, err = io.ReadFull(stream, got[size/4:])
+			}
+			if err == nil && !bytes.Equal(got, want) {
+				err = io.ErrUnexpectedEOF
+			}
+			errs <- err
+		}(stream, want)
+	}
+
+	// 唯一的连接断开，两端挂起会话，客户端通过 Redial 重新加入后继续传输
+	paused.Wait()
+	peer1.Close()
+	close(proceed)
+
+	for i := 0; i < streamCount; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if atomic.LoadInt32(&redials) == 0 {
+		t.Fatal("client did not redial")
+	}
+	if client.LinkCount() != 1 || server.LinkCount() != 1 {
+		t.Fatalf("links after resume: client(%d) server(%d)", client.LinkCount(), server.LinkCount())
+	}
+
+	client.Close()
+	for _, done := range []chan error{clientDone, serverDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel did not stop")
+		}
+	}
+}
+
+func TestEncryptTunPeerResumeTimeout(t *testing.T) {
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	client.ResumeTimeout = 200 * time.Millisecond
+	server := NewEncryptTunServer(peer2)
+	server.ResumeTimeout = 200 * time.Millisecond
+	clientDone, serverDone := startTunPair(client, server)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer1.Close()
+	for _, done := range []chan error{clientDone, serverDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("suspended tunnel did not stop")
+		}
+	}
+	if _, err = stream.Write([]byte("late")); err != ErrConnClosed {
+		t.Fatalf("write after resume timeout: %v", err)
+	}
+}
+
+func TestEncryptTunPeerRateLimit(t *testing.T) {
+	const size = 0x80000
+	const rate = 0x100000
+	cases := []struct {
+		name string
+		set  func(client *EncryptTunPeer, server *EncryptTunPeer)
+	}{
+		{"tunnel send", func(client *EncryptTunPeer, server *EncryptTunPeer) {
+			client.SendLimit = RateLimit{Rate: rate, Burst: 0x10000}
+		}},
+		{"stream recv", func(client *EncryptTunPeer, server *EncryptTunPeer) {
+			server.StreamRecvLimit = RateLimit{Rate: rate, Burst: 0x10000}
+		}},
+	}
+	for _, c := range cases {
+		peer1, peer2 := net.Pipe()
+		client := NewEncryptTunClient(peer1)
+		server := NewEncryptTunServer(peer2)
+		c.set(client, server)
+		clientDone, serverDone := startTunPair(client, server)
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		go stream.Write(make([]byte, size))
+		accepted, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err = io.ReadFull(accepted, make([]byte, size)); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		// 除去突发容量，剩下的数据需要按 rate 发送
+		if elapsed, min := time.Since(start), time.Duration(float64(size-0x10000)/rate*1e9); elapsed < min {
+			t.Fatalf("%s: %d bytes in %v, limit needs at least %v", c.name, size, elapsed, min)
+		}
+
+		client.Close()
+		<-clientDone
+		<-serverDone
+	}
+}
+
+// 等待令牌时超过写超时，返回隧道的超时错误
+func TestEncryptTunPeerRateLimitDeadline(t *testing.T) {
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	client.StreamSendLimit = RateLimit{Rate: 0x400, Burst: 0x400}
+	server := NewEncryptTunServer(peer2)
+	clientDone, serverDone := startTunPair(client, server)
+	go echoAccept(server)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(ioutil.Discard, stream)
+	stream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	if _, err = stream.Write(make([]byte, 0x10000)); err != errTunTimeout || !err.(net.Error).Timeout() {
+		t.Fatalf("write should time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("write returned after %v", elapsed)
+	}
+
+	client.Close()
+	<-clientDone
+	<-serverDone
+}
+
+// 大流量传输占满隧道的带宽时，高优先级的连接仍然能及时发送
+func TestEncryptTunPeerPriority(t *testing.T) {
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	client.SendLimit = RateLimit{Rate: 0x40000, Burst: 0x4000}
+	client.Classify = func(stream TunStream) StreamPriority {
+		if stream.Target() == "bulk" {
+			return PriorityLow
+		}
+		return PriorityHigh
+	}
+	server := NewEncryptTunServer(peer2)
+	clientDone, serverDone := startTunPair(client, server)
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	bulk, err := client.openStream("bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(ioutil.Discard, bulk)
+	go func() {
+		data := make([]byte, 0x10000)
+		for {
+			if _, err := bulk.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	interactive, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 独占隧道带宽时需要 total/rate，与大流量传输平分带宽时需要两倍
+	const total = 4 * 0x8000
+	start := time.Now()
+	msg := string(newBenchData(total / 4))
+	for i := 0; i < 4; i++ {
+		checkEcho(t, interactive, msg)
+	}
+	if elapsed, max := time.Since(start), time.Duration(total*1.5/0x40000*1e9); elapsed > max {
+		t.Fatalf("interactive stream starved by bulk transfer: %v > %v", elapsed, max)
+	}
+
+	client.Close()
+	<-clientDone
+	<-serverDone
+}
+
+func TestEncryptTunPeerMetrics(t *testing.T) {
+	echoAddr, echoLstn := startEchoServer(t)
+	defer echoLstn.Close()
+
+	exporter := NewPrometheusExporter()
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	client.Metrics = exporter.With("side", "client")
+	agent := NewEncryptConnAgent(peer2, echoAddr)
+	agent.Metrics = exporter.With("side", "agent")
+	clientDone, agentDone := startTunPair(client, agent)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, stream, "hello")
+	stream.Close()
+	// agent 没有设置 TargetFilter，拒绝所有指定了目标的连接
+	if _, err = client.DialStream("127.0.0.1:1"); err != ErrTunConnectRefused {
+		t.Fatalf("dial refused target: %v", err)
+	}
+
+	client.Close()
+	<-clientDone
+	<-agentDone
+	var buf bytes.Buffer
+	exporter.Export(&buf)
+	for _, line := range []string{
+		`tnet_tun_bytes_out_total{side="client"} 5`,
+		`tnet_tun_bytes_in_total{side="client"} 5`,
+		`tnet_tun_bytes_in_total{side="agent"} 5`,
+		`tnet_tun_bytes_out_total{side="agent"} 5`,
+		`tnet_tun_streams_opened_total{side="client"} 2`,
+		`tnet_tun_streams_opened_total{side="agent"} 2`,
+		`tnet_tun_streams_active{side="client"} 0`,
+		`tnet_tun_streams_active{side="agent"} 0`,
+		`tnet_tun_dial_failures_total{reason="refused",side="agent"} 1`,
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte(line+"\n")) {
+			t.Errorf("missing metric %s in\n%s", line, buf.String())
+		}
+	}
+}
+
+// 只知道 sessionId 不能加入会话：连接需要通过认证，并且与会话的第一条连接是同一个身份
+func TestEncryptTunPeerJoinIdentity(t *testing.T) {
+	pub1, priv1, _ := GenerateIdentityKey()
+	pub2, priv2, _ := GenerateIdentityKey()
+	pub3, priv3, _ := GenerateIdentityKey()
+	sessions := NewTunSessionTable()
+	newServer := func(conn net.Conn) (done chan error) {
+		server := NewEncryptTunServer(conn)
+		server.IdentityKey, server.PeerKeys = priv2, []ed25519.PublicKey{pub1, pub3}
+		server.Sessions = sessions
+		done = make(chan error, 1)
+		go func() { done <- server.Start() }()
+		return done
+	}
+
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	client.IdentityKey, client.PeerKeys = priv1, []ed25519.PublicKey{pub2}
+	clientDone := make(chan error, 1)
+	go func() { clientDone <- client.Start() }()
+	serverDone := newServer(peer2)
+
+	c, s := net.Pipe()
+	joinDone := newServer(s)
+	if err := client.AddLink(c); err != nil {
+		t.Fatalf("join with the same identity: %v", err)
+	}
+	if err := <-joinDone; err != nil {
+		t.Fatalf("server join: %v", err)
+	}
+
+	// 另一个服务端也认可的身份，带着偷来的 sessionId 加入
+	c, s = net.Pipe()
+	joinDone = newServer(s)
+	other := NewEncryptTunClient(c)
+	other.IdentityKey, other.PeerKeys = priv3, []ed25519.PublicKey{pub2}
+	link := newTunLink(other, c)
+	if err := link.setup(); err != nil {
+		t.Fatal(err)
+	}
+	var reply []byte
+	err := link.writePacket(cmd_session, 0, packSession(session_join, client.sessionId))
+	if err == nil {
+		reply, err = link.readPacket()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, left, _ := unpackPacket(reply); len(left) < 1 || left[0] != session_unknown {
+		t.Fatalf("join with another identity: reply %v", left)
+	}
+	link.release()
+	if err := <-joinDone; err != ErrTunJoinRefused {
+		t.Fatalf("server join with another identity: %v", err)
+	}
+
+	client.Close()
+	<-clientDone
+	<-serverDone
+}
+
+// 没有握手的旧版本连接不能加入会话
+func TestEncryptTunPeerJoinLegacy(t *testing.T) {
+	sessions := NewTunSessionTable()
+	newServer := func(conn net.Conn) (done chan error) {
+		server := NewEncryptTunServer(conn)
+		server.Sessions = sessions
+		done = make(chan error, 1)
+		go func() { done <- server.Start() }()
+		return done
+	}
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	clientDone := make(chan error, 1)
+	go func() { clientDone <- client.Start() }()
+	serverDone := newServer(peer2)
+
+	c, s := net.Pipe()
+	joinDone := newServer(s)
+	if err := client.AddLink(c); err != ErrTunJoinRefused {
+		t.Fatalf("legacy join: %v", err)
+	}
+	if err := <-joinDone; err != ErrTunJoinRefused {
+		t.Fatalf("server legacy join: %v", err)
+	}
+
+	client.Close()
+	<-clientDone
+	<-serverDone
+}
+
+func TestEncryptTunPeerJoinUnknownSession(t *testing.T) {
+	peer1, peer2 := net.Pipe()
+	client := NewEncryptTunClient(peer1)
+	server := NewEncryptTunServer(peer2)
+	clientDone, serverDone := startTunPair(client, server)
+
+	c, s := net.Pipe()
+	joinDone := make(chan error, 1)
+	go func() { joinDone <- NewEncryptTunServer(s).Start() }()
+	if err := client.AddLink(c); err != ErrTunJoinRefused {
+		t.Fatalf("join without session table: %v", err)
+	}
+	if err := <-joinDone; err != ErrTunJoinRefused {
+		t.Fatalf("server join: %v", err)
+	}
+
+	client.Close()
+	<-clientDone
+	<-serverDone
+}
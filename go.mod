@@ -1,11 +1,12 @@
 module git.tutils.com/tutils/tnet
 
-go 1.13
+go 1.20
 
 require (
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/golang/protobuf v1.3.4
 	github.com/jamescun/tuntap v0.0.0-20190712092105-cb1fb277045c
+	github.com/klauspost/compress v1.10.3
 	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
 	golang.org/x/sys v0.0.0-20200301040627-c5d0d7b4ec88 // indirect
 	golang.org/x/text v0.3.2 // indirect
@@ -0,0 +1,418 @@
+package tnet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"git.tutils.com/tutils/tnet/tlog"
+	"io"
+	"time"
+)
+
+/* EncryptTunPeer 握手
+===================================
+1. proxy -> agent: magic | auth:uint8 | proxy 临时公钥 | count:uint8 | 压缩方式:uint8 * count
+2. agent -> proxy: magic | auth:uint8 | agent 临时公钥 | 1:uint8 | 选择的压缩方式:uint8 | agent 认证
+3. proxy -> agent: proxy 认证
+===================================
+每条消息前带 len:uint16
+proxy 按优先顺序提供压缩方式，agent 选择其中第一个自己也允许的，没有时握手失败；选择结果包含在 th 中，不能被篡改
+auth 是认证方式的位组合，双方必须一致：handshake_auth_psk 认证为 HMAC-SHA256(PSK, 标签 | 角色 | th)，
+handshake_auth_ed25519 认证为 身份公钥 | Ed25519 签名(标签 | 角色 | th)，两种都启用时先 HMAC 后签名
+th = SHA256(消息 1 | 消息 2 去掉认证部分)，角色写进认证内容，一端的认证不能被反射回去冒充另一端
+临时公钥做 X25519 密钥交换，共享密钥（和 PSK）经 HKDF-SHA256 派生出两个方向各自的 AES-256-GCM 密钥，
+nonce 是每个方向从 0 开始的帧序号，不在帧中传输，重放、丢弃或者乱序的帧都会解密失败
+*/
+
+const (
+	handshake_magic              = "TNH2"
+	handshake_auth_psk     uint8 = 1
+	handshake_auth_ed25519 uint8 = 2
+
+	handshake_timeout      time.Duration = 10e9
+	max_handshake_msg_size int           = 0x100 // 旧版本的 Slde 帧以 SLDE_STX 开头，会被当作超长消息立即拒绝
+	handshake_key_size     int           = 32
+	handshake_hello_size   int           = 4 + 1 + 32 + 1 // 不含压缩方式列表
+
+	handshake_auth_label = "tnet auth "
+	handshake_role_proxy = "proxy"
+	handshake_role_agent = "agent"
+)
+
+var (
+	ErrHandshakeAuth = errors.New("tnet: tunnel handshake authentication failed")
+
+	errFrameAuth = errors.New("tnet: frame authentication failed")
+)
+
+// 隧道帧的加密层，数据先压缩再交给它
+// 每个方向一个实例，同一方向上的调用必须与帧在连接上的顺序一致
+type frameCipher interface {
+	// 加密 data 并追加到 dst
+	sealTo(dst *bytes.Buffer, data []byte)
+	// 原地解密，返回值引用 data
+	open(data []byte) (ret []byte, err error)
+}
+
+// 旧版本使用的固定种子异或，没有保密性，只用于兼容
+type xorFrameCipher struct {
+	seed int64
+}
+
+func (self *xorFrameCipher) sealTo(dst *bytes.Buffer, data []byte) {
+	start := dst.Len()
+	dst.Write(data)
+	out := dst.Bytes()[start:]
+	xorBytes(out, out, self.seed)
+}
+
+func (self *xorFrameCipher) open(data []byte) (ret []byte, err error) {
+	xorBytes(data, data, self.seed)
+	return data, nil
+}
+
+type aeadFrameCipher struct {
+	aead  cipher.AEAD
+	seq   uint64
+	nonce []byte
+}
+
+func newAeadFrameCipher(key []byte) (obj *aeadFrameCipher, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	obj = new(aeadFrameCipher)
+	if obj.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	obj.nonce = make([]byte, obj.aead.NonceSize())
+	return obj, nil
+}
+
+func (self *aeadFrameCipher) nextNonce() []byte {
+	binary.BigEndian.PutUint64(self.nonce[len(self.nonce)-8:], self.seq)
+	self.seq++
+	return self.nonce
+}
+
+func (self *aeadFrameCipher) sealTo(dst *bytes.Buffer, data []byte) {
+	out := getBuf(len(data) + self.aead.Overhead())
+	dst.Write(self.aead.Seal((*out)[:0], self.nextNonce(), data, nil))
+	putBuf(out)
+}
+
+func (self *aeadFrameCipher) open(data []byte) (ret []byte, err error) {
+	ret, err = self.aead.Open(data[:0], self.nextNonce(), data, nil)
+	if err != nil {
+		return nil, errFrameAuth
+	}
+	return ret, nil
+}
+
+// HKDF-SHA256，RFC 5869
+func hkdfSha256(secret []byte, salt []byte, info string, size int) (key []byte) {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var block []byte
+	for counter := byte(1); len(key) < size; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write([]byte(info))
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		key = append(key, block...)
+	}
+	return key[:size]
+}
+
+func writeHandshakeMsg(w io.Writer, msg []byte) (err error) {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err = w.Write(buf)
+	return err
+}
+
+func readHandshakeMsg(r io.Reader) (msg []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > max_handshake_msg_size {
+		return nil, errors.New(fmt.Sprintf("handshake message too large(%d)", size))
+	}
+	msg = make([]byte, size)
+	if _, err = io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 握手的一端
+type tunHandshake struct {
+	psk      []byte
+	identity ed25519.PrivateKey
+	peerKeys []ed25519.PublicKey
+	auth     uint8
+	eph      *ecdh.PrivateKey
+	th       []byte
+	peerKey  ed25519.PublicKey // verify 通过的对端公钥
+
+	compressions []Compression // proxy 提供的压缩方式，或者 agent 允许的压缩方式
+	compression  Compression   // 协商结果
+}
+
+func (self *tunHandshake) hello(compressions []Compression) (msg []byte) {
+	msg = append([]byte(handshake_magic), self.auth)
+	msg = append(msg, self.eph.PublicKey().Bytes()...)
+	msg = append(msg, uint8(len(compressions)))
+	for _, c := range compressions {
+		msg = append(msg, uint8(c))
+	}
+	return msg
+}
+
+// 解析对端的 hello，返回对端临时公钥、压缩方式列表和 hello 的长度
+func (self *tunHandshake) parseHello(msg []byte) (pub *ecdh.PublicKey, compressions []Compression, size int, err error) {
+	if len(msg) < handshake_hello_size || string(msg[:4]) != handshake_magic {
+		return nil, nil, 0, errors.New("invalid handshake hello")
+	}
+	if msg[4] != self.auth {
+		return nil, nil, 0, errors.New(fmt.Sprintf("handshake auth mismatch, local(%d), peer(%d)", self.auth, msg[4]))
+	}
+	count := int(msg[handshake_hello_size-1])
+	size = handshake_hello_size + count
+	if count > max_compressions || len(msg) < size {
+		return nil, nil, 0, errors.New("invalid handshake hello")
+	}
+	for _, c := range msg[handshake_hello_size:size] {
+		compressions = append(compressions, Compression(c))
+	}
+	if pub, err = ecdh.X25519().NewPublicKey(msg[5 : 5+handshake_key_size]); err != nil {
+		return nil, nil, 0, err
+	}
+	return pub, compressions, size, nil
+}
+
+// agent 在 proxy 提供的压缩方式中选择第一个自己也允许的
+func (self *tunHandshake) chooseCompression(offered []Compression) (err error) {
+	for _, c := range offered {
+		if !c.supported() {
+			continue
+		}
+		for _, allowed := range self.compressions {
+			if c == allowed {
+				self.compression = c
+				return nil
+			}
+		}
+	}
+	return errors.New(fmt.Sprintf("no common compression with peer, offered(%v), allowed(%v)", offered, self.compressions))
+}
+
+// proxy 检查 agent 的选择是否在自己提供的压缩方式中
+func (self *tunHandshake) checkCompression(chosen []Compression) (err error) {
+	if len(chosen) == 1 {
+		for _, c := range self.compressions {
+			if c == chosen[0] {
+				self.compression = c
+				return nil
+			}
+		}
+	}
+	return errors.New(fmt.Sprintf("invalid compression chosen by peer(%v)", chosen))
+}
+
+func (self *tunHandshake) authContent(role string) (content []byte) {
+	content = append([]byte(handshake_auth_label+role), 0)
+	return append(content, self.th...)
+}
+
+func (self *tunHandshake) sign(role string) (auth []byte) {
+	content := self.authContent(role)
+	if self.auth&handshake_auth_psk != 0 {
+		mac := hmac.New(sha256.New, self.psk)
+		mac.Write(content)
+		auth = mac.Sum(auth)
+	}
+	if self.auth&handshake_auth_ed25519 != 0 {
+		auth = append(auth, self.identity.Public().(ed25519.PublicKey)...)
+		auth = append(auth, ed25519.Sign(self.identity, content)...)
+	}
+	return auth
+}
+
+func (self *tunHandshake) verify(role string, auth []byte) (err error) {
+	content := self.authContent(role)
+	if self.auth&handshake_auth_psk != 0 {
+		mac := hmac.New(sha256.New, self.psk)
+		mac.Write(content)
+		if len(auth) < sha256.Size || !hmac.Equal(auth[:sha256.Size], mac.Sum(nil)) {
+			return ErrHandshakeAuth
+		}
+		auth = auth[sha256.Size:]
+	}
+	if self.auth&handshake_auth_ed25519 != 0 {
+		if len(auth) != ed25519.PublicKeySize+ed25519.SignatureSize {
+			return ErrHandshakeAuth
+		}
+		pub := ed25519.PublicKey(auth[:ed25519.PublicKeySize])
+		known := false
+		for _, key := range self.peerKeys {
+			if bytes.Equal(key, pub) {
+				known = true
+				break
+			}
+		}
+		if !known || !ed25519.Verify(pub, content, auth[ed25519.PublicKeySize:]) {
+			return ErrHandshakeAuth
+		}
+		self.peerKey = append(ed25519.PublicKey(nil), pub...)
+	} else if len(auth) != 0 {
+		return ErrHandshakeAuth
+	}
+	return nil
+}
+
+// 派生两个方向的帧加密
+func (self *tunHandshake) ciphers(peerPub *ecdh.PublicKey, proxy bool) (send frameCipher, recv frameCipher, err error) {
+	shared, err := self.eph.ECDH(peerPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret := append(shared, self.psk...)
+	sendKey := hkdfSha256(secret, self.th, "tnet proxy to agent", handshake_key_size)
+	recvKey := hkdfSha256(secret, self.th, "tnet agent to proxy", handshake_key_size)
+	if !proxy {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	if send, err = newAeadFrameCipher(sendKey); err != nil {
+		return nil, nil, err
+	}
+	if recv, err = newAeadFrameCipher(recvKey); err != nil {
+		return nil, nil, err
+	}
+	return send, recv, nil
+}
+
+func transcriptHash(hello1 []byte, hello2 []byte) []byte {
+	h := sha256.New()
+	h.Write(hello1)
+	h.Write(hello2)
+	return h.Sum(nil)
+}
+
+func (self *tunHandshake) runProxy(conn io.ReadWriter) (send frameCipher, recv frameCipher, err error) {
+	hello := self.hello(self.compressions)
+	if err = writeHandshakeMsg(conn, hello); err != nil {
+		return nil, nil, err
+	}
+	msg, err := readHandshakeMsg(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	peerPub, chosen, size, err := self.parseHello(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	self.th = transcriptHash(hello, msg[:size])
+	if err = self.verify(handshake_role_agent, msg[size:]); err != nil {
+		return nil, nil, err
+	}
+	if err = self.checkCompression(chosen); err != nil {
+		return nil, nil, err
+	}
+	if err = writeHandshakeMsg(conn, self.sign(handshake_role_proxy)); err != nil {
+		return nil, nil, err
+	}
+	return self.ciphers(peerPub, true)
+}
+
+func (self *tunHandshake) runAgent(conn io.ReadWriter) (send frameCipher, recv frameCipher, err error) {
+	msg, err := readHandshakeMsg(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	peerPub, offered, size, err := self.parseHello(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = self.chooseCompression(offered); err != nil {
+		return nil, nil, err
+	}
+	hello := self.hello([]Compression{self.compression})
+	self.th = transcriptHash(msg[:size], hello)
+	if err = writeHandshakeMsg(conn, append(hello, self.sign(handshake_role_agent)...)); err != nil {
+		return nil, nil, err
+	}
+	if msg, err = readHandshakeMsg(conn); err != nil {
+		return nil, nil, err
+	}
+	if err = self.verify(handshake_role_proxy, msg); err != nil {
+		return nil, nil, err
+	}
+	return self.ciphers(peerPub, false)
+}
+
+// 在 peer 连接上完成握手，得到两个方向的帧加密和压缩
+// 没有配置 PSK 和 IdentityKey 时不握手，使用旧版本的固定种子异或和 zlib 压缩
+func (self *tunLink) startHandshake() (err error) {
+	tun := self.tun
+	if tun.PSK == nil && tun.IdentityKey == nil {
+		self.sendCipher = &xorFrameCipher{xor_encrypt_seed}
+		self.recvCipher = &xorFrameCipher{xor_encrypt_seed}
+		self.compressor = newLegacyFrameCompressor()
+		return nil
+	}
+
+	hs := &tunHandshake{psk: tun.PSK, identity: tun.IdentityKey, peerKeys: tun.PeerKeys}
+	if hs.compressions, err = availableCompressions(tun.Compressions); err != nil {
+		tun.Logger.Warn("compression unavailable", tlog.Err(err))
+	}
+	if len(hs.compressions) > max_compressions {
+		hs.compressions = hs.compressions[:max_compressions]
+	}
+	if tun.PSK != nil {
+		hs.auth |= handshake_auth_psk
+	}
+	if tun.IdentityKey != nil {
+		hs.auth |= handshake_auth_ed25519
+	}
+	if hs.eph, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return err
+	}
+
+	tun.Logger.Info("handshake with peer")
+	self.rawConn.SetDeadline(time.Now().Add(handshake_timeout))
+	defer self.rawConn.SetDeadline(time.Time{})
+	if tun.mode == server_mode_proxy {
+		self.sendCipher, self.recvCipher, err = hs.runProxy(self.conn)
+	} else {
+		self.sendCipher, self.recvCipher, err = hs.runAgent(self.conn)
+	}
+	if err != nil {
+		return err
+	}
+	tun.Logger.Info("handshake done", tlog.F("compression", hs.compression))
+	self.compressor = newFrameCompressor(hs.compression)
+	self.authed = true
+	self.peerKey = hs.peerKey
+	return nil
+}
+
+// 生成 Ed25519 身份密钥，公钥配置到对端的 PeerKeys 中
+func GenerateIdentityKey() (pub ed25519.PublicKey, priv ed25519.PrivateKey, err error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
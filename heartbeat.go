@@ -0,0 +1,116 @@
+package tnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"git.tutils.com/tutils/tnet/tlog"
+	"sync/atomic"
+	"time"
+)
+
+// peer 连接的心跳，每条连接每隔 HeartbeatInterval 发送一个 cmd_ping，对端在同一条连接上原样回复 cmd_pong，用来测量 RTT
+// 收到对端的任何协议包都算作存活，超过 HeartbeatInterval * HeartbeatMisses 没有收到时关闭这条连接，
+// 上面的 stream 迁移到其他连接；最后一条连接关闭后隧道挂起等待恢复（参见 resume.go），不能恢复时 clean，Start 返回，由调用者重连
+// 心跳也能让 NAT 映射保持活跃；对端即使没有开启心跳也会回复 cmd_pong
+
+const (
+	default_heartbeat_misses = 3
+	ping_size                = 8
+)
+
+// ping = cmd:uint16 + seq:uint32 + sendTime:int64，pong 原样带回
+func packPing(sendTime time.Time) (data []byte) {
+	data = make([]byte, ping_size)
+	binary.BigEndian.PutUint64(data, uint64(sendTime.UnixNano()))
+	return data
+}
+
+func unpackPing(data []byte) (sendTime time.Time, err error) {
+	if len(data) < ping_size {
+		return time.Time{}, errors.New(fmt.Sprintf("ping packet too short(%d)", len(data)))
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), nil
+}
+
+// 各条 peer 连接最近一次心跳测量的 RTT 中最小的，还没有测量时为 0
+func (self *EncryptTunPeer) RTT() (rtt time.Duration) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	for _, link := range self.links {
+		if r := link.RTT(); r > 0 && (rtt == 0 || r < rtt) {
+			rtt = r
+		}
+	}
+	return rtt
+}
+
+// 最后一次从任意一条 peer 连接收到协议包的时间
+func (self *EncryptTunPeer) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&self.lastSeen))
+}
+
+func (self *EncryptTunPeer) handlePing(link *tunLink, seq uint32, data []byte) {
+	// 在 peer 读例程中，写入可能阻塞，不能直接回复
+	pong := append([]byte(nil), data...)
+	self.goTask(func() {
+		link.writePacket(cmd_pong, seq, pong)
+	})
+}
+
+func (self *EncryptTunPeer) handlePong(link *tunLink, seq uint32, data []byte) {
+	sendTime, err := unpackPing(data)
+	if err != nil {
+		self.Logger.Warn("unpack pong failed", tlog.Err(err))
+		return
+	}
+	rtt := time.Since(sendTime)
+	atomic.StoreInt64(&link.rtt, int64(rtt))
+	self.Metrics.Observe(MetricTunRTT, rtt)
+	self.Logger.Debug("recv pong", tlog.F("link", link.id), tlog.F("seq", seq), tlog.F("rtt", rtt))
+}
+
+// 连接加入隧道时启动，HeartbeatInterval 为 0 时不发送心跳，也不检测对端
+func (self *EncryptTunPeer) startHeartbeat(link *tunLink) {
+	if self.HeartbeatInterval <= 0 {
+		return
+	}
+	misses := self.HeartbeatMisses
+	if misses <= 0 {
+		misses = default_heartbeat_misses
+	}
+	timeout := self.HeartbeatInterval * time.Duration(misses)
+
+	self.goTask(func() {
+		ticker := time.NewTicker(self.HeartbeatInterval)
+		defer ticker.Stop()
+		var seq uint32
+		var sending int32
+		for {
+			select {
+			case <-self.quit:
+				return
+			case <-link.closed:
+				return
+			case <-ticker.C:
+			}
+			if idle := time.Since(link.LastSeen()); idle >= timeout {
+				self.Logger.Error("peer heartbeat timeout, close link", tlog.F("link", link.id), tlog.F("idle", idle), tlog.RemoteAddr(link.rawConn.RemoteAddr()))
+				link.close()
+				return
+			}
+			// 对端不读时写入会阻塞，上一个 ping 还没写完就跳过这一次，不影响超时检测
+			if !atomic.CompareAndSwapInt32(&sending, 0, 1) {
+				continue
+			}
+			seq++
+			ping := seq
+			if !self.goTask(func() {
+				link.writePacket(cmd_ping, ping, packPing(time.Now()))
+				atomic.StoreInt32(&sending, 0)
+			}) {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,518 @@
+package tnet
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"git.tutils.com/tutils/tnet/tlog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 一个隧道可以由多条 peer 连接组成，每条 stream 按 LinkPolicy 绑定到其中一条连接上发送，接收方从任意一条连接收到的数据都按 connId 分发
+// cmd_data 带有数据在 stream 中的偏移，接收方按偏移去重；发送方保留对端还没有消费（没有归还信用）的数据，最多一个窗口
+// 一条连接断开后，绑定在上面的 stream 迁移到其他连接并重发这些数据，同时通过 cmd_resume 告诉对端本端已经收到的偏移，由对端重发
+// 客户端（proxy 一端）在每条连接握手后先发送 cmd_session：第一条连接新建会话，之后通过 AddLink 增加的连接加入会话
+// 服务端所有接入的 EncryptTunPeer 需要设置同一个 Sessions，加入会话的连接才能找到所属的隧道
+
+const (
+	session_new     byte = 0
+	session_join    byte = 1
+	session_ok      byte = 2
+	session_unknown byte = 3
+
+	session_id_size = 16
+	resume_size     = 16
+)
+
+var (
+	ErrTunJoinRefused = errors.New("tnet: peer refused to join the session")
+)
+
+// 新建 stream 时选择连接的策略
+type LinkPolicy int
+
+const (
+	LinkRoundRobin  LinkPolicy = iota // 轮流使用每条连接
+	LinkLeastLoaded                   // 绑定 stream 最少的连接
+	LinkLowestRTT                     // 心跳测得 RTT 最小的连接，需要设置 HeartbeatInterval，还没有测量时轮流使用
+)
+
+// 隧道中的一条 peer 连接
+type tunLink struct {
+	id         uint32
+	tun        *EncryptTunPeer
+	conn       net.Conn // TLS 握手后为 tls.Conn
+	rawConn    net.Conn
+	writeMtx   sync.Mutex  // 保证帧的加密顺序与写入顺序一致
+	sendCipher frameCipher // 由 writeMtx 保护
+	recvCipher frameCipher // 只在读例程中使用
+	streams    int32       // 绑定在这条连接上的 stream 数，原子操作
+	lastSeen   int64       // UnixNano，原子操作
+	rtt        int64       // time.Duration，原子操作
+	closeOnce  sync.Once
+	closed     chan struct{}
+	compressor *frameCompressor  // 握手时确定，两个方向共用
+	authed     bool              // 是否通过 PSK 或者 IdentityKey 认证，没有握手的旧版本连接为 false
+	peerKey    ed25519.PublicKey // 握手认证的对端公钥，只用 PSK 认证时为 nil
+
+	// 只在读例程中使用
+	rbuf     *[]byte
+	slde     *Slde
+	sldeleft int
+}
+
+func newTunLink(tun *EncryptTunPeer, conn net.Conn) (obj *tunLink) {
+	obj = new(tunLink)
+	obj.tun = tun
+	obj.conn = conn
+	obj.rawConn = conn
+	obj.closed = make(chan struct{})
+	obj.rbuf = getBuf(max_tcp_read)
+	obj.slde = NewSlde()
+	obj.sldeleft = SLDE_HEADER_SIZE
+	return obj
+}
+
+// 完成 TLS 握手和隧道握手，失败时关闭连接
+func (self *tunLink) setup() (err error) {
+	if self.tun.TLSConfig != nil {
+		if err = self.startTLS(); err != nil {
+			self.release()
+			return err
+		}
+	}
+	if err = self.startHandshake(); err != nil {
+		self.tun.Logger.Error("handshake with peer failed", tlog.RemoteAddr(self.rawConn.RemoteAddr()), tlog.Err(err))
+		self.release()
+		return err
+	}
+	return nil
+}
+
+// 在连接上完成 TLS 握手
+func (self *tunLink) startTLS() (err error) {
+	rawConn := self.rawConn
+	var tlsConn *tls.Conn
+	if self.tun.mode == server_mode_proxy {
+		tlsConn = tls.Client(rawConn, tlsClientConfig(self.tun.TLSConfig, rawConn.RemoteAddr().String()))
+	} else {
+		tlsConn = tls.Server(rawConn, self.tun.TLSConfig)
+	}
+	self.tun.Logger.Info("TLS handshake with peer", tlog.RemoteAddr(rawConn.RemoteAddr()))
+	err = tlsHandshake(tlsConn, rawConn, 0)
+	if err != nil {
+		self.tun.Logger.Error("TLS handshake with peer failed", tlog.RemoteAddr(rawConn.RemoteAddr()), tlog.Err(err))
+		return err
+	}
+	self.conn = tlsConn
+	return nil
+}
+
+func (self *tunLink) close() {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+		self.rawConn.Close()
+	})
+}
+
+func (self *tunLink) isClosed() bool {
+	select {
+	case <-self.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// 关闭连接并释放读缓冲区，只能在读例程中或者读例程启动前调用
+func (self *tunLink) release() {
+	self.close()
+	self.slde.Release()
+	putBuf(self.rbuf)
+}
+
+func (self *tunLink) touch() {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&self.lastSeen, now)
+	atomic.StoreInt64(&self.tun.lastSeen, now)
+}
+
+func (self *tunLink) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&self.lastSeen))
+}
+
+func (self *tunLink) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&self.rtt))
+}
+
+// 压缩、加密后写入连接，多个例程会同时调用，出错时关闭连接，由读例程完成迁移
+func (self *tunLink) writeFrame(payload *bytes.Buffer) (err error) {
+	// 压缩可以并发进行，加密需要按写入顺序
+	compressed := getBuffer()
+	self.compressor.compressTo(compressed, payload.Bytes())
+
+	frame := getBuffer()
+	self.writeMtx.Lock()
+	sealSldeTo(frame, compressed.Bytes(), self.sendCipher)
+	_, err = self.conn.Write(frame.Bytes())
+	self.writeMtx.Unlock()
+	putBuffer(frame)
+	putBuffer(compressed)
+	if err != nil {
+		self.tun.Logger.Debug("link write failed", tlog.F("link", self.id), tlog.Err(err))
+		self.close()
+	}
+	return err
+}
+
+// 编码协议包并写入连接，一个协议包只调用一次 Write
+func (self *tunLink) writePacket(cmd uint16, connId uint32, data []byte) (err error) {
+	payload := getBuffer()
+	defer putBuffer(payload)
+	packPacket(payload, cmd, connId, data)
+	return self.writeFrame(payload)
+}
+
+func (self *tunLink) writeData(connId uint32, offset uint64, data []byte) (err error) {
+	payload := getBuffer()
+	defer putBuffer(payload)
+	packDataPacket(payload, connId, offset, data)
+	return self.writeFrame(payload)
+}
+
+// 读取并解密一个完整的协议包，返回的数据在下一次调用前有效
+func (self *tunLink) readPacket() (data []byte, err error) {
+	buf := *self.rbuf
+	for {
+		n, err0 := self.conn.Read(buf[:self.sldeleft])
+		if n > 0 {
+			if self.sldeleft, err = self.slde.WriteAndGetNextToWrite(buf[:n]); err != nil {
+				return nil, err
+			}
+			if self.sldeleft == 0 {
+				data, err = self.slde.open(self.recvCipher, self.compressor)
+				self.slde.Reset()
+				self.sldeleft = SLDE_HEADER_SIZE
+				return data, err
+			} else if self.sldeleft > max_tcp_read {
+				self.sldeleft = max_tcp_read
+			}
+		}
+		if err0 != nil {
+			return nil, err0
+		}
+	}
+}
+
+// 连接的读例程，连接断开后从隧道中移除
+func (self *tunLink) readLoop() {
+	self.tun.Logger.Info("start link handler", tlog.F("link", self.id), tlog.RemoteAddr(self.rawConn.RemoteAddr()))
+	for {
+		data, err := self.readPacket()
+		if err != nil {
+			self.tun.Logger.Info("link read failed", tlog.F("link", self.id), tlog.Err(err))
+			break
+		}
+		self.tun.handlePeerPacket(self, data)
+	}
+	self.release()
+	self.tun.Logger.Info("stop link handler", tlog.F("link", self.id))
+	self.tun.removeLink(self)
+}
+
+// 服务端的会话表，同一个监听端口接入的所有 EncryptTunPeer 共用一个，客户端通过 AddLink 增加的连接据此找到所属的隧道
+type TunSessionTable struct {
+	sessions sync.Map // map[string]*EncryptTunPeer
+}
+
+func NewTunSessionTable() (obj *TunSessionTable) {
+	return new(TunSessionTable)
+}
+
+func (self *TunSessionTable) add(id []byte, tun *EncryptTunPeer) {
+	self.sessions.Store(string(id), tun)
+}
+
+func (self *TunSessionTable) get(id []byte) (tun *EncryptTunPeer) {
+	if v, ok := self.sessions.Load(string(id)); ok {
+		return v.(*EncryptTunPeer)
+	}
+	return nil
+}
+
+func (self *TunSessionTable) remove(id []byte, tun *EncryptTunPeer) {
+	if v, ok := self.sessions.Load(string(id)); ok && v.(*EncryptTunPeer) == tun {
+		self.sessions.Delete(string(id))
+	}
+}
+
+// session = cmd:uint16 + 0:uint32 + op:uint8 + sessionId:string(16)，服务端回复的 session_ok 和 session_unknown 不带 sessionId
+func packSession(op byte, id []byte) (data []byte) {
+	data = make([]byte, 1, 1+len(id))
+	data[0] = op
+	return append(data, id...)
+}
+
+func unpackSession(data []byte) (op byte, id []byte, err error) {
+	if len(data) < 1 {
+		return 0, nil, errors.New("session packet too short")
+	}
+	op = data[0]
+	if (op == session_new || op == session_join) && len(data) < 1+session_id_size {
+		return 0, nil, errors.New(fmt.Sprintf("session packet too short(%d)", len(data)))
+	}
+	return op, data[1:], nil
+}
+
+// resume = cmd:uint16 + connId:uint32 + recvOff:uint64 + returned:uint64
+// recvOff 为本端已经收到的偏移，对端从这里开始重发；returned 为本端已经归还的信用，用来补上丢失的 cmd_window_update
+func packResume(recvOff uint64, returned uint64) (data []byte) {
+	data = make([]byte, resume_size)
+	binary.BigEndian.PutUint64(data, recvOff)
+	binary.BigEndian.PutUint64(data[8:], returned)
+	return data
+}
+
+func unpackResume(data []byte) (recvOff uint64, returned uint64, err error) {
+	if len(data) < resume_size {
+		return 0, 0, errors.New(fmt.Sprintf("resume packet too short(%d)", len(data)))
+	}
+	return binary.BigEndian.Uint64(data), binary.BigEndian.Uint64(data[8:]), nil
+}
+
+// 握手后协商会话：客户端发送 session_new；服务端读取第一个协议包，
+// 是 session_join 时把连接交给所属的隧道，joined 为 true，不是 cmd_session 时（旧版本的客户端）返回这个协议包 first 留给读例程处理
+func (self *EncryptTunPeer) startSession(link *tunLink) (first []byte, joined bool, err error) {
+	if self.mode == server_mode_proxy {
+		self.sessionId = make([]byte, session_id_size)
+		if _, err = rand.Read(self.sessionId); err != nil {
+			link.release()
+			return nil, false, err
+		}
+		if err = link.writePacket(cmd_session, 0, packSession(session_new, self.sessionId)); err != nil {
+			link.release()
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+
+	if first, err = link.readPacket(); err != nil {
+		self.Logger.Info("peer read failed", tlog.Err(err))
+		link.release()
+		return nil, false, err
+	}
+	cmd, _, left, err := unpackPacket(first)
+	if err != nil || cmd != cmd_session {
+		return first, false, nil
+	}
+	op, id, err := unpackSession(left)
+	if err != nil {
+		link.release()
+		return nil, false, err
+	}
+	switch op {
+	case session_new:
+		self.sessionId = append([]byte(nil), id...)
+		// 没有认证的连接上 sessionId 相当于明文，不能用来加入会话
+		if self.Sessions != nil && link.authed {
+			self.peerKey = link.peerKey
+			self.Sessions.add(self.sessionId, self)
+		}
+		return nil, false, nil
+	case session_join:
+		return nil, true, self.joinSession(link, id)
+	default:
+		link.release()
+		return nil, false, errors.New(fmt.Sprintf("unexpected session op(%d)", op))
+	}
+}
+
+// 服务端把加入会话的连接交给所属的隧道
+// 连接需要通过握手认证，并且与会话的第一条连接是同一个对端身份，只知道 sessionId 不能加入
+func (self *EncryptTunPeer) joinSession(link *tunLink, id []byte) (err error) {
+	var tun *EncryptTunPeer
+	if self.Sessions != nil && link.authed {
+		tun = self.Sessions.get(id)
+	}
+	if tun != nil && !bytes.Equal(tun.peerKey, link.peerKey) {
+		self.Logger.Warn("join session with another identity", tlog.RemoteAddr(link.rawConn.RemoteAddr()))
+		tun = nil
+	}
+	if tun == nil {
+		self.Logger.Warn("join unknown session", tlog.RemoteAddr(link.rawConn.RemoteAddr()))
+		link.writePacket(cmd_session, 0, packSession(session_unknown, nil))
+		link.release()
+		return ErrTunJoinRefused
+	}
+	if err = link.writePacket(cmd_session, 0, packSession(session_ok, nil)); err != nil {
+		link.release()
+		return err
+	}
+	self.Logger.Info("link joined session", tlog.RemoteAddr(link.rawConn.RemoteAddr()))
+	return tun.attachLink(link, nil)
+}
+
+// 客户端增加一条 peer 连接，conn 上的握手与 Start 相同，之后加入会话，Start 完成握手前会阻塞
+// 连接断开或者通过 RemoveLink 移除后，上面的 stream 迁移到其他连接
+func (self *EncryptTunPeer) AddLink(conn net.Conn) (err error) {
+	if self.mode != server_mode_proxy {
+		conn.Close()
+		return errors.New("tnet: only the client side can add links")
+	}
+	select {
+	case <-self.ready:
+	case <-self.quit:
+		conn.Close()
+		return ErrConnClosed
+	}
+
+	link := newTunLink(self, conn)
+	if err = link.setup(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(handshake_timeout))
+	var reply []byte
+	if err = link.writePacket(cmd_session, 0, packSession(session_join, self.sessionId)); err == nil {
+		reply, err = link.readPacket()
+	}
+	if err == nil {
+		cmd, _, left, err0 := unpackPacket(reply)
+		if err0 != nil || cmd != cmd_session || len(left) < 1 || left[0] != session_ok {
+			err = ErrTunJoinRefused
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		self.Logger.Error("join session failed", tlog.RemoteAddr(conn.RemoteAddr()), tlog.Err(err))
+		link.release()
+		return err
+	}
+	return self.attachLink(link, nil)
+}
+
+// 关闭 conn 对应的 peer 连接，上面的 stream 迁移到其他连接，最后一条连接移除后隧道关闭或者挂起，参见 ResumeTimeout
+func (self *EncryptTunPeer) RemoveLink(conn net.Conn) (err error) {
+	self.mtx.Lock()
+	var link *tunLink
+	for _, l := range self.links {
+		if l.rawConn == conn {
+			link = l
+			break
+		}
+	}
+	self.mtx.Unlock()
+	if link == nil {
+		return errors.New("tnet: link not found")
+	}
+	link.close()
+	return nil
+}
+
+// 当前的 peer 连接数
+func (self *EncryptTunPeer) LinkCount() int {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	return len(self.links)
+}
+
+// 把握手完成的连接加入隧道并启动读例程，first 为握手后已经读出的第一个协议包
+func (self *EncryptTunPeer) attachLink(link *tunLink, first []byte) (err error) {
+	self.mtx.Lock()
+	select {
+	case <-self.quit:
+		self.mtx.Unlock()
+		link.release()
+		return ErrConnClosed
+	default:
+	}
+	self.linkSeq++
+	link.id = self.linkSeq
+	link.tun = self
+	self.links = append(self.links, link)
+	count := len(self.links)
+	resumed := self.stopSuspend()
+	self.mtx.Unlock()
+
+	self.Logger.Info("link attached", tlog.F("link", link.id), tlog.RemoteAddr(link.rawConn.RemoteAddr()), tlog.F("links", count))
+	link.touch()
+	if first != nil {
+		self.handlePeerPacket(link, first)
+	}
+	self.startHeartbeat(link)
+	go link.readLoop()
+	if resumed {
+		self.Logger.Info("session resumed", tlog.F("link", link.id))
+		self.goTask(self.migrateStreams)
+	}
+	return nil
+}
+
+// 连接断开，绑定在上面的 stream 迁移到其他连接，没有其他连接时挂起会话等待恢复，参见 resume.go
+func (self *EncryptTunPeer) removeLink(link *tunLink) {
+	self.mtx.Lock()
+	for i, l := range self.links {
+		if l == link {
+			self.links = append(self.links[:i], self.links[i+1:]...)
+			break
+		}
+	}
+	count := len(self.links)
+	self.mtx.Unlock()
+
+	if count == 0 {
+		if !self.suspend() {
+			self.clean()
+		}
+		return
+	}
+	select {
+	case <-self.quit:
+		return
+	default:
+	}
+	self.Logger.Warn("link lost, migrate streams", tlog.F("link", link.id), tlog.F("links", count))
+	self.migrateStreams()
+}
+
+func (self *EncryptTunPeer) migrateStreams() {
+	self.streams.Range(func(k, v interface{}) bool {
+		v.(*tunStream).migrate()
+		return true
+	})
+}
+
+// 按 LinkPolicy 选择一条连接，没有可用的连接时返回 nil
+func (self *EncryptTunPeer) pickLink() (link *tunLink) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if len(self.links) == 0 {
+		return nil
+	}
+	switch self.LinkPolicy {
+	case LinkLeastLoaded:
+		for _, l := range self.links {
+			if link == nil || atomic.LoadInt32(&l.streams) < atomic.LoadInt32(&link.streams) {
+				link = l
+			}
+		}
+		return link
+	case LinkLowestRTT:
+		for _, l := range self.links {
+			if rtt := l.RTT(); rtt > 0 && (link == nil || rtt < link.RTT()) {
+				link = l
+			}
+		}
+		if link != nil {
+			return link
+		}
+	}
+	self.linkRR++
+	return self.links[self.linkRR%uint32(len(self.links))]
+}
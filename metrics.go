@@ -0,0 +1,303 @@
+package tnet
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TcpServer、TcpClient、UdpPeer 上报的指标名
+const (
+	MetricConnsAccepted     = "tnet_conns_accepted_total"         // 接入的连接数
+	MetricConnsRejected     = "tnet_conns_rejected_total"         // 被连接限制拒绝的连接数，标签 reason
+	MetricConnsClosed       = "tnet_conns_closed_total"           // 关闭的连接数
+	MetricConnsActive       = "tnet_conns_active"                 // 当前连接数
+	MetricTLSHandshakeFails = "tnet_tls_handshake_failures_total" // TLS 握手失败次数
+	MetricDials             = "tnet_dials_total"                  // 客户端发起连接的次数
+	MetricDialFails         = "tnet_dial_failures_total"          // 客户端连接失败的次数
+	MetricBytesIn           = "tnet_bytes_in_total"               // 收到的字节数
+	MetricBytesOut          = "tnet_bytes_out_total"              // 发出的字节数
+	MetricPacketsIn         = "tnet_packets_in_total"             // UDP 收到的包数
+	MetricPacketsOut        = "tnet_packets_out_total"            // UDP 发出的包数
+	MetricSessionsActive    = "tnet_udp_sessions_active"          // 当前 UDP 会话数
+	MetricSessionsExpired   = "tnet_udp_sessions_expired_total"   // 过期的 UDP 会话数
+	MetricGoroutines        = "tnet_goroutines"                   // 读写例程数
+	MetricCallbackDuration  = "tnet_callback_duration_seconds"    // 回调耗时，标签 callback
+)
+
+// EncryptTunPeer 上报的指标名
+// stream 的目标地址由对端决定，取值没有上限，因此不作为标签，需要按目标统计时由调用方自行汇总
+const (
+	MetricTunBytesIn         = "tnet_tun_bytes_in_total"           // stream 从对端收到并被读走的字节数
+	MetricTunBytesOut        = "tnet_tun_bytes_out_total"          // stream 发往对端的字节数
+	MetricTunStreamsOpened   = "tnet_tun_streams_opened_total"     // 本端打开和接受的 stream 数
+	MetricTunStreamsClosed   = "tnet_tun_streams_closed_total"     // 关闭的 stream 数
+	MetricTunStreamsActive   = "tnet_tun_streams_active"           // 当前 stream 数
+	MetricTunStreamDuration  = "tnet_tun_stream_duration_seconds"  // stream 从打开到关闭的时间
+	MetricTunDialFails       = "tnet_tun_dial_failures_total"      // 本端替对端连接目标失败的次数，标签 reason
+	MetricTunConnectDuration = "tnet_tun_connect_duration_seconds" // DialStream 从发出请求到对端连接上目标的耗时
+	MetricTunRTT             = "tnet_tun_rtt_seconds"              // 心跳测得的 RTT
+)
+
+const (
+	metric_label_callback   = "callback"
+	metric_label_reason     = "reason"
+	max_cached_labels       = 4 // 最多两对标签的指标按原始标签缓存，不用每次都格式化
+	prometheus_content_type = "text/plain; version=0.0.4; charset=utf-8"
+	prometheus_default_path = "/metrics"
+)
+
+var prometheusLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 指标钩子，labels 为 key, value 交替排列的标签，实现需要保证可以被多个例程并发调用
+type Metrics interface {
+	// 计数器增加 delta
+	AddCounter(name string, delta int64, labels ...string)
+
+	// 当前值增加 delta，delta 可以为负数
+	AddGauge(name string, delta int64, labels ...string)
+
+	// 记录一次耗时
+	Observe(name string, d time.Duration, labels ...string)
+}
+
+type nopMetrics struct{}
+
+// 默认的指标钩子，不做任何事
+func NewNopMetrics() (obj Metrics) {
+	return nopMetrics{}
+}
+
+func (self nopMetrics) AddCounter(name string, delta int64, labels ...string)  {}
+func (self nopMetrics) AddGauge(name string, delta int64, labels ...string)    {}
+func (self nopMetrics) Observe(name string, d time.Duration, labels ...string) {}
+
+// 记录从 start 到现在的回调耗时
+func observeCallback(metrics Metrics, callback string, start time.Time) {
+	metrics.Observe(MetricCallbackDuration, time.Since(start), metric_label_callback, callback)
+}
+
+// 指标名和原始标签，用作缓存的 key
+type prometheusKey struct {
+	name   string
+	n      int
+	labels [max_cached_labels]string
+}
+
+// 标签太多时返回 false，不缓存
+func newPrometheusKey(name string, labels []string) (key prometheusKey, ok bool) {
+	if len(labels) > max_cached_labels {
+		return key, false
+	}
+	key.name = name
+	key.n = copy(key.labels[:], labels)
+	return key, true
+}
+
+type prometheusSeries struct {
+	kind   string
+	name   string
+	labels string
+	value  int64 // counter/gauge 的值，summary 的次数
+	sum    int64 // summary 的总耗时（纳秒）
+}
+
+// 以 Prometheus 文本格式导出指标
+// 每个 TcpServer/TcpClient/UdpPeer 通过 With 取得带有固定标签的 Metrics，然后由 ServeHTTP 统一导出
+type PrometheusExporter struct {
+	mtx    sync.RWMutex
+	series map[string]*prometheusSeries        // 按格式化后的标签索引
+	cache  map[prometheusKey]*prometheusSeries // 按原始标签索引
+	server *http.Server
+}
+
+func NewPrometheusExporter() (obj *PrometheusExporter) {
+	obj = new(PrometheusExporter)
+	obj.series = make(map[string]*prometheusSeries)
+	obj.cache = make(map[prometheusKey]*prometheusSeries)
+	return obj
+}
+
+// 返回一个 Metrics，它上报的每个指标都带上 labels，例如 With("server", "tun")
+func (self *PrometheusExporter) With(labels ...string) (obj Metrics) {
+	return &prometheusMetrics{exporter: self, labels: labels, cache: make(map[prometheusKey]*prometheusSeries)}
+}
+
+func (self *PrometheusExporter) AddCounter(name string, delta int64, labels ...string) {
+	atomic.AddInt64(&self.load("counter", name, labels).value, delta)
+}
+
+func (self *PrometheusExporter) AddGauge(name string, delta int64, labels ...string) {
+	atomic.AddInt64(&self.load("gauge", name, labels).value, delta)
+}
+
+func (self *PrometheusExporter) Observe(name string, d time.Duration, labels ...string) {
+	series := self.load("summary", name, labels)
+	atomic.AddInt64(&series.value, 1)
+	atomic.AddInt64(&series.sum, int64(d))
+}
+
+func (self *PrometheusExporter) load(kind string, name string, labels []string) (series *prometheusSeries) {
+	cacheKey, cached := newPrometheusKey(name, labels)
+	if cached {
+		self.mtx.RLock()
+		series, ok := self.cache[cacheKey]
+		self.mtx.RUnlock()
+		if ok {
+			return series
+		}
+	}
+
+	formatted := formatPrometheusLabels(labels)
+	key := name + formatted
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	series, ok := self.series[key]
+	if !ok {
+		series = &prometheusSeries{kind: kind, name: name, labels: formatted}
+		self.series[key] = series
+	}
+	if cached {
+		self.cache[cacheKey] = series
+	}
+	return series
+}
+
+// 按标签名排序后格式化成 {k1="v1",k2="v2"}
+func formatPrometheusLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+prometheusLabelReplacer.Replace(labels[i+1])+`"`)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// 按 Prometheus 文本格式写出所有指标
+func (self *PrometheusExporter) Export(buf *bytes.Buffer) {
+	self.mtx.RLock()
+	all := make([]*prometheusSeries, 0, len(self.series))
+	for _, series := range self.series {
+		all = append(all, series)
+	}
+	self.mtx.RUnlock()
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		return all[i].labels < all[j].labels
+	})
+
+	lastName := ""
+	for _, series := range all {
+		if series.name != lastName {
+			fmt.Fprintf(buf, "# TYPE %s %s\n", series.name, series.kind)
+			lastName = series.name
+		}
+		value := atomic.LoadInt64(&series.value)
+		if series.kind == "summary" {
+			sum := time.Duration(atomic.LoadInt64(&series.sum))
+			fmt.Fprintf(buf, "%s_sum%s %g\n", series.name, series.labels, sum.Seconds())
+			fmt.Fprintf(buf, "%s_count%s %d\n", series.name, series.labels, value)
+		} else {
+			fmt.Fprintf(buf, "%s%s %d\n", series.name, series.labels, value)
+		}
+	}
+
+	fmt.Fprintf(buf, "# TYPE go_goroutines gauge\ngo_goroutines %d\n", runtime.NumGoroutine())
+}
+
+func (self *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := bytes.NewBuffer(make([]byte, 0, bytes.MinRead))
+	self.Export(buf)
+	w.Header().Set("Content-Type", prometheus_content_type)
+	w.Write(buf.Bytes())
+}
+
+// 在 addr 上启动 HTTP 服务，通过 /metrics 导出指标，阻塞直到 Close
+func (self *PrometheusExporter) ListenAndServe(addr string) (err error) {
+	mux := http.NewServeMux()
+	mux.Handle(prometheus_default_path, self)
+	lstn, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	self.mtx.Lock()
+	self.server = &http.Server{Handler: mux}
+	server := self.server
+	self.mtx.Unlock()
+	err = server.Serve(lstn)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (self *PrometheusExporter) Close() (err error) {
+	self.mtx.RLock()
+	server := self.server
+	self.mtx.RUnlock()
+	if server == nil {
+		return nil
+	}
+	return server.Close()
+}
+
+// 带有固定标签的 Metrics
+type prometheusMetrics struct {
+	exporter *PrometheusExporter
+	labels   []string
+	mtx      sync.RWMutex
+	cache    map[prometheusKey]*prometheusSeries // 按额外标签索引，避免每次都拼接和格式化标签
+}
+
+func (self *prometheusMetrics) load(kind string, name string, labels []string) (series *prometheusSeries) {
+	key, cached := newPrometheusKey(name, labels)
+	if !cached {
+		return self.exporter.load(kind, name, self.join(labels))
+	}
+	self.mtx.RLock()
+	series, ok := self.cache[key]
+	self.mtx.RUnlock()
+	if ok {
+		return series
+	}
+	series = self.exporter.load(kind, name, self.join(labels))
+	self.mtx.Lock()
+	self.cache[key] = series
+	self.mtx.Unlock()
+	return series
+}
+
+func (self *prometheusMetrics) join(labels []string) []string {
+	if len(labels) == 0 {
+		return self.labels
+	}
+	all := make([]string, 0, len(self.labels)+len(labels))
+	all = append(all, self.labels...)
+	return append(all, labels...)
+}
+
+func (self *prometheusMetrics) AddCounter(name string, delta int64, labels ...string) {
+	atomic.AddInt64(&self.load("counter", name, labels).value, delta)
+}
+
+func (self *prometheusMetrics) AddGauge(name string, delta int64, labels ...string) {
+	atomic.AddInt64(&self.load("gauge", name, labels).value, delta)
+}
+
+func (self *prometheusMetrics) Observe(name string, d time.Duration, labels ...string) {
+	series := self.load("summary", name, labels)
+	atomic.AddInt64(&series.value, 1)
+	atomic.AddInt64(&series.sum, int64(d))
+}
@@ -0,0 +1,148 @@
+package tnet
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportMetrics(exporter *PrometheusExporter) string {
+	var buf bytes.Buffer
+	exporter.Export(&buf)
+	return buf.String()
+}
+
+func TestPrometheusExporterExport(t *testing.T) {
+	exporter := NewPrometheusExporter()
+	exporter.AddCounter(MetricDials, 2)
+	exporter.AddCounter(MetricDials, 1)
+	exporter.AddGauge(MetricConnsActive, 3)
+	exporter.AddGauge(MetricConnsActive, -1)
+	exporter.Observe(MetricCallbackDuration, 1500*time.Millisecond, metric_label_callback, "dial")
+	exporter.Observe(MetricCallbackDuration, 500*time.Millisecond, metric_label_callback, "dial")
+	// 标签按名字排序，值中的特殊字符需要转义
+	exporter.AddCounter(MetricConnsRejected, 1, "z", "1", "a", "x\"y\\z\n")
+	svr := exporter.With("server", "tun")
+	svr.AddCounter(MetricBytesIn, 10)
+	svr.AddCounter(MetricBytesIn, 5)
+	svr.AddCounter(MetricConnsRejected, 1, metric_label_reason, "limit")
+	svr.AddCounter(MetricConnsRejected, 1, metric_label_reason, "limit")
+	// 标签超过缓存上限时每次都格式化，仍然累加到同一个指标
+	for i := 0; i < 2; i++ {
+		exporter.AddCounter(MetricDialFails, 1, "c", "3", "b", "2", "a", "1")
+	}
+
+	want := strings.Join([]string{
+		"# TYPE tnet_bytes_in_total counter",
+		`tnet_bytes_in_total{server="tun"} 15`,
+		"# TYPE tnet_callback_duration_seconds summary",
+		`tnet_callback_duration_seconds_sum{callback="dial"} 2`,
+		`tnet_callback_duration_seconds_count{callback="dial"} 2`,
+		"# TYPE tnet_conns_active gauge",
+		"tnet_conns_active 2",
+		"# TYPE tnet_conns_rejected_total counter",
+		`tnet_conns_rejected_total{a="x\"y\\z\n",z="1"} 1`,
+		`tnet_conns_rejected_total{reason="limit",server="tun"} 2`,
+		"# TYPE tnet_dial_failures_total counter",
+		`tnet_dial_failures_total{a="1",b="2",c="3"} 2`,
+		"# TYPE tnet_dials_total counter",
+		"tnet_dials_total 3",
+		"# TYPE go_goroutines gauge",
+	}, "\n")
+	if got := exportMetrics(exporter); !strings.HasPrefix(got, want) {
+		t.Fatalf("got:\n%s\nwant prefix:\n%s", got, want)
+	}
+}
+
+// OnDialCallback 自己处理连接（readSize 为 0）时，回调关闭 conn 后当前连接数回到 0
+func TestTcpClientMetrics(t *testing.T) {
+	lstn := NewPipeListener("metrics")
+	defer lstn.Close()
+	go func() {
+		for {
+			conn, err := lstn.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	exporter := NewPrometheusExporter()
+	clt := NewTcpClient()
+	clt.Addr = "metrics"
+	clt.Dialer = lstn.DialContext
+	clt.Metrics = exporter
+	dials := 0
+	clt.OnDialCallback = func(self *TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{}) {
+		dials++
+		conn.Close()
+		return dials < 3, 0, nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- clt.Start()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		clt.Close()
+		t.Fatal("client did not stop")
+	}
+
+	got := exportMetrics(exporter)
+	for _, line := range []string{
+		MetricConnsAccepted + " 3\n",
+		MetricConnsClosed + " 3\n",
+		MetricConnsActive + " 0\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Fatalf("missing %q in:\n%s", line, got)
+		}
+	}
+}
+
+// ReadSize 为 0 的连接属于回调，回调返回后仍然可用，由调用者关闭时更新指标
+func TestTcpClientOwnedConn(t *testing.T) {
+	lstn := NewPipeListener("owned")
+	defer lstn.Close()
+	go echoAccept(lstn)
+
+	exporter := NewPrometheusExporter()
+	clt := NewTcpClient()
+	clt.Addr = "owned"
+	clt.Dialer = lstn.DialContext
+	clt.Metrics = exporter
+	owned := make(chan net.Conn, 1)
+	clt.OnDialCallback = func(self *TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{}) {
+		select {
+		case owned <- conn:
+			return true, 0, nil
+		default:
+			return false, 0, nil
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- clt.Start()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		clt.Close()
+		t.Fatal("client did not stop")
+	}
+
+	conn := <-owned
+	checkEcho(t, conn, "hello")
+	if got := exportMetrics(exporter); !strings.Contains(got, MetricConnsActive+" 1\n") {
+		t.Fatalf("owned conn should be active:\n%s", got)
+	}
+	conn.Close()
+	conn.Close()
+	if got := exportMetrics(exporter); !strings.Contains(got, MetricConnsActive+" 0\n") || !strings.Contains(got, MetricConnsClosed+" 2\n") {
+		t.Fatalf("closing the owned conn should update metrics:\n%s", got)
+	}
+}
@@ -1,22 +1,27 @@
 package tnet
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"log"
+	"git.tutils.com/tutils/tnet/tlog"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	read_buf_size int = 0xffff
+	read_buf_size       int    = 0xffff
+	default_network     string = "tcp"
+	default_udp_network string = "udp"
 )
 
-type TCPConnEx struct {
-	net.TCPConn
-	ReadSize int
-	Ext      interface{}
-}
+var (
+	// Shutdown 或 Close 之后 Start 返回该错误
+	ErrServerClosed = errors.New("tnet: server closed")
+)
 
 type TcpServer struct {
 	Addr        string
@@ -25,22 +30,99 @@ type TcpServer struct {
 	ReadBufSize int
 	Ext         interface{}
 
+	// 监听的网络类型，默认为 "tcp"，也可以是 "tcp4"、"tcp6"、"unix" 等 net.Listen 支持的类型
+	Network string
+
+	// 为 true 且 Network 为 "tcp"、Addr 为通配地址（例如 ":80"、"0.0.0.0:80"、"[::]:80"）时，
+	// 分别在 IPv4 和 IPv6 上监听，其中一个地址族不可用时只监听另一个
+	DualStack bool
+
+	// 不为 nil 时直接从它接入连接，忽略 Network 和 Addr，例如自定义的 Listener 或者测试用的 tnet.NewPipeListener
+	// Start 返回时会关闭它
+	Listener net.Listener
+
+	// 发送队列设置，参见 TCPConnEx.Send
+	SendQueueSize   int
+	SendQueuePolicy SendQueuePolicy
+	WriteTimeout    time.Duration // 每次写操作的超时时间，0 表示不超时
+
+	// 超时设置，0 表示不超时，超时后调用 OnTimeoutCallback
+	ReadTimeout     time.Duration // 单次读操作的超时时间
+	IdleTimeout     time.Duration // 连接没有任何读写的最长时间
+	KeepAlivePeriod time.Duration // TCP keepalive 探测间隔，0 使用系统默认，< 0 关闭 keepalive，只对 TCP 连接生效
+
+	// 不为 nil 时在连接上启用 TLS，握手完成后才会调用连接回调
+	TLSConfig           *tls.Config
+	TLSHandshakeTimeout time.Duration // 0 表示使用默认的 10s
+
+	// 不为 nil 时为每个连接创建一个 FrameCodec，读例程按帧解码后调用 OnHandleMessageCallback，
+	// 这时 ReadSize 由读例程管理，不会再调用 OnHandleConnDataCallback，例如 tnet.NewSldeCodec
+	FrameCodecFactory func() FrameCodec
+
+	// 连接限制，0 表示不限制，超过限制时调用 OnRejectConnCallback
+	MaxConns      int     // 最大并发连接数
+	MaxConnsPerIP int     // 单个来源 IP 的最大并发连接数
+	AcceptRate    float64 // 每秒最多接入的连接数
+	AcceptBurst   int     // 接入速率的突发容量，0 表示与 AcceptRate 相同
+
+	// 日志，默认不输出
+	Logger tlog.Logger
+
+	// 指标钩子，默认不上报，例如 tnet.NewPrometheusExporter().With("server", "tun")
+	Metrics Metrics
+
+	lstn    net.Listener
+	lstnMtx sync.Mutex
+	closing int32
+	quit    chan struct{}
+
+	// 依次完成接入，启用 TLS 时握手在各自的例程中进行，OnAcceptConnCallback 仍然依次调用
+	acceptMtx  sync.Mutex
+	lastConnId uint32 // 由 acceptMtx 保护
+
+	// 登记连接与 Shutdown 遍历连接互斥，登记成功的连接一定会被 Shutdown 通知退出，connWg.Add 不会与 Wait 并发
+	connsMtx    sync.Mutex
+	handshaking map[net.Conn]struct{} // 正在 TLS 握手的连接，由 connsMtx 保护
+
+	acceptBucket *tokenBucket
+	limitMtx     sync.Mutex
+	limitCond    *sync.Cond
+	connCount    int
+	ipConnCount  map[string]int
+
 	// Listener 监听成功后调用，如果返回 false 则服务器会退出
-	// func(self *tnet.TcpServer, lstn *net.TCPListener) (ok bool) {}
-	OnListenSuccCallback func(self *TcpServer, lstn *net.TCPListener) (ok bool)
+	// func(self *tnet.TcpServer, lstn net.Listener) (ok bool) {}
+	OnListenSuccCallback func(self *TcpServer, lstn net.Listener) (ok bool)
 
 	// 有新连接接入后调用，返回值意义如下：
+	// 启用 TLS 时 conn 是底层的连接，已经完成握手，不能直接读写，应使用 TCPConnEx
 	// ok: 如果为 false 该连接将会关闭
 	// ReadSize: conn 希望连接读取的字节数，如果设置为0，则不会提供一个 self.connReadHandler 例程来读取数据，也就是说可以在 OnAcceptConnCallback 中自定义处理例程
+	// ReadSize 为 0 时由回调负责关闭 conn，关闭后释放 MaxConns、MaxConnsPerIP 的计数；conn 是包装过的连接，不能断言为 *net.TCPConn
 	// connExt: 为 conn 扩展的字段，将会传递到 TCPConnEx 结构中
-	// func(self *tnet.TcpServer, conn *net.TCPConn, connId uint32) (ok bool, readSize int, connExt interface{}) {}
-	OnAcceptConnCallback func(self *TcpServer, conn *net.TCPConn, connId uint32) (ok bool, readSize int, connExt interface{})
+	// func(self *tnet.TcpServer, conn net.Conn, connId uint32) (ok bool, readSize int, connExt interface{}) {}
+	OnAcceptConnCallback func(self *TcpServer, conn net.Conn, connId uint32) (ok bool, readSize int, connExt interface{})
+
+	// 新连接超过连接限制或接入速率限制时调用，reason 为超过的限制
+	// 返回值 wait 为 true 将阻塞接入例程排队等待，直到满足限制后继续接入该连接，为 false 或者未设置回调将关闭该连接
+	// func(self *tnet.TcpServer, conn net.Conn, reason tnet.RejectReason) (wait bool) {}
+	OnRejectConnCallback func(self *TcpServer, conn net.Conn, reason RejectReason) (wait bool)
 
 	// 连接收到数据后调用，len(data) <= conn.ReadSize，可以在回调中重新设置 conn.ReadSize 来调整下一次期望收到数据的长度
 	// 返回值 ok 为 false 将清理并关闭该连接
 	// func(self *tnet.TcpServer, conn *tnet.TCPConnEx, connId uint32, data []byte) (ok bool) {}
 	OnHandleConnDataCallback func(self *TcpServer, conn *TCPConnEx, connId uint32, data []byte) (ok bool)
 
+	// 设置了 FrameCodecFactory 时，连接每收到一个完整的消息后调用
+	// 返回值 ok 为 false 将清理并关闭该连接
+	// func(self *tnet.TcpServer, conn *tnet.TCPConnEx, connId uint32, msg []byte) (ok bool) {}
+	OnHandleMessageCallback func(self *TcpServer, conn *TCPConnEx, connId uint32, msg []byte) (ok bool)
+
+	// 连接读超时或空闲超时后调用，kind 为超时类型
+	// 返回值 ok 为 true 将重新计时并继续读取（例如在回调中发送一个 ping），为 false 或者未设置回调将关闭该连接
+	// func(self *tnet.TcpServer, conn *tnet.TCPConnEx, connId uint32, kind tnet.TimeoutKind) (ok bool) {}
+	OnTimeoutCallback func(self *TcpServer, conn *TCPConnEx, connId uint32, kind TimeoutKind) (ok bool)
+
 	// 关闭连接时调用
 	// func(self *tnet.TcpServer, conn *tnet.TCPConnEx, connId uint32) {}
 	OnCloseConnCallback func(self *TcpServer, conn *TCPConnEx, connId uint32)
@@ -50,9 +132,34 @@ func NewTcpServer() (obj *TcpServer) {
 	obj = new(TcpServer)
 	obj.ConnMap = new(sync.Map)
 	obj.ReadBufSize = read_buf_size
+	obj.Network = default_network
+	obj.SendQueueSize = send_queue_size
+	obj.SendQueuePolicy = SendQueueBlock
+	obj.quit = make(chan struct{})
+	obj.limitCond = sync.NewCond(&obj.limitMtx)
+	obj.ipConnCount = make(map[string]int)
+	obj.handshaking = make(map[net.Conn]struct{})
+	obj.Logger = tlog.NewNopLogger()
+	obj.Metrics = NewNopMetrics()
 	return obj
 }
 
+func (self *TcpServer) newConnEx(owned *ownedConn, tlsConn *tls.Conn, connId uint32, readSize int, ext interface{}, handled bool) (connx *TCPConnEx) {
+	conn := owned.Conn
+	connx = newTCPConnEx(conn, tlsConn, readSize, ext)
+	connx.logger = self.Logger.With(tlog.ConnId(connId), tlog.RemoteAddr(conn.RemoteAddr()))
+	connx.metrics = self.Metrics
+	connx.handled = handled
+	if self.FrameCodecFactory != nil && handled {
+		connx.codec = self.FrameCodecFactory()
+		connx.ReadSize = self.ReadBufSize
+	}
+	connx.onClose = owned.release
+	connx.setSendQueue(self.SendQueueSize, self.SendQueuePolicy, self.WriteTimeout)
+	connx.setTimeouts(self.ReadTimeout, self.IdleTimeout, self.KeepAlivePeriod)
+	return connx
+}
+
 func (self *TcpServer) connReadHandler(conn *TCPConnEx, connId uint32) {
 	defer func() {
 		if self.OnCloseConnCallback != nil {
@@ -60,98 +167,372 @@ func (self *TcpServer) connReadHandler(conn *TCPConnEx, connId uint32) {
 		}
 		self.ConnMap.Delete(connId)
 		conn.Close()
-		log.Printf("close TCP conn(%d)", connId)
-		log.Printf("stop TCP conn(%d) handler", connId)
+		conn.logger.Info("close TCP conn")
+		conn.logger.Debug("stop TCP conn handler")
+		self.Metrics.AddGauge(MetricGoroutines, -1)
 		self.connWg.Done()
 	}()
 
-	log.Printf("start TCP conn(%d) handler", connId)
+	conn.logger.Debug("start TCP conn handler")
+	self.Metrics.AddGauge(MetricGoroutines, 1)
 
-	buf := make([]byte, self.ReadBufSize)
+	handleMessage := func(msg []byte) (ok bool) {
+		if self.OnHandleMessageCallback == nil {
+			return true
+		}
+		defer observeCallback(self.Metrics, "OnHandleMessageCallback", time.Now())
+		return self.OnHandleMessageCallback(self, conn, connId, msg)
+	}
+	handleData := func(data []byte) (ok bool) {
+		if self.OnHandleConnDataCallback == nil {
+			return true
+		}
+		defer observeCallback(self.Metrics, "OnHandleConnDataCallback", time.Now())
+		return self.OnHandleConnDataCallback(self, conn, connId, data)
+	}
+	pbuf := getBuf(self.ReadBufSize)
+	defer putBuf(pbuf)
+	buf := *pbuf
 	for {
-		n, err0 := conn.Read(buf[:conn.ReadSize])
+		n, err0, kind := conn.readWithDeadline(buf[:conn.ReadSize])
 		if n > 0 {
 			data := buf[:n]
-			if self.OnHandleConnDataCallback != nil && !self.OnHandleConnDataCallback(self, conn, connId, data) {
-				log.Printf("OnHandleConnDataCallback return false")
+			if conn.codec != nil {
+				if ok, err := decodeFrames(conn.codec, data, handleMessage); err != nil {
+					conn.logger.Warn("TCP conn decode failed", tlog.Err(err))
+					break
+				} else if !ok {
+					conn.logger.Debug("OnHandleMessageCallback return false")
+					break
+				}
+			} else if !handleData(data) {
+				conn.logger.Debug("OnHandleConnDataCallback return false")
 				break
 			}
 		}
 
 		if err0 != nil {
-			log.Printf("TCP conn(%d), %s", connId, err0.Error())
+			if self.isClosing() {
+				conn.logger.Debug("TCP server is shutting down")
+				break
+			}
+
+			if timeout, expired := conn.checkTimeout(err0, kind); timeout {
+				if !expired {
+					continue
+				}
+				if self.OnTimeoutCallback != nil && self.OnTimeoutCallback(self, conn, connId, kind) {
+					conn.touch()
+					continue
+				}
+				conn.logger.Info("TCP conn timeout", tlog.F("kind", kind))
+				break
+			}
+
+			conn.logger.Debug("TCP conn read failed", tlog.Err(err0))
 			break
 		}
 	}
 }
 
+func (self *TcpServer) isClosing() bool {
+	return atomic.LoadInt32(&self.closing) != 0
+}
+
+// 返回监听使用的 Listener，设置了 Listener 时直接使用它
+func (self *TcpServer) listen() (lstn net.Listener, err error) {
+	if self.Listener != nil {
+		self.Logger.Info("use custom listener", tlog.Addr(self.Listener.Addr()))
+		return self.Listener, nil
+	}
+
+	network := self.Network
+	if network == "" {
+		network = default_network
+	}
+	if self.DualStack && network == default_network {
+		if addr4, addr6, ok := dualStackAddrs(self.Addr); ok {
+			return self.listenDualStack(addr4, addr6)
+		}
+		self.Logger.Warn("dual stack needs a wildcard addr, listen on single stack", tlog.F("addr", self.Addr))
+	}
+	self.Logger.Info("listen on "+network, tlog.F("addr", self.Addr))
+	lstn, err = net.Listen(network, self.Addr)
+	if err != nil {
+		self.Logger.Error("listen on "+network+" failed", tlog.F("addr", self.Addr), tlog.Err(err))
+		return nil, err
+	}
+	return lstn, nil
+}
+
+func (self *TcpServer) listenDualStack(addr4 string, addr6 string) (lstn net.Listener, err error) {
+	self.Logger.Info("listen on tcp4", tlog.F("addr", addr4))
+	lstn4, err := net.Listen("tcp4", addr4)
+	if err != nil {
+		self.Logger.Warn("listen on tcp4 failed", tlog.F("addr", addr4), tlog.Err(err))
+	} else {
+		addr6 = samePortAddr(addr6, lstn4.Addr())
+	}
+
+	self.Logger.Info("listen on tcp6", tlog.F("addr", addr6))
+	lstn6, err6 := net.Listen("tcp6", addr6)
+	if err6 != nil {
+		self.Logger.Warn("listen on tcp6 failed", tlog.F("addr", addr6), tlog.Err(err6))
+		if lstn4 == nil {
+			return nil, err
+		}
+		return lstn4, nil
+	}
+	if lstn4 == nil {
+		return lstn6, nil
+	}
+	return newMultiListener(lstn4, lstn6), nil
+}
+
 func (self *TcpServer) Start() (err error) {
-	var lstn *net.TCPListener
+	var lstn net.Listener
 	defer func() {
 		if lstn != nil {
 			lstn.Close()
-			log.Println("close TCP listener")
+			self.Logger.Debug("close TCP listener")
 		}
-		log.Println("stop TCP server")
+		self.Logger.Info("stop TCP server")
 	}()
 
-	log.Println("start TCP server")
-	log.Printf("resolve TCP addr(%s)", self.Addr)
-	addr, err := net.ResolveTCPAddr("tcp", self.Addr)
-	if err != nil {
-		log.Println(err.Error())
-		return err
+	if self.isClosing() {
+		return ErrServerClosed
 	}
 
-	log.Printf("listen on TCP %s", addr.String())
-	lstn, err = net.ListenTCP("tcp", addr)
+	self.Logger.Info("start TCP server")
+	lstn, err = self.listen()
 	if err != nil {
-		log.Println(err.Error())
 		return err
 	}
 
+	self.lstnMtx.Lock()
+	if self.isClosing() {
+		// 监听期间已经调用了 Shutdown
+		self.lstnMtx.Unlock()
+		return ErrServerClosed
+	}
+	self.lstn = lstn
+	self.lstnMtx.Unlock()
+
+	if self.AcceptRate > 0 {
+		self.acceptBucket = newTokenBucket(self.AcceptRate, self.AcceptBurst)
+	}
+
 	if self.OnListenSuccCallback != nil {
 		if ok := self.OnListenSuccCallback(self, lstn); !ok {
 			return errors.New("OnListenSuccCallback return false")
 		}
 	}
 
-	var connId uint32 = 0
 	for {
-		conn, err := lstn.AcceptTCP()
+		conn, err := lstn.Accept()
 		if err != nil {
-			log.Println(err.Error())
+			if self.isClosing() {
+				return ErrServerClosed
+			}
+			self.Logger.Error("accept TCP conn failed", tlog.Err(err))
 			return err
 		}
 
-		connId++
-		log.Printf("new TCP conn(%d) from %s", connId, conn.RemoteAddr().String())
-		if self.OnAcceptConnCallback != nil {
-			if ok, readSize, ext := self.OnAcceptConnCallback(self, conn, connId); ok {
-				connx := &TCPConnEx{*conn, readSize, ext}
-				self.ConnMap.Store(connId, connx)
-				self.connWg.Add(1)
-				if self.ReadBufSize > 0 && readSize > 0 {
-					// ReadSize > 0 的时候走正常处理函数
-					go self.connReadHandler(connx, connId)
-				}
-			} else {
-				connId--
-				conn.Close()
-				log.Printf("close TCP conn(%d)", connId)
-			}
+		if self.isClosing() {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		if !self.admitConn(conn) {
+			continue
+		}
+
+		if self.TLSConfig != nil {
+			// 慢速或者恶意的客户端不能阻塞后续的接入
+			go self.handshakeConn(conn)
+			continue
+		}
+		self.acceptConn(conn, nil)
+	}
+}
+
+// 完成 TLS 握手后接入连接，握手期间 Shutdown 会关闭连接
+func (self *TcpServer) handshakeConn(conn net.Conn) {
+	self.connsMtx.Lock()
+	if self.isClosing() {
+		self.connsMtx.Unlock()
+		self.releaseConn(remoteIp(conn))
+		conn.Close()
+		return
+	}
+	self.handshaking[conn] = struct{}{}
+	self.connsMtx.Unlock()
+
+	tlsConn := tls.Server(conn, self.TLSConfig)
+	err := tlsHandshake(tlsConn, conn, self.TLSHandshakeTimeout)
+
+	self.connsMtx.Lock()
+	delete(self.handshaking, conn)
+	self.connsMtx.Unlock()
+	if err != nil {
+		self.Logger.Warn("TLS handshake failed", tlog.RemoteAddr(conn.RemoteAddr()), tlog.Err(err))
+		self.Metrics.AddCounter(MetricTLSHandshakeFails, 1)
+		self.releaseConn(remoteIp(conn))
+		conn.Close()
+		return
+	}
+	self.acceptConn(conn, tlsConn)
+}
+
+// 分配 connId 并调用 OnAcceptConnCallback，由 acceptMtx 保证依次进行
+func (self *TcpServer) acceptConn(conn net.Conn, tlsConn *tls.Conn) {
+	self.acceptMtx.Lock()
+	defer self.acceptMtx.Unlock()
+	if self.isClosing() {
+		self.releaseConn(remoteIp(conn))
+		conn.Close()
+		return
+	}
+
+	self.lastConnId++
+	connId := self.lastConnId
+	self.Logger.Info("new TCP conn", tlog.ConnId(connId), tlog.RemoteAddr(conn.RemoteAddr()))
+	self.Metrics.AddCounter(MetricConnsAccepted, 1)
+	self.Metrics.AddGauge(MetricConnsActive, 1)
+	// 无论连接由 TCPConnEx 还是回调关闭，都释放计数并更新指标
+	ip := remoteIp(conn)
+	owned := newOwnedConn(conn, func() {
+		self.ConnMap.Delete(connId)
+		self.releaseConn(ip)
+		self.Metrics.AddCounter(MetricConnsClosed, 1)
+		self.Metrics.AddGauge(MetricConnsActive, -1)
+	})
+	if self.OnAcceptConnCallback != nil {
+		start := time.Now()
+		ok, readSize, ext := self.OnAcceptConnCallback(self, owned, connId)
+		observeCallback(self.Metrics, "OnAcceptConnCallback", start)
+		if ok {
+			// ReadSize > 0 的时候走正常处理函数
+			self.startConn(self.newConnEx(owned, tlsConn, connId, readSize, ext, self.ReadBufSize > 0 && readSize > 0), owned, connId)
 		} else {
-			connx := &TCPConnEx{*conn, self.ReadBufSize, nil}
-			self.ConnMap.Store(connId, connx)
-			self.connWg.Add(1)
-			go self.connReadHandler(connx, connId)
+			self.Logger.Info("close TCP conn", tlog.ConnId(connId))
+			self.lastConnId--
+			owned.Close()
 		}
+	} else {
+		self.startConn(self.newConnEx(owned, tlsConn, connId, self.ReadBufSize, nil, true), owned, connId)
 	}
+}
 
-	return nil
+// 登记连接并启动读例程，Shutdown 已经开始时直接关闭连接
+func (self *TcpServer) startConn(connx *TCPConnEx, owned *ownedConn, connId uint32) {
+	self.connsMtx.Lock()
+	if self.isClosing() {
+		self.connsMtx.Unlock()
+		if self.OnCloseConnCallback != nil {
+			self.OnCloseConnCallback(self, connx, connId)
+		}
+		connx.Close()
+		connx.logger.Info("close TCP conn")
+		return
+	}
+	self.ConnMap.Store(connId, connx)
+	if connx.handled {
+		self.connWg.Add(1)
+	} else if owned.isClosed() {
+		// 回调返回前已经关闭了连接
+		self.ConnMap.Delete(connId)
+	}
+	self.connsMtx.Unlock()
+	if connx.handled {
+		go self.connReadHandler(connx, connId)
+	}
 }
 
-func (self *TcpServer) PeekConn(connId int32) (ret *TCPConnEx) {
+// 优雅关闭服务器
+// 关闭 Listener 后通知所有 connReadHandler 例程退出，例程退出前会依次调用 OnCloseConnCallback 并关闭连接，
+// 然后等待所有例程结束，ctx 到期后强制关闭剩余的连接并返回 ctx.Err()
+// 没有 connReadHandler 例程的连接（OnAcceptConnCallback 返回的 ReadSize 为 0）将在最后被关闭
+func (self *TcpServer) Shutdown(ctx context.Context) (err error) {
+	if !atomic.CompareAndSwapInt32(&self.closing, 0, 1) {
+		return ErrServerClosed
+	}
+	self.Logger.Info("shutdown TCP server")
+	close(self.quit)
+
+	self.lstnMtx.Lock()
+	if self.lstn != nil {
+		self.lstn.Close()
+	}
+	self.lstnMtx.Unlock()
+
+	// 唤醒排队等待连接限制的接入例程
+	self.limitMtx.Lock()
+	self.limitCond.Broadcast()
+	self.limitMtx.Unlock()
+
+	// 打断阻塞中的 Read，connReadHandler 会走正常的关闭流程；之后登记的连接会看到 closing 并自行关闭
+	self.connsMtx.Lock()
+	for conn := range self.handshaking {
+		conn.Close()
+	}
+	self.ConnMap.Range(func(k, v interface{}) bool {
+		conn := v.(*TCPConnEx)
+		if conn.handled {
+			conn.stopRead()
+		}
+		return true
+	})
+	self.connsMtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		self.connWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		self.Logger.Debug("all of TCP conn handlers stopped")
+	case <-ctx.Done():
+		err = ctx.Err()
+		self.Logger.Warn("wait for TCP conn handlers failed", tlog.Err(err))
+	}
+
+	// 强制关闭剩余的连接
+	self.ConnMap.Range(func(k, v interface{}) bool {
+		connId := k.(uint32)
+		conn := v.(*TCPConnEx)
+		if conn.handled {
+			// connReadHandler 仍未退出，关闭连接后由它自己完成清理
+			conn.Close()
+			conn.logger.Info("force close TCP conn")
+			return true
+		}
+
+		if self.OnCloseConnCallback != nil {
+			self.OnCloseConnCallback(self, conn, connId)
+		}
+		self.ConnMap.Delete(connId)
+		conn.Close()
+		conn.logger.Info("close TCP conn")
+		return true
+	})
+	return err
+}
+
+// 立即关闭服务器及所有连接，不等待 connReadHandler 例程结束
+func (self *TcpServer) Close() (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = self.Shutdown(ctx)
+	if err == context.Canceled {
+		err = nil
+	}
+	return err
+}
+
+func (self *TcpServer) PeekConn(connId uint32) (ret *TCPConnEx) {
 	if v, ok := self.ConnMap.Load(connId); ok {
 		conn := v.(*TCPConnEx)
 		return conn
@@ -167,18 +548,80 @@ type TcpClient struct {
 	ReadBufSize int
 	Ext         interface{}
 
+	// 连接的网络类型，默认为 "tcp"，也可以是 "tcp4"、"tcp6"、"unix" 等 net.Dial 支持的类型
+	Network string
+
+	// 不为 nil 时用它建立连接，代替 net.Dialer，例如通过代理连接或者测试用的 tnet.PipeListener.DialContext
+	// func(ctx context.Context, network string, addr string) (conn net.Conn, err error) {}
+	Dialer func(ctx context.Context, network string, addr string) (conn net.Conn, err error)
+
+	// 不为 nil 时按指数退避重连，代替固定的 RetryDelay，参见 NewReconnectPolicy
+	Reconnect *ReconnectPolicy
+
+	// 发送队列设置，参见 TCPConnEx.Send
+	SendQueueSize   int
+	SendQueuePolicy SendQueuePolicy
+	WriteTimeout    time.Duration // 每次写操作的超时时间，0 表示不超时
+
+	// 超时设置，0 表示不超时，超时后调用 OnTimeoutCallback
+	ReadTimeout     time.Duration // 单次读操作的超时时间
+	IdleTimeout     time.Duration // 连接没有任何读写的最长时间
+	KeepAlivePeriod time.Duration // TCP keepalive 探测间隔，0 使用系统默认，< 0 关闭 keepalive，只对 TCP 连接生效
+
+	// 不为 nil 时在连接上启用 TLS，握手完成后才会调用连接回调
+	TLSConfig           *tls.Config
+	TLSHandshakeTimeout time.Duration // 0 表示使用默认的 10s
+
+	// 不为 nil 时为每个连接创建一个 FrameCodec，读例程按帧解码后调用 OnHandleMessageCallback，
+	// 这时 ReadSize 由读例程管理，不会再调用 OnHandleConnDataCallback，例如 tnet.NewSldeCodec
+	FrameCodecFactory func() FrameCodec
+
+	// 日志，默认不输出
+	Logger tlog.Logger
+
+	// 指标钩子，默认不上报
+	Metrics Metrics
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closing   int32
+	conn      net.Conn
+	connMtx   sync.Mutex
+	rnd       *rand.Rand
+	connected bool // 是否成功连接过
+
+	// 连接失败或断开后，重新连接之前调用，attempt 为连续失败的次数，delay 为将要等待的时间
+	// 返回值 ok 为 false 将停止客户端
+	// func(self *tnet.TcpClient, attempt int, delay time.Duration) (ok bool) {}
+	OnReconnectingCallback func(self *TcpClient, attempt int, delay time.Duration) (ok bool)
+
+	// 重新连接成功后调用，在 OnDialCallback 之后，attempt 为本次成功之前连续失败的次数
+	// func(self *tnet.TcpClient, conn *tnet.TCPConnEx, attempt int) {}
+	OnReconnectedCallback func(self *TcpClient, conn *TCPConnEx, attempt int)
+
 	// 连接成功后调用，返回值意义如下
+	// 启用 TLS 时 conn 是底层的连接，已经完成握手，不能直接读写，应使用 TCPConnEx
 	// ok: 如果为 false 该连接将会关闭
-	// ReadSize: conn 希望连接读取的字节数
+	// ReadSize: conn 希望连接读取的字节数，为 0 时由回调负责关闭 conn，关闭时更新连接指标；conn 是包装过的连接，不能断言为 *net.TCPConn
 	// connExt: 为 conn 扩展的字段，将会传递到 TCPConnEx 结构中
-	// func(self *tnet.TcpClient, conn *net.TCPConn) (ok bool, readSize int, connExt interface{}) {}
-	OnDialCallback func(self *TcpClient, conn *net.TCPConn) (ok bool, readSize int, connExt interface{})
+	// func(self *tnet.TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{}) {}
+	OnDialCallback func(self *TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{})
 
 	// 连接收到数据后调用，len(data) <= conn.ReadSize，可以在回调中重新设置 conn.ReadSize 来调整下一次期望收到数据的长度
 	// 返回值 ok 为 false 将清理并关闭该连接
 	// func(self *tnet.TcpClient, conn *tnet.TCPConnEx, data []byte) (ok bool) {}
 	OnHandleConnDataCallback func(self *TcpClient, conn *TCPConnEx, data []byte) (ok bool)
 
+	// 设置了 FrameCodecFactory 时，连接每收到一个完整的消息后调用
+	// 返回值 ok 为 false 将清理并关闭该连接
+	// func(self *tnet.TcpClient, conn *tnet.TCPConnEx, msg []byte) (ok bool) {}
+	OnHandleMessageCallback func(self *TcpClient, conn *TCPConnEx, msg []byte) (ok bool)
+
+	// 连接读超时或空闲超时后调用，kind 为超时类型
+	// 返回值 ok 为 true 将重新计时并继续读取（例如在回调中发送一个 ping），为 false 或者未设置回调将关闭该连接
+	// func(self *tnet.TcpClient, conn *tnet.TCPConnEx, kind tnet.TimeoutKind) (ok bool) {}
+	OnTimeoutCallback func(self *TcpClient, conn *TCPConnEx, kind TimeoutKind) (ok bool)
+
 	// 关闭连接时调用
 	// func(self *tnet.TcpClient, conn *tnet.TCPConnEx) {}
 	OnCloseConnCallback func(self *TcpClient, conn *TCPConnEx)
@@ -189,105 +632,328 @@ func NewTcpClient() (obj *TcpClient) {
 	obj.RetryDelay = 0
 	obj.MaxRetry = 0
 	obj.ReadBufSize = read_buf_size
+	obj.Network = default_network
+	obj.SendQueueSize = send_queue_size
+	obj.SendQueuePolicy = SendQueueBlock
+	obj.ctx, obj.cancel = context.WithCancel(context.Background())
+	obj.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	obj.Logger = tlog.NewNopLogger()
+	obj.Metrics = NewNopMetrics()
 	return obj
 }
 
+func (self *TcpClient) newConnEx(owned *ownedConn, tlsConn *tls.Conn, readSize int, ext interface{}) (connx *TCPConnEx) {
+	conn := owned.Conn
+	connx = newTCPConnEx(conn, tlsConn, readSize, ext)
+	connx.logger = self.Logger.With(tlog.RemoteAddr(conn.RemoteAddr()))
+	connx.metrics = self.Metrics
+	connx.onClose = owned.release
+	connx.handled = readSize > 0
+	if self.FrameCodecFactory != nil && connx.handled {
+		connx.codec = self.FrameCodecFactory()
+		connx.ReadSize = self.ReadBufSize
+	}
+	connx.setSendQueue(self.SendQueueSize, self.SendQueuePolicy, self.WriteTimeout)
+	connx.setTimeouts(self.ReadTimeout, self.IdleTimeout, self.KeepAlivePeriod)
+	return connx
+}
+
 func (self *TcpClient) connReadHandler(conn *TCPConnEx) {
 	defer func() {
 		if self.OnCloseConnCallback != nil {
 			self.OnCloseConnCallback(self, conn)
 		}
 		conn.Close()
-		log.Println("close TCP conn")
-		log.Println("stop TCP conn handler")
+		conn.logger.Info("close TCP conn")
+		conn.logger.Debug("stop TCP conn handler")
+		self.Metrics.AddGauge(MetricGoroutines, -1)
 	}()
 
-	log.Println("start TCP conn handler")
-	buf := make([]byte, self.ReadBufSize)
+	conn.logger.Debug("start TCP conn handler")
+	self.Metrics.AddGauge(MetricGoroutines, 1)
+	handleMessage := func(msg []byte) (ok bool) {
+		if self.OnHandleMessageCallback == nil {
+			return true
+		}
+		defer observeCallback(self.Metrics, "OnHandleMessageCallback", time.Now())
+		return self.OnHandleMessageCallback(self, conn, msg)
+	}
+	handleData := func(data []byte) (ok bool) {
+		if self.OnHandleConnDataCallback == nil {
+			return true
+		}
+		defer observeCallback(self.Metrics, "OnHandleConnDataCallback", time.Now())
+		return self.OnHandleConnDataCallback(self, conn, data)
+	}
+	pbuf := getBuf(self.ReadBufSize)
+	defer putBuf(pbuf)
+	buf := *pbuf
 	for {
-		n, err0 := conn.Read(buf[:conn.ReadSize])
+		n, err0, kind := conn.readWithDeadline(buf[:conn.ReadSize])
 		if n > 0 {
 			data := buf[:n]
-			if self.OnHandleConnDataCallback != nil && !self.OnHandleConnDataCallback(self, conn, data) {
-				log.Printf("OnHandleConnDataCallback return false")
+			if conn.codec != nil {
+				if ok, err := decodeFrames(conn.codec, data, handleMessage); err != nil {
+					conn.logger.Warn("TCP conn decode failed", tlog.Err(err))
+					break
+				} else if !ok {
+					conn.logger.Debug("OnHandleMessageCallback return false")
+					break
+				}
+			} else if !handleData(data) {
+				conn.logger.Debug("OnHandleConnDataCallback return false")
 				break
 			}
 		}
 
 		if err0 != nil {
-			log.Printf("%s", err0.Error())
+			if timeout, expired := conn.checkTimeout(err0, kind); timeout {
+				if !expired {
+					continue
+				}
+				if self.OnTimeoutCallback != nil && self.OnTimeoutCallback(self, conn, kind) {
+					conn.touch()
+					continue
+				}
+				conn.logger.Info("TCP conn timeout", tlog.F("kind", kind))
+				break
+			}
+
+			conn.logger.Debug("TCP conn read failed", tlog.Err(err0))
 			break
 		}
 	}
 }
 
-func (self *TcpClient) Start() (err error) {
-	log.Println("start TCP client")
-	log.Printf("resolve TCP addr(%s)", self.Addr)
-	addr, err := net.ResolveTCPAddr("tcp", self.Addr)
+func (self *TcpClient) isClosing() bool {
+	return atomic.LoadInt32(&self.closing) != 0
+}
+
+// 停止客户端，关闭当前连接并打断正在进行的连接或等待，Start 随后返回
+func (self *TcpClient) Close() (err error) {
+	if !atomic.CompareAndSwapInt32(&self.closing, 0, 1) {
+		return nil
+	}
+	self.Logger.Info("close TCP client")
+	self.cancel()
+	self.connMtx.Lock()
+	if self.conn != nil {
+		err = self.conn.Close()
+	}
+	self.connMtx.Unlock()
+	return err
+}
+
+// 记录当前连接，供 Close 关闭，返回 false 表示客户端已经停止
+func (self *TcpClient) setConn(conn net.Conn) (ok bool) {
+	self.connMtx.Lock()
+	defer self.connMtx.Unlock()
+	self.conn = conn
+	if conn != nil && self.isClosing() {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// 等待重连，返回 false 表示客户端需要停止
+func (self *TcpClient) waitForReconnect(attempt int, lastDial time.Time) (ok bool) {
+	var delay time.Duration
+	if self.Reconnect != nil {
+		delay = self.Reconnect.delay(attempt, self.rnd)
+	} else if attempt > 0 {
+		delay = self.RetryDelay - time.Now().Sub(lastDial)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	if self.OnReconnectingCallback != nil && !self.OnReconnectingCallback(self, attempt, delay) {
+		self.Logger.Debug("OnReconnectingCallback return false")
+		return false
+	}
+
+	if delay > 0 {
+		self.Logger.Debug("wait for reconnecting", tlog.F("attempt", attempt), tlog.F("delay", delay))
+		select {
+		case <-time.After(delay):
+		case <-self.ctx.Done():
+			return false
+		}
+	}
+	return !self.isClosing()
+}
+
+// 建立连接，启用 TLS 时同时完成握手
+func (self *TcpClient) dial(network string) (conn net.Conn, tlsConn *tls.Conn, err error) {
+	if self.Dialer != nil {
+		conn, err = self.Dialer(self.ctx, network, self.Addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(self.ctx, network, self.Addr)
+	}
 	if err != nil {
-		log.Println(err.Error())
-		return err
+		return nil, nil, err
 	}
+	if self.TLSConfig != nil {
+		tlsConn = tls.Client(conn, tlsClientConfig(self.TLSConfig, self.Addr))
+		if err = tlsHandshake(tlsConn, conn, self.TLSHandshakeTimeout); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, tlsConn, nil
+}
+
+func (self *TcpClient) Start() (err error) {
+	self.Logger.Info("start TCP client")
+	network := self.Network
+	if network == "" {
+		network = default_network
+	}
+	addr := tlog.F("addr", self.Addr)
 
 	retryTimesLeft := self.MaxRetry
-	for {
-		log.Printf("dial to TCP %s", addr.String())
-		tm := time.Now()
-		conn, err := net.DialTCP("tcp", nil, addr)
+	attempt := 0 // 连续失败的次数
+	var tm time.Time
+	for !self.isClosing() {
+		if !tm.IsZero() && !self.waitForReconnect(attempt, tm) {
+			break
+		}
+
+		self.Logger.Info("dial to "+network, addr)
+		tm = time.Now()
+		self.Metrics.AddCounter(MetricDials, 1)
+		conn, tlsConn, err := self.dial(network)
 		if err != nil {
-			log.Printf("%s, retry times(%d)", err.Error(), retryTimesLeft)
+			if self.isClosing() {
+				break
+			}
+			self.Metrics.AddCounter(MetricDialFails, 1)
+			self.Logger.Warn("dial to "+network+" failed", addr, tlog.Err(err), tlog.F("retry_times", retryTimesLeft))
 			if retryTimesLeft == 0 {
 				break
 			} else if retryTimesLeft > 0 {
 				retryTimesLeft--
 			}
-
-			left := self.RetryDelay - time.Now().Sub(tm)
-			if left > 0 {
-				log.Printf("wait for %dms", left/1e6)
-				time.Sleep(left)
-			}
+			attempt++
 			continue
 		}
 
-		log.Println("TCP conn is established")
+		if !self.setConn(conn) {
+			break
+		}
+		self.Logger.Info("TCP conn is established", addr)
+		self.Metrics.AddCounter(MetricConnsAccepted, 1)
+		self.Metrics.AddGauge(MetricConnsActive, 1)
 		retryTimesLeft = self.MaxRetry
+		established := time.Now()
+		// 无论连接由 TCPConnEx 还是回调关闭，都更新指标
+		owned := newOwnedConn(conn, func() {
+			self.Metrics.AddCounter(MetricConnsClosed, 1)
+			self.Metrics.AddGauge(MetricConnsActive, -1)
+		})
 		// 连接成功
 		if self.OnDialCallback != nil {
-			ok, readSize, ext := self.OnDialCallback(self, conn)
+			ok, readSize, ext := self.OnDialCallback(self, owned)
 			if !ok {
-				conn.Close()
-				log.Println("close TCP conn")
+				self.setConn(nil)
+				owned.Close()
+				self.Logger.Info("close TCP conn")
 				break
 			}
-			connx := &TCPConnEx{*conn, readSize, ext}
+			connx := self.newConnEx(owned, tlsConn, readSize, ext)
+			self.onConnected(connx, attempt)
 			if readSize > 0 {
 				// ReadSize > 0 的时候走正常处理函数
 				self.connReadHandler(connx)
 			}
 		} else {
-			connx := &TCPConnEx{*conn, self.ReadBufSize, nil}
+			connx := self.newConnEx(owned, tlsConn, self.ReadBufSize, nil)
+			self.onConnected(connx, attempt)
 			self.connReadHandler(connx)
 		}
+		self.setConn(nil)
+
+		if self.Reconnect != nil && time.Now().Sub(established) < self.Reconnect.StableAfter {
+			// 连接不稳定，继续退避
+			attempt++
+		} else {
+			attempt = 0
+		}
 	}
 
-	log.Println("stop TCP client")
+	self.Logger.Info("stop TCP client")
 	return nil
 }
 
+func (self *TcpClient) onConnected(conn *TCPConnEx, attempt int) {
+	if self.connected && self.OnReconnectedCallback != nil {
+		self.OnReconnectedCallback(self, conn, attempt)
+	}
+	self.connected = true
+}
+
 const (
 	udp_peer_mode_defualt int = 0
 	udp_peer_mode_server  int = 1
 	udp_peer_mode_client  int = 2
 )
 
+// 服务器模式下按远端地址区分的虚拟 UDP 会话
+type UdpSession struct {
+	lastActive int64 // UnixNano，放在首位保证 64 位对齐
+	Addr       *net.UDPAddr
+	Ext        interface{}
+	key        string
+	conn       *net.UDPConn // 收到该远端数据的 socket，双栈时回复需要走同一个 socket
+}
+
+func (self *UdpSession) touch() {
+	atomic.StoreInt64(&self.lastActive, time.Now().UnixNano())
+}
+
+// 最后一次收到数据的时间
+func (self *UdpSession) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&self.lastActive))
+}
+
+// 会话表的 key，IPv4-mapped IPv6 地址与对应的 IPv4 地址视为同一个远端
+func udpSessionKey(addr *net.UDPAddr) string {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		return (&net.UDPAddr{IP: ip4, Port: addr.Port}).String()
+	}
+	return addr.String()
+}
+
 type UdpPeer struct {
 	Addr        string
 	ReadBufSize int
 	mode        int
 	Ext         interface{}
 
+	// 网络类型，默认为 "udp"，也可以是 "udp4"、"udp6"
+	Network string
+
+	// 服务器模式下为 true 且 Network 为 "udp"、Addr 为通配地址时，分别在 IPv4 和 IPv6 上监听，
+	// 每个 socket 一个读例程，OnListenSuccCallback 和 OnCloseConnCallback 对每个 socket 各调用一次
+	DualStack bool
+
+	// 服务器模式下的会话表 map[string]*UdpSession，设置了任意一个会话回调时才会记录会话
+	SessionMap *sync.Map
+	// 会话超过该时间没有收到数据将过期，为 0 时不过期
+	SessionIdleTimeout time.Duration
+	conn               *net.UDPConn   // 由 connMtx 保护
+	conns              []*net.UDPConn // 由 connMtx 保护
+	connMtx            sync.Mutex
+	closed             bool // 由 connMtx 保护
+
+	// 日志，默认不输出
+	Logger tlog.Logger
+
+	// 指标钩子，默认不上报
+	Metrics Metrics
+
 	// Listener 监听成功后调用，如果返回 false 则服务器会退出
 	// func(self *tnet.UdpPeer, conn *net.UDPConn) (ok bool) {}
 	OnListenSuccCallback func(self *UdpPeer, conn *net.UDPConn) (ok bool)
@@ -304,12 +970,29 @@ type UdpPeer struct {
 	// 关闭连接时调用
 	// func(self *tnet.UdpPeer, conn *net.UDPConn) {}
 	OnCloseConnCallback func(self *UdpPeer, conn *net.UDPConn)
+
+	// 服务器模式下收到新远端地址的数据时调用，可以在这里设置 sess.Ext
+	// 返回值 ok 为 false 将丢弃该数据且不创建会话
+	// func(self *tnet.UdpPeer, sess *tnet.UdpSession) (ok bool) {}
+	OnNewSessionCallback func(self *UdpPeer, sess *UdpSession) (ok bool)
+
+	// 服务器模式下会话收到数据后调用，设置后将代替 OnHandleConnDataCallback
+	// 返回值 ok 为 false 将关闭服务器
+	// func(self *tnet.UdpPeer, sess *tnet.UdpSession, data []byte) (ok bool) {}
+	OnHandleSessionDataCallback func(self *UdpPeer, sess *UdpSession, data []byte) (ok bool)
+
+	// 会话过期或被移除时调用
+	// func(self *tnet.UdpPeer, sess *tnet.UdpSession) {}
+	OnSessionExpiredCallback func(self *UdpPeer, sess *UdpSession)
 }
 
 func NewUdpPeer() (obj *UdpPeer) {
 	obj = new(UdpPeer)
 	obj.mode = udp_peer_mode_defualt
 	obj.ReadBufSize = read_buf_size
+	obj.Network = default_udp_network
+	obj.Logger = tlog.NewNopLogger()
+	obj.Metrics = NewNopMetrics()
 	return obj
 }
 
@@ -317,6 +1000,9 @@ func NewUdpClient() (obj *UdpPeer) {
 	obj = new(UdpPeer)
 	obj.mode = udp_peer_mode_client
 	obj.ReadBufSize = read_buf_size
+	obj.Network = default_udp_network
+	obj.Logger = tlog.NewNopLogger()
+	obj.Metrics = NewNopMetrics()
 	return obj
 }
 
@@ -324,16 +1010,166 @@ func NewUdpServer() (obj *UdpPeer) {
 	obj = new(UdpPeer)
 	obj.mode = udp_peer_mode_server
 	obj.ReadBufSize = read_buf_size
+	obj.Network = default_udp_network
+	obj.Logger = tlog.NewNopLogger()
+	obj.Metrics = NewNopMetrics()
+	obj.SessionMap = new(sync.Map)
 	return obj
 }
 
+func (self *UdpPeer) sessionEnabled() bool {
+	return self.mode == udp_peer_mode_server && self.SessionMap != nil &&
+		(self.OnNewSessionCallback != nil || self.OnHandleSessionDataCallback != nil || self.OnSessionExpiredCallback != nil)
+}
+
+// 取出 addr 对应的会话，不存在时创建，返回 nil 表示 OnNewSessionCallback 拒绝了该远端
+func (self *UdpPeer) loadOrNewSession(conn *net.UDPConn, addr *net.UDPAddr) (sess *UdpSession) {
+	key := udpSessionKey(addr)
+	if v, ok := self.SessionMap.Load(key); ok {
+		sess = v.(*UdpSession)
+		sess.touch()
+		return sess
+	}
+
+	// ReadFromUDP 每次返回新的 addr，可以直接保存
+	sess = &UdpSession{Addr: addr, key: key, conn: conn}
+	sess.touch()
+	if self.OnNewSessionCallback != nil && !self.OnNewSessionCallback(self, sess) {
+		return nil
+	}
+	// 只有读例程会创建会话，这里不会与其他 Store 冲突
+	self.SessionMap.Store(key, sess)
+	self.Metrics.AddGauge(MetricSessionsActive, 1)
+	self.Logger.Info("new UDP session", tlog.RemoteAddr(addr))
+	return sess
+}
+
+// 取出 addr 对应的会话，不存在时返回 nil
+func (self *UdpPeer) PeekSession(addr *net.UDPAddr) (sess *UdpSession) {
+	if self.SessionMap == nil {
+		return nil
+	}
+	if v, ok := self.SessionMap.Load(udpSessionKey(addr)); ok {
+		return v.(*UdpSession)
+	}
+	return nil
+}
+
+// 从会话表中移除 sess 并调用 OnSessionExpiredCallback，之后收到该远端的数据会创建新的会话
+// 可以并发调用，同一个会话只会移除一次
+func (self *UdpPeer) RemoveSession(sess *UdpSession) {
+	if !self.SessionMap.CompareAndDelete(sess.key, sess) {
+		return
+	}
+	self.Metrics.AddGauge(MetricSessionsActive, -1)
+	self.Metrics.AddCounter(MetricSessionsExpired, 1)
+	if self.OnSessionExpiredCallback != nil {
+		self.OnSessionExpiredCallback(self, sess)
+	}
+}
+
+// 定期清理超过 SessionIdleTimeout 没有收到数据的会话
+func (self *UdpPeer) sessionExpireHandler(quit chan struct{}) {
+	interval := self.SessionIdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	self.Metrics.AddGauge(MetricGoroutines, 1)
+	defer self.Metrics.AddGauge(MetricGoroutines, -1)
+	for {
+		select {
+		case <-ticker.C:
+			self.SessionMap.Range(func(k, v interface{}) bool {
+				sess := v.(*UdpSession)
+				if time.Since(sess.LastActive()) >= self.SessionIdleTimeout {
+					self.Logger.Info("UDP session expired", tlog.RemoteAddr(sess.Addr))
+					self.RemoveSession(sess)
+				}
+				return true
+			})
+		case <-quit:
+			return
+		}
+	}
+}
+
+// 关闭 UDP 连接，Start 中的读例程会随之退出
+func (self *UdpPeer) Close() (err error) {
+	self.connMtx.Lock()
+	defer self.connMtx.Unlock()
+	self.closed = true
+	for _, conn := range self.conns {
+		if err0 := conn.Close(); err0 != nil && err == nil {
+			err = err0
+		}
+	}
+	return err
+}
+
+// 向会话的远端发送数据，只能在服务器模式下使用
+func (self *UdpPeer) SendTo(sess *UdpSession, data []byte) (err error) {
+	conn := sess.conn
+	if conn == nil {
+		self.connMtx.Lock()
+		conn = self.conn
+		self.connMtx.Unlock()
+	}
+	if conn == nil {
+		return ErrConnClosed
+	}
+	n, err := conn.WriteToUDP(data, sess.Addr)
+	if n > 0 {
+		self.Metrics.AddCounter(MetricPacketsOut, 1)
+		self.Metrics.AddCounter(MetricBytesOut, int64(n))
+	}
+	return err
+}
+
+func (self *UdpPeer) handleData(conn *net.UDPConn, addr *net.UDPAddr, data []byte, sessionEnabled bool) (ok bool) {
+	self.Metrics.AddCounter(MetricPacketsIn, 1)
+	self.Metrics.AddCounter(MetricBytesIn, int64(len(data)))
+	if sessionEnabled {
+		sess := self.loadOrNewSession(conn, addr)
+		if sess == nil {
+			return true
+		}
+		if self.OnHandleSessionDataCallback != nil {
+			start := time.Now()
+			ok = self.OnHandleSessionDataCallback(self, sess, data)
+			observeCallback(self.Metrics, "OnHandleSessionDataCallback", start)
+			if !ok {
+				self.Logger.Debug("OnHandleSessionDataCallback return false", tlog.RemoteAddr(sess.Addr))
+				return false
+			}
+			return true
+		}
+	}
+	if self.OnHandleConnDataCallback == nil {
+		return true
+	}
+	start := time.Now()
+	ok = self.OnHandleConnDataCallback(self, conn, addr, data)
+	observeCallback(self.Metrics, "OnHandleConnDataCallback", start)
+	if !ok {
+		self.Logger.Debug("OnHandleConnDataCallback return false", tlog.RemoteAddr(addr))
+		return false
+	}
+	return true
+}
+
 func (self *UdpPeer) connReadHandler(conn *net.UDPConn) {
 	defer func() {
-		log.Println("stop UDP conn handler")
+		self.Logger.Debug("stop UDP conn handler")
+		self.Metrics.AddGauge(MetricGoroutines, -1)
 	}()
 
-	log.Println("start UDP conn handler")
-	buf := make([]byte, self.ReadBufSize)
+	self.Logger.Debug("start UDP conn handler")
+	self.Metrics.AddGauge(MetricGoroutines, 1)
+	pbuf := getBuf(self.ReadBufSize)
+	defer putBuf(pbuf)
+	buf := *pbuf
 	var err0 error
 	var n int
 	var addr *net.UDPAddr
@@ -341,6 +1177,7 @@ func (self *UdpPeer) connReadHandler(conn *net.UDPConn) {
 		caddr := conn.RemoteAddr()
 		addr, _ = net.ResolveUDPAddr(caddr.Network(), caddr.String())
 	}
+	sessionEnabled := self.sessionEnabled()
 	for {
 		if self.mode == udp_peer_mode_client {
 			n, err0 = conn.Read(buf)
@@ -349,61 +1186,155 @@ func (self *UdpPeer) connReadHandler(conn *net.UDPConn) {
 		}
 
 		if n > 0 {
-			data := buf[:n]
-			if self.OnHandleConnDataCallback != nil && !self.OnHandleConnDataCallback(self, conn, addr, data) {
-				log.Printf("OnHandleConnDataCallback return false")
+			if !self.handleData(conn, addr, buf[:n], sessionEnabled) {
 				break
 			}
 		}
 
 		if err0 != nil {
-			log.Printf("%s", err0.Error())
+			self.Logger.Debug("UDP conn read failed", tlog.Err(err0))
 			break
 		}
 	}
 }
 
+// 服务器模式下监听，双栈时返回 IPv4 和 IPv6 两个 socket
+func (self *UdpPeer) listen(network string) (conns []*net.UDPConn, err error) {
+	if self.DualStack && network == default_udp_network {
+		if addr4, addr6, ok := dualStackAddrs(self.Addr); ok {
+			return self.listenDualStack(addr4, addr6)
+		}
+		self.Logger.Warn("dual stack needs a wildcard addr, listen on single stack", tlog.F("addr", self.Addr))
+	}
+
+	conn, err := self.listenUDP(network, self.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{conn}, nil
+}
+
+func (self *UdpPeer) listenUDP(network string, address string) (conn *net.UDPConn, err error) {
+	self.Logger.Debug("resolve UDP addr", tlog.F("addr", address))
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		self.Logger.Error("resolve UDP addr failed", tlog.F("addr", address), tlog.Err(err))
+		return nil, err
+	}
+
+	self.Logger.Info("listen on "+network, tlog.Addr(addr))
+	conn, err = net.ListenUDP(network, addr)
+	if err != nil {
+		self.Logger.Error("listen on "+network+" failed", tlog.Addr(addr), tlog.Err(err))
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (self *UdpPeer) listenDualStack(addr4 string, addr6 string) (conns []*net.UDPConn, err error) {
+	conn4, err := self.listenUDP("udp4", addr4)
+	if err == nil {
+		conns = append(conns, conn4)
+		addr6 = samePortAddr(addr6, conn4.LocalAddr())
+	}
+	conn6, err6 := self.listenUDP("udp6", addr6)
+	if err6 == nil {
+		conns = append(conns, conn6)
+	}
+	if len(conns) == 0 {
+		return nil, err
+	}
+	return conns, nil
+}
+
+// 每个 socket 一个读例程，任意一个读例程退出后打断其他读例程，全部退出后返回
+func (self *UdpPeer) readConns(conns []*net.UDPConn) {
+	if self.sessionEnabled() && self.SessionIdleTimeout > 0 {
+		quit := make(chan struct{})
+		defer close(quit)
+		go self.sessionExpireHandler(quit)
+	}
+
+	done := make(chan struct{}, len(conns))
+	for _, conn := range conns {
+		go func(conn *net.UDPConn) {
+			self.connReadHandler(conn)
+			done <- struct{}{}
+		}(conn)
+	}
+	<-done
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	for i := 1; i < len(conns); i++ {
+		<-done
+	}
+}
+
+// 记录 Start 创建的连接，供 Close 和 SendTo 使用，返回 false 表示已经调用了 Close
+func (self *UdpPeer) setConns(conns []*net.UDPConn) (ok bool) {
+	self.connMtx.Lock()
+	defer self.connMtx.Unlock()
+	if self.closed {
+		return false
+	}
+	self.conn = conns[0]
+	self.conns = conns
+	return true
+}
+
 func (self *UdpPeer) Start() (err error) {
-	var conn *net.UDPConn
+	var conns []*net.UDPConn
 	defer func() {
-		if conn != nil {
+		for _, conn := range conns {
 			if self.OnCloseConnCallback != nil {
 				self.OnCloseConnCallback(self, conn)
 			}
 			conn.Close()
-			log.Println("close UDP conn")
+			self.Logger.Debug("close UDP conn", tlog.Addr(conn.LocalAddr()))
 		}
-		log.Println("stop UDP server")
+		self.Logger.Info("stop UDP peer")
 	}()
-	log.Println("start UDP server")
-	log.Printf("resolve UDP addr(%s)", self.Addr)
-	addr, err := net.ResolveUDPAddr("udp", self.Addr)
-	if err != nil {
-		log.Println(err.Error())
-		return err
+	self.Logger.Info("start UDP peer")
+	network := self.Network
+	if network == "" {
+		network = default_udp_network
 	}
 
 	if self.mode == udp_peer_mode_server {
-		log.Printf("listen on UDP %s", addr.String())
-		conn, err = net.ListenUDP("udp", addr)
+		conns, err = self.listen(network)
 		if err != nil {
-			log.Println(err.Error())
 			return err
 		}
+		if !self.setConns(conns) {
+			return ErrServerClosed
+		}
 
 		if self.OnListenSuccCallback != nil {
-			if ok := self.OnListenSuccCallback(self, conn); !ok {
-				return errors.New("OnListenSuccCallback return false")
+			for _, conn := range conns {
+				if ok := self.OnListenSuccCallback(self, conn); !ok {
+					return errors.New("OnListenSuccCallback return false")
+				}
 			}
 		}
 	} else if self.mode == udp_peer_mode_client {
-		log.Printf("dial to UDP %s", addr.String())
-		conn, err = net.DialUDP("udp", nil, addr)
+		self.Logger.Debug("resolve UDP addr", tlog.F("addr", self.Addr))
+		addr, err := net.ResolveUDPAddr(network, self.Addr)
 		if err != nil {
-			log.Println(err.Error())
+			self.Logger.Error("resolve UDP addr failed", tlog.F("addr", self.Addr), tlog.Err(err))
 			return err
 		}
-		//log.Println("UDP conn is established")
+
+		self.Logger.Info("dial to "+network, tlog.Addr(addr))
+		conn, err := net.DialUDP(network, nil, addr)
+		if err != nil {
+			self.Logger.Error("dial to "+network+" failed", tlog.Addr(addr), tlog.Err(err))
+			return err
+		}
+		conns = []*net.UDPConn{conn}
+		if !self.setConns(conns) {
+			return ErrServerClosed
+		}
 
 		if self.OnDialCallback != nil {
 			if ok := self.OnDialCallback(self, conn); !ok {
@@ -412,10 +1343,9 @@ func (self *UdpPeer) Start() (err error) {
 		}
 	}
 
-	if self.ReadBufSize > 0 {
-		self.connReadHandler(conn)
+	if self.ReadBufSize > 0 && len(conns) > 0 {
+		self.readConns(conns)
 	}
 
-	log.Println("stop UDP client")
 	return nil
 }
@@ -0,0 +1,601 @@
+package tnet
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 客户端连接后发送 hello，服务端原样返回，检查客户端收到的数据
+func runEcho(t *testing.T, svr *TcpServer, clt *TcpClient) {
+	svr.OnHandleConnDataCallback = func(self *TcpServer, conn *TCPConnEx, connId uint32, data []byte) (ok bool) {
+		_, err := conn.Write(data)
+		return err == nil
+	}
+	svrDone := make(chan error, 1)
+	go func() {
+		svrDone <- svr.Start()
+	}()
+	defer func() {
+		svr.Close()
+		select {
+		case <-svrDone:
+		case <-time.After(5 * time.Second):
+			t.Error("server did not stop")
+		}
+	}()
+
+	received := make(chan string, 1)
+	clt.OnDialCallback = func(self *TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{}) {
+		_, err := conn.Write([]byte("hello"))
+		return err == nil, read_buf_size, nil
+	}
+	clt.OnHandleConnDataCallback = func(self *TcpClient, conn *TCPConnEx, data []byte) (ok bool) {
+		received <- string(data)
+		return false
+	}
+	go clt.Start()
+	defer clt.Close()
+
+	select {
+	case got := <-received:
+		if got != "hello" {
+			t.Fatalf("got %q, want %q", got, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("echo timeout")
+	}
+}
+
+func TestTcpServerPipe(t *testing.T) {
+	lstn := NewPipeListener("test")
+	svr := NewTcpServer()
+	svr.Listener = lstn
+	clt := NewTcpClient()
+	clt.Addr = "test"
+	clt.Dialer = lstn.DialContext
+	runEcho(t, svr, clt)
+}
+
+// Shutdown 通知所有连接退出并等待，期间不断有新的连接接入
+func TestTcpServerShutdown(t *testing.T) {
+	lstn := NewPipeListener("shutdown")
+	svr := NewTcpServer()
+	svr.Listener = lstn
+	var accepted, closed int32
+	svr.OnAcceptConnCallback = func(self *TcpServer, conn net.Conn, connId uint32) (ok bool, readSize int, connExt interface{}) {
+		atomic.AddInt32(&accepted, 1)
+		return true, read_buf_size, nil
+	}
+	svr.OnCloseConnCallback = func(self *TcpServer, conn *TCPConnEx, connId uint32) {
+		atomic.AddInt32(&closed, 1)
+	}
+	svrDone := make(chan error, 1)
+	go func() {
+		svrDone <- svr.Start()
+	}()
+
+	for i := 0; i < 3; i++ {
+		if _, err := lstn.Dial(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for atomic.LoadInt32(&accepted) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	stop := make(chan struct{})
+	dialDone := make(chan struct{})
+	go func() {
+		defer close(dialDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if conn, err := lstn.Dial(); err == nil {
+				defer conn.Close()
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	close(stop)
+	<-dialDone
+	if err := <-svrDone; err != ErrServerClosed {
+		t.Fatalf("Start returned %v", err)
+	}
+	if a, c := atomic.LoadInt32(&accepted), atomic.LoadInt32(&closed); a != c {
+		t.Fatalf("accepted %d conns, closed %d", a, c)
+	}
+	if err := svr.Shutdown(ctx); err != ErrServerClosed {
+		t.Fatalf("second shutdown: %v", err)
+	}
+}
+
+func TestTcpServerUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "echo.sock")
+
+	svr := NewTcpServer()
+	svr.Network = "unix"
+	svr.Addr = path
+	clt := NewTcpClient()
+	clt.Network = "unix"
+	clt.Addr = path
+	clt.MaxRetry = 10
+	clt.RetryDelay = 50 * time.Millisecond
+	runEcho(t, svr, clt)
+}
+
+func skipWithoutIPv6(t *testing.T) {
+	lstn, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	lstn.Close()
+}
+
+func TestTcpServerDualStack(t *testing.T) {
+	skipWithoutIPv6(t)
+	svr := NewTcpServer()
+	svr.Addr = ":0"
+	svr.DualStack = true
+	addrCh := make(chan net.Addr, 1)
+	svr.OnListenSuccCallback = func(self *TcpServer, lstn net.Listener) (ok bool) {
+		addrCh <- lstn.Addr()
+		return true
+	}
+	svr.OnHandleConnDataCallback = func(self *TcpServer, conn *TCPConnEx, connId uint32, data []byte) (ok bool) {
+		_, err := conn.Write(data)
+		return err == nil
+	}
+	go svr.Start()
+	defer svr.Close()
+
+	_, port, _ := net.SplitHostPort((<-addrCh).String())
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 5*time.Second)
+		if err != nil {
+			t.Fatalf("dial %s: %v", host, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 5)
+		conn.Write([]byte(host[:1] + "ping"))
+		_, err = conn.Read(buf)
+		conn.Close()
+		if err != nil || string(buf) != host[:1]+"ping" {
+			t.Fatalf("echo over %s: %q, %v", host, buf, err)
+		}
+	}
+}
+
+func TestUdpPeerDualStack(t *testing.T) {
+	skipWithoutIPv6(t)
+	svr := NewUdpServer()
+	svr.Addr = ":0"
+	svr.DualStack = true
+	addrCh := make(chan net.Addr, 2)
+	svr.OnListenSuccCallback = func(self *UdpPeer, conn *net.UDPConn) (ok bool) {
+		addrCh <- conn.LocalAddr()
+		return true
+	}
+	svr.OnHandleSessionDataCallback = func(self *UdpPeer, sess *UdpSession, data []byte) (ok bool) {
+		return self.SendTo(sess, data) == nil
+	}
+	done := make(chan struct{})
+	go func() {
+		svr.Start()
+		close(done)
+	}()
+	defer func() {
+		svr.Close()
+		<-done
+	}()
+
+	_, port, _ := net.SplitHostPort((<-addrCh).String())
+	if addr := <-addrCh; addr.(*net.UDPAddr).IP.To4() != nil {
+		t.Fatalf("second socket should be IPv6, got %s", addr)
+	}
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("udp", net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatalf("dial %s: %v", host, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 5)
+		conn.Write([]byte(host[:1] + "ping"))
+		_, err = conn.Read(buf)
+		conn.Close()
+		if err != nil || string(buf) != host[:1]+"ping" {
+			t.Fatalf("echo over %s: %q, %v", host, buf, err)
+		}
+	}
+}
+
+func TestUdpPeerSession(t *testing.T) {
+	svr := NewUdpServer()
+	svr.Addr = "127.0.0.1:0"
+	addrCh := make(chan net.Addr, 1)
+	svr.OnListenSuccCallback = func(self *UdpPeer, conn *net.UDPConn) (ok bool) {
+		addrCh <- conn.LocalAddr()
+		return true
+	}
+	var created, expired int32
+	sessCh := make(chan *UdpSession, 1)
+	svr.OnNewSessionCallback = func(self *UdpPeer, sess *UdpSession) (ok bool) {
+		atomic.AddInt32(&created, 1)
+		sessCh <- sess
+		return true
+	}
+	svr.OnHandleSessionDataCallback = func(self *UdpPeer, sess *UdpSession, data []byte) (ok bool) {
+		return self.SendTo(sess, data) == nil
+	}
+	svr.OnSessionExpiredCallback = func(self *UdpPeer, sess *UdpSession) {
+		atomic.AddInt32(&expired, 1)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- svr.Start()
+	}()
+
+	conn, err := net.Dial("udp", (<-addrCh).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	for i := 0; i < 2; i++ {
+		conn.Write([]byte("ping"))
+		if _, err = conn.Read(buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo: %q, %v", buf, err)
+		}
+	}
+	if n := atomic.LoadInt32(&created); n != 1 {
+		t.Fatalf("created %d sessions, want 1", n)
+	}
+	sess := <-sessCh
+	svr.RemoveSession(sess)
+	svr.RemoveSession(sess)
+	if n := atomic.LoadInt32(&expired); n != 1 {
+		t.Fatalf("expired %d sessions, want 1", n)
+	}
+
+	// 关闭与发送并发进行
+	sendDone := make(chan struct{})
+	go func() {
+		defer close(sendDone)
+		for svr.SendTo(sess, []byte("x")) == nil {
+		}
+	}()
+	svr.Close()
+	<-sendDone
+	<-done
+
+	// Start 之前已经 Close
+	svr = NewUdpServer()
+	svr.Addr = "127.0.0.1:0"
+	svr.Close()
+	if err = svr.Start(); err != ErrServerClosed {
+		t.Fatalf("Start after Close returned %v", err)
+	}
+}
+
+// 启动回显服务器，超时回调记录超时类型，返回 false 关闭连接
+func startTimeoutServer(t *testing.T, svr *TcpServer, keep int) (lstn *PipeListener, kinds chan TimeoutKind) {
+	lstn = NewPipeListener("timeout")
+	kinds = make(chan TimeoutKind, 16)
+	svr.Listener = lstn
+	svr.OnHandleConnDataCallback = func(self *TcpServer, conn *TCPConnEx, connId uint32, data []byte) (ok bool) {
+		_, err := conn.Write(data)
+		return err == nil
+	}
+	var timeouts int32
+	svr.OnTimeoutCallback = func(self *TcpServer, conn *TCPConnEx, connId uint32, kind TimeoutKind) (ok bool) {
+		kinds <- kind
+		return int(atomic.AddInt32(&timeouts, 1)) <= keep
+	}
+	go svr.Start()
+	return lstn, kinds
+}
+
+// 对端关闭连接后读操作返回错误
+func expectConnClosed(t *testing.T, conn net.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 16)
+	for {
+		_, err := conn.Read(buf)
+		if err == nil {
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("conn should be closed by the server")
+		}
+		return
+	}
+}
+
+// 空闲的连接超过 IdleTimeout 后关闭，不断收发数据的连接不会被关闭
+func TestTcpServerIdleTimeout(t *testing.T) {
+	svr := NewTcpServer()
+	svr.IdleTimeout = 200 * time.Millisecond
+	lstn, kinds := startTimeoutServer(t, svr, 0)
+	defer svr.Close()
+
+	idle, err := lstn.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := lstn.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	idleClosed := make(chan time.Duration, 1)
+	go func() {
+		idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+		ioutil.ReadAll(idle)
+		idleClosed <- time.Since(start)
+	}()
+
+	for time.Since(start) < 3*svr.IdleTimeout {
+		checkEcho(t, active, "ping")
+		time.Sleep(svr.IdleTimeout / 4)
+	}
+	if d := <-idleClosed; d < svr.IdleTimeout/2 || d > 2*time.Second {
+		t.Fatalf("idle conn closed after %v", d)
+	}
+	if kind := <-kinds; kind != TimeoutIdle {
+		t.Fatalf("timeout kind %v, want idle", kind)
+	}
+	select {
+	case kind := <-kinds:
+		t.Fatalf("active conn timed out: %v", kind)
+	default:
+	}
+	expectConnClosed(t, active, 5*time.Second)
+}
+
+// OnTimeoutCallback 返回 true 时重新计时，返回 false 后关闭连接
+func TestTcpServerReadTimeoutCallback(t *testing.T) {
+	svr := NewTcpServer()
+	svr.ReadTimeout = 50 * time.Millisecond
+	svr.IdleTimeout = 10 * time.Second
+	lstn, kinds := startTimeoutServer(t, svr, 2)
+	defer svr.Close()
+
+	conn, err := lstn.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectConnClosed(t, conn, 5*time.Second)
+	if n := len(kinds); n != 3 {
+		t.Fatalf("OnTimeoutCallback called %d times, want 3", n)
+	}
+	for i := 0; i < 3; i++ {
+		if kind := <-kinds; kind != TimeoutRead {
+			t.Fatalf("timeout kind %v, want read", kind)
+		}
+	}
+}
+
+func TestTcpClientIdleTimeout(t *testing.T) {
+	lstn := NewPipeListener("client-timeout")
+	defer lstn.Close()
+	go echoAccept(lstn)
+
+	clt := NewTcpClient()
+	clt.Addr = "client-timeout"
+	clt.Dialer = lstn.DialContext
+	clt.IdleTimeout = 100 * time.Millisecond
+	clt.OnDialCallback = func(self *TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{}) {
+		return true, read_buf_size, nil
+	}
+	kinds := make(chan TimeoutKind, 1)
+	clt.OnTimeoutCallback = func(self *TcpClient, conn *TCPConnEx, kind TimeoutKind) (ok bool) {
+		kinds <- kind
+		self.Close()
+		return false
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- clt.Start()
+	}()
+	select {
+	case kind := <-kinds:
+		if kind != TimeoutIdle {
+			t.Fatalf("timeout kind %v, want idle", kind)
+		}
+	case <-time.After(5 * time.Second):
+		clt.Close()
+		t.Fatal("OnTimeoutCallback was not called")
+	}
+	<-done
+}
+
+// 接受连接后立即关闭，客户端每次连接成功后都会断开
+func dropAccept(lstn net.Listener) {
+	for {
+		conn, err := lstn.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
+
+func waitClientStop(t *testing.T, clt *TcpClient, done chan error) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		clt.Close()
+		t.Fatal("client did not stop")
+	}
+}
+
+// 连接不稳定时按指数退避重连，每次重连前后调用回调
+func TestTcpClientReconnect(t *testing.T) {
+	lstn := NewPipeListener("reconnect")
+	defer lstn.Close()
+	go dropAccept(lstn)
+
+	clt := NewTcpClient()
+	clt.Addr = "reconnect"
+	clt.Dialer = lstn.DialContext
+	clt.Reconnect = NewReconnectPolicy()
+	clt.Reconnect.InitialDelay = 10 * time.Millisecond
+	clt.Reconnect.MaxDelay = 40 * time.Millisecond
+	clt.Reconnect.Jitter = 0
+	clt.Reconnect.StableAfter = time.Hour
+	dials := 0
+	clt.OnDialCallback = func(self *TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{}) {
+		dials++
+		return true, read_buf_size, nil
+	}
+	var delays []time.Duration
+	clt.OnReconnectingCallback = func(self *TcpClient, attempt int, delay time.Duration) (ok bool) {
+		if attempt != len(delays)+1 {
+			t.Errorf("reconnecting attempt %d, want %d", attempt, len(delays)+1)
+		}
+		delays = append(delays, delay)
+		return attempt < 5
+	}
+	var reconnected []int
+	clt.OnReconnectedCallback = func(self *TcpClient, conn *TCPConnEx, attempt int) {
+		reconnected = append(reconnected, attempt)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- clt.Start()
+	}()
+	waitClientStop(t, clt, done)
+
+	want := []time.Duration{10e6, 20e6, 40e6, 40e6, 40e6}
+	if len(delays) != len(want) {
+		t.Fatalf("delays %v, want %v", delays, want)
+	}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Fatalf("delays %v, want %v", delays, want)
+		}
+	}
+	if dials != 5 || len(reconnected) != 4 {
+		t.Fatalf("dialed %d times, reconnected %v", dials, reconnected)
+	}
+	for i, attempt := range reconnected {
+		if attempt != i+1 {
+			t.Fatalf("reconnected attempts %v", reconnected)
+		}
+	}
+}
+
+// 连续连接失败 MaxRetry 次后停止
+func TestTcpClientMaxRetry(t *testing.T) {
+	dials := 0
+	clt := NewTcpClient()
+	clt.Addr = "retry"
+	clt.MaxRetry = 2
+	clt.RetryDelay = time.Millisecond
+	clt.Dialer = func(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+		dials++
+		return nil, errors.New("refused")
+	}
+	var attempts []int
+	clt.OnReconnectingCallback = func(self *TcpClient, attempt int, delay time.Duration) (ok bool) {
+		attempts = append(attempts, attempt)
+		return true
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- clt.Start()
+	}()
+	waitClientStop(t, clt, done)
+	if dials != 3 || len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Fatalf("dialed %d times, reconnecting attempts %v", dials, attempts)
+	}
+}
+
+// Close 打断正在进行的退避等待
+func TestTcpClientCloseDuringBackoff(t *testing.T) {
+	clt := NewTcpClient()
+	clt.Addr = "backoff"
+	clt.MaxRetry = -1
+	clt.Reconnect = NewReconnectPolicy()
+	clt.Reconnect.InitialDelay = time.Hour
+	clt.Dialer = func(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+		return nil, errors.New("refused")
+	}
+	waiting := make(chan time.Duration, 1)
+	clt.OnReconnectingCallback = func(self *TcpClient, attempt int, delay time.Duration) (ok bool) {
+		waiting <- delay
+		return true
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- clt.Start()
+	}()
+	if delay := <-waiting; delay < 30*time.Second {
+		t.Fatalf("backoff delay %v", delay)
+	}
+	clt.Close()
+	waitClientStop(t, clt, done)
+}
+
+// 并发移除同一个会话时只移除一次，已经被新会话替换的旧会话不会移除新会话
+func TestUdpPeerRemoveSessionConcurrent(t *testing.T) {
+	exporter := NewPrometheusExporter()
+	svr := NewUdpServer()
+	svr.Metrics = exporter
+	var expired int32
+	svr.OnSessionExpiredCallback = func(self *UdpPeer, sess *UdpSession) {
+		atomic.AddInt32(&expired, 1)
+	}
+	var sessions []*UdpSession
+	for i := 0; i < 16; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000 + i}
+		sessions = append(sessions, svr.loadOrNewSession(nil, addr))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, sess := range sessions {
+				svr.RemoveSession(sess)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&expired); n != int32(len(sessions)) {
+		t.Fatalf("expired %d sessions, want %d", n, len(sessions))
+	}
+	got := exportMetrics(exporter)
+	if !strings.Contains(got, MetricSessionsActive+" 0\n") || !strings.Contains(got, MetricSessionsExpired+" 16\n") {
+		t.Fatalf("session metrics:\n%s", got)
+	}
+
+	old := sessions[0]
+	sess := svr.loadOrNewSession(nil, old.Addr)
+	svr.RemoveSession(old)
+	if svr.PeekSession(old.Addr) != sess {
+		t.Fatal("removing a stale session removed the new one")
+	}
+}
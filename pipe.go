@@ -0,0 +1,76 @@
+package tnet
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+const (
+	pipe_network = "pipe"
+)
+
+type pipeAddr string
+
+func (self pipeAddr) Network() string {
+	return pipe_network
+}
+
+func (self pipeAddr) String() string {
+	return string(self)
+}
+
+// 基于 net.Pipe 的内存 Listener，不经过网络协议栈，主要用于测试
+// TcpServer.Listener 设置为它，TcpClient.Dialer 设置为它的 DialContext，两者就可以在同一个进程内通信
+type PipeListener struct {
+	addr      pipeAddr
+	conns     chan net.Conn
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPipeListener(name string) (obj *PipeListener) {
+	obj = new(PipeListener)
+	obj.addr = pipeAddr(name)
+	obj.conns = make(chan net.Conn)
+	obj.quit = make(chan struct{})
+	return obj
+}
+
+func (self *PipeListener) Accept() (conn net.Conn, err error) {
+	select {
+	case conn = <-self.conns:
+		return conn, nil
+	case <-self.quit:
+		return nil, ErrConnClosed
+	}
+}
+
+func (self *PipeListener) Close() (err error) {
+	self.closeOnce.Do(func() { close(self.quit) })
+	return nil
+}
+
+func (self *PipeListener) Addr() net.Addr {
+	return self.addr
+}
+
+// 创建一对内存连接，一端交给 Accept，另一端返回，阻塞直到被 Accept 或者 ctx 到期
+func (self *PipeListener) DialContext(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+	client, server := net.Pipe()
+	select {
+	case self.conns <- server:
+		return client, nil
+	case <-self.quit:
+		err = ErrConnClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	client.Close()
+	server.Close()
+	return nil, err
+}
+
+func (self *PipeListener) Dial() (conn net.Conn, err error) {
+	return self.DialContext(context.Background(), pipe_network, string(self.addr))
+}
@@ -0,0 +1,220 @@
+package tnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"git.tutils.com/tutils/tnet/tlog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 端口映射，一条 peer 连接上可以同时有多条正向和反向映射
+// 正向映射与 ssh -L 类似：本端监听 Listen，接入的连接通过 DialStream 由对端连接 Target，对端的 TargetFilter 需要允许 Target
+// 反向映射与 ssh -R 类似：通过 cmd_listen 让对端监听 Listen，对端接入的连接由本端连接 Target，对端的 ListenFilter 需要允许 Listen
+// 反向映射的 Target 是本端的配置，不经过本端的 TargetFilter，对端也只能让本端连接配置中的 Target
+
+const (
+	listen_addr_len_size = 2
+)
+
+type PortMapping struct {
+	Reverse bool
+	Listen  string // host:port
+	Target  string // host:port
+}
+
+// 解析 L:listen=target 或者 R:listen=target 格式的映射，例如 L:127.0.0.1:2222=10.0.0.5:22、R::8080=localhost:80
+func ParsePortMapping(s string) (mapping PortMapping, err error) {
+	if len(s) < 2 || s[1] != ':' || (s[0] != 'L' && s[0] != 'R') {
+		return mapping, errors.New(fmt.Sprintf("invalid port mapping(%s)", s))
+	}
+	pos := strings.LastIndexByte(s, '=')
+	if pos < 0 {
+		return mapping, errors.New(fmt.Sprintf("invalid port mapping(%s)", s))
+	}
+	mapping.Reverse = s[0] == 'R'
+	mapping.Listen = s[2:pos]
+	mapping.Target = s[pos+1:]
+	if _, _, err = net.SplitHostPort(mapping.Listen); err != nil {
+		return mapping, err
+	}
+	if _, _, err = net.SplitHostPort(mapping.Target); err != nil {
+		return mapping, err
+	}
+	return mapping, nil
+}
+
+// listen = cmd:uint16 + mappingId:uint32 + listenLen:uint16 + listen:string(listenLen) + target:string
+func packListen(listen string, target string) (data []byte) {
+	data = make([]byte, listen_addr_len_size, listen_addr_len_size+len(listen)+len(target))
+	binary.BigEndian.PutUint16(data, uint16(len(listen)))
+	data = append(data, listen...)
+	data = append(data, target...)
+	return data
+}
+
+func unpackListen(data []byte) (listen string, target string, err error) {
+	if len(data) < listen_addr_len_size {
+		return "", "", errors.New(fmt.Sprintf("listen packet too short(%d)", len(data)))
+	}
+	size := int(binary.BigEndian.Uint16(data))
+	data = data[listen_addr_len_size:]
+	if size > len(data) {
+		return "", "", errors.New(fmt.Sprintf("listen addr length field(%d) exceeds packet(%d)", size, len(data)))
+	}
+	return string(data[:size]), string(data[size:]), nil
+}
+
+// 反向映射的 Target 需要在 peer 读例程开始前记录下来
+func (self *EncryptTunPeer) loadReverseTargets() {
+	self.reverseTargets = make(map[string]bool)
+	for _, mapping := range self.Mappings {
+		if mapping.Reverse {
+			self.reverseTargets[mapping.Target] = true
+		}
+	}
+}
+
+// Start 完成握手后启动配置的映射
+func (self *EncryptTunPeer) startMappings() {
+	if len(self.Mappings) == 0 {
+		return
+	}
+	// 写 peer 可能阻塞到对端开始读取，不能在 Start 中直接发送
+	self.goTask(func() {
+		for i, mapping := range self.Mappings {
+			if mapping.Reverse {
+				self.Logger.Info("request reverse mapping", tlog.F("listen", mapping.Listen), tlog.F("target", mapping.Target))
+				self.writePacket(cmd_listen, uint32(i), packListen(mapping.Listen, mapping.Target))
+				continue
+			}
+			lstn, err := net.Listen("tcp", mapping.Listen)
+			if err != nil {
+				self.Logger.Error("start mapping listener failed", tlog.F("listen", mapping.Listen), tlog.Err(err))
+				continue
+			}
+			self.goServeMapping(lstn, mapping.Target)
+		}
+	})
+}
+
+// 接受 lstn 上的连接并通过 DialStream 转发到对端的 target，隧道关闭时关闭 lstn
+func (self *EncryptTunPeer) goServeMapping(lstn net.Listener, target string) {
+	self.Logger.Info("start mapping listener", tlog.Addr(lstn.Addr()), tlog.F("target", target))
+	if !self.addTask(2) {
+		lstn.Close()
+		return
+	}
+	go func() {
+		defer self.wg.Done()
+		<-self.quit
+		lstn.Close()
+	}()
+	go func() {
+		defer self.wg.Done()
+		for {
+			conn, err := lstn.Accept()
+			if err != nil {
+				self.Logger.Info("accept mapping conn failed", tlog.Addr(lstn.Addr()), tlog.Err(err))
+				lstn.Close()
+				return
+			}
+			if !self.addTask(1) {
+				conn.Close()
+				lstn.Close()
+				return
+			}
+			go func() {
+				defer self.wg.Done()
+				stream, err := self.DialStream(target)
+				if err != nil {
+					self.Logger.Warn("dial mapping target failed", tlog.RemoteAddr(conn.RemoteAddr()), tlog.F("target", target), tlog.Err(err))
+					conn.Close()
+					return
+				}
+				ts := stream.(*tunStream)
+				self.Logger.Info("new mapping conn", tlog.ConnId(ts.id), tlog.RemoteAddr(conn.RemoteAddr()), tlog.F("target", target))
+				self.goForward(conn, ts)
+			}()
+		}
+	}()
+}
+
+// 收到对端的 cmd_listen，按 ListenFilter 检查后监听，并回复 cmd_listen_result
+func (self *EncryptTunPeer) handleListen(mappingId uint32, data []byte) {
+	listen, target, err := unpackListen(data)
+	if err != nil {
+		self.Logger.Warn("unpack listen failed", tlog.Err(err))
+		return
+	}
+	result := self.listenAllowed(listen)
+	if result == connect_ok {
+		lstn, err := net.Listen("tcp", listen)
+		if err != nil {
+			self.Logger.Warn("start reverse mapping listener failed", tlog.F("listen", listen), tlog.Err(err))
+			result = connect_failed
+		} else {
+			self.goServeMapping(lstn, target)
+		}
+	} else {
+		self.Logger.Warn("reverse mapping refused", tlog.F("listen", listen))
+	}
+	// 在 peer 读例程中，写入可能阻塞，不能直接发送
+	self.goTask(func() {
+		self.writePacket(cmd_listen_result, mappingId, []byte{result})
+	})
+}
+
+func (self *EncryptTunPeer) listenAllowed(listen string) (result byte) {
+	if self.ListenFilter == nil {
+		return connect_refused
+	}
+	host, portStr, err := net.SplitHostPort(listen)
+	if err != nil {
+		return connect_failed
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return connect_failed
+	}
+	ip := net.ParseIP(host)
+	if host == "" {
+		ip = net.IPv4zero
+	}
+	if !self.ListenFilter.Allow(host, ip, port) {
+		return connect_refused
+	}
+	return connect_ok
+}
+
+func (self *EncryptTunPeer) handleListenResult(mappingId uint32, data []byte) {
+	if len(data) < 1 || int(mappingId) >= len(self.Mappings) {
+		self.Logger.Warn("invalid listen result", tlog.F("mapping", mappingId))
+		return
+	}
+	mapping := self.Mappings[mappingId]
+	if data[0] != connect_ok {
+		self.Logger.Error("reverse mapping failed", tlog.F("listen", mapping.Listen), tlog.F("target", mapping.Target), tlog.F("result", data[0]))
+		return
+	}
+	self.Logger.Info("reverse mapping started", tlog.F("listen", mapping.Listen), tlog.F("target", mapping.Target))
+}
+
+// 对端通过反向映射打开的连接，由本端连接映射的 Target
+func (self *EncryptTunPeer) goDialReverse(stream *tunStream) {
+	self.goTask(func() {
+		self.Logger.Info("dial to reverse mapping target", tlog.ConnId(stream.id), tlog.F("target", stream.target))
+		conn, err := net.DialTimeout("tcp", stream.target, tun_dial_timeout)
+		if err != nil {
+			self.Logger.Warn("dial to reverse mapping target failed", tlog.ConnId(stream.id), tlog.F("target", stream.target), tlog.Err(err))
+			self.dialFailed(connect_failed)
+			stream.writePacket(cmd_connect_result, []byte{connect_failed})
+			stream.Close()
+			return
+		}
+		stream.writePacket(cmd_connect_result, []byte{connect_ok})
+		self.goForward(conn, stream)
+	})
+}
@@ -0,0 +1,89 @@
+package tnet
+
+import (
+	"sync"
+	"time"
+)
+
+// 令牌桶，rate 为每秒生成的令牌数，burst 为桶的容量
+type tokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) (obj *tokenBucket) {
+	obj = new(tokenBucket)
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	obj.rate = rate
+	obj.burst = float64(burst)
+	obj.tokens = obj.burst
+	obj.last = time.Now()
+	return obj
+}
+
+func (self *tokenBucket) refill(now time.Time) {
+	delta := now.Sub(self.last).Seconds()
+	self.last = now
+	self.tokens += delta * self.rate
+	if self.tokens > self.burst {
+		self.tokens = self.burst
+	}
+}
+
+// 令牌足够时取出 n 个令牌并返回 true，否则不取出并返回 false
+func (self *tokenBucket) allow(n float64) (ok bool) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.refill(time.Now())
+	if self.tokens < n {
+		return false
+	}
+	self.tokens -= n
+	return true
+}
+
+// 预先取出 n 个令牌（允许透支），返回需要等待多久这些令牌才真正可用
+func (self *tokenBucket) reserve(n float64) (wait time.Duration) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.refill(time.Now())
+	self.tokens -= n
+	if self.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-self.tokens / self.rate * 1e9)
+}
+
+// 令牌不少于 least 个时取出最多 n 个，否则不取出，并返回还需要等待多久才有 least 个令牌
+func (self *tokenBucket) take(n int, least int) (got int, wait time.Duration) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.refill(time.Now())
+	if self.tokens < float64(least) {
+		return 0, time.Duration((float64(least) - self.tokens) / self.rate * 1e9)
+	}
+	got = n
+	if float64(got) > self.tokens {
+		got = int(self.tokens)
+	}
+	self.tokens -= float64(got)
+	return got, 0
+}
+
+// 归还 take 取出但没有用掉的令牌
+func (self *tokenBucket) refund(n int) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.tokens += float64(n)
+	if self.tokens > self.burst {
+		self.tokens = self.burst
+	}
+}
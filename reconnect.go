@@ -0,0 +1,44 @@
+package tnet
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// 指数退避重连策略
+type ReconnectPolicy struct {
+	InitialDelay time.Duration // 第一次失败后的等待时间
+	MaxDelay     time.Duration // 等待时间上限
+	Multiplier   float64       // 每次失败后等待时间的倍数
+	Jitter       float64       // 随机抖动比例，0.2 表示实际等待时间在计算值的 [0.8, 1.2] 倍之间
+	StableAfter  time.Duration // 连接保持超过该时间才算稳定，断开后重置退避，否则按一次失败计算
+}
+
+func NewReconnectPolicy() (obj *ReconnectPolicy) {
+	obj = new(ReconnectPolicy)
+	obj.InitialDelay = 1e9
+	obj.MaxDelay = 60e9
+	obj.Multiplier = 2
+	obj.Jitter = 0.2
+	obj.StableAfter = 30e9
+	return obj
+}
+
+// 连续失败 attempt 次后需要等待的时间
+func (self *ReconnectPolicy) delay(attempt int, rnd *rand.Rand) (ret time.Duration) {
+	if attempt <= 0 {
+		return 0
+	}
+	d := float64(self.InitialDelay) * math.Pow(self.Multiplier, float64(attempt-1))
+	if self.MaxDelay > 0 && d > float64(self.MaxDelay) {
+		d = float64(self.MaxDelay)
+	}
+	if self.Jitter > 0 {
+		d *= 1 + self.Jitter*(rnd.Float64()*2-1)
+	}
+	if self.MaxDelay > 0 && d > float64(self.MaxDelay) {
+		d = float64(self.MaxDelay)
+	}
+	return time.Duration(d)
+}
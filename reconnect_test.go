@@ -0,0 +1,41 @@
+package tnet
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// 等待时间按 Multiplier 增长，不超过 MaxDelay
+func TestReconnectPolicyDelay(t *testing.T) {
+	policy := NewReconnectPolicy()
+	policy.InitialDelay = 100 * time.Millisecond
+	policy.MaxDelay = time.Second
+	policy.Jitter = 0
+	rnd := rand.New(rand.NewSource(1))
+	for attempt, want := range []time.Duration{0, 100e6, 200e6, 400e6, 800e6, 1e9, 1e9} {
+		if got := policy.delay(attempt, rnd); got != want {
+			t.Fatalf("attempt %d: delay %v, want %v", attempt, got, want)
+		}
+	}
+	if got := policy.delay(1000, rnd); got != policy.MaxDelay {
+		t.Fatalf("delay of a large attempt %v, want %v", got, policy.MaxDelay)
+	}
+}
+
+// 抖动后的等待时间在 [1-Jitter, 1+Jitter] 倍之间，也不超过 MaxDelay
+func TestReconnectPolicyJitter(t *testing.T) {
+	policy := NewReconnectPolicy()
+	policy.InitialDelay = 100 * time.Millisecond
+	policy.MaxDelay = time.Second
+	policy.Jitter = 0.2
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if d := policy.delay(2, rnd); d < 160*time.Millisecond || d > 240*time.Millisecond {
+			t.Fatalf("delay %v out of range", d)
+		}
+		if d := policy.delay(10, rnd); d < 800*time.Millisecond || d > policy.MaxDelay {
+			t.Fatalf("capped delay %v out of range", d)
+		}
+	}
+}
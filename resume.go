@@ -0,0 +1,109 @@
+package tnet
+
+import (
+	"git.tutils.com/tutils/tnet/tlog"
+	"math/rand"
+	"time"
+)
+
+// 会话恢复，最后一条 peer 连接断开后，设置了 ResumeTimeout 的隧道不会立即 clean，而是挂起等待新的连接加入会话
+// 挂起期间 stream 保持打开，写入的数据留在重发缓冲区中，最多一个窗口，之后 Write 阻塞；Read 阻塞到恢复后收到数据
+// 客户端通过 Redial 或者调用者通过 AddLink 重新建立连接，用 cmd_session 加入原来的会话，服务端的会话在挂起期间仍然留在 Sessions 中
+// 新的连接加入后，挂起的一端把所有 stream 迁移到这条连接，重发对端还没有读走的数据，并通过 cmd_resume 让对端从本端已经收到的偏移重发
+// 对端如果还没有发现旧的连接断开，收到 cmd_resume 后同样改用新的连接；接收方按偏移去重，两端重发的数据不会重复交付
+// 超过 ResumeTimeout 还没有连接加入时 clean 隧道，Start 返回；对端分不清连接断开和本端 Close，本端 Close 后对端同样会挂起到超时
+
+// 挂起会话，没有设置 ResumeTimeout 或者隧道已经关闭时返回 false，由调用者 clean
+func (self *EncryptTunPeer) suspend() (ok bool) {
+	if self.ResumeTimeout <= 0 {
+		return false
+	}
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	select {
+	case <-self.quit:
+		return false
+	default:
+	}
+	if len(self.links) > 0 || self.resumeTimer != nil {
+		return true
+	}
+	self.suspendSeq++
+	seq := self.suspendSeq
+	self.resumeTimer = time.AfterFunc(self.ResumeTimeout, func() {
+		self.resumeTimeout(seq)
+	})
+	self.Logger.Warn("all links lost, suspend session", tlog.F("timeout", self.ResumeTimeout))
+	if self.mode == server_mode_proxy && self.Redial != nil {
+		// 已经在 mtx 保护下检查过 quit，参见 addTask
+		self.wg.Add(1)
+		go self.redial(seq, time.Now().Add(self.ResumeTimeout))
+	}
+	return true
+}
+
+// 结束挂起，返回之前是否处于挂起状态，调用者需要持有 mtx
+func (self *EncryptTunPeer) stopSuspend() (resumed bool) {
+	if self.resumeTimer == nil {
+		return false
+	}
+	self.resumeTimer.Stop()
+	self.resumeTimer = nil
+	return true
+}
+
+// 是否还处于第 seq 次挂起
+func (self *EncryptTunPeer) suspending(seq uint32) bool {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	return self.resumeTimer != nil && self.suspendSeq == seq
+}
+
+func (self *EncryptTunPeer) resumeTimeout(seq uint32) {
+	if !self.suspending(seq) {
+		return
+	}
+	self.Logger.Error("resume session timeout, close tunnel", tlog.F("timeout", self.ResumeTimeout))
+	self.clean()
+}
+
+// 客户端在挂起期间按 Reconnect 的退避策略调用 Redial 重新建立连接并加入会话，直到恢复、超时或者隧道关闭
+func (self *EncryptTunPeer) redial(seq uint32, deadline time.Time) {
+	defer self.wg.Done()
+	policy := self.Reconnect
+	if policy == nil {
+		policy = NewReconnectPolicy()
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for attempt := 0; ; attempt++ {
+		delay := policy.delay(attempt, rnd)
+		if remain := time.Until(deadline); delay > remain {
+			delay = remain
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-self.quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !self.suspending(seq) || !time.Now().Before(deadline) {
+			return
+		}
+		conn, err := self.Redial()
+		if err != nil {
+			self.Logger.Warn("redial peer failed", tlog.F("attempt", attempt+1), tlog.Err(err))
+			continue
+		}
+		err = self.AddLink(conn)
+		if err == nil {
+			return
+		}
+		if err == ErrTunJoinRefused {
+			// 对端已经清理了会话，不用再等待；clean 会等待这个例程结束，不能在这里同步调用
+			self.Logger.Error("session lost on peer, close tunnel")
+			go self.clean()
+			return
+		}
+	}
+}
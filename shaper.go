@@ -0,0 +1,200 @@
+package tnet
+
+import (
+	"sync"
+	"time"
+)
+
+// 隧道的带宽整形，两个方向分别限制：发送方向在 stream 的 Write 中限制；接收方向在 Read 中限制，
+// 读得慢归还信用也慢，对端的发送被流量控制拖慢，peer 读例程不会因此阻塞
+// 每个方向有隧道级和 stream 级两个令牌桶，数据需要同时取得两者的令牌
+// 隧道级的令牌桶由所有 stream 共享，令牌不足时按优先级排队：有更高优先级的 stream 在等待时，低优先级的 stream 不能取得令牌
+// 交互式的连接设置为 PriorityHigh、大流量传输设置为 PriorityLow 后，交互式的连接不会被同一隧道中的大流量传输饿死
+
+const (
+	shape_min_chunk      = 0x1000 // 令牌不足时至少攒够这么多再发送，避免切出很多小包
+	shape_yield_interval = 10e6   // 让给更高优先级的 stream 后重新检查的间隔
+)
+
+// 带宽限制，单位为字节每秒
+type RateLimit struct {
+	Rate  float64 // 为 0 表示不限制
+	Burst int     // 突发容量，0 表示与 Rate 相同
+}
+
+// stream 在隧道级带宽限制中的优先级
+type StreamPriority int
+
+const (
+	PriorityLow    StreamPriority = -1 // 大流量传输
+	PriorityNormal StreamPriority = 0
+	PriorityHigh   StreamPriority = 1 // 交互式连接
+
+	priority_count = 3
+)
+
+func (self StreamPriority) clamp() StreamPriority {
+	if self < PriorityLow {
+		return PriorityLow
+	}
+	if self > PriorityHigh {
+		return PriorityHigh
+	}
+	return self
+}
+
+func newRateBucket(limit RateLimit) (bucket *tokenBucket) {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	return newTokenBucket(limit.Rate, limit.Burst)
+}
+
+// 隧道一个方向的带宽限制，由所有 stream 共享
+type tunShaper struct {
+	bucket  *tokenBucket
+	mtx     sync.Mutex
+	waiting [priority_count]int // 各个优先级正在等待令牌的 stream 数
+}
+
+func newTunShaper(limit RateLimit) (obj *tunShaper) {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	obj = new(tunShaper)
+	obj.bucket = newTokenBucket(limit.Rate, limit.Burst)
+	return obj
+}
+
+// 与 tokenBucket.take 相同，有更高优先级的 stream 在等待时不取出令牌
+func (self *tunShaper) take(n int, least int, priority StreamPriority) (got int, wait time.Duration) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	for p := priority + 1; p <= PriorityHigh; p++ {
+		if self.waiting[p-PriorityLow] > 0 {
+			return 0, shape_yield_interval
+		}
+	}
+	return self.bucket.take(n, least)
+}
+
+func (self *tunShaper) setWaiting(priority StreamPriority, delta int) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.waiting[priority-PriorityLow] += delta
+}
+
+// 新建的连接按 Classify 设置优先级，接受的连接在 peer 读例程中调用，Classify 不能阻塞
+func (self *EncryptTunPeer) classify(stream *tunStream) {
+	if self.Classify != nil {
+		stream.priority = self.Classify(stream).clamp()
+	}
+}
+
+// 按带宽限制取得最多 n 个字节的令牌，send 为 true 时是发送方向，否则是接收方向
+// 令牌不足时阻塞，受本地关闭和读写超时的影响
+func (self *tunStream) shape(n int, send bool) (granted int, err error) {
+	tun := self.peer.recvShaper
+	self.mtx.Lock()
+	bucket := self.recvBucket
+	if send {
+		tun = self.peer.sendShaper
+		bucket = self.sendBucket
+	}
+	priority := self.priority
+	self.mtx.Unlock()
+	if n <= 0 || (bucket == nil && tun == nil) {
+		return n, nil
+	}
+
+	least := n
+	if least > shape_min_chunk {
+		least = shape_min_chunk
+	}
+	if bucket != nil && least > int(bucket.burst) {
+		least = int(bucket.burst)
+	}
+	if tun != nil && least > int(tun.bucket.burst) {
+		least = int(tun.bucket.burst)
+	}
+	waiting := false
+	defer func() {
+		if waiting {
+			tun.setWaiting(priority, -1)
+		}
+	}()
+	for {
+		granted = n
+		var wait time.Duration
+		if bucket != nil {
+			granted, wait = bucket.take(granted, least)
+		}
+		if granted == 0 && waiting {
+			// 受 stream 自己的限制时不占用隧道的排队位置
+			tun.setWaiting(priority, -1)
+			waiting = false
+		}
+		if granted > 0 && tun != nil {
+			var got int
+			got, wait = tun.take(granted, least, priority)
+			if got < granted && bucket != nil {
+				bucket.refund(granted - got)
+			}
+			granted = got
+			if granted == 0 && !waiting {
+				tun.setWaiting(priority, 1)
+				waiting = true
+			}
+		}
+		if granted > 0 {
+			return granted, nil
+		}
+		if err = self.pause(wait, send); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// 等待 d，期间本地关闭或者读写超时时返回错误
+func (self *tunStream) pause(d time.Duration, write bool) (err error) {
+	until := time.Now().Add(d)
+	timer := time.AfterFunc(d, func() {
+		self.mtx.Lock()
+		self.cond.Broadcast()
+		self.mtx.Unlock()
+	})
+	defer timer.Stop()
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	for {
+		if self.localClosed {
+			return ErrConnClosed
+		}
+		deadline := self.readDeadline
+		if write {
+			deadline = self.writeDeadline
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return errTunTimeout
+		}
+		if !time.Now().Before(until) {
+			return nil
+		}
+		self.cond.Wait()
+	}
+}
+
+// 设置这条连接在隧道级带宽限制中的优先级
+func (self *tunStream) SetPriority(priority StreamPriority) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.priority = priority.clamp()
+}
+
+// 设置这条连接发送和接收的带宽限制，Rate 为 0 表示不限制
+func (self *tunStream) SetRateLimit(send RateLimit, recv RateLimit) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.sendBucket = newRateBucket(send)
+	self.recvBucket = newRateBucket(recv)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -20,8 +21,22 @@ const (
 	xor_encrypt_seed int64 = 776103
 )
 
+var (
+	sldeRidMtx sync.Mutex
+	sldeRidRnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func nextSldeRid() (rid uint32) {
+	sldeRidMtx.Lock()
+	rid = sldeRidRnd.Uint32()
+	sldeRidMtx.Unlock()
+	return rid
+}
+
+// 缓冲区来自缓冲区池，不再使用时可以调用 Release 归还
 type Slde struct {
 	writebuf    *bytes.Buffer
+	decodebuf   *bytes.Buffer
 	length      int
 	nextToWrite int
 
@@ -40,22 +55,20 @@ func (self *Slde) Write(data []byte) (n int, err error) {
 		}
 
 		// header enough
-		var stx byte
-		binary.Read(self.writebuf, binary.BigEndian, &stx)
-		if stx != SLDE_STX {
+		header := self.writebuf.Next(SLDE_HEADER_SIZE)
+		if header[0] != SLDE_STX {
 			self.nextToWrite = -1
 			return -1, errors.New("field stx err")
 		}
 
 		// TODO: add custom field
-		binary.Read(self.writebuf, binary.BigEndian, &self.rid)
+		self.rid = binary.BigEndian.Uint32(header[1:])
 		//log.Printf("decode slde.rid: %04X", self.rid)
 
-		var length int32
-		binary.Read(self.writebuf, binary.BigEndian, &length)
-		if length < 0 {
+		length := int32(binary.BigEndian.Uint32(header[1+SLDE_CUSTOM_SIZE:]))
+		if length < 0 || int(length) > max_frame_size {
 			self.nextToWrite = -1
-			return -1, errors.New("field length err")
+			return -1, errors.New(fmt.Sprintf("field length err(%d)", length))
 		}
 		self.length = int(length)
 		//log.Println("decode slde.length:", self.length)
@@ -86,13 +99,51 @@ func (self *Slde) WriteAndGetNextToWrite(data []byte) (left int, err error) {
 }
 
 func (self *Slde) Decode() (ret []byte, err error) {
+	data, err := self.decode()
+	if err != nil {
+		return nil, err
+	}
+	ret = make([]byte, len(data))
+	copy(ret, data)
+	return ret, nil
+}
+
+func (self *Slde) checkLength() (err error) {
 	if self.length < 0 || self.writebuf.Len() != self.length+1 {
-		return nil, errors.New(fmt.Sprintf("data format err, length field(%d), real data field length(%d), data after header: [% x]", self.length, self.writebuf.Len()-1, self.writebuf.Bytes()))
+		return errors.New(fmt.Sprintf("data format err, length field(%d), real data field length(%d), data after header: [% x]", self.length, self.writebuf.Len()-1, self.writebuf.Bytes()))
+	}
+	if self.decodebuf == nil {
+		self.decodebuf = getBuffer()
 	}
+	self.decodebuf.Reset()
+	return nil
+}
 
-	ret = self.writebuf.Bytes()[:self.length]
-	ret, err = zlibXorDecrypt(ret, xor_encrypt_seed)
-	return ret, err
+// 与 Decode 相同，但返回的数据引用内部缓冲区，只在下一次 decode 或 Release 之前有效
+func (self *Slde) decode() (ret []byte, err error) {
+	if err = self.checkLength(); err != nil {
+		return nil, err
+	}
+	err = zlibXorDecryptTo(self.decodebuf, self.writebuf.Bytes()[:self.length], xor_encrypt_seed)
+	if err != nil {
+		return nil, err
+	}
+	return self.decodebuf.Bytes(), nil
+}
+
+// 用 c 解密后用 comp 解压，解密在接收缓冲区上原地进行，返回的数据引用内部缓冲区
+func (self *Slde) open(c frameCipher, comp *frameCompressor) (ret []byte, err error) {
+	if err = self.checkLength(); err != nil {
+		return nil, err
+	}
+	data, err := c.open(self.writebuf.Bytes()[:self.length])
+	if err != nil {
+		return nil, err
+	}
+	if err = comp.decompressTo(self.decodebuf, data); err != nil {
+		return nil, err
+	}
+	return self.decodebuf.Bytes(), nil
 }
 
 func (self *Slde) DecodeAndReset() (ret []byte, err error) {
@@ -103,23 +154,14 @@ func (self *Slde) DecodeAndReset() (ret []byte, err error) {
 	return ret, err
 }
 
+// 返回的数据引用内部缓冲区，只在下一次 Encode、Reset 或 Release 之前有效
 func (self *Slde) Encode(data []byte) (ret []byte, err error) {
-	data = zlibXorEncrypt(data, xor_encrypt_seed)
-	self.length = len(data)
+	self.writebuf.Reset()
+	encodeSldeTo(self.writebuf, data)
+	self.rid = binary.BigEndian.Uint32(self.writebuf.Bytes()[1:])
+	self.length = self.writebuf.Len() - SLDE_HEADER_SIZE - 1
 	self.nextToWrite = 0
 	//log.Println("encode slde.length:", self.length)
-	self.writebuf.Reset()
-	binary.Write(self.writebuf, binary.BigEndian, SLDE_STX)
-
-	// TODO: add custom fields
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-	self.rid = rnd.Uint32()
-	//log.Printf("encode slde.rid: %04X", self.rid)
-	binary.Write(self.writebuf, binary.BigEndian, self.rid)
-
-	binary.Write(self.writebuf, binary.BigEndian, int32(self.length))
-	self.writebuf.Write(data)
-	binary.Write(self.writebuf, binary.BigEndian, SLDE_ETX)
 	return self.writebuf.Bytes(), nil
 }
 
@@ -136,38 +178,64 @@ func (self *Slde) Reset() {
 	self.rid = 0
 }
 
-func (self *Slde) encodeHeader() {
-	//self.length = len(data)
-	//log.Println("encode slde.length:", self.length)
-	self.writebuf.Reset()
-	binary.Write(self.writebuf, binary.BigEndian, SLDE_STX)
+// 将缓冲区归还到缓冲区池，之后不能再使用这个 Slde
+func (self *Slde) Release() {
+	if self.writebuf != nil {
+		putBuffer(self.writebuf)
+		self.writebuf = nil
+	}
+	if self.decodebuf != nil {
+		putBuffer(self.decodebuf)
+		self.decodebuf = nil
+	}
+}
 
+// 将 data 编码成一个完整的 Slde 帧追加到 dst
+func encodeSldeTo(dst *bytes.Buffer, data []byte) {
+	start := dst.Len()
+	var header [SLDE_HEADER_SIZE]byte
+	header[0] = SLDE_STX
 	// TODO: add custom fields
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-	self.rid = rnd.Uint32()
-	//log.Printf("encode slde.rid: %04X", self.rid)
-	binary.Write(self.writebuf, binary.BigEndian, self.rid)
+	binary.BigEndian.PutUint32(header[1:], nextSldeRid())
+	dst.Write(header[:])
+
+	zlibXorEncryptTo(dst, data, xor_encrypt_seed)
+	length := dst.Len() - start - SLDE_HEADER_SIZE
+	binary.BigEndian.PutUint32(dst.Bytes()[start+1+SLDE_CUSTOM_SIZE:], uint32(length))
+	dst.WriteByte(SLDE_ETX)
+}
+
+// 将已经压缩的 data 用 c 加密，编码成一个完整的 Slde 帧追加到 dst
+func sealSldeTo(dst *bytes.Buffer, data []byte, c frameCipher) {
+	start := dst.Len()
+	var header [SLDE_HEADER_SIZE]byte
+	header[0] = SLDE_STX
+	binary.BigEndian.PutUint32(header[1:], nextSldeRid())
+	dst.Write(header[:])
+
+	c.sealTo(dst, data)
+	length := dst.Len() - start - SLDE_HEADER_SIZE
+	binary.BigEndian.PutUint32(dst.Bytes()[start+1+SLDE_CUSTOM_SIZE:], uint32(length))
+	dst.WriteByte(SLDE_ETX)
 }
 
 func NewSlde() (obj *Slde) {
 	obj = new(Slde)
-	obj.writebuf = &bytes.Buffer{}
-	obj.writebuf.Grow(0xffff)
+	obj.writebuf = getBuffer()
 	obj.length = -1
 	obj.nextToWrite = SLDE_HEADER_SIZE
 	return obj
 }
 
 func EncodeToSldeDataFromBytes(data []byte) (ret []byte, err error) {
-	obj := new(Slde)
-	obj.writebuf = &bytes.Buffer{}
-	obj.writebuf.Grow(SLDE_HEADER_SIZE + len(data) + 1)
-	ret, err = obj.Encode(data)
-	return ret, err
+	buf := bytes.NewBuffer(make([]byte, 0, SLDE_HEADER_SIZE+len(data)+1))
+	encodeSldeTo(buf, data)
+	return buf.Bytes(), nil
 }
 
 func DecodeToBytesFromSldeReader(r io.Reader) (ret []byte, err error) {
 	slde := NewSlde()
+	defer slde.Release()
 	for {
 		n, err := io.CopyN(slde, r, int64(slde.GetNextToWrite()))
 		if err != nil {
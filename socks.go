@@ -0,0 +1,221 @@
+package tnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"git.tutils.com/tutils/tnet/tlog"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// proxy 端的 SOCKS5 和 HTTP CONNECT 代理，每个请求通过 DialStream 让 agent 连接请求的目标
+// 两种协议共用一个端口，第一个字节是 socks5_version 的按 SOCKS5 处理，否则按 HTTP 处理
+// SOCKS5 只支持无认证和 CONNECT 命令
+
+const (
+	socks5_version       byte = 5
+	socks5_auth_none     byte = 0
+	socks5_auth_no_match byte = 0xff
+	socks5_cmd_connect   byte = 1
+	socks5_atyp_ipv4     byte = 1
+	socks5_atyp_domain   byte = 3
+	socks5_atyp_ipv6     byte = 4
+
+	socks5_rep_succeeded         byte = 0
+	socks5_rep_general_failure   byte = 1
+	socks5_rep_not_allowed       byte = 2
+	socks5_rep_host_unreachable  byte = 4
+	socks5_rep_cmd_not_supported byte = 7
+	socks5_rep_atyp_unsupported  byte = 8
+
+	proxy_handshake_timeout time.Duration = 30e9
+)
+
+// 在 lstn 上提供 SOCKS5 和 HTTP CONNECT 代理，lstn 出错或者隧道关闭后返回
+// 同时按 TargetFilter 转发对端通过正向映射打开的连接，调用后不能再使用 Accept
+func (self *EncryptTunPeer) ServeProxy(lstn net.Listener) (err error) {
+	self.goForwardLoop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-self.quit:
+			lstn.Close()
+		case <-done:
+		}
+	}()
+
+	self.Logger.Info("start proxy server", tlog.Addr(lstn.Addr()))
+	for {
+		conn, err := lstn.Accept()
+		if err != nil {
+			self.Logger.Info("accept proxy conn failed", tlog.Err(err))
+			return err
+		}
+		go self.handleProxyConn(conn)
+	}
+}
+
+func (self *EncryptTunPeer) handleProxyConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(proxy_handshake_timeout))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	var stream net.Conn
+	if first[0] == socks5_version {
+		stream, err = self.handleSocks5(conn, br)
+	} else {
+		stream, err = self.handleHTTPConnect(conn, br)
+	}
+	if err != nil {
+		self.Logger.Info("proxy request failed", tlog.RemoteAddr(conn.RemoteAddr()), tlog.Err(err))
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// 客户端可能在收到回复之前就发送了数据
+	if n := br.Buffered(); n > 0 {
+		data, _ := br.Peek(n)
+		if _, err = stream.Write(data); err != nil {
+			conn.Close()
+			stream.Close()
+			return
+		}
+	}
+	ts := stream.(*tunStream)
+	self.Logger.Info("new proxy conn", tlog.ConnId(ts.id), tlog.RemoteAddr(conn.RemoteAddr()), tlog.F("target", ts.target))
+	self.goForward(conn, ts)
+}
+
+// 回复中的绑定地址对客户端没有意义，固定为 0.0.0.0:0
+func socks5Reply(rep byte) []byte {
+	return []byte{socks5_version, rep, 0, socks5_atyp_ipv4, 0, 0, 0, 0, 0, 0}
+}
+
+func socks5ReplyForError(err error) (rep byte) {
+	switch err {
+	case ErrTunConnectRefused:
+		return socks5_rep_not_allowed
+	case ErrTunConnectFailed:
+		return socks5_rep_host_unreachable
+	default:
+		return socks5_rep_general_failure
+	}
+}
+
+func readSocks5Target(br *bufio.Reader) (target string, rep byte, err error) {
+	var header [4]byte
+	if _, err = io.ReadFull(br, header[:]); err != nil {
+		return "", socks5_rep_general_failure, err
+	}
+	if header[1] != socks5_cmd_connect {
+		return "", socks5_rep_cmd_not_supported, errors.New(fmt.Sprintf("unsupported socks5 cmd(%d)", header[1]))
+	}
+
+	var host string
+	switch header[3] {
+	case socks5_atyp_ipv4, socks5_atyp_ipv6:
+		ip := make([]byte, net.IPv4len)
+		if header[3] == socks5_atyp_ipv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err = io.ReadFull(br, ip); err != nil {
+			return "", socks5_rep_general_failure, err
+		}
+		host = net.IP(ip).String()
+	case socks5_atyp_domain:
+		size, err := br.ReadByte()
+		if err != nil {
+			return "", socks5_rep_general_failure, err
+		}
+		domain := make([]byte, size)
+		if _, err = io.ReadFull(br, domain); err != nil {
+			return "", socks5_rep_general_failure, err
+		}
+		host = string(domain)
+	default:
+		return "", socks5_rep_atyp_unsupported, errors.New(fmt.Sprintf("unsupported socks5 address type(%d)", header[3]))
+	}
+
+	var port [2]byte
+	if _, err = io.ReadFull(br, port[:]); err != nil {
+		return "", socks5_rep_general_failure, err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), socks5_rep_succeeded, nil
+}
+
+func (self *EncryptTunPeer) handleSocks5(conn net.Conn, br *bufio.Reader) (stream net.Conn, err error) {
+	// 协商认证方式
+	var header [2]byte
+	if _, err = io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(br, methods); err != nil {
+		return nil, err
+	}
+	method := socks5_auth_no_match
+	for _, m := range methods {
+		if m == socks5_auth_none {
+			method = socks5_auth_none
+			break
+		}
+	}
+	if _, err = conn.Write([]byte{socks5_version, method}); err != nil {
+		return nil, err
+	}
+	if method == socks5_auth_no_match {
+		return nil, errors.New("no acceptable socks5 auth method")
+	}
+
+	target, rep, err := readSocks5Target(br)
+	if err == nil {
+		if stream, err = self.DialStream(target); err != nil {
+			rep = socks5ReplyForError(err)
+		}
+	}
+	if _, werr := conn.Write(socks5Reply(rep)); werr != nil && err == nil {
+		stream.Close()
+		return nil, werr
+	}
+	return stream, err
+}
+
+func (self *EncryptTunPeer) handleHTTPConnect(conn net.Conn, br *bufio.Reader) (stream net.Conn, err error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n")
+		return nil, errors.New(fmt.Sprintf("unsupported http method(%s)", req.Method))
+	}
+	if _, _, err = net.SplitHostPort(req.Host); err != nil {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return nil, err
+	}
+
+	if stream, err = self.DialStream(req.Host); err != nil {
+		status := "502 Bad Gateway"
+		if err == ErrTunConnectRefused {
+			status = "403 Forbidden"
+		}
+		io.WriteString(conn, "HTTP/1.1 "+status+"\r\nConnection: close\r\n\r\n")
+		return nil, err
+	}
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
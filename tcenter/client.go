@@ -49,21 +49,33 @@ func getHostInfo(info *HostInfo) (ret string) {
 		ifInfo.Name = itf.Name
 		ifInfo.Mac = itf.HardwareAddr.String()
 		addrs, _ := itf.Addrs()
-		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok {
-				if ipnet.IP.To4() != nil {
-					ifInfo.Ip = ipnet.IP.String()
-					ifInfo.Mask = net.IP(ipnet.Mask).String()
-					break
-				}
-			}
-		}
+		setIfAddrs(ifInfo, addrs)
 	}
 	info.Envs = os.Environ()
 	info.Numcpu = int32(runtime.NumCPU())
 	return info.String()
 }
 
+func setIfAddrs(ifInfo *IfInfo, addrs []net.Addr) {
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			// Ip 和 Mask 只记录第一个 IPv4 地址
+			if ifInfo.Ip == "" {
+				ifInfo.Ip = ipnet.IP.String()
+				ifInfo.Mask = net.IP(ipnet.Mask).String()
+			}
+		} else {
+			prefix, _ := ipnet.Mask.Size()
+			ifInfo.Ipv6 = append(ifInfo.Ipv6, ipnet.IP.String())
+			ifInfo.Ipv6Prefix = append(ifInfo.Ipv6Prefix, uint32(prefix))
+		}
+	}
+}
+
 func (self *TCenterClient) Login() (ret string) {
 	loginReq := &LoginReq{}
 	loginReq.HostInfo = &HostInfo{}
@@ -98,12 +110,24 @@ func (self *TCenterClient) HealthLoop(loginInfoStr string) {
 	}
 }
 
+func getIfInfoStr(itf *IfInfo) (ret string) {
+	ret = fmt.Sprintf("  name: %s\n    mac: %s\n    ip: %s\n    mask: %s\n", itf.Name, itf.Mac, itf.Ip, itf.Mask)
+	for i, ip := range itf.Ipv6 {
+		if i < len(itf.Ipv6Prefix) {
+			ret = ret + fmt.Sprintf("    ipv6: %s/%d\n", ip, itf.Ipv6Prefix[i])
+		} else {
+			ret = ret + fmt.Sprintf("    ipv6: %s\n", ip)
+		}
+	}
+	return ret
+}
+
 func getClientInfoStr(info *HostInfo) (ret string) {
 	s := fmt.Sprintf("os: %s\narch: %s\nhostname: %s", info.Os, info.Arch, info.Hostname)
 	if info.Interfaces != nil {
 		s = s + fmt.Sprintf("\ninterfaces(%d):\n", len(info.Interfaces))
 		for _, itf := range info.Interfaces {
-			s = s + fmt.Sprintf("  name: %s\n    mac: %s\n    ip: %s\n    mask: %s\n", itf.Name, itf.Mac, itf.Ip, itf.Mask)
+			s = s + getIfInfoStr(itf)
 		}
 	}
 	s = s + fmt.Sprintf("envs(%d):\n", len(info.Envs))
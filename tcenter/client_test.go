@@ -0,0 +1,61 @@
+package tcenter
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) net.Addr {
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipnet.IP = ip
+	return ipnet
+}
+
+func TestSetIfAddrs(t *testing.T) {
+	info := &IfInfo{}
+	setIfAddrs(info, []net.Addr{
+		mustParseCIDR(t, "fe80::1/64"),
+		mustParseCIDR(t, "192.168.1.10/24"),
+		&net.IPAddr{IP: net.ParseIP("10.0.0.1")},
+		mustParseCIDR(t, "10.0.0.1/8"),
+		mustParseCIDR(t, "2001:db8::10/48"),
+	})
+	if info.Ip != "192.168.1.10" || info.Mask != "255.255.255.0" {
+		t.Fatalf("ip %s mask %s, want the first IPv4 address", info.Ip, info.Mask)
+	}
+	if want := []string{"fe80::1", "2001:db8::10"}; !reflect.DeepEqual(info.Ipv6, want) {
+		t.Fatalf("ipv6 %v, want %v", info.Ipv6, want)
+	}
+	if want := []uint32{64, 48}; !reflect.DeepEqual(info.Ipv6Prefix, want) {
+		t.Fatalf("ipv6 prefix %v, want %v", info.Ipv6Prefix, want)
+	}
+}
+
+func TestGetIfInfoStr(t *testing.T) {
+	for _, c := range []struct {
+		itf  *IfInfo
+		want string
+	}{
+		{
+			&IfInfo{Name: "eth0", Mac: "00:11:22:33:44:55", Ip: "192.168.1.10", Mask: "255.255.255.0"},
+			"  name: eth0\n    mac: 00:11:22:33:44:55\n    ip: 192.168.1.10\n    mask: 255.255.255.0\n",
+		},
+		{
+			&IfInfo{Name: "eth1", Ipv6: []string{"fe80::1", "2001:db8::10"}, Ipv6Prefix: []uint32{64, 48}},
+			"  name: eth1\n    mac: \n    ip: \n    mask: \n    ipv6: fe80::1/64\n    ipv6: 2001:db8::10/48\n",
+		},
+		// 旧版本客户端没有上报前缀长度
+		{
+			&IfInfo{Name: "eth2", Ipv6: []string{"fe80::2", "2001:db8::20"}, Ipv6Prefix: []uint32{64}},
+			"  name: eth2\n    mac: \n    ip: \n    mask: \n    ipv6: fe80::2/64\n    ipv6: 2001:db8::20\n",
+		},
+	} {
+		if got := getIfInfoStr(c.itf); got != c.want {
+			t.Fatalf("%s: got %q, want %q", c.itf.Name, got, c.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"git.tutils.com/tutils/tnet"
+	"git.tutils.com/tutils/tnet/tlog"
 	"log"
 	"net"
 )
@@ -15,22 +16,26 @@ type CustomTCenterServer struct {
 	Addr                    string
 	Seri                    tnet.Serializer
 	OnHandleMessageCallback func(self *CustomTCenterServer, cmd string, payload []byte)
+
+	// 日志，默认不输出，Start 时同时设置给内部的 TcpServer
+	Logger tlog.Logger
 }
 
 type CustomTCenterConnExt struct {
-	slde *tnet.Slde
 }
 
 func NewCustomTCenterServer() (obj *CustomTCenterServer) {
 	obj = &CustomTCenterServer{}
 	svr := tnet.NewTcpServer()
 	svr.Ext = obj
+	svr.FrameCodecFactory = tnet.NewSldeCodec
 	svr.OnListenSuccCallback = onServerListenSuccCallback
 	svr.OnAcceptConnCallback = onServerAcceptConnCallback
-	svr.OnHandleConnDataCallback = onServerHandleConnDataCallback
+	svr.OnHandleMessageCallback = onServerHandleMessageCallback
 	svr.OnCloseConnCallback = onServerCloseConnCallback
 	obj.svr = svr
 	obj.Seri = NewPbSeri()
+	obj.Logger = tlog.NewNopLogger()
 	return obj
 }
 
@@ -40,19 +45,23 @@ func unused(interface{}) {
 
 func (self *CustomTCenterServer) Start() {
 	self.svr.Addr = self.Addr
+	self.svr.Logger = self.Logger
 	self.svr.Start()
 }
 
-func (self *CustomTCenterServer) SendCmd(connId int32, cmd string, req interface{}, rsp interface{}) (err error) {
+func (self *CustomTCenterServer) SendCmd(connId uint32, cmd string, req interface{}, rsp interface{}) (err error) {
 	encodeddata, err := encodeTCenterData(cmd, self.Seri, req)
 	if err != nil {
 		return err
 	}
 	conn := self.svr.PeekConn(connId)
-	if conn != nil {
+	if conn == nil {
 		return errors.New(fmt.Sprintf("invalid connId(%d)", connId))
 	}
-	conn.Write(encodeddata)
+	err = conn.Send(encodeddata)
+	if err != nil {
+		return err
+	}
 	decodeddata, err := tnet.DecodeToBytesFromSldeReader(conn)
 	if err != nil {
 		return err
@@ -66,14 +75,14 @@ func (self *CustomTCenterServer) SendCmd(connId int32, cmd string, req interface
 	return nil
 }
 
-func onServerListenSuccCallback(self *tnet.TcpServer, lstn *net.TCPListener) (ok bool) {
+func onServerListenSuccCallback(self *tnet.TcpServer, lstn net.Listener) (ok bool) {
 	ext := self.Ext.(*CustomTCenterServer)
 	unused(ext)
 	return true
 }
 
-func onServerAcceptConnCallback(self *tnet.TcpServer, conn *net.TCPConn, connId uint32) (ok bool, readSize int, connExt interface{}) {
-	connExt = &CustomTCenterConnExt{tnet.NewSlde()}
+func onServerAcceptConnCallback(self *tnet.TcpServer, conn net.Conn, connId uint32) (ok bool, readSize int, connExt interface{}) {
+	connExt = &CustomTCenterConnExt{}
 	//ext := self.Ext.(*CustomTCenterServer)
 	//self.ConnMap.Range(func(key, value interface{}) bool {
 	//    k := key.(uint32)
@@ -85,27 +94,8 @@ func onServerAcceptConnCallback(self *tnet.TcpServer, conn *net.TCPConn, connId
 	return true, tnet.SLDE_HEADER_SIZE, connExt
 }
 
-func onServerHandleConnDataCallback(self *tnet.TcpServer, conn *tnet.TCPConnEx, connId uint32, data []byte) (ok bool) {
-	connExt := conn.Ext.(*CustomTCenterConnExt)
+func onServerHandleMessageCallback(self *tnet.TcpServer, conn *tnet.TCPConnEx, connId uint32, decodeddata []byte) (ok bool) {
 	ext := self.Ext.(*CustomTCenterServer)
-	left, err := connExt.slde.WriteAndGetNextToWrite(data)
-	if err != nil {
-		panic(err)
-	}
-	if left > 0 {
-		conn.ReadSize = left
-		//log.Printf("slde:left(%d) > 0", elft)
-		return true
-	} else if left < 0 {
-		panic(errors.New("left < 0"))
-	}
-
-	// left == 0
-	conn.ReadSize = tnet.SLDE_HEADER_SIZE
-	decodeddata, err := connExt.slde.DecodeAndReset()
-	if err != nil {
-		panic(err)
-	}
 	buf := bytes.NewBuffer(decodeddata)
 
 	var cmdLen uint8
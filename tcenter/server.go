@@ -5,6 +5,7 @@ package tcenter
 import (
 	"errors"
 	"fmt"
+	"git.tutils.com/tutils/tnet/tlog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
@@ -30,12 +31,16 @@ type TCenterServer struct {
 	svr   *grpc.Server
 	idgen uint32
 	clts  *sync.Map
+
+	// 日志，默认不输出，启动失败时仍然使用 log.Fatalf 退出
+	Logger tlog.Logger
 }
 
 func NewTCenterServer() (obj *TCenterServer) {
 	obj = &TCenterServer{}
 	obj.idgen = 1000
 	obj.clts = &sync.Map{}
+	obj.Logger = tlog.NewNopLogger()
 	return obj
 }
 
@@ -58,12 +63,12 @@ func (self *TCenterServer) nextId() (ret uint32) {
 	return atomic.AddUint32(&self.idgen, 1)
 }
 
-func printClientInfo(id uint32, info *TCenterClientInfo) {
+func (self *TCenterServer) printClientInfo(id uint32, info *TCenterClientInfo) {
 	s := fmt.Sprintf("os: %s\narch: %s\nhostname: %s", info.hostInfo.Os, info.hostInfo.Arch, info.hostInfo.Hostname)
 	if info.hostInfo.Interfaces != nil {
 		s = s + fmt.Sprintf("\ninterfaces(%d):\n", len(info.hostInfo.Interfaces))
 		for _, itf := range info.hostInfo.Interfaces {
-			s = s + fmt.Sprintf("  name: %s\n    mac: %s\n    ip: %s\n    mask: %s\n", itf.Name, itf.Mac, itf.Ip, itf.Mask)
+			s = s + getIfInfoStr(itf)
 		}
 	}
 	s = s + fmt.Sprintf("envs(%d):\n", len(info.hostInfo.Envs))
@@ -72,7 +77,7 @@ func printClientInfo(id uint32, info *TCenterClientInfo) {
 	}
 	s = s + fmt.Sprintf("numcpu: %d\n", info.hostInfo.Numcpu)
 
-	log.Printf("client(%d) info:\n%s", id, s)
+	self.Logger.Info("client info", tlog.F("client_id", id), tlog.F("info", s))
 }
 
 func (self *TCenterServer) storeClientInfo(id uint32, info *TCenterClientInfo) {
@@ -83,7 +88,7 @@ func (self *TCenterServer) storeClientInfo(id uint32, info *TCenterClientInfo) {
 		v := value.(*TCenterClientInfo)
 		delta := now.Unix() - v.lastHealth.Unix()
 		if delta > 120 {
-			log.Printf("@@ %v delta %v", k, delta)
+			self.Logger.Debug("client timeout", tlog.F("client_id", k), tlog.F("delta", delta))
 			todel = append(todel, k)
 		}
 		return true
@@ -101,8 +106,8 @@ func (self *TCenterServer) Login(ctx context.Context, req *LoginReq) (rsp *Login
 	info.lastHealth = time.Now()
 	self.clts.Store(id, info)
 	//self.storeClientInfo(id, info)
-	log.Printf("client(%d) login", id)
-	printClientInfo(id, info)
+	self.Logger.Info("client login", tlog.F("client_id", id))
+	self.printClientInfo(id, info)
 
 	rsp = &LoginRsp{}
 	rsp.Id = id
@@ -114,7 +119,7 @@ func (self *TCenterServer) Health(ctx context.Context, req *HealthReq) (rsp *Emp
 	v, ok := self.clts.Load(id)
 	if !ok {
 		err = errors.New(fmt.Sprintf("invalid client(%d)", id))
-		log.Printf("%v", err)
+		self.Logger.Warn("health failed", tlog.Err(err))
 		return nil, err
 	}
 
@@ -132,7 +137,7 @@ func (self *TCenterServer) ListClients(ctx context.Context, req *ListClientsReq)
 	_, ok := self.clts.Load(id)
 	if !ok {
 		err = errors.New(fmt.Sprintf("invalid client(%d)", id))
-		log.Printf("%v", err)
+		self.Logger.Warn("list clients failed", tlog.Err(err))
 		return nil, err
 	}
 
@@ -159,7 +164,7 @@ func (self *TCenterServer) ListClients(ctx context.Context, req *ListClientsReq)
 	})
 
 	for _, d := range todel {
-		log.Printf("del timeout client(%v)", d)
+		self.Logger.Info("del timeout client", tlog.F("client_id", d))
 		self.clts.Delete(d)
 	}
 
@@ -44,6 +44,10 @@ type IfInfo struct {
 	Mac  string `protobuf:"bytes,2,opt,name=mac" json:"mac,omitempty"`
 	Ip   string `protobuf:"bytes,3,opt,name=ip" json:"ip,omitempty"`
 	Mask string `protobuf:"bytes,4,opt,name=mask" json:"mask,omitempty"`
+	// IPv6 addresses of the interface
+	Ipv6 []string `protobuf:"bytes,5,rep,name=ipv6" json:"ipv6,omitempty"`
+	// prefix lengths of ipv6, one for each address
+	Ipv6Prefix []uint32 `protobuf:"varint,6,rep,packed,name=ipv6Prefix" json:"ipv6Prefix,omitempty"`
 }
 
 func (m *IfInfo) Reset()                    { *m = IfInfo{} }
@@ -79,6 +83,20 @@ func (m *IfInfo) GetMask() string {
 	return ""
 }
 
+func (m *IfInfo) GetIpv6() []string {
+	if m != nil {
+		return m.Ipv6
+	}
+	return nil
+}
+
+func (m *IfInfo) GetIpv6Prefix() []uint32 {
+	if m != nil {
+		return m.Ipv6Prefix
+	}
+	return nil
+}
+
 type HostInfo struct {
 	Os         string    `protobuf:"bytes,1,opt,name=os" json:"os,omitempty"`
 	Arch       string    `protobuf:"bytes,2,opt,name=arch" json:"arch,omitempty"`
@@ -416,31 +434,33 @@ var _TCenterService_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("tcenter.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 411 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x53, 0xcd, 0x8e, 0xd3, 0x30,
-	0x10, 0x56, 0x92, 0x36, 0x64, 0x27, 0xda, 0x00, 0x73, 0x60, 0xa3, 0x1c, 0x50, 0xe4, 0x53, 0x2f,
-	0xdb, 0x95, 0xca, 0x89, 0x13, 0x87, 0x82, 0xb4, 0x45, 0x3d, 0x19, 0x5e, 0x20, 0xa4, 0x2e, 0xb1,
-	0x9a, 0xc4, 0x6e, 0xec, 0x56, 0xe2, 0x89, 0x38, 0xf3, 0x0c, 0xbc, 0x18, 0xb2, 0xf3, 0xdb, 0xaa,
-	0x88, 0x03, 0xb7, 0x99, 0xf1, 0x7c, 0xdf, 0x37, 0xf3, 0x8d, 0x0c, 0xf7, 0x3a, 0x67, 0xb5, 0x66,
-	0xcd, 0x52, 0x36, 0x42, 0x0b, 0x7c, 0xd1, 0xa5, 0x84, 0x82, 0xbf, 0xd9, 0x6f, 0xea, 0xbd, 0x40,
-	0x84, 0x59, 0x9d, 0x55, 0x2c, 0x76, 0x52, 0x67, 0x71, 0x47, 0x6d, 0x8c, 0xaf, 0xc0, 0xab, 0xb2,
-	0x3c, 0x76, 0x6d, 0xc9, 0x84, 0x18, 0x81, 0xcb, 0x65, 0xec, 0xd9, 0x82, 0xcb, 0xa5, 0x41, 0x55,
-	0x99, 0x3a, 0xc4, 0xb3, 0x16, 0x65, 0x62, 0xf2, 0xd3, 0x81, 0xe0, 0x59, 0x28, 0x6d, 0x69, 0x23,
-	0x70, 0x85, 0xea, 0x48, 0x5d, 0xa1, 0x0c, 0x20, 0x6b, 0xf2, 0xa2, 0xe3, 0xb4, 0x31, 0x26, 0x10,
-	0x14, 0x42, 0x69, 0x2b, 0xdf, 0x52, 0x0f, 0x39, 0x3e, 0x01, 0x70, 0x33, 0xe9, 0x3e, 0xcb, 0x99,
-	0x8a, 0x67, 0xa9, 0xb7, 0x08, 0x57, 0x2f, 0x97, 0xfd, 0x36, 0xed, 0xec, 0x74, 0xd2, 0x62, 0x04,
-	0x58, 0x7d, 0x56, 0xf1, 0x3c, 0xf5, 0x8c, 0x80, 0x89, 0xf1, 0x0d, 0xf8, 0xf5, 0xa9, 0xca, 0xe5,
-	0x29, 0xf6, 0x53, 0x67, 0x31, 0xa7, 0x5d, 0x46, 0xde, 0x43, 0xb0, 0x15, 0xdf, 0x79, 0x4d, 0xd9,
-	0x11, 0x1f, 0xdb, 0x21, 0x0c, 0x9f, 0x1d, 0x37, 0x5c, 0xbd, 0x1e, 0x64, 0xfa, 0x6d, 0xe8, 0xd0,
-	0x42, 0x92, 0x1e, 0xaa, 0xa4, 0x35, 0x65, 0x67, 0x41, 0xf7, 0xd4, 0xe5, 0x3b, 0xf2, 0x19, 0xee,
-	0x9e, 0x59, 0x56, 0xea, 0xc2, 0xf0, 0x5e, 0x3d, 0x5e, 0xe8, 0xb8, 0xff, 0xd6, 0x01, 0x08, 0x3e,
-	0x55, 0x52, 0xff, 0xa0, 0x4a, 0x92, 0x14, 0xa2, 0x2d, 0x57, 0x7a, 0x5d, 0x72, 0x56, 0x6b, 0x75,
-	0x83, 0x9c, 0xfc, 0x76, 0x2e, 0x5b, 0x94, 0xc4, 0x8f, 0x10, 0xe6, 0x36, 0x33, 0x74, 0xe6, 0x12,
-	0xc6, 0x41, 0x32, 0x48, 0x5e, 0x76, 0x2f, 0xd7, 0x43, 0x2b, 0x9d, 0xc2, 0x92, 0x03, 0xc0, 0xf8,
-	0xf4, 0x9f, 0x3b, 0xe1, 0x5b, 0x80, 0x32, 0x53, 0xba, 0xf5, 0xc8, 0x5e, 0xdc, 0xa3, 0x93, 0xca,
-	0xea, 0x97, 0x03, 0xd1, 0xd7, 0xb5, 0x85, 0x7f, 0x61, 0xcd, 0x99, 0xe7, 0x0c, 0x1f, 0x61, 0x5e,
-	0x1a, 0xbb, 0x71, 0x24, 0xee, 0x2f, 0x97, 0x5c, 0x97, 0x94, 0xc4, 0x27, 0xf0, 0x0b, 0xcb, 0x85,
-	0x38, 0x0e, 0xd2, 0x9f, 0x64, 0x02, 0xe8, 0xad, 0xc5, 0x0f, 0x10, 0x96, 0xa3, 0x13, 0xf8, 0x70,
-	0xd3, 0x1f, 0x76, 0x4c, 0x1e, 0xfe, 0x62, 0xdc, 0x37, 0xdf, 0x7e, 0xac, 0x77, 0x7f, 0x02, 0x00,
-	0x00, 0xff, 0xff, 0xbb, 0xba, 0x4d, 0x79, 0x69, 0x03, 0x00, 0x00,
+	// 439 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x53, 0xcd, 0x6e, 0xd3, 0x40,
+	0x10, 0x96, 0xed, 0xc4, 0xa4, 0x13, 0x25, 0xc0, 0x1c, 0xe8, 0xca, 0x07, 0x64, 0xed, 0x29, 0x97,
+	0xa6, 0x52, 0x90, 0x90, 0x38, 0x71, 0x08, 0x48, 0x2d, 0xea, 0x01, 0x2d, 0xbc, 0x80, 0x71, 0x37,
+	0x64, 0x55, 0xdb, 0xbb, 0xf5, 0x6e, 0x23, 0x78, 0x01, 0x5e, 0x85, 0x33, 0xcf, 0xc0, 0x8b, 0xa1,
+	0x59, 0xff, 0xa6, 0x0a, 0xe2, 0xc0, 0x29, 0x33, 0xb3, 0xf3, 0x7d, 0xf3, 0xcd, 0x37, 0x31, 0x2c,
+	0x5c, 0x2e, 0x2b, 0x27, 0xeb, 0xb5, 0xa9, 0xb5, 0xd3, 0xf8, 0xa4, 0x4d, 0xf9, 0x8f, 0x00, 0xe2,
+	0xeb, 0xdd, 0x75, 0xb5, 0xd3, 0x88, 0x30, 0xa9, 0xb2, 0x52, 0xb2, 0x20, 0x0d, 0x56, 0x67, 0xc2,
+	0xc7, 0xf8, 0x0c, 0xa2, 0x32, 0xcb, 0x59, 0xe8, 0x4b, 0x14, 0xe2, 0x12, 0x42, 0x65, 0x58, 0xe4,
+	0x0b, 0xa1, 0x32, 0x84, 0x2a, 0x33, 0x7b, 0xc7, 0x26, 0x0d, 0x8a, 0x62, 0xaa, 0x29, 0x73, 0x78,
+	0xcd, 0xa6, 0x69, 0x44, 0x35, 0x8a, 0xf1, 0x25, 0x00, 0xfd, 0x7e, 0xac, 0xe5, 0x4e, 0x7d, 0x63,
+	0x71, 0x1a, 0xad, 0x16, 0x62, 0x54, 0xe1, 0x3f, 0x03, 0x98, 0x5d, 0x69, 0xeb, 0xbc, 0x94, 0x25,
+	0x84, 0xda, 0xb6, 0x42, 0x42, 0x6d, 0x89, 0x30, 0xab, 0xf3, 0x7d, 0xab, 0xc3, 0xc7, 0x98, 0xc0,
+	0x6c, 0xaf, 0xad, 0xf3, 0x92, 0x1b, 0x39, 0x7d, 0x8e, 0x97, 0x00, 0x8a, 0xd6, 0xdb, 0x65, 0xb9,
+	0xb4, 0x6c, 0x92, 0x46, 0xab, 0xf9, 0xe6, 0xe9, 0xba, 0xb3, 0xa0, 0xd9, 0x57, 0x8c, 0x5a, 0x68,
+	0x80, 0xac, 0x0e, 0xb6, 0x53, 0x4c, 0x31, 0xbe, 0x80, 0xb8, 0x7a, 0x28, 0x73, 0xf3, 0xc0, 0xe2,
+	0x34, 0x58, 0x4d, 0x45, 0x9b, 0xf1, 0x37, 0x30, 0xbb, 0xd1, 0x5f, 0x55, 0x25, 0xe4, 0x3d, 0x5e,
+	0x34, 0x22, 0x88, 0xcf, 0xcb, 0x9d, 0x6f, 0x9e, 0xf7, 0x63, 0xba, 0x6d, 0x44, 0xdf, 0xc2, 0x93,
+	0x0e, 0x6a, 0x8d, 0x37, 0xf2, 0xd6, 0x83, 0x16, 0x22, 0x54, 0xb7, 0xfc, 0x03, 0x9c, 0x5d, 0xc9,
+	0xac, 0x70, 0x7b, 0xe2, 0x7d, 0xf4, 0x78, 0x34, 0x27, 0xfc, 0xf7, 0x1c, 0x80, 0xd9, 0xfb, 0xd2,
+	0xb8, 0xef, 0xc2, 0x1a, 0x9e, 0xc2, 0xf2, 0x46, 0x59, 0xb7, 0x2d, 0x94, 0xac, 0x9c, 0x3d, 0x41,
+	0xce, 0x7f, 0x07, 0xc7, 0x2d, 0xd6, 0xe0, 0x3b, 0x98, 0xe7, 0x3e, 0x23, 0x3a, 0xba, 0x04, 0x39,
+	0xc8, 0xfb, 0x91, 0xc7, 0xdd, 0xeb, 0x6d, 0xdf, 0x2a, 0xc6, 0xb0, 0xe4, 0x0e, 0x60, 0x78, 0xfa,
+	0xcf, 0x9d, 0xe8, 0x0f, 0x54, 0x64, 0xd6, 0x35, 0x1e, 0xf9, 0x8b, 0x47, 0x62, 0x54, 0xd9, 0xfc,
+	0x0a, 0x60, 0xf9, 0x79, 0xeb, 0xe1, 0x9f, 0x64, 0x7d, 0x50, 0xb9, 0xc4, 0x0b, 0x98, 0x16, 0x64,
+	0x37, 0x0e, 0xc4, 0xdd, 0xe5, 0x92, 0xc7, 0x25, 0x6b, 0xf0, 0x12, 0xe2, 0xbd, 0xe7, 0x42, 0x1c,
+	0x84, 0x74, 0x27, 0x19, 0x01, 0x3a, 0x6b, 0xf1, 0x2d, 0xcc, 0x8b, 0xc1, 0x09, 0x3c, 0x3f, 0xe9,
+	0x8f, 0xbc, 0x4f, 0xce, 0xff, 0x62, 0xdc, 0x97, 0xd8, 0x7f, 0x8d, 0xaf, 0xfe, 0x0c, 0x00, 0x64,
+	0xf0, 0xf4, 0x21, 0x9e, 0x03, 0x00, 0x00,
 }
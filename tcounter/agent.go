@@ -3,6 +3,7 @@ package tcounter
 import (
 	"bytes"
 	"encoding/binary"
+	"git.tutils.com/tutils/tnet/tlog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"log"
@@ -26,6 +27,9 @@ type CounterAgent struct {
 	tableLock sync.Mutex
 	quit      chan interface{}
 	reqs      chan interface{}
+
+	// 日志，默认不输出，启动失败时仍然使用 log.Fatalf 退出
+	Logger tlog.Logger
 }
 
 func NewCounterAgentUseUnix(sock string, serverAddr string) (obj *CounterAgent) {
@@ -33,6 +37,7 @@ func NewCounterAgentUseUnix(sock string, serverAddr string) (obj *CounterAgent)
 	obj.table = make(counter_map)
 	obj.quit = make(chan interface{}, 10)
 	obj.reqs = make(chan interface{}, 10)
+	obj.Logger = tlog.NewNopLogger()
 
 	os.Remove(sock)
 	var err error
@@ -49,6 +54,7 @@ func NewCounterAgentUseUdp(laddr string, serverAddr string) (obj *CounterAgent)
 	obj.table = make(counter_map)
 	obj.quit = make(chan interface{}, 10)
 	obj.reqs = make(chan interface{}, 10)
+	obj.Logger = tlog.NewNopLogger()
 
 	var err error
 	obj.conn, err = net.ListenPacket("udp", laddr)
@@ -86,7 +92,7 @@ func (self *CounterAgent) parseCommand(data []byte) {
 		self.parseSendValue(payload)
 		break
 	default:
-		log.Fatal("unknown cmd(%v)", cmd)
+		self.Logger.Warn("unknown cmd", tlog.Cmd(cmd))
 	}
 }
 
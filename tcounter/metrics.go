@@ -0,0 +1,45 @@
+package tcounter
+
+import (
+	"time"
+)
+
+// 通过 CounterClient 上报 tnet.Metrics 的指标，例如设置为 EncryptTunPeer.Metrics
+// keys 把指标名映射到 tcounter 的 key，没有映射的指标不上报；标签被忽略，同名指标累加到同一个 key
+// 计数器和当前值上报增量，耗时上报毫秒数
+type CounterMetrics struct {
+	client *CounterClient
+	keys   map[string]counter_key
+}
+
+// client 为 nil 时（例如 NewCounterClientUseUnix 失败）不上报
+func NewCounterMetrics(client *CounterClient, keys map[string]uint32) (obj *CounterMetrics) {
+	obj = new(CounterMetrics)
+	obj.client = client
+	obj.keys = make(map[string]counter_key, len(keys))
+	for name, key := range keys {
+		obj.keys[name] = key
+	}
+	return obj
+}
+
+func (self *CounterMetrics) send(name string, value int64) {
+	if self.client == nil {
+		return
+	}
+	if key, ok := self.keys[name]; ok {
+		self.client.SendValue(key, value)
+	}
+}
+
+func (self *CounterMetrics) AddCounter(name string, delta int64, labels ...string) {
+	self.send(name, delta)
+}
+
+func (self *CounterMetrics) AddGauge(name string, delta int64, labels ...string) {
+	self.send(name, delta)
+}
+
+func (self *CounterMetrics) Observe(name string, d time.Duration, labels ...string) {
+	self.send(name, int64(d/time.Millisecond))
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"git.tutils.com/tutils/tnet/tlog"
 	_ "github.com/go-sql-driver/mysql"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -63,6 +64,9 @@ type CounterServer struct {
 	quit          chan interface{}
 	sendTableReqs chan interface{}
 	db            *sql.DB
+
+	// 日志，默认不输出，启动失败时仍然使用 log.Fatalf 退出
+	Logger tlog.Logger
 }
 
 func NewCounterServer() (obj *CounterServer) {
@@ -70,6 +74,7 @@ func NewCounterServer() (obj *CounterServer) {
 	obj.table = make(counter_map)
 	obj.quit = make(chan interface{}, 10)
 	obj.sendTableReqs = make(chan interface{}, 128)
+	obj.Logger = tlog.NewNopLogger()
 	return obj
 }
 
@@ -129,12 +134,12 @@ func (self *CounterServer) handleHttpChart(w http.ResponseWriter, r *http.Reques
 
 	// get id
 	if v, err := self.getHttpGetParam(r, "id"); err != nil || v == "" {
-		responseError(w, 1, 11, err.Error())
+		self.responseError(w, 1, 11, err.Error())
 		return
 	} else {
 		v, err := strconv.ParseUint(v, 10, 32)
 		if err != nil {
-			responseError(w, 1, 12, err.Error())
+			self.responseError(w, 1, 12, err.Error())
 			return
 		}
 		id = counter_key(v)
@@ -148,7 +153,7 @@ func (self *CounterServer) handleHttpChart(w http.ResponseWriter, r *http.Reques
 	} else {
 		v, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			responseError(w, 1, 13, err.Error())
+			self.responseError(w, 1, 13, err.Error())
 			return
 		}
 		begin = v
@@ -160,7 +165,7 @@ func (self *CounterServer) handleHttpChart(w http.ResponseWriter, r *http.Reques
 	} else {
 		v, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			responseError(w, 1, 14, err.Error())
+			self.responseError(w, 1, 14, err.Error())
 			return
 		}
 		end = v
@@ -168,7 +173,7 @@ func (self *CounterServer) handleHttpChart(w http.ResponseWriter, r *http.Reques
 
 	if end < begin || begin < 0 || end < 0 {
 		err := errors.New("begin or end value err")
-		responseError(w, 1, 14, err.Error())
+		self.responseError(w, 1, 14, err.Error())
 		return
 	}
 
@@ -178,7 +183,7 @@ func (self *CounterServer) handleHttpChart(w http.ResponseWriter, r *http.Reques
 	} else {
 		v, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			responseError(w, 1, 14, err.Error())
+			self.responseError(w, 1, 14, err.Error())
 			return
 		}
 		align = v
@@ -199,7 +204,7 @@ func (self *CounterServer) handleHttpChart(w http.ResponseWriter, r *http.Reques
 	end = end / alignment * alignment
 	pts, err := self.loadTableMapped(id, begin, end)
 	if err != nil {
-		responseError(w, 1, 15, err.Error())
+		self.responseError(w, 1, 15, err.Error())
 		return
 	}
 
@@ -225,9 +230,9 @@ func (self *CounterServer) handleHttpChart(w http.ResponseWriter, r *http.Reques
 
 	data := &HttpChartRspData{id, begin, end, align, pts}
 	if callback != "" {
-		responeJsonp(w, 1, data, callback)
+		self.responeJsonp(w, 1, data, callback)
 	} else {
-		responseData(w, 1, data)
+		self.responseData(w, 1, data)
 	}
 }
 
@@ -235,7 +240,7 @@ func (self *CounterServer) loadTableMapped(key counter_key, begin int64, end int
 	sql := fmt.Sprintf("SELECT `ts`, `sum`, `count` FROM `values_%d` WHERE `ts`>=? AND `ts`<=? ORDER BY `ts`;", key)
 	row, err := self.db.Query(sql, begin, end)
 	if err != nil {
-		log.Printf("query db failed(%v): %v", sql, err)
+		self.Logger.Warn("query db failed", tlog.F("sql", sql), tlog.Err(err))
 		return nil, err
 	}
 
@@ -281,7 +286,7 @@ func (self *CounterServer) loadTableMapped(key counter_key, begin int64, end int
 	return ret, nil
 }
 
-func responseError(w http.ResponseWriter, ver int, errcode int, errmsg string) {
+func (self *CounterServer) responseError(w http.ResponseWriter, ver int, errcode int, errmsg string) {
 	w.Header().Add("content-type", "application/json; charset=utf-8")
 	rsp := HttpRsp{
 		ver,
@@ -291,13 +296,13 @@ func responseError(w http.ResponseWriter, ver int, errcode int, errmsg string) {
 	}
 	jsStr, err := json.Marshal(rsp)
 	if err != nil {
-		log.Printf(err.Error())
+		self.Logger.Error("marshal http rsp failed", tlog.Err(err))
 		return
 	}
 	w.Write(jsStr)
 }
 
-func responseData(w http.ResponseWriter, ver int, data interface{}) {
+func (self *CounterServer) responseData(w http.ResponseWriter, ver int, data interface{}) {
 	w.Header().Add("content-type", "application/json; charset=utf-8")
 	rsp := HttpRsp{
 		ver,
@@ -315,14 +320,14 @@ func responseData(w http.ResponseWriter, ver int, data interface{}) {
 		}
 		jsStr, err = json.Marshal(rsp)
 		if err != nil {
-			log.Printf(err.Error())
+			self.Logger.Error("marshal http rsp failed", tlog.Err(err))
 			return
 		}
 	}
 	w.Write(jsStr)
 }
 
-func responeJsonp(w http.ResponseWriter, ver int, data interface{}, callback string) {
+func (self *CounterServer) responeJsonp(w http.ResponseWriter, ver int, data interface{}, callback string) {
 	w.Header().Add("content-type", "application/json; charset=utf-8")
 	rsp := HttpRsp{
 		ver,
@@ -340,7 +345,7 @@ func responeJsonp(w http.ResponseWriter, ver int, data interface{}, callback str
 		}
 		jsStr, err = json.Marshal(rsp)
 		if err != nil {
-			log.Printf(err.Error())
+			self.Logger.Error("marshal http rsp failed", tlog.Err(err))
 			return
 		}
 	}
@@ -354,14 +359,13 @@ func (self *CounterServer) SendTable(ctx context.Context, req *SendTableReq) (rs
 
 func (self *CounterServer) saveTableMapped(key counter_key, mapped *counter_mapped) {
 	// TODO: save table mapped of key to db
-	log.Printf("\n\n=== save key(%v) mapped (%v -> %v)", key, mapped.valueList[mapped.saveBegin].time, mapped.valueList[mapped.saveEnd].time)
+	self.Logger.Debug("save table mapped", tlog.F("key", key), tlog.F("begin", mapped.valueList[mapped.saveBegin].time), tlog.F("end", mapped.valueList[mapped.saveEnd].time))
 
 	num := mapped.saveEnd - mapped.saveBegin + 1
 	valueStrings := make([]string, 0, num)
 	valueArgs := make([]interface{}, 0, num*3)
 	for i := mapped.saveBegin; i <= mapped.saveEnd; i++ {
 		value := mapped.valueList[i]
-		log.Printf("=== %v", *value)
 		if value.count <= 0 {
 			continue
 		}
@@ -376,7 +380,7 @@ func (self *CounterServer) saveTableMapped(key counter_key, mapped *counter_mapp
 	sql := fmt.Sprintf("INSERT INTO `values_%d` (`ts`, `sum`, `count`) VALUES %s ON DUPLICATE KEY UPDATE `sum`=VALUES(`sum`), `count`=VALUES(`count`);", key, strings.Join(valueStrings, ", "))
 	row, err := self.db.Query(sql, valueArgs...)
 	if err != nil {
-		log.Printf("query db failed(%v): %v", sql, err)
+		self.Logger.Warn("query db failed", tlog.F("sql", sql), tlog.Err(err))
 		return
 	}
 	row.Close()
@@ -392,7 +396,7 @@ func (self *CounterServer) handleSendTableReq(req *SendTableReq) {
 		mapped, ok := self.table[k]
 		if !ok {
 			// key isnot exist, init new value list
-			log.Printf("key isnot exist, init new value list")
+			self.Logger.Debug("key isnot exist, init new value list", tlog.F("key", k))
 
 			mapped = &counter_mapped{}
 			self.table[k] = mapped
@@ -433,7 +437,7 @@ func (self *CounterServer) handleSendTableReq(req *SendTableReq) {
 			base := mapped.valueList[0].time
 			if reqTimeEnd-base >= cache_range {
 				// not enough, init new value list
-				log.Printf("not enough, init new value list")
+				self.Logger.Debug("not enough, init new value list", tlog.F("key", k))
 
 				self.saveTableMapped(k, mapped)
 
@@ -482,7 +486,7 @@ func (self *CounterServer) handleSendTableReq(req *SendTableReq) {
 				}
 			} else {
 				// merge values
-				log.Printf("merge values")
+				self.Logger.Debug("merge values", tlog.F("key", k))
 				saveBegin := (reqTimeBegin - base) / alignment
 				if saveBegin < mapped.saveBegin {
 					if saveBegin > 0 {
@@ -0,0 +1,159 @@
+package tlog
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (self Level) String() string {
+	switch self {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+// 结构化字段，Value 只在真正输出时才会被格式化
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+func ConnId(connId uint32) Field {
+	return Field{"conn_id", connId}
+}
+
+func Addr(addr net.Addr) Field {
+	return Field{"addr", addr}
+}
+
+func RemoteAddr(addr net.Addr) Field {
+	return Field{"remote_addr", addr}
+}
+
+func Cmd(cmd interface{}) Field {
+	return Field{"cmd", cmd}
+}
+
+func Err(err error) Field {
+	return Field{"err", err}
+}
+
+// 库内所有日志都通过该接口输出
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+
+	// 返回一个子 Logger，它输出的每条日志都带上 fields
+	With(fields ...Field) Logger
+}
+
+// 不输出任何日志，是库内各个对象的默认 Logger
+type nopLogger struct{}
+
+func NewNopLogger() (obj Logger) {
+	return nopLogger{}
+}
+
+func (self nopLogger) Debug(msg string, fields ...Field) {}
+func (self nopLogger) Info(msg string, fields ...Field)  {}
+func (self nopLogger) Warn(msg string, fields ...Field)  {}
+func (self nopLogger) Error(msg string, fields ...Field) {}
+func (self nopLogger) With(fields ...Field) Logger       { return self }
+
+// 标准库 log 的适配器，输出格式为 "[LEVEL] msg key=value ..."
+type StdLogger struct {
+	Logger *log.Logger // 为 nil 时使用 log 包的默认 Logger
+	Level  Level       // 低于该级别的日志不输出
+	fields []Field
+}
+
+func NewStdLogger(logger *log.Logger, level Level) (obj *StdLogger) {
+	obj = new(StdLogger)
+	obj.Logger = logger
+	obj.Level = level
+	return obj
+}
+
+func (self *StdLogger) Debug(msg string, fields ...Field) {
+	self.output(LevelDebug, msg, fields)
+}
+
+func (self *StdLogger) Info(msg string, fields ...Field) {
+	self.output(LevelInfo, msg, fields)
+}
+
+func (self *StdLogger) Warn(msg string, fields ...Field) {
+	self.output(LevelWarn, msg, fields)
+}
+
+func (self *StdLogger) Error(msg string, fields ...Field) {
+	self.output(LevelError, msg, fields)
+}
+
+func (self *StdLogger) With(fields ...Field) Logger {
+	obj := &StdLogger{Logger: self.Logger, Level: self.Level}
+	obj.fields = make([]Field, 0, len(self.fields)+len(fields))
+	obj.fields = append(obj.fields, self.fields...)
+	obj.fields = append(obj.fields, fields...)
+	return obj
+}
+
+func (self *StdLogger) output(level Level, msg string, fields []Field) {
+	if level < self.Level {
+		return
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 128))
+	buf.WriteByte('[')
+	buf.WriteString(level.String())
+	buf.WriteString("] ")
+	buf.WriteString(msg)
+	writeFields(buf, self.fields)
+	writeFields(buf, fields)
+
+	// 2 层调用后才是打日志的位置
+	if self.Logger != nil {
+		self.Logger.Output(3, buf.String())
+	} else {
+		log.Output(3, buf.String())
+	}
+}
+
+func writeFields(buf *bytes.Buffer, fields []Field) {
+	for _, field := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(field.Key)
+		buf.WriteByte('=')
+		value := fmt.Sprint(field.Value)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		buf.WriteString(value)
+	}
+}
@@ -0,0 +1,94 @@
+package tlog
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func newTestLogger(level Level) (logger *StdLogger, buf *bytes.Buffer) {
+	buf = new(bytes.Buffer)
+	return NewStdLogger(log.New(buf, "", 0), level), buf
+}
+
+func TestStdLoggerLevel(t *testing.T) {
+	logger, buf := newTestLogger(LevelWarn)
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+	want := "[WARN] warn\n[ERROR] error\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestStdLoggerFields(t *testing.T) {
+	logger, buf := newTestLogger(LevelDebug)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+	logger.Debug("conn closed",
+		ConnId(7),
+		Addr(addr),
+		RemoteAddr(addr),
+		Cmd("ping"),
+		Err(errors.New("broken pipe")),
+		F("empty", ""),
+		F("quote", `a"b`),
+		F("eq", "a=b"),
+	)
+	want := `[DEBUG] conn closed conn_id=7 addr=127.0.0.1:80 remote_addr=127.0.0.1:80 cmd=ping err="broken pipe" empty="" quote="a\"b" eq="a=b"` + "\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+// 子 Logger 带上父 Logger 的字段，不影响父 Logger
+func TestStdLoggerWith(t *testing.T) {
+	logger, buf := newTestLogger(LevelInfo)
+	child := logger.With(F("server", "tun"))
+	grandchild := child.With(ConnId(1))
+	grandchild.Info("accepted", F("n", 2))
+	child.Info("listening")
+	logger.Info("started")
+	grandchild.Debug("filtered")
+	want := "[INFO] accepted server=tun conn_id=1 n=2\n[INFO] listening server=tun\n[INFO] started\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestNopLogger(t *testing.T) {
+	logger := NewNopLogger()
+	logger.Debug("debug", F("k", "v"))
+	logger.Error("error")
+	if logger.With(F("k", "v")) != logger {
+		t.Fatal("With of nop logger should return itself")
+	}
+}
+
+func TestLevelString(t *testing.T) {
+	for level, want := range map[Level]string{
+		LevelDebug: "DEBUG",
+		LevelInfo:  "INFO",
+		LevelWarn:  "WARN",
+		LevelError: "ERROR",
+		Level(10):  "UNKNOWN",
+	} {
+		if got := level.String(); got != want {
+			t.Fatalf("%d: got %s, want %s", level, got, want)
+		}
+	}
+}
+
+// 日志位置指向调用 Logger 方法的代码
+func TestStdLoggerCallDepth(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := NewStdLogger(log.New(buf, "", log.Lshortfile), LevelInfo)
+	logger.Info("here")
+	if !strings.HasPrefix(buf.String(), "logger_test.go:") {
+		t.Fatalf("got %q", buf.String())
+	}
+}
@@ -0,0 +1,96 @@
+package tnet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	tls_handshake_timeout time.Duration = 10e9
+)
+
+// 在 rawConn 上完成 TLS 握手，timeout 为 0 时使用默认超时
+func tlsHandshake(conn *tls.Conn, rawConn net.Conn, timeout time.Duration) (err error) {
+	if timeout <= 0 {
+		timeout = tls_handshake_timeout
+	}
+	rawConn.SetDeadline(time.Now().Add(timeout))
+	err = conn.Handshake()
+	rawConn.SetDeadline(time.Time{})
+	return err
+}
+
+// 客户端未指定 ServerName 时使用 addr 中的主机名校验证书
+func tlsClientConfig(config *tls.Config, addr string) (ret *tls.Config) {
+	if config.ServerName != "" || config.InsecureSkipVerify {
+		return config
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ret = config.Clone()
+	ret.ServerName = host
+	return ret
+}
+
+func loadCertPool(caFile string) (pool *x509.CertPool, err error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(fmt.Sprintf("no certificate found in %s", caFile))
+	}
+	return pool, nil
+}
+
+// 创建服务端 TLS 配置，clientCAFile 不为空时要求并校验客户端证书（双向认证）
+func NewTLSServerConfig(certFile string, keyFile string, clientCAFile string) (config *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		config.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// 创建客户端 TLS 配置
+// certFile 和 keyFile 不为空时向服务端出示客户端证书，caFile 不为空时使用它代替系统根证书校验服务端，
+// serverName 为空时使用连接地址中的主机名
+func NewTLSClientConfig(certFile string, keyFile string, caFile string, serverName string) (config *tls.Config, err error) {
+	config = &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		config.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
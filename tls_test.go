@@ -0,0 +1,227 @@
+package tnet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试用的证书文件
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem string
+	keyPem  string
+}
+
+// 生成证书并写入 dir，parent 为 nil 时生成自签名的 CA
+func newTestCert(t *testing.T, dir string, name string, parent *testCert) (obj *testCert) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj = &testCert{key: key}
+	if obj.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.certPem = filepath.Join(dir, name+".crt")
+	obj.keyPem = filepath.Join(dir, name+".key")
+	ioutil.WriteFile(obj.certPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(obj.keyPem, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return obj
+}
+
+// 双向认证的服务端和客户端配置，以及一个不受信任的客户端配置
+func newTestTLSConfigs(t *testing.T) (server *tls.Config, client *tls.Config, untrusted *tls.Config) {
+	dir, err := ioutil.TempDir("", "tnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, dir, "ca", nil)
+	other := newTestCert(t, dir, "other", nil)
+	serverCert := newTestCert(t, dir, "server", ca)
+	clientCert := newTestCert(t, dir, "client", ca)
+	otherCert := newTestCert(t, dir, "stranger", other)
+
+	if server, err = NewTLSServerConfig(serverCert.certPem, serverCert.keyPem, ca.certPem); err != nil {
+		t.Fatal(err)
+	}
+	if client, err = NewTLSClientConfig(clientCert.certPem, clientCert.keyPem, ca.certPem, ""); err != nil {
+		t.Fatal(err)
+	}
+	if untrusted, err = NewTLSClientConfig(otherCert.certPem, otherCert.keyPem, ca.certPem, ""); err != nil {
+		t.Fatal(err)
+	}
+	return server, client, untrusted
+}
+
+// 启动一个启用 TLS 的回显服务器，返回监听地址
+func startTLSEchoServer(t *testing.T, config *tls.Config, metrics Metrics) (svr *TcpServer, addr string) {
+	svr = NewTcpServer()
+	svr.Addr = "127.0.0.1:0"
+	svr.TLSConfig = config
+	svr.Metrics = metrics
+	addrCh := make(chan string, 1)
+	svr.OnListenSuccCallback = func(self *TcpServer, lstn net.Listener) (ok bool) {
+		addrCh <- lstn.Addr().String()
+		return true
+	}
+	svr.OnHandleConnDataCallback = func(self *TcpServer, conn *TCPConnEx, connId uint32, data []byte) (ok bool) {
+		_, err := conn.Write(data)
+		return err == nil
+	}
+	go svr.Start()
+	return svr, <-addrCh
+}
+
+func checkTLSEcho(t *testing.T, addr string, config *tls.Config) (err error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		return err
+	}
+	buf := make([]byte, 5)
+	if _, err = conn.Read(buf); err != nil {
+		return err
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("got %q, want %q", buf, "hello")
+	}
+	return nil
+}
+
+func TestTcpServerTLS(t *testing.T) {
+	serverConfig, clientConfig, untrusted := newTestTLSConfigs(t)
+	exporter := NewPrometheusExporter()
+	svr, addr := startTLSEchoServer(t, serverConfig, exporter)
+	defer svr.Close()
+
+	if err := checkTLSEcho(t, addr, clientConfig); err != nil {
+		t.Fatalf("echo over TLS: %v", err)
+	}
+	// 服务端不信任客户端证书，握手失败
+	if err := checkTLSEcho(t, addr, untrusted); err == nil {
+		t.Fatal("untrusted client should be rejected")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var buf bytes.Buffer
+		exporter.Export(&buf)
+		if strings.Contains(buf.String(), MetricTLSHandshakeFails+" 1\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("handshake failure not counted:\n%s", buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 不完成握手的客户端不能阻塞其他连接的接入
+func TestTcpServerTLSSlowHandshake(t *testing.T) {
+	serverConfig, clientConfig, _ := newTestTLSConfigs(t)
+	svr, addr := startTLSEchoServer(t, serverConfig, NewNopMetrics())
+	defer svr.Close()
+
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- checkTLSEcho(t, addr, clientConfig)
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("echo over TLS: %v", err)
+		}
+	case <-time.After(tls_handshake_timeout / 2):
+		t.Fatal("accept blocked by a stalled handshake")
+	}
+}
+
+func TestTcpClientTLS(t *testing.T) {
+	serverConfig, clientConfig, _ := newTestTLSConfigs(t)
+	lstn, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+	go func() {
+		conn, err := lstn.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	received := make(chan string, 1)
+	clt := NewTcpClient()
+	clt.Addr = lstn.Addr().String()
+	clt.TLSConfig = clientConfig
+	clt.OnDialCallback = func(self *TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{}) {
+		return true, read_buf_size, nil
+	}
+	clt.OnHandleConnDataCallback = func(self *TcpClient, conn *TCPConnEx, data []byte) (ok bool) {
+		received <- string(data)
+		return false
+	}
+	go clt.Start()
+	defer clt.Close()
+	select {
+	case got := <-received:
+		if got != "hello" {
+			t.Fatalf("got %q, want %q", got, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TLS client timeout")
+	}
+}
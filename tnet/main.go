@@ -2,13 +2,13 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
-	"errors"
+	"crypto/tls"
 	"fmt"
 	"git.tutils.com/tutils/tnet"
 	"git.tutils.com/tutils/tnet/messager"
 	"git.tutils.com/tutils/tnet/tcenter"
 	"git.tutils.com/tutils/tnet/tcounter"
+	"git.tutils.com/tutils/tnet/tlog"
 	"git.tutils.com/tutils/tnet/tqa"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jamescun/tuntap"
@@ -18,10 +18,27 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+var logger = tlog.NewStdLogger(nil, tlog.LevelInfo)
+
+// 隧道的心跳间隔，连续 3 次没有收到对端的数据时断开重连
+const peer_heartbeat_interval = 15 * time.Second
+
+// 所有 peer 连接断开后保留会话的时间，proxy 和 socks 在这段时间内重连后，原来的连接继续传输
+const peer_resume_timeout = 60 * time.Second
+
+// 会话挂起时 proxy 和 socks 用来重新建立 peer 连接
+func redialPeer(addr string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, 10*time.Second)
+	}
+}
+
 type UdpExt struct {
 	first bool
 }
@@ -41,14 +58,16 @@ func test() {
 }
 
 type UdpTunServerExt struct {
-	codec      tnet.CryptCodec
-	device     string
-	secret     string
+	codec    tnet.CryptCodec
+	device   string
+	secret   string
+	maxWrite int
+	itf      tuntap.Interface
+	routes   *sync.Map // map[string]*tnet.UdpSession，客户端虚拟 IP -> 会话
+}
+
+type UdpTunSessionExt struct {
 	handshaked bool
-	maxWrite   int
-	itf        tuntap.Interface
-	mtx        *sync.RWMutex
-	lastAddr   *net.UDPAddr
 }
 
 func buildParams() []byte {
@@ -74,17 +93,39 @@ func buildParams() []byte {
 	return buf.Bytes()
 }
 
-func parseIpPacket(data []byte) {
-	buf := bytes.NewBuffer(data)
-	var pad32 uint32
-	binary.Read(buf, binary.BigEndian, &pad32)
-	binary.Read(buf, binary.BigEndian, &pad32)
-	binary.Read(buf, binary.BigEndian, &pad32)
-	srcIp := net.IP{0, 0, 0, 0}
-	dstIp := net.IP{0, 0, 0, 0}
-	binary.Read(buf, binary.BigEndian, &srcIp)
-	binary.Read(buf, binary.BigEndian, &dstIp)
-	log.Printf("%s -> %s", srcIp.String(), dstIp.String())
+const (
+	ipv4_header_size = 20
+	ipv6_header_size = 40
+)
+
+// 按 IP 头的版本号解析 IPv4 或 IPv6 包的源地址和目的地址，无法识别或 IP 头不完整时返回 nil
+func parseIpPacket(data []byte) (srcIp net.IP, dstIp net.IP) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	switch data[0] >> 4 {
+	case 4:
+		// IHL 为 IP 头的长度，单位 4 字节
+		headerSize := int(data[0]&0x0f) * 4
+		if headerSize < ipv4_header_size || len(data) < headerSize {
+			return nil, nil
+		}
+		srcIp = make(net.IP, net.IPv4len)
+		dstIp = make(net.IP, net.IPv4len)
+		copy(srcIp, data[12:16])
+		copy(dstIp, data[16:20])
+	case 6:
+		if len(data) < ipv6_header_size {
+			return nil, nil
+		}
+		srcIp = make(net.IP, net.IPv6len)
+		dstIp = make(net.IP, net.IPv6len)
+		copy(srcIp, data[8:24])
+		copy(dstIp, data[24:40])
+	default:
+		return nil, nil
+	}
+	return srcIp, dstIp
 }
 
 // "\x00m,1400 a,192.168.100.2,32 d,8.8.8.8 r,0.0.0.0,0"
@@ -93,17 +134,18 @@ func runUdpTunServer() {
 		tnet.NewZlibXorCodec(19284562),
 		os.Args[3],
 		os.Args[4],
-		false,
 		3,
 		nil,
-		new(sync.RWMutex),
-		nil,
+		new(sync.Map),
 	}
 
 	laddr := os.Args[2]
 	svr := tnet.NewUdpServer()
 	svr.Addr = laddr
+	svr.DualStack = true
+	svr.Logger = logger
 	svr.Ext = ext
+	svr.SessionIdleTimeout = 5 * time.Minute
 	svr.OnListenSuccCallback = func(self *tnet.UdpPeer, conn *net.UDPConn) (ok bool) {
 		ext := self.Ext.(*UdpTunServerExt)
 		var err error
@@ -118,16 +160,13 @@ func runUdpTunServer() {
 				n, err0 := ext.itf.Read(buf)
 				if n > 0 {
 					data := buf[:n]
-					encodeddata := ext.codec.Encrypt(data)
-					ext.mtx.RLock()
-					addr := ext.lastAddr
-					ext.mtx.RUnlock()
-					if ext.lastAddr != nil {
-						parseIpPacket(data)
-						log.Printf("write to conn %d(%d) bytes", len(encodeddata), len(data))
-						_, err := conn.WriteToUDP(encodeddata, addr)
-						if err != nil {
-							panic(err)
+					_, dstIp := parseIpPacket(data)
+					if v, ok := ext.routes.Load(dstIp.String()); ok {
+						sess := v.(*tnet.UdpSession)
+						encodeddata := ext.codec.Encrypt(data)
+						logger.Debug("write to UDP session", tlog.Addr(sess.Addr), tlog.F("bytes", len(data)))
+						if err := self.SendTo(sess, encodeddata); err != nil {
+							logger.Warn("send to UDP session failed", tlog.Addr(sess.Addr), tlog.Err(err))
 						}
 					}
 				}
@@ -139,37 +178,49 @@ func runUdpTunServer() {
 
 		return true
 	}
-	svr.OnHandleConnDataCallback = func(self *tnet.UdpPeer, conn *net.UDPConn, addr *net.UDPAddr, data []byte) (ok bool) {
+	svr.OnNewSessionCallback = func(self *tnet.UdpPeer, sess *tnet.UdpSession) (ok bool) {
+		sess.Ext = &UdpTunSessionExt{false}
+		return true
+	}
+	svr.OnSessionExpiredCallback = func(self *tnet.UdpPeer, sess *tnet.UdpSession) {
+		ext := self.Ext.(*UdpTunServerExt)
+		ext.routes.Range(func(k, v interface{}) bool {
+			if v.(*tnet.UdpSession) == sess {
+				ext.routes.Delete(k)
+			}
+			return true
+		})
+	}
+	svr.OnHandleSessionDataCallback = func(self *tnet.UdpPeer, sess *tnet.UdpSession, data []byte) (ok bool) {
 		ext := self.Ext.(*UdpTunServerExt)
+		sessExt := sess.Ext.(*UdpTunSessionExt)
 		decodeddata, err := ext.codec.Decrypt(data)
-		if err != nil {
-			panic(err)
+		if err != nil || len(decodeddata) == 0 {
+			logger.Debug("UDP session sent invalid data", tlog.Addr(sess.Addr))
+			return true
 		}
 
 		if decodeddata[0] == 0x00 {
-			log.Printf("handshake")
 			secret := string(decodeddata[1:])
 			if secret == ext.secret {
-				log.Printf("secret is ok")
+				logger.Info("UDP session handshake succ", tlog.Addr(sess.Addr))
 				data := buildParams()
 				encodeddata := ext.codec.Encrypt(data)
 				for i := 0; i < ext.maxWrite; i++ {
-					conn.WriteToUDP(encodeddata, addr)
+					self.SendTo(sess, encodeddata)
 				}
-
-				ext.mtx.Lock()
-				ext.lastAddr = addr
-				ext.mtx.Unlock()
-
-				ext.handshaked = true
+				sessExt.handshaked = true
 			} else {
-				log.Printf("secret(%s) is wrong", secret)
+				logger.Warn("UDP session sent wrong secret", tlog.Addr(sess.Addr))
+			}
+		} else if sessExt.handshaked {
+			// 按源 IP 记住会话，用于把 tun 设备读到的数据发回对应的客户端
+			srcIp, _ := parseIpPacket(decodeddata)
+			if srcIp != nil {
+				ext.routes.Store(srcIp.String(), sess)
 			}
-		} else {
-			// parse data
-			parseIpPacket(decodeddata)
 
-			log.Printf("write to device %d bytes", len(decodeddata))
+			logger.Debug("write to device", tlog.F("bytes", len(decodeddata)))
 			ext.itf.Write(decodeddata)
 		}
 		return true
@@ -182,7 +233,6 @@ type SvrExt struct {
 }
 
 type ConnExt struct {
-	slde      *tnet.Slde
 	handshake bool
 }
 
@@ -194,75 +244,55 @@ func tunTcpServer() {
 
 	svr := tnet.NewTcpServer()
 	svr.Addr = "0.0.0.0:2888"
+	svr.Logger = logger
 	svr.Ext = &SvrExt{0}
-	svr.OnListenSuccCallback = func(self *tnet.TcpServer, lstn *net.TCPListener) (ok bool) {
+	svr.FrameCodecFactory = tnet.NewSldeCodec
+	svr.OnListenSuccCallback = func(self *tnet.TcpServer, lstn net.Listener) (ok bool) {
 		go func() {
 			buf := make([]byte, 0xffff)
 			for {
 				n, err0 := itf.Read(buf)
 				if n > 0 {
-					log.Printf("/dev/tun READ: %d bytes", n)
 					svrExt := svr.Ext.(*SvrExt)
 					if v, ok := self.ConnMap.Load(svrExt.lastConnId); ok {
 						conn := v.(*tnet.TCPConnEx)
-						encodeddata, _ := tnet.EncodeToSldeDataFromBytes(buf[:n])
-						log.Printf("write to conn %d bytes", len(encodeddata))
-						conn.Write(encodeddata)
+						logger.Debug("write to TCP conn", tlog.ConnId(svrExt.lastConnId), tlog.F("bytes", n))
+						data := make([]byte, n)
+						copy(data, buf[:n])
+						conn.SendMessage(data)
 					} else {
-						log.Printf("conn not found, lastConnId: %d", svrExt.lastConnId)
+						logger.Debug("TCP conn not found", tlog.ConnId(svrExt.lastConnId))
 					}
 				}
 				if err0 != nil {
-					log.Printf(err0.Error())
+					logger.Error("read from device failed", tlog.Err(err0))
 					break
 				}
 			}
 		}()
 		return true
 	}
-	svr.OnAcceptConnCallback = func(self *tnet.TcpServer, conn *net.TCPConn, connId uint32) (ok bool, readSize int, connExt interface{}) {
+	svr.OnAcceptConnCallback = func(self *tnet.TcpServer, conn net.Conn, connId uint32) (ok bool, readSize int, connExt interface{}) {
 		svrExt := self.Ext.(*SvrExt)
 		svrExt.lastConnId = connId
-		connExt = &ConnExt{tnet.NewSlde(), false}
+		connExt = &ConnExt{false}
 		return true, tnet.SLDE_HEADER_SIZE, connExt
 	}
-	svr.OnHandleConnDataCallback = func(self *tnet.TcpServer, conn *tnet.TCPConnEx, connId uint32, data []byte) (ok bool) {
+	svr.OnHandleMessageCallback = func(self *tnet.TcpServer, conn *tnet.TCPConnEx, connId uint32, decodeddata []byte) (ok bool) {
 		ext := conn.Ext.(*ConnExt)
-		left, err := ext.slde.WriteAndGetNextToWrite(data)
-		if err != nil {
-			panic(err)
-		}
-		if left > 0 {
-			conn.ReadSize = left
-			log.Printf("slde:left(%d) > 0", left)
-			return true
-		} else if left < 0 {
-			panic(errors.New("left < 0"))
-		}
-
-		// left == 0
-		conn.ReadSize = tnet.SLDE_HEADER_SIZE
-		decodeddata, err := ext.slde.DecodeAndReset()
-		if err != nil {
-			panic(err)
-		}
-
 		//log.Printf("decodeddata: [% x]", decodeddata)
 		if !ext.handshake {
 			if string(decodeddata[1:]) == "test" {
 				params := []byte("\x00m,1400 a,192.168.100.2,32 d,8.8.8.8 r,0.0.0.0,0")
-				encodedcode, _ := tnet.EncodeToSldeDataFromBytes(params)
-				conn.Write(encodedcode)
-				log.Println("handshake succ!")
+				conn.SendMessage(params)
+				logger.Info("TCP conn handshake succ", tlog.ConnId(connId))
 				ext.handshake = true
-				ext = conn.Ext.(*ConnExt)
-				log.Println(ext.handshake)
 			} else {
-				log.Println("handshake failed!")
+				logger.Warn("TCP conn handshake failed", tlog.ConnId(connId))
 				return false
 			}
 		} else {
-			log.Println("write to tun")
+			logger.Debug("write to device", tlog.F("bytes", len(decodeddata)))
 			itf.Write(decodeddata)
 		}
 
@@ -271,30 +301,329 @@ func tunTcpServer() {
 	svr.Start()
 }
 
+// 可选参数 cert key ca，启用 peer 连接的 TLS 双向认证
+func loadPeerTLSConfig(server bool) (config *tls.Config) {
+	if len(os.Args) < 7 {
+		return nil
+	}
+	var err error
+	if server {
+		config, err = tnet.NewTLSServerConfig(os.Args[4], os.Args[5], os.Args[6])
+	} else {
+		config, err = tnet.NewTLSClientConfig(os.Args[4], os.Args[5], os.Args[6], "")
+	}
+	if err != nil {
+		log.Fatalf("load TLS config: %v", err)
+	}
+	return config
+}
+
+// 环境变量 TNET_PSK 设置隧道握手的预共享密钥，不放在命令行参数中，避免被 ps 看到
+func loadPeerPSK() (psk []byte) {
+	if v := os.Getenv("TNET_PSK"); v != "" {
+		return []byte(v)
+	}
+	return nil
+}
+
+// 环境变量 TNET_COMPRESSION 设置隧道帧的压缩方式，逗号分隔，可选 snappy(S2，代替 LZ4)、zstd、zlib、none，只在设置了 TNET_PSK 时生效
+// proxy 和 socks 按顺序提供，agent 只允许其中的方式，没有设置时使用默认的顺序
+func loadCompressions() (compressions []tnet.Compression) {
+	for _, v := range splitEnv("TNET_COMPRESSION") {
+		c, err := tnet.ParseCompression(v)
+		if err != nil {
+			log.Fatalf("load compression: %v", err)
+		}
+		compressions = append(compressions, c)
+	}
+	return compressions
+}
+
+// 环境变量 TNET_TARGET_ALLOW 和 TNET_TARGET_DENY 设置允许对端连接的动态目标，逗号分隔
+// agent 用来检查 socks 的目标，proxy 和 socks 用来检查 agent 配置的正向映射，两者都没有设置时拒绝所有动态目标
+func loadTargetFilter() (filter *tnet.AddrFilter) {
+	return loadAddrFilter("TNET_TARGET_ALLOW", "TNET_TARGET_DENY")
+}
+
+// 环境变量 TNET_LISTEN_ALLOW 设置允许对端通过反向映射让本端监听的地址，逗号分隔，没有设置时拒绝所有反向映射
+func loadListenFilter() (filter *tnet.AddrFilter) {
+	return loadAddrFilter("TNET_LISTEN_ALLOW", "")
+}
+
+func splitEnv(key string) (list []string) {
+	if key == "" {
+		return nil
+	}
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func loadAddrFilter(allowKey string, denyKey string) (filter *tnet.AddrFilter) {
+	allow, deny := splitEnv(allowKey), splitEnv(denyKey)
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	filter, err := tnet.NewAddrFilter(allow, deny)
+	if err != nil {
+		log.Fatalf("load addr filter: %v", err)
+	}
+	return filter
+}
+
+// 环境变量 TNET_MAPPINGS 设置端口映射，逗号分隔，格式参见 tnet.ParsePortMapping
+func loadMappings() (mappings []tnet.PortMapping) {
+	for _, v := range splitEnv("TNET_MAPPINGS") {
+		mapping, err := tnet.ParsePortMapping(v)
+		if err != nil {
+			log.Fatalf("load port mappings: %v", err)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// 隧道的带宽限制和连接优先级
+type peerShaping struct {
+	send       tnet.RateLimit
+	recv       tnet.RateLimit
+	streamSend tnet.RateLimit
+	streamRecv tnet.RateLimit
+	high       map[string]bool
+	low        map[string]bool
+}
+
+// 环境变量 TNET_SEND_RATE、TNET_RECV_RATE 设置整个隧道发送和接收的带宽，TNET_STREAM_SEND_RATE、TNET_STREAM_RECV_RATE 设置每条连接的带宽
+// 单位为字节每秒，可以带 K、M 后缀，例如 512K，没有设置时不限制
+// 环境变量 TNET_HIGH_PORTS、TNET_LOW_PORTS 按目标端口设置连接的优先级，逗号分隔，例如 TNET_HIGH_PORTS=22,3389，只对指定了目标的连接生效
+func loadShaping() (shaping *peerShaping) {
+	shaping = new(peerShaping)
+	shaping.send = loadRateLimit("TNET_SEND_RATE")
+	shaping.recv = loadRateLimit("TNET_RECV_RATE")
+	shaping.streamSend = loadRateLimit("TNET_STREAM_SEND_RATE")
+	shaping.streamRecv = loadRateLimit("TNET_STREAM_RECV_RATE")
+	shaping.high = make(map[string]bool)
+	for _, port := range splitEnv("TNET_HIGH_PORTS") {
+		shaping.high[port] = true
+	}
+	shaping.low = make(map[string]bool)
+	for _, port := range splitEnv("TNET_LOW_PORTS") {
+		shaping.low[port] = true
+	}
+	return shaping
+}
+
+func loadRateLimit(key string) (limit tnet.RateLimit) {
+	v := strings.ToUpper(strings.TrimSpace(os.Getenv(key)))
+	if v == "" {
+		return limit
+	}
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(v, "K"):
+		unit, v = 1<<10, v[:len(v)-1]
+	case strings.HasSuffix(v, "M"):
+		unit, v = 1<<20, v[:len(v)-1]
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate < 0 {
+		log.Fatalf("invalid %s(%s)", key, os.Getenv(key))
+	}
+	limit.Rate = rate * unit
+	return limit
+}
+
+func (self *peerShaping) apply(tun *tnet.EncryptTunPeer) {
+	tun.SendLimit = self.send
+	tun.RecvLimit = self.recv
+	tun.StreamSendLimit = self.streamSend
+	tun.StreamRecvLimit = self.streamRecv
+	if len(self.high) > 0 || len(self.low) > 0 {
+		tun.Classify = self.classify
+	}
+}
+
+func (self *peerShaping) classify(stream tnet.TunStream) tnet.StreamPriority {
+	_, port, err := net.SplitHostPort(stream.Target())
+	if err != nil {
+		return tnet.PriorityNormal
+	}
+	if self.high[port] {
+		return tnet.PriorityHigh
+	}
+	if self.low[port] {
+		return tnet.PriorityLow
+	}
+	return tnet.PriorityNormal
+}
+
+// 环境变量 TNET_LINKS 设置 proxy 和 socks 到 agent 的 peer 连接数，默认 1，多条连接时按轮流的方式分配 stream
+func loadLinkCount() (count int) {
+	count = 1
+	if v := os.Getenv("TNET_LINKS"); v != "" {
+		var err error
+		if count, err = strconv.Atoi(v); err != nil || count < 1 {
+			log.Fatalf("invalid TNET_LINKS(%s)", v)
+		}
+	}
+	return count
+}
+
+// 第一条连接握手完成后再增加其他连接，断开的连接不会重新增加，所有连接都断开后通过 Redial 恢复一条连接，不能恢复时随隧道一起重连
+func addPeerLinks(tun *tnet.EncryptTunPeer, addr string, count int) {
+	for i := 1; i < count; i++ {
+		go func() {
+			conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+			if err != nil {
+				logger.Error("dial peer link failed", tlog.Err(err))
+				return
+			}
+			tun.AddLink(conn)
+		}()
+	}
+}
+
 func runProxy() {
-	for {
-		clt := tnet.NewTcpClient()
-		clt.Addr = os.Args[2]
-		clt.RetryDelay = 1e9
-		clt.MaxRetry = -1
-		clt.OnDialCallback = func(self *tnet.TcpClient, conn *net.TCPConn) (ok bool, readSize int, connExt interface{}) {
-			proxy := tnet.NewEncryptConnProxy(conn, os.Args[3])
-			proxy.Start()
-			return false, 0, proxy
+	tlsConfig := loadPeerTLSConfig(false)
+	psk := loadPeerPSK()
+	compressions := loadCompressions()
+	mappings := loadMappings()
+	listenFilter := loadListenFilter()
+	targetFilter := loadTargetFilter()
+	links := loadLinkCount()
+	shaping := loadShaping()
+	clt := tnet.NewTcpClient()
+	clt.Addr = os.Args[2]
+	clt.Logger = logger
+	clt.MaxRetry = -1
+	clt.Reconnect = tnet.NewReconnectPolicy()
+	clt.OnDialCallback = func(self *tnet.TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{}) {
+		proxy := tnet.NewEncryptConnProxy(conn, os.Args[3])
+		proxy.TLSConfig = tlsConfig
+		proxy.PSK = psk
+		proxy.Compressions = compressions
+		proxy.Mappings = mappings
+		proxy.ListenFilter = listenFilter
+		proxy.TargetFilter = targetFilter
+		proxy.HeartbeatInterval = peer_heartbeat_interval
+		proxy.ResumeTimeout = peer_resume_timeout
+		proxy.Redial = redialPeer(self.Addr)
+		shaping.apply(proxy)
+		proxy.Logger = logger
+		addPeerLinks(proxy, self.Addr, links)
+		proxy.Start()
+		// proxy 已经结束，返回 true 让客户端按退避策略重连
+		return true, 0, proxy
+	}
+	clt.Start()
+}
+
+// 本地提供 SOCKS5 和 HTTP CONNECT 代理，目标地址由 agent 连接
+func runSocks() {
+	tlsConfig := loadPeerTLSConfig(false)
+	psk := loadPeerPSK()
+	compressions := loadCompressions()
+	mappings := loadMappings()
+	listenFilter := loadListenFilter()
+	targetFilter := loadTargetFilter()
+	links := loadLinkCount()
+	shaping := loadShaping()
+	clt := tnet.NewTcpClient()
+	clt.Addr = os.Args[2]
+	clt.Logger = logger
+	clt.MaxRetry = -1
+	clt.Reconnect = tnet.NewReconnectPolicy()
+	clt.OnDialCallback = func(self *tnet.TcpClient, conn net.Conn) (ok bool, readSize int, connExt interface{}) {
+		lstn, err := net.Listen("tcp", os.Args[3])
+		if err != nil {
+			logger.Error("listen socks failed", tlog.Err(err))
+			conn.Close()
+			return true, 0, nil
 		}
-		clt.Start()
+		tun := tnet.NewEncryptTunClient(conn)
+		tun.TLSConfig = tlsConfig
+		tun.PSK = psk
+		tun.Compressions = compressions
+		tun.Mappings = mappings
+		tun.ListenFilter = listenFilter
+		tun.TargetFilter = targetFilter
+		tun.HeartbeatInterval = peer_heartbeat_interval
+		tun.ResumeTimeout = peer_resume_timeout
+		tun.Redial = redialPeer(self.Addr)
+		shaping.apply(tun)
+		tun.Logger = logger
+		go tun.ServeProxy(lstn)
+		addPeerLinks(tun, self.Addr, links)
+		tun.Start()
+		// 隧道结束后 ServeProxy 会关闭 lstn，重连时重新监听
+		return true, 0, tun
+	}
+	clt.Start()
+}
 
-		time.Sleep(1e9)
+// agent 通过 tcounter 上报隧道的指标
+// 环境变量 TNET_TCOUNTER_SOCK 设置 tcounter agent 的 unix socket，默认 /tmp/tcountera.sock，为 none 时不上报
+// 环境变量 TNET_TCOUNTER_KEYS 设置上报的指标和 key，格式为 指标名=key，逗号分隔，指标名参见 tnet.MetricTunBytesIn 等
+func loadCounterMetrics() (metrics tnet.Metrics) {
+	sock := os.Getenv("TNET_TCOUNTER_SOCK")
+	if sock == "" {
+		sock = "/tmp/tcountera.sock"
+	} else if sock == "none" {
+		return tnet.NewNopMetrics()
+	}
+	// 默认与之前一样只上报 agent 转发的流量，从隧道流向本地连接为 200，反方向为 201
+	keys := map[string]uint32{
+		tnet.MetricTunBytesIn:  200,
+		tnet.MetricTunBytesOut: 201,
 	}
+	if list := splitEnv("TNET_TCOUNTER_KEYS"); len(list) > 0 {
+		keys = make(map[string]uint32)
+		for _, v := range list {
+			pos := strings.LastIndexByte(v, '=')
+			if pos < 0 {
+				log.Fatalf("invalid TNET_TCOUNTER_KEYS(%s)", v)
+			}
+			key, err := strconv.ParseUint(v[pos+1:], 10, 32)
+			if err != nil {
+				log.Fatalf("invalid TNET_TCOUNTER_KEYS(%s)", v)
+			}
+			keys[v[:pos]] = uint32(key)
+		}
+	}
+	return tcounter.NewCounterMetrics(tcounter.NewCounterClientUseUnix(sock), keys)
 }
 
 func runAgent() {
+	tlsConfig := loadPeerTLSConfig(true)
+	psk := loadPeerPSK()
+	compressions := loadCompressions()
+	targetFilter := loadTargetFilter()
+	mappings := loadMappings()
+	listenFilter := loadListenFilter()
+	shaping := loadShaping()
+	metrics := loadCounterMetrics()
+	sessions := tnet.NewTunSessionTable()
 	for {
 		svr := tnet.NewTcpServer()
 		svr.Addr = os.Args[2]
-		svr.OnAcceptConnCallback = func(self *tnet.TcpServer, conn *net.TCPConn, connId uint32) (ok bool, readSize int, connExt interface{}) {
+		svr.Logger = logger
+		svr.OnAcceptConnCallback = func(self *tnet.TcpServer, conn net.Conn, connId uint32) (ok bool, readSize int, connExt interface{}) {
 			agent := tnet.NewEncryptConnAgent(conn, os.Args[3])
-			log.Printf("@@@@@ OnAcceptConnCallback")
+			agent.TLSConfig = tlsConfig
+			agent.PSK = psk
+			agent.Compressions = compressions
+			agent.TargetFilter = targetFilter
+			agent.Mappings = mappings
+			agent.ListenFilter = listenFilter
+			agent.HeartbeatInterval = peer_heartbeat_interval
+			agent.ResumeTimeout = peer_resume_timeout
+			agent.Sessions = sessions
+			shaping.apply(agent)
+			agent.Metrics = metrics
+			agent.Logger = logger.With(tlog.ConnId(connId))
 			go agent.Start()
 			return true, 0, agent
 		}
@@ -307,6 +636,7 @@ func runAgent() {
 func runTCenterServer() {
 	svr := tcenter.NewTCenterServer()
 	svr.Addr = os.Args[2]
+	svr.Logger = logger
 	svr.Start()
 }
 
@@ -342,12 +672,14 @@ func runTCounterServer() {
 	svr.DbCfg.User = "tcounter"
 	svr.DbCfg.Pass = "tcounter"
 	svr.HttpAddr = ":51001"
+	svr.Logger = logger
 
 	svr.Start()
 }
 
 func runTCounterAgent() {
 	agent := tcounter.NewCounterAgentUseUnix("/tmp/tcountera.sock", "tvpsx.tutils.com:53088")
+	agent.Logger = logger
 	agent.Start()
 }
 
@@ -377,6 +709,7 @@ func runQaServer() {
 	qas := tqa.NewQaServer()
 	qas.HttpAddr = ":8080"
 	qas.StaticRoot = "qaroot/static/"
+	qas.Logger = logger
 	//qas.ExpiredAnswered = 10e9
 	//qas.ExpiredUnanswered = 10e9
 	qas.Start()
@@ -387,8 +720,15 @@ func main() {
 	args := os.Args
 	if len(args) < 2 {
 		fmt.Printf("Usage:\n")
-		fmt.Printf("\t%s proxy remotehost:10000 localhost:8080\n", args[0])
-		fmt.Printf("\t%s agent :10000 localhost:3128\n", args[0])
+		fmt.Printf("\t%s proxy remotehost:10000 localhost:8080 [cert key ca]\n", args[0])
+		fmt.Printf("\t%s agent :10000 localhost:3128 [cert key ca]\n", args[0])
+		fmt.Printf("\t%s socks remotehost:10000 localhost:1080 [cert key ca]\n", args[0])
+		fmt.Printf("\t\tproxy, socks and agent read the tunnel pre-shared key from env TNET_PSK\n")
+		fmt.Printf("\t\tframe compression is negotiated from env TNET_COMPRESSION, e.g. snappy,zstd,zlib,none (snappy is S2, used in place of LZ4)\n")
+		fmt.Printf("\t\ttargets the peer may dial (socks targets on agent, agent's L: mappings on proxy and socks) are read from env TNET_TARGET_ALLOW and TNET_TARGET_DENY\n")
+		fmt.Printf("\t\tport mappings are read from env TNET_MAPPINGS, e.g. L:127.0.0.1:2222=10.0.0.5:22,R::8080=localhost:80\n")
+		fmt.Printf("\t\treverse mappings requested by the peer must be allowed by env TNET_LISTEN_ALLOW\n")
+		fmt.Printf("\t\tproxy and socks open env TNET_LINKS parallel peer links to the agent\n")
 		fmt.Printf("\t%s tun :10000 tun0 secret -m 1400 -a 192.168.100.2 32 -d 8.8.8.8 -r 0.0.0.0 0 1\n", args[0])
 		return
 	}
@@ -404,6 +744,9 @@ func main() {
 	case "proxy":
 		runProxy()
 
+	case "socks":
+		runSocks()
+
 	case "agent":
 		runAgent()
 
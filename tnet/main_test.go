@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func ipv4Packet(ihl byte, src string, dst string, size int) []byte {
+	data := make([]byte, size)
+	data[0] = 0x40 | ihl
+	copy(data[12:16], net.ParseIP(src).To4())
+	copy(data[16:20], net.ParseIP(dst).To4())
+	return data
+}
+
+func ipv6Packet(src string, dst string, size int) []byte {
+	data := make([]byte, size)
+	data[0] = 0x60
+	copy(data[8:24], net.ParseIP(src))
+	copy(data[24:40], net.ParseIP(dst))
+	return data
+}
+
+func TestParseIpPacket(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data []byte
+		src  string
+		dst  string
+	}{
+		{"ipv4", ipv4Packet(5, "192.168.100.2", "8.8.8.8", 60), "192.168.100.2", "8.8.8.8"},
+		{"ipv4 options", ipv4Packet(6, "10.0.0.1", "10.0.0.2", 24), "10.0.0.1", "10.0.0.2"},
+		{"ipv6", ipv6Packet("fd00::2", "2001:4860:4860::8888", 60), "fd00::2", "2001:4860:4860::8888"},
+		{"ipv6 header only", ipv6Packet("fd00::2", "fd00::1", ipv6_header_size), "fd00::2", "fd00::1"},
+		{"empty", nil, "", ""},
+		{"ipv4 short", ipv4Packet(5, "10.0.0.1", "10.0.0.2", 20)[:ipv4_header_size-1], "", ""},
+		{"ipv4 truncated options", ipv4Packet(15, "10.0.0.1", "10.0.0.2", 40), "", ""},
+		{"ipv4 bad ihl", ipv4Packet(4, "10.0.0.1", "10.0.0.2", 40), "", ""},
+		{"ipv6 short", ipv6Packet("fd00::2", "fd00::1", ipv6_header_size)[:ipv6_header_size-1], "", ""},
+		{"bad version", []byte{0x50, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, "", ""},
+	} {
+		src, dst := parseIpPacket(c.data)
+		if c.src == "" {
+			if src != nil || dst != nil {
+				t.Fatalf("%s: got %s -> %s, want nil", c.name, src, dst)
+			}
+			continue
+		}
+		if !src.Equal(net.ParseIP(c.src)) || !dst.Equal(net.ParseIP(c.dst)) {
+			t.Fatalf("%s: got %s -> %s, want %s -> %s", c.name, src, dst, c.src, c.dst)
+		}
+	}
+}
+
+// 返回的地址是复制出来的，数据缓冲区被复用时不受影响
+func TestParseIpPacketCopy(t *testing.T) {
+	data := ipv4Packet(5, "192.168.100.2", "8.8.8.8", 20)
+	src, dst := parseIpPacket(data)
+	for i := range data {
+		data[i] = 0
+	}
+	if src.String() != "192.168.100.2" || dst.String() != "8.8.8.8" {
+		t.Fatalf("got %s -> %s", src, dst)
+	}
+}
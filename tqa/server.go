@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"git.tutils.com/tutils/tnet"
 	"git.tutils.com/tutils/tnet/encoding/mapstructure"
+	"git.tutils.com/tutils/tnet/tlog"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -50,6 +51,9 @@ type QaServer struct {
 	ExpiredAnswered   time.Duration
 	ExpiredUnanswered time.Duration
 
+	// 日志，默认不输出
+	Logger tlog.Logger
+
 	idWorker *tnet.IdWorker
 	db       *sync.Map
 }
@@ -60,6 +64,7 @@ func NewQaServer() (obj *QaServer) {
 	obj.db = &sync.Map{}
 	obj.ExpiredAnswered = 3600 * 1e9
 	obj.ExpiredUnanswered = 3600 * 24 * 1e9
+	obj.Logger = tlog.NewNopLogger()
 	return obj
 }
 
@@ -131,26 +136,26 @@ func (self *QaServer) handleHttpViewQuestionNotFound(w http.ResponseWriter, r *h
 func (self *QaServer) handleHttpApiAsk(w http.ResponseWriter, r *http.Request) {
 	var payload HttpReq
 	raw, _ := ioutil.ReadAll(r.Body)
-	log.Printf("%s|%s", r.RequestURI, string(raw))
+	self.Logger.Debug("http request", tlog.F("uri", r.RequestURI), tlog.F("body", string(raw)))
 	err := json.Unmarshal(raw, &payload)
 	if err != nil {
-		log.Printf(err.Error())
-		responseError(w, 1, CodeError, err.Error())
+		self.Logger.Warn("bad http request", tlog.F("uri", r.RequestURI), tlog.Err(err))
+		self.responseError(w, 1, CodeError, err.Error())
 		return
 	}
 
 	var reqData HttpAskReqData
 	err = mapstructure.Decode(payload.Data, &reqData)
 	if err != nil {
-		log.Printf(err.Error())
-		responseError(w, 1, CodeError, err.Error())
+		self.Logger.Warn("bad http request", tlog.F("uri", r.RequestURI), tlog.Err(err))
+		self.responseError(w, 1, CodeError, err.Error())
 		return
 	}
 
 	imgData, err := base64.StdEncoding.DecodeString(reqData.Question)
 	if err != nil {
-		log.Printf(err.Error())
-		responseError(w, 1, CodeError, err.Error())
+		self.Logger.Warn("bad http request", tlog.F("uri", r.RequestURI), tlog.Err(err))
+		self.responseError(w, 1, CodeError, err.Error())
 		return
 	}
 
@@ -159,7 +164,7 @@ func (self *QaServer) handleHttpApiAsk(w http.ResponseWriter, r *http.Request) {
 	self.db.Store(id, v)
 	idStr := strconv.FormatInt(id, 16)
 	rspData := &HttpAskRspData{idStr}
-	responseData(w, 1, rspData)
+	self.responseData(w, 1, rspData)
 }
 
 type HttpQueryReqData struct {
@@ -171,11 +176,11 @@ type HttpQueryRspData struct {
 }
 
 func (self *QaServer) handleHttpApiQuery(w http.ResponseWriter, r *http.Request) {
-	log.Printf(r.RequestURI)
+	self.Logger.Debug("http request", tlog.F("uri", r.RequestURI))
 	uri := r.RequestURI
 	n := strings.Index(uri, PatternApiQuery)
 	if n < 0 {
-		responseError(w, 1, CodeQuestionNotFound, "question not found")
+		self.responseError(w, 1, CodeQuestionNotFound, "question not found")
 		//http.NotFound(w, r)
 		return
 	}
@@ -183,27 +188,27 @@ func (self *QaServer) handleHttpApiQuery(w http.ResponseWriter, r *http.Request)
 
 	id, err := strconv.ParseInt(idStr, 16, 64)
 	if err != nil {
-		log.Printf(err.Error())
-		responseError(w, 1, CodeError, err.Error())
+		self.Logger.Warn("bad http request", tlog.F("uri", r.RequestURI), tlog.Err(err))
+		self.responseError(w, 1, CodeError, err.Error())
 		return
 	}
 
 	v_, ok := self.db.Load(id)
 	if !ok {
-		responseError(w, 1, CodeQuestionNotFound, "question not found")
+		self.responseError(w, 1, CodeQuestionNotFound, "question not found")
 		//http.NotFound(w, r)
 		return
 	}
 
 	v := v_.(*QuestionAndAnwser)
 	if v.Answer == nil {
-		responseError(w, 1, CodeNoAnswer, "no answer")
+		self.responseError(w, 1, CodeNoAnswer, "no answer")
 		return
 	}
 
 	answer := v.Answer.(string)
 	rspData := &HttpQueryRspData{answer}
-	responseData(w, 1, rspData)
+	self.responseData(w, 1, rspData)
 }
 
 type HttpQuestionReqData struct {
@@ -214,7 +219,7 @@ type HttpQuestionRspData struct {
 }
 
 func (self *QaServer) handleHttpApiQuestion(w http.ResponseWriter, r *http.Request) {
-	log.Printf(r.RequestURI)
+	self.Logger.Debug("http request", tlog.F("uri", r.RequestURI))
 	uri := r.RequestURI
 	n := strings.Index(uri, PatternApiQuestion)
 	if n < 0 {
@@ -225,8 +230,8 @@ func (self *QaServer) handleHttpApiQuestion(w http.ResponseWriter, r *http.Reque
 
 	id, err := strconv.ParseInt(idStr, 16, 64)
 	if err != nil {
-		log.Printf(err.Error())
-		responseError(w, 1, CodeError, err.Error())
+		self.Logger.Warn("bad http request", tlog.F("uri", r.RequestURI), tlog.Err(err))
+		self.responseError(w, 1, CodeError, err.Error())
 		return
 	}
 
@@ -238,7 +243,7 @@ func (self *QaServer) handleHttpApiQuestion(w http.ResponseWriter, r *http.Reque
 
 	v := v_.(*QuestionAndAnwser)
 	if v.Question == nil {
-		responseError(w, 1, CodeAnswered, "answered")
+		self.responseError(w, 1, CodeAnswered, "answered")
 		return
 	}
 
@@ -259,7 +264,7 @@ func (self *QaServer) handleHttpApiAnswer(w http.ResponseWriter, r *http.Request
 	uri := r.RequestURI
 	n := strings.Index(uri, PatternApiAnswer)
 	if n < 0 {
-		responseError(w, 1, CodeQuestionNotFound, "question not found")
+		self.responseError(w, 1, CodeQuestionNotFound, "question not found")
 		//http.NotFound(w, r)
 		return
 	}
@@ -267,33 +272,33 @@ func (self *QaServer) handleHttpApiAnswer(w http.ResponseWriter, r *http.Request
 
 	var payload HttpReq
 	raw, _ := ioutil.ReadAll(r.Body)
-	log.Printf("%s|%s", r.RequestURI, string(raw))
+	self.Logger.Debug("http request", tlog.F("uri", r.RequestURI), tlog.F("body", string(raw)))
 	err := json.Unmarshal(raw, &payload)
 	if err != nil {
-		log.Printf(err.Error())
-		responseError(w, 1, CodeError, err.Error())
+		self.Logger.Warn("bad http request", tlog.F("uri", r.RequestURI), tlog.Err(err))
+		self.responseError(w, 1, CodeError, err.Error())
 		return
 	}
 
 	var reqData HttpAnswerReqData
 	err = mapstructure.Decode(payload.Data, &reqData)
 	if err != nil {
-		log.Printf(err.Error())
-		responseError(w, 1, CodeError, err.Error())
+		self.Logger.Warn("bad http request", tlog.F("uri", r.RequestURI), tlog.Err(err))
+		self.responseError(w, 1, CodeError, err.Error())
 		return
 	}
 
-	log.Printf("Answer(%s): %s", idStr, reqData.Answer)
+	self.Logger.Info("answer", tlog.F("id", idStr), tlog.F("answer", reqData.Answer))
 	id, err := strconv.ParseInt(idStr, 16, 64)
 	if err != nil {
-		log.Printf(err.Error())
-		responseError(w, 1, CodeError, err.Error())
+		self.Logger.Warn("bad http request", tlog.F("uri", r.RequestURI), tlog.Err(err))
+		self.responseError(w, 1, CodeError, err.Error())
 		return
 	}
 
 	v_, ok := self.db.Load(id)
 	if !ok {
-		responseError(w, 1, CodeQuestionNotFound, "question not found")
+		self.responseError(w, 1, CodeQuestionNotFound, "question not found")
 		//http.NotFound(w, r)
 		return
 	}
@@ -303,7 +308,7 @@ func (self *QaServer) handleHttpApiAnswer(w http.ResponseWriter, r *http.Request
 	self.db.Store(id, v2)
 
 	rspData := &HttpAnswerRspData{}
-	responseData(w, 1, rspData)
+	self.responseData(w, 1, rspData)
 }
 
 type QuestionStatus struct {
@@ -316,7 +321,7 @@ type HttpListRspData struct {
 }
 
 func (self *QaServer) handleHttpApiList(w http.ResponseWriter, r *http.Request) {
-	log.Printf(r.RequestURI)
+	self.Logger.Debug("http request", tlog.F("uri", r.RequestURI))
 
 	lst := make([]QuestionStatus, 0)
 	self.db.Range(func(k_, v_ interface{}) bool {
@@ -334,14 +339,14 @@ func (self *QaServer) handleHttpApiList(w http.ResponseWriter, r *http.Request)
 	})
 
 	rspData := &HttpListRspData{lst}
-	responseData(w, 1, rspData)
+	self.responseData(w, 1, rspData)
 }
 
 type AnswerView struct {
 }
 
 func (self *QaServer) handleHttpViewAnswer(w http.ResponseWriter, r *http.Request) {
-	log.Printf(r.RequestURI)
+	self.Logger.Debug("http request", tlog.F("uri", r.RequestURI))
 	uri := r.RequestURI
 	n := strings.Index(uri, PatternViewAnswer)
 	if n < 0 {
@@ -353,7 +358,7 @@ func (self *QaServer) handleHttpViewAnswer(w http.ResponseWriter, r *http.Reques
 
 	id, err := strconv.ParseInt(idStr, 16, 64)
 	if err != nil {
-		log.Printf(err.Error())
+		self.Logger.Warn("bad http request", tlog.F("uri", r.RequestURI), tlog.Err(err))
 		self.handleHttpViewQuestionNotFound(w, r)
 		return
 	}
@@ -369,11 +374,11 @@ func (self *QaServer) handleHttpViewAnswer(w http.ResponseWriter, r *http.Reques
 }
 
 func (self *QaServer) handleHttpViewList(w http.ResponseWriter, r *http.Request) {
-	log.Printf(r.RequestURI)
+	self.Logger.Debug("http request", tlog.F("uri", r.RequestURI))
 	http.ServeFile(w, r, "qaroot/view/list.html")
 }
 
-func responseError(w http.ResponseWriter, ver int, errcode HttpRspCode, errmsg string) {
+func (self *QaServer) responseError(w http.ResponseWriter, ver int, errcode HttpRspCode, errmsg string) {
 	w.Header().Add("content-type", "application/json; charset=utf-8")
 	rsp := HttpRsp{
 		ver,
@@ -383,13 +388,13 @@ func responseError(w http.ResponseWriter, ver int, errcode HttpRspCode, errmsg s
 	}
 	jsStr, err := json.Marshal(rsp)
 	if err != nil {
-		log.Printf(err.Error())
+		self.Logger.Error("marshal http rsp failed", tlog.Err(err))
 		return
 	}
 	w.Write(jsStr)
 }
 
-func responseData(w http.ResponseWriter, ver int, data interface{}) {
+func (self *QaServer) responseData(w http.ResponseWriter, ver int, data interface{}) {
 	w.Header().Add("content-type", "application/json; charset=utf-8")
 	rsp := HttpRsp{
 		ver,
@@ -407,7 +412,7 @@ func responseData(w http.ResponseWriter, ver int, data interface{}) {
 		}
 		jsStr, err = json.Marshal(rsp)
 		if err != nil {
-			log.Printf(err.Error())
+			self.Logger.Error("marshal http rsp failed", tlog.Err(err))
 			return
 		}
 	}
@@ -1,11 +1,15 @@
 package main
 
-import "git.tutils.com/tutils/tnet/tqa"
+import (
+	"git.tutils.com/tutils/tnet/tlog"
+	"git.tutils.com/tutils/tnet/tqa"
+)
 
 func main() {
 	qas := tqa.NewQaServer()
 	qas.HttpAddr = ":58000"
 	qas.StaticRoot = "qaroot/static/"
+	qas.Logger = tlog.NewStdLogger(nil, tlog.LevelInfo)
 	qas.ExpiredAnswered = 3600e9
 	qas.ExpiredUnanswered = 36 * 3600e9
 	qas.Start()
@@ -0,0 +1,537 @@
+package tnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 隧道中每条逻辑连接的流量控制，与 HTTP/2、yamux 类似：
+// 发送方持有对端给的信用（窗口），每发送一个字节消耗一个信用，信用用完后只阻塞该连接的写；
+// 接收方收到的数据先放入该连接的接收队列，peer 读例程不会阻塞，数据被读走后再通过 cmd_window_update 归还信用
+// 接收队列超过窗口说明对端没有遵守流量控制，该连接会被重置
+// cmd_window_update 带的是累计归还的信用，重复或者乱序收到都不影响结果，丢失后由 cmd_resume 补上
+
+const (
+	tun_stream_window  int = 0x40000 // 每条连接初始的接收窗口 256KB，双方约定，不在协议中传递
+	window_update_size int = 8
+)
+
+var (
+	errTunStreamWindowExceeded = errors.New("tnet: stream receive window exceeded")
+	errTunTimeout              = &tunTimeoutError{}
+)
+
+// 隧道连接的读写超过 deadline 时返回，与 net.Conn 一样可以通过 net.Error 判断
+type tunTimeoutError struct{}
+
+func (self *tunTimeoutError) Error() string   { return "tnet: tunnel stream i/o timeout" }
+func (self *tunTimeoutError) Timeout() bool   { return true }
+func (self *tunTimeoutError) Temporary() bool { return true }
+
+// 隧道中的一条逻辑连接，实现了 net.Conn
+// 由 EncryptTunPeer.OpenStream 主动打开，或者由 EncryptTunPeer.Accept 接受对端打开的连接
+type tunStream struct {
+	id     uint32
+	peer   *EncryptTunPeer
+	target string
+	start  time.Time
+
+	// 持有期间写入 peer 连接，保证同一个 stream 的协议包按偏移顺序发送，迁移时的重发也在 sendMtx 保护下进行
+	sendMtx sync.Mutex
+
+	mtx          sync.Mutex
+	cond         *sync.Cond
+	link         *tunLink  // 发送使用的 peer 连接，修改时同时持有 sendMtx
+	bound        bool      // 是否计入了 link.streams
+	recvq        []*[]byte // 待读取的数据，来自缓冲区池
+	recvOff      int       // recvq[0] 已经读取的字节数
+	recvBytes    int
+	recvEnd      uint64 // 已经收到的数据在连接中的偏移
+	consumed     int    // 已读取但还没有归还的信用
+	returned     uint64 // 累计归还的信用
+	window       int    // 接收窗口
+	sendWnd      int    // 剩余的发送信用
+	sendOff      uint64 // 已经发送的数据在连接中的偏移
+	acked        uint64 // 对端累计归还的信用，这之前的数据对端已经读走
+	rtx          []byte // [acked, sendOff) 之间的数据，连接断开后重发
+	localClosed  bool   // 本地已经调用 Close，或者隧道已经清理
+	remoteClosed bool   // 收到了对端的 cmd_close
+	result       int    // 对端回复的 cmd_connect_result，还没有回复时为 -1
+
+	// 带宽限制，参见 shaper.go
+	priority   StreamPriority
+	sendBucket *tokenBucket
+	recvBucket *tokenBucket
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newTunStream(peer *EncryptTunPeer, id uint32) (obj *tunStream) {
+	obj = new(tunStream)
+	obj.id = id
+	obj.peer = peer
+	obj.cond = sync.NewCond(&obj.mtx)
+	obj.window = tun_stream_window
+	obj.sendWnd = tun_stream_window
+	obj.result = -1
+	obj.start = time.Now()
+	obj.sendBucket = newRateBucket(peer.StreamSendLimit)
+	obj.recvBucket = newRateBucket(peer.StreamRecvLimit)
+	return obj
+}
+
+func (self *tunStream) Target() string {
+	return self.target
+}
+
+// 绑定发送使用的 peer 连接，除了新建时，调用者需要持有 sendMtx
+func (self *tunStream) bind(link *tunLink) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if self.bound {
+		atomic.AddInt32(&self.link.streams, -1)
+	}
+	self.link = link
+	self.bound = true
+	atomic.AddInt32(&link.streams, 1)
+}
+
+func (self *tunStream) unbind() {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if self.bound {
+		atomic.AddInt32(&self.link.streams, -1)
+		self.bound = false
+	}
+}
+
+func (self *tunStream) currentLink() *tunLink {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	return self.link
+}
+
+func (self *tunStream) setConnectResult(result byte) {
+	self.mtx.Lock()
+	self.result = int(result)
+	self.cond.Broadcast()
+	self.mtx.Unlock()
+}
+
+// 等待对端回复 cmd_connect_result
+func (self *tunStream) waitConnect(timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		self.mtx.Lock()
+		self.cond.Broadcast()
+		self.mtx.Unlock()
+	})
+	defer timer.Stop()
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	for {
+		switch {
+		case self.result == int(connect_ok):
+			return nil
+		case self.result == int(connect_refused):
+			return ErrTunConnectRefused
+		case self.result >= 0:
+			return ErrTunConnectFailed
+		case self.localClosed:
+			return ErrConnClosed
+		case self.remoteClosed:
+			return ErrTunConnectFailed
+		case !time.Now().Before(deadline):
+			return errTunTimeout
+		}
+		self.cond.Wait()
+	}
+}
+
+// 放入对端发来的从 offset 开始的数据，不会阻塞，超过接收窗口时返回错误
+// 重发造成的重复部分被丢弃；offset 之前有缺口时整个丢弃，缺口的数据会在迁移后重发
+func (self *tunStream) push(offset uint64, buf *[]byte) (err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	end := offset + uint64(len(*buf))
+	if self.localClosed || self.remoteClosed || end <= self.recvEnd || offset > self.recvEnd {
+		putBuf(buf)
+		return nil
+	}
+	if skip := int(self.recvEnd - offset); skip > 0 {
+		n := copy(*buf, (*buf)[skip:])
+		*buf = (*buf)[:n]
+	}
+	if self.recvBytes+len(*buf) > self.window {
+		putBuf(buf)
+		return errTunStreamWindowExceeded
+	}
+	self.recvq = append(self.recvq, buf)
+	self.recvBytes += len(*buf)
+	self.recvEnd = end
+	self.cond.Broadcast()
+	return nil
+}
+
+// 对端累计归还了 returned 个字节的信用，之前的数据不再需要重发
+func (self *tunStream) updateCredit(returned uint64) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	// 对端不可能读走还没有发送的数据
+	if returned > self.sendOff {
+		returned = self.sendOff
+	}
+	if returned <= self.acked || self.localClosed {
+		return
+	}
+	delta := int(returned - self.acked)
+	self.acked = returned
+	self.rtx = self.rtx[delta:]
+	self.sendWnd += delta
+	self.cond.Broadcast()
+}
+
+// 收到对端的 cmd_close，剩余的数据读完后 Read 返回 io.EOF
+func (self *tunStream) remoteClose() {
+	self.mtx.Lock()
+	self.remoteClosed = true
+	self.cond.Broadcast()
+	self.mtx.Unlock()
+}
+
+// 结束本地连接，丢弃未读取的数据，返回值 notify 表示是否需要通知对端关闭
+func (self *tunStream) localClose() (notify bool) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	notify = !self.localClosed && !self.remoteClosed
+	self.localClosed = true
+	for _, buf := range self.recvq {
+		putBuf(buf)
+	}
+	self.recvq = nil
+	self.recvBytes = 0
+	self.rtx = nil
+	if self.readTimer != nil {
+		self.readTimer.Stop()
+	}
+	if self.writeTimer != nil {
+		self.writeTimer.Stop()
+	}
+	self.cond.Broadcast()
+	return notify
+}
+
+func (self *tunStream) Read(buf []byte) (n int, err error) {
+	self.mtx.Lock()
+	for {
+		if self.localClosed {
+			self.mtx.Unlock()
+			return 0, ErrConnClosed
+		}
+		if len(self.recvq) > 0 {
+			break
+		}
+		if self.remoteClosed {
+			self.mtx.Unlock()
+			return 0, io.EOF
+		}
+		if !self.readDeadline.IsZero() && !time.Now().Before(self.readDeadline) {
+			self.mtx.Unlock()
+			return 0, errTunTimeout
+		}
+		self.cond.Wait()
+	}
+
+	if self.recvBucket != nil || self.peer.recvShaper != nil {
+		// 有带宽限制时按取得的令牌缩短这次读取的长度
+		size := len(buf)
+		if size > self.recvBytes {
+			size = self.recvBytes
+		}
+		self.mtx.Unlock()
+		if size, err = self.shape(size, false); err != nil {
+			return 0, err
+		}
+		buf = buf[:size]
+		self.mtx.Lock()
+		if self.localClosed {
+			self.mtx.Unlock()
+			return 0, ErrConnClosed
+		}
+	}
+
+	for len(self.recvq) > 0 && n < len(buf) {
+		data := *self.recvq[0]
+		m := copy(buf[n:], data[self.recvOff:])
+		n += m
+		self.recvOff += m
+		if self.recvOff == len(data) {
+			putBuf(self.recvq[0])
+			self.recvq[0] = nil
+			self.recvq = self.recvq[1:]
+			self.recvOff = 0
+		}
+	}
+	self.recvBytes -= n
+
+	// 读走一半窗口后归还信用，对端已经关闭时不再需要
+	var returned uint64
+	self.consumed += n
+	if self.consumed >= self.window/2 && !self.remoteClosed {
+		self.returned += uint64(self.consumed)
+		self.consumed = 0
+		returned = self.returned
+	}
+	link := self.link
+	self.mtx.Unlock()
+
+	// 信用是累计值，不需要和数据保持顺序，不经过 sendMtx
+	if returned > 0 {
+		link.writePacket(cmd_window_update, self.id, packWindowUpdate(returned))
+	}
+	self.peer.Metrics.AddCounter(MetricTunBytesIn, int64(n))
+	return n, nil
+}
+
+// 取得最多 n 个字节的发送信用，没有信用时阻塞
+func (self *tunStream) acquire(n int) (granted int, err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	for {
+		if self.localClosed {
+			return 0, ErrConnClosed
+		}
+		if self.remoteClosed {
+			return 0, io.ErrClosedPipe
+		}
+		if !self.writeDeadline.IsZero() && !time.Now().Before(self.writeDeadline) {
+			return 0, errTunTimeout
+		}
+		if self.sendWnd > 0 {
+			break
+		}
+		self.cond.Wait()
+	}
+	if n > self.sendWnd {
+		n = self.sendWnd
+	}
+	self.sendWnd -= n
+	return n, nil
+}
+
+// 归还 acquire 取得但没有用掉的发送信用
+func (self *tunStream) unacquire(n int) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.sendWnd += n
+	self.cond.Broadcast()
+}
+
+// 按发送信用和带宽限制把数据切分成协议包写入 peer，没有信用或者令牌时阻塞
+func (self *tunStream) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		size := len(data)
+		if size > max_tcp_read {
+			size = max_tcp_read
+		}
+		if size, err = self.acquire(size); err != nil {
+			return n, err
+		}
+		granted, err := self.shape(size, true)
+		if granted < size {
+			self.unacquire(size - granted)
+		}
+		if err != nil {
+			return n, err
+		}
+		size = granted
+		if err = self.send(data[:size]); err != nil {
+			return n, err
+		}
+		self.peer.Metrics.AddCounter(MetricTunBytesOut, int64(size))
+		data = data[size:]
+		n += size
+	}
+	return n, nil
+}
+
+// 数据先放入重发缓冲区再写入当前的 peer 连接，连接出错时数据会在迁移到其他连接后重发，只有隧道关闭时才返回错误
+func (self *tunStream) send(data []byte) (err error) {
+	self.sendMtx.Lock()
+	defer self.sendMtx.Unlock()
+	self.mtx.Lock()
+	if self.localClosed {
+		self.mtx.Unlock()
+		return ErrConnClosed
+	}
+	offset := self.sendOff
+	self.sendOff += uint64(len(data))
+	self.rtx = append(self.rtx, data...)
+	link := self.link
+	self.mtx.Unlock()
+
+	if err = link.writeData(self.id, offset, data); err != nil {
+		select {
+		case <-self.peer.quit:
+			return ErrConnClosed
+		default:
+		}
+	}
+	return nil
+}
+
+// 写入 cmd_data 以外属于这个 stream 的协议包，与数据保持顺序
+func (self *tunStream) writePacket(cmd uint16, data []byte) (err error) {
+	self.sendMtx.Lock()
+	defer self.sendMtx.Unlock()
+	return self.currentLink().writePacket(cmd, self.id, data)
+}
+
+// 从 from 开始在 link 上重发还在重发缓冲区中的数据，调用者需要持有 sendMtx
+// 重发缓冲区只在持有 sendMtx 时追加，其他时候只会从头部截断，取出的切片不会被修改
+func (self *tunStream) resendLocked(link *tunLink, from uint64) {
+	self.mtx.Lock()
+	if self.localClosed {
+		self.mtx.Unlock()
+		return
+	}
+	if from < self.acked {
+		from = self.acked
+	}
+	if from > self.sendOff {
+		from = self.sendOff
+	}
+	data := self.rtx[from-self.acked:]
+	self.mtx.Unlock()
+
+	for len(data) > 0 {
+		size := len(data)
+		if size > max_tcp_read {
+			size = max_tcp_read
+		}
+		if err := link.writeData(self.id, from, data[:size]); err != nil {
+			return
+		}
+		data = data[size:]
+		from += uint64(size)
+	}
+}
+
+func (self *tunStream) closed() bool {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	return self.localClosed || self.remoteClosed
+}
+
+// 发送使用的 peer 连接断开了，迁移到其他连接并重发对端还没有读走的数据
+// 无论是否迁移，都通过 cmd_resume 让对端从本端已经收到的偏移重发
+func (self *tunStream) migrate() {
+	self.sendMtx.Lock()
+	defer self.sendMtx.Unlock()
+	if self.closed() {
+		return
+	}
+	link := self.currentLink()
+	if link.isClosed() {
+		if link = self.peer.pickLink(); link == nil {
+			return
+		}
+		self.bind(link)
+		self.resendLocked(link, 0)
+	}
+	self.mtx.Lock()
+	recvEnd, returned := self.recvEnd, self.returned
+	self.mtx.Unlock()
+	link.writePacket(cmd_resume, self.id, packResume(recvEnd, returned))
+}
+
+// 对端在 link 上请求从 from 开始重发，说明对端正在使用这条连接，之后也改用它发送
+func (self *tunStream) resume(link *tunLink, from uint64) {
+	self.sendMtx.Lock()
+	defer self.sendMtx.Unlock()
+	if self.closed() {
+		return
+	}
+	if !link.isClosed() && link != self.currentLink() {
+		self.bind(link)
+	}
+	self.resendLocked(self.currentLink(), from)
+}
+
+// 关闭连接并通知对端，未读取的数据会被丢弃
+func (self *tunStream) Close() (err error) {
+	if self.localClose() {
+		self.writePacket(cmd_close, nil)
+	}
+	self.peer.removeStream(self)
+	return nil
+}
+
+func (self *tunStream) LocalAddr() net.Addr {
+	return self.currentLink().conn.LocalAddr()
+}
+
+func (self *tunStream) RemoteAddr() net.Addr {
+	return self.currentLink().conn.RemoteAddr()
+}
+
+func (self *tunStream) SetDeadline(t time.Time) (err error) {
+	self.SetReadDeadline(t)
+	self.SetWriteDeadline(t)
+	return nil
+}
+
+func (self *tunStream) SetReadDeadline(t time.Time) (err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.readDeadline = t
+	self.readTimer = self.resetDeadlineTimer(self.readTimer, t)
+	return nil
+}
+
+func (self *tunStream) SetWriteDeadline(t time.Time) (err error) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.writeDeadline = t
+	self.writeTimer = self.resetDeadlineTimer(self.writeTimer, t)
+	return nil
+}
+
+// 到达超时时间时唤醒阻塞中的读写
+func (self *tunStream) resetDeadlineTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	self.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		self.mtx.Lock()
+		self.cond.Broadcast()
+		self.mtx.Unlock()
+	})
+}
+
+func packWindowUpdate(returned uint64) (data []byte) {
+	data = make([]byte, window_update_size)
+	binary.BigEndian.PutUint64(data, returned)
+	return data
+}
+
+func unpackWindowUpdate(data []byte) (returned uint64, err error) {
+	if len(data) < window_update_size {
+		return 0, errors.New(fmt.Sprintf("window update packet too short(%d)", len(data)))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}